@@ -0,0 +1,439 @@
+/*
+Copyright 2018 Turbine Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/turbinelabs/api/service/stats"
+	"github.com/turbinelabs/nonstdlib/log/console"
+	tbntime "github.com/turbinelabs/nonstdlib/time"
+)
+
+const (
+	// DefaultAPIRetryBufferSize is the default maximum size, in
+	// bytes, of stats buffered for retry while the API is
+	// unavailable.
+	DefaultAPIRetryBufferSize = 8 * 1024 * 1024
+
+	// DefaultAPIRetryInitialBackoff is the default delay before the
+	// first retry of stats that could not be forwarded to the API.
+	DefaultAPIRetryInitialBackoff = time.Second
+
+	// DefaultAPIRetryMaxBackoff is the default maximum delay between
+	// retries of stats that could not be forwarded to the API.
+	DefaultAPIRetryMaxBackoff = time.Minute
+
+	apiRetrySuffix = ".json"
+
+	// Estimated sizes, in bytes, of the JSON encoding of parts of a
+	// payload, used to account for payloads buffered in memory
+	// without marshalling them.
+	apiPayloadSizeEstimate = 64 // field names and punctuation
+	apiStatSizeEstimate    = 48 // field names, punctuation, timestamp and value
+	apiTagSizeEstimate     = 6  // punctuation
+	apiNumberSizeEstimate  = 12 // a histogram bucket or limit
+)
+
+// apiRetrier forwards payloads to a stats.StatsService. Payloads that
+// cannot be forwarded are buffered and retried in order with
+// exponential backoff and jitter. While payloads are buffered, new
+// payloads are buffered behind them. Buffered payloads are held in
+// memory or, if dir is set, in files in dir, which are retried by the
+// next apiRetrier started with the same dir. When the buffered
+// payloads exceed maxBytes, the oldest are dropped.
+type apiRetrier struct {
+	svc            stats.StatsService
+	deliveryStats  *deliveryStats
+	timeSource     tbntime.Source
+	maxBytes       int64
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	dir            string
+
+	lock     sync.Mutex
+	pending  []*pendingPayload
+	bytes    int64
+	seq      int64
+	attempts int
+	sending  *pendingPayload
+	rand     *rand.Rand
+	timer    tbntime.Timer
+
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+// pendingPayload is a buffered payload. If path is set, the payload
+// is stored in the file at path.
+type pendingPayload struct {
+	payload  *stats.Payload
+	path     string
+	size     int64
+	numStats int
+}
+
+// start loads any payloads buffered in r.dir and starts retrying in
+// the background.
+func (r *apiRetrier) start() error {
+	r.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	r.done = make(chan struct{})
+	r.stopped = make(chan struct{})
+
+	// create the timer stopped; it is reset when payloads are buffered
+	r.timer = r.timeSource.NewTimer(r.maxBackoff)
+	r.timer.Stop()
+
+	if r.dir != "" {
+		if err := r.load(); err != nil {
+			return err
+		}
+	}
+
+	go r.run()
+	return nil
+}
+
+// load buffers the payloads stored in r.dir, retrying them
+// immediately.
+func (r *apiRetrier) load() error {
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return fmt.Errorf("could not create API retry directory: %s", err)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(r.dir, "*"+apiRetrySuffix))
+	if err != nil {
+		return fmt.Errorf("could not read API retry directory: %s", err)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		seq, err := strconv.ParseInt(
+			strings.TrimSuffix(filepath.Base(path), apiRetrySuffix),
+			10,
+			64,
+		)
+		if err != nil {
+			continue
+		}
+		if seq > r.seq {
+			r.seq = seq
+		}
+
+		p := &pendingPayload{path: path}
+		payload, err := r.payload(p)
+		if err != nil {
+			console.Error().Printf("discarding buffered stats in %s: %s", path, err)
+			os.Remove(path)
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		p.size = info.Size()
+		p.numStats = len(payload.Stats)
+		r.pending = append(r.pending, p)
+		r.bytes += p.size
+	}
+
+	r.dropOldest(r.maxBytes)
+
+	if len(r.pending) > 0 {
+		r.timer.Reset(0)
+	}
+
+	return nil
+}
+
+func (r *apiRetrier) run() {
+	defer close(r.stopped)
+
+	for {
+		select {
+		case <-r.done:
+			return
+
+		case <-r.timer.C():
+			r.retry()
+		}
+	}
+}
+
+// forward forwards the payload, buffering it for retry on failure.
+// If payloads are already buffered, the payload is buffered without
+// attempting to forward it. The lock is held while forwarding, so
+// that concurrently forwarded payloads are not reordered.
+func (r *apiRetrier) forward(payload *stats.Payload) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.pending) == 0 {
+		if err := sendPayload(r.svc, r.deliveryStats, payload); err == nil {
+			return
+		}
+	}
+
+	r.enqueue(payload)
+}
+
+// enqueue buffers the payload, dropping the oldest buffered payloads
+// to make room for it, and schedules a retry if none is scheduled.
+// The caller must hold r.lock.
+func (r *apiRetrier) enqueue(payload *stats.Payload) {
+	var (
+		data []byte
+		p    = &pendingPayload{numStats: len(payload.Stats)}
+	)
+	if r.dir != "" {
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			console.Error().Printf("could not buffer stats: %s", err)
+			r.deliveryStats.drop(p.numStats)
+			return
+		}
+		p.size = int64(len(data))
+	} else {
+		p.size = estimatePayloadSize(payload)
+	}
+
+	if p.size > r.maxBytes {
+		console.Error().Printf(
+			"dropped %d stats: %d bytes exceeds the retry buffer size",
+			p.numStats,
+			p.size,
+		)
+		r.deliveryStats.drop(p.numStats)
+		return
+	}
+
+	if r.dir != "" {
+		r.seq++
+		p.path = filepath.Join(r.dir, fmt.Sprintf("%020d%s", r.seq, apiRetrySuffix))
+		if err := ioutil.WriteFile(p.path, data, 0644); err != nil {
+			console.Error().Printf("could not buffer stats: %s", err)
+			r.deliveryStats.drop(p.numStats)
+			return
+		}
+	} else {
+		p.payload = payload
+	}
+
+	r.dropOldest(r.maxBytes - p.size)
+	r.pending = append(r.pending, p)
+	r.bytes += p.size
+
+	if len(r.pending) == 1 && r.sending == nil {
+		r.attempts = 1
+		r.timer.Reset(r.backoff())
+	}
+}
+
+// retry forwards buffered payloads in order until all have been
+// forwarded or one fails, in which case the next retry is scheduled.
+func (r *apiRetrier) retry() {
+	for {
+		r.lock.Lock()
+		if len(r.pending) == 0 {
+			r.attempts = 0
+			r.lock.Unlock()
+			return
+		}
+		p := r.pending[0]
+		r.sending = p
+		r.lock.Unlock()
+
+		payload, err := r.payload(p)
+		if err != nil {
+			console.Error().Printf("discarding buffered stats: %s", err)
+			r.deliveryStats.drop(p.numStats)
+		} else {
+			err = sendPayload(r.svc, r.deliveryStats, payload)
+			if err != nil {
+				r.lock.Lock()
+				r.sending = nil
+				r.attempts++
+				r.timer.Reset(r.backoff())
+				r.lock.Unlock()
+				return
+			}
+		}
+
+		r.lock.Lock()
+		r.sending = nil
+		r.remove(p)
+		r.lock.Unlock()
+	}
+}
+
+// payload returns the buffered payload, reading it from its file if
+// necessary.
+func (r *apiRetrier) payload(p *pendingPayload) (*stats.Payload, error) {
+	if p.path == "" {
+		return p.payload, nil
+	}
+
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := &stats.Payload{}
+	if err := json.Unmarshal(data, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// estimatePayloadSize estimates the size, in bytes, of the payload's
+// JSON encoding.
+func estimatePayloadSize(payload *stats.Payload) int64 {
+	size := apiPayloadSizeEstimate + len(payload.Source) + len(payload.Zone)
+	for _, s := range []*string{payload.Node, payload.Proxy, payload.ProxyVersion} {
+		if s != nil {
+			size += len(*s)
+		}
+	}
+
+	for name, limits := range payload.Limits {
+		size += len(name) + apiTagSizeEstimate + len(limits)*apiNumberSizeEstimate
+	}
+
+	for i := range payload.Stats {
+		stat := &payload.Stats[i]
+		size += apiStatSizeEstimate + len(stat.Name)
+		for k, v := range stat.Tags {
+			size += len(k) + len(v) + apiTagSizeEstimate
+		}
+		if h := stat.Histogram; h != nil {
+			size += apiStatSizeEstimate + len(h.Limits) + len(h.Buckets)*apiNumberSizeEstimate
+		}
+	}
+
+	return int64(size)
+}
+
+// backoff returns the delay before the next retry: the initial
+// backoff doubled for each failed attempt, up to the maximum backoff,
+// with up to half of the delay randomized. The caller must hold
+// r.lock.
+func (r *apiRetrier) backoff() time.Duration {
+	d := r.initialBackoff
+	for i := 1; i < r.attempts && d < r.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.maxBackoff {
+		d = r.maxBackoff
+	}
+
+	half := d / 2
+	return half + time.Duration(r.rand.Int63n(int64(d-half)+1))
+}
+
+// dropOldest drops the oldest buffered payloads, other than one being
+// retried, until at most limit bytes are buffered. Dropped stats are
+// recorded. The caller must hold r.lock.
+func (r *apiRetrier) dropOldest(limit int64) {
+	dropped := 0
+	for r.bytes > limit {
+		idx := 0
+		if len(r.pending) > 0 && r.pending[0] == r.sending {
+			idx = 1
+		}
+		if idx >= len(r.pending) {
+			break
+		}
+
+		p := r.pending[idx]
+		r.pending = append(r.pending[:idx], r.pending[idx+1:]...)
+		r.discard(p)
+		dropped += p.numStats
+	}
+
+	if dropped > 0 {
+		console.Error().Printf("retry buffer full, dropped %d stats", dropped)
+		r.deliveryStats.drop(dropped)
+	}
+}
+
+// remove removes the oldest buffered payload. The caller must hold
+// r.lock.
+func (r *apiRetrier) remove(p *pendingPayload) {
+	if len(r.pending) > 0 && r.pending[0] == p {
+		r.pending = r.pending[1:]
+		r.discard(p)
+	}
+}
+
+// discard releases the payload's buffer space. The caller must hold
+// r.lock.
+func (r *apiRetrier) discard(p *pendingPayload) {
+	r.bytes -= p.size
+	if p.path != "" {
+		os.Remove(p.path)
+	}
+}
+
+// close stops retrying in the background and makes a final attempt
+// to forward buffered payloads. Payloads that cannot be forwarded are
+// dropped, unless they are stored in files.
+func (r *apiRetrier) close() {
+	r.once.Do(func() {
+		close(r.done)
+		<-r.stopped
+		r.timer.Stop()
+	})
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for len(r.pending) > 0 {
+		p := r.pending[0]
+		payload, err := r.payload(p)
+		if err != nil {
+			console.Error().Printf("discarding buffered stats: %s", err)
+			r.deliveryStats.drop(p.numStats)
+		} else if sendPayload(r.svc, r.deliveryStats, payload) != nil {
+			break
+		}
+		r.remove(p)
+	}
+
+	if r.dir == "" && len(r.pending) > 0 {
+		dropped := 0
+		for _, p := range r.pending {
+			r.discard(p)
+			dropped += p.numStats
+		}
+		r.pending = nil
+
+		console.Error().Printf("dropped %d stats that could not be forwarded", dropped)
+		r.deliveryStats.drop(dropped)
+	}
+}
@@ -0,0 +1,423 @@
+/*
+Copyright 2018 Turbine Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/turbinelabs/api/service/stats"
+	tbntime "github.com/turbinelabs/nonstdlib/time"
+	"github.com/turbinelabs/test/assert"
+)
+
+// fakeStatsService is a stats.StatsService that records forwarded
+// payloads and fails while failing is set.
+type fakeStatsService struct {
+	lock      sync.Mutex
+	failing   bool
+	forwarded []*stats.Payload
+	attempts  chan struct{}
+}
+
+func newFakeStatsService() *fakeStatsService {
+	return &fakeStatsService{attempts: make(chan struct{}, 100)}
+}
+
+func (f *fakeStatsService) ForwardV2(p *stats.Payload) (*stats.Result, error) {
+	f.lock.Lock()
+	defer func() {
+		f.lock.Unlock()
+		f.attempts <- struct{}{}
+	}()
+
+	if f.failing {
+		return nil, errors.New("unavailable")
+	}
+	f.forwarded = append(f.forwarded, p)
+	return &stats.Result{NumAccepted: len(p.Stats)}, nil
+}
+
+func (f *fakeStatsService) Close() error {
+	return nil
+}
+
+func (f *fakeStatsService) setFailing(failing bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failing = failing
+}
+
+func (f *fakeStatsService) names() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	names := []string{}
+	for _, p := range f.forwarded {
+		for _, st := range p.Stats {
+			names = append(names, st.Name)
+		}
+	}
+	return names
+}
+
+// awaitAttempt advances time until the fake service sees a forward
+// attempt.
+func (f *fakeStatsService) awaitAttempt(cs tbntime.ControlledSource) {
+	for {
+		cs.Advance(time.Minute)
+		select {
+		case <-f.attempts:
+			return
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// awaitEmpty waits until the apiRetrier has no buffered payloads.
+func awaitEmpty(r *apiRetrier) {
+	for {
+		r.lock.Lock()
+		empty := len(r.pending) == 0
+		r.lock.Unlock()
+
+		if empty {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func testPayload(names ...string) *stats.Payload {
+	payload := &stats.Payload{Source: "src", Zone: "zone"}
+	for _, name := range names {
+		value := 1.0
+		payload.Stats = append(payload.Stats, stats.Stat{Name: name, Count: &value})
+	}
+	return payload
+}
+
+func testAPIRetrier(
+	svc stats.StatsService,
+	cs tbntime.Source,
+	ds *deliveryStats,
+	maxBytes int64,
+	dir string,
+) *apiRetrier {
+	return &apiRetrier{
+		svc:            svc,
+		deliveryStats:  ds,
+		timeSource:     cs,
+		maxBytes:       maxBytes,
+		initialBackoff: time.Second,
+		maxBackoff:     time.Minute,
+		dir:            dir,
+	}
+}
+
+func TestEstimatePayloadSize(t *testing.T) {
+	node := "node"
+	payload := testPayload("a", "b")
+	payload.Node = &node
+	payload.Limits = map[string][]float64{"default": {1, 2, 4, 8}}
+	payload.Stats[0].Tags = map[string]string{"upstream": "foo", "method": "GET"}
+	payload.Stats = append(payload.Stats, stats.Stat{
+		Name:      "latency",
+		Histogram: &stats.Histogram{Buckets: []int64{1, 0, 3, 9}, Limits: "default"},
+		Timestamp: 1500000000000,
+	})
+
+	for _, p := range []*stats.Payload{testPayload(), testPayload("a"), payload} {
+		data, err := json.Marshal(p)
+		assert.Nil(t, err)
+
+		estimate := estimatePayloadSize(p)
+		assert.GreaterThanEqual(t, estimate, int64(len(data))/2)
+		assert.LessThanEqual(t, estimate, int64(len(data))*2)
+	}
+}
+
+func TestAPIRetrierBackoff(t *testing.T) {
+	r := &apiRetrier{
+		initialBackoff: time.Second,
+		maxBackoff:     10 * time.Second,
+		rand:           rand.New(rand.NewSource(1)),
+	}
+
+	for attempts, max := range []time.Duration{
+		time.Second,
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		10 * time.Second,
+		10 * time.Second,
+	} {
+		r.attempts = attempts
+		for i := 0; i < 100; i++ {
+			d := r.backoff()
+			assert.GreaterThanEqual(t, d, max/2)
+			assert.LessThanEqual(t, d, max)
+		}
+	}
+}
+
+func TestAPIRetrierRetriesInOrder(t *testing.T) {
+	tbntime.WithCurrentTimeFrozen(func(cs tbntime.ControlledSource) {
+		svc := newFakeStatsService()
+		ds := newDeliveryStats("api")
+		r := testAPIRetrier(svc, cs, ds, 1024*1024, "")
+		assert.Nil(t, r.start())
+
+		svc.setFailing(true)
+		r.forward(testPayload("a"))
+		<-svc.attempts
+
+		// buffered behind "a" without an attempt
+		r.forward(testPayload("b", "c"))
+		assert.Equal(t, len(svc.attempts), 0)
+
+		svc.awaitAttempt(cs)
+		assert.Equal(t, len(svc.names()), 0)
+
+		svc.setFailing(false)
+		svc.awaitAttempt(cs)
+		<-svc.attempts
+		assert.ArrayEqual(t, svc.names(), []string{"a", "b", "c"})
+		awaitEmpty(r)
+
+		// forwarded directly once the buffer is empty
+		r.forward(testPayload("d"))
+		assert.ArrayEqual(t, svc.names(), []string{"a", "b", "c", "d"})
+
+		r.close()
+		assert.Equal(t, ds.sendErrors, int64(2))
+		assert.Equal(t, ds.dropped, int64(0))
+	})
+}
+
+func TestAPIRetrierDropsOldest(t *testing.T) {
+	tbntime.WithCurrentTimeFrozen(func(cs tbntime.ControlledSource) {
+		svc := newFakeStatsService()
+		ds := newDeliveryStats("api")
+
+		size := estimatePayloadSize(testPayload("a", "b"))
+		r := testAPIRetrier(svc, cs, ds, 2*size, "")
+		assert.Nil(t, r.start())
+
+		svc.setFailing(true)
+		r.forward(testPayload("a", "b"))
+		r.forward(testPayload("c", "d"))
+		r.forward(testPayload("e", "f"))
+		assert.Equal(t, ds.dropped, int64(2))
+
+		// larger than the buffer
+		r.forward(testPayload("g", "h", "i", "j", "k", "l"))
+		assert.Equal(t, ds.dropped, int64(8))
+
+		svc.setFailing(false)
+		svc.awaitAttempt(cs)
+		r.close()
+		assert.ArrayEqual(t, svc.names(), []string{"c", "d", "e", "f"})
+	})
+}
+
+func TestAPIRetrierCloseDropsBufferedStats(t *testing.T) {
+	tbntime.WithCurrentTimeFrozen(func(cs tbntime.ControlledSource) {
+		svc := newFakeStatsService()
+		ds := newDeliveryStats("api")
+		r := testAPIRetrier(svc, cs, ds, 1024*1024, "")
+		assert.Nil(t, r.start())
+
+		svc.setFailing(true)
+		r.forward(testPayload("a"))
+		r.forward(testPayload("b"))
+		r.close()
+
+		assert.Equal(t, ds.dropped, int64(2))
+		assert.Equal(t, len(r.pending), 0)
+		assert.Equal(t, r.bytes, int64(0))
+	})
+}
+
+func TestAPIRetrierDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "api-retry")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	files := func() []string {
+		paths, err := filepath.Glob(filepath.Join(dir, "*"+apiRetrySuffix))
+		assert.Nil(t, err)
+		return paths
+	}
+
+	tbntime.WithCurrentTimeFrozen(func(cs tbntime.ControlledSource) {
+		svc := newFakeStatsService()
+		svc.setFailing(true)
+
+		ds := newDeliveryStats("api")
+		r := testAPIRetrier(svc, cs, ds, 1024*1024, dir)
+		assert.Nil(t, r.start())
+
+		r.forward(testPayload("a"))
+		r.forward(testPayload("b"))
+		assert.Equal(t, len(files()), 2)
+
+		// remains on disk after close
+		r.close()
+		assert.Equal(t, len(files()), 2)
+		assert.Equal(t, ds.dropped, int64(0))
+
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "invalid"+apiRetrySuffix), nil, 0644))
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "0"+apiRetrySuffix), []byte("{"), 0644))
+
+		svc = newFakeStatsService()
+		r = testAPIRetrier(svc, cs, ds, 1024*1024, dir)
+		assert.Nil(t, r.start())
+		assert.Equal(t, len(r.pending), 2)
+
+		svc.awaitAttempt(cs)
+		<-svc.attempts
+		r.forward(testPayload("c"))
+		r.close()
+
+		assert.ArrayEqual(t, svc.names(), []string{"a", "b", "c"})
+		assert.ArrayEqual(
+			t,
+			files(),
+			[]string{filepath.Join(dir, "invalid"+apiRetrySuffix)},
+		)
+	})
+}
+
+// blockingStatsService is a fakeStatsService whose forward attempts
+// block until release is closed.
+type blockingStatsService struct {
+	*fakeStatsService
+
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingStatsService) ForwardV2(p *stats.Payload) (*stats.Result, error) {
+	b.entered <- struct{}{}
+	<-b.release
+	return b.fakeStatsService.ForwardV2(p)
+}
+
+func TestAPIRetrierConcurrentForwardsStayOrdered(t *testing.T) {
+	tbntime.WithCurrentTimeFrozen(func(cs tbntime.ControlledSource) {
+		svc := &blockingStatsService{
+			fakeStatsService: newFakeStatsService(),
+			entered:          make(chan struct{}, 100),
+			release:          make(chan struct{}),
+		}
+		svc.setFailing(true)
+
+		r := testAPIRetrier(svc, cs, nil, 1024*1024, "")
+		assert.Nil(t, r.start())
+
+		forward := func(name string) <-chan struct{} {
+			done := make(chan struct{})
+			go func() {
+				r.forward(testPayload(name))
+				close(done)
+			}()
+			return done
+		}
+
+		aDone := forward("a")
+		<-svc.entered
+
+		// b waits for a to be forwarded or buffered
+		bDone := forward("b")
+		select {
+		case <-svc.entered:
+			t.Fatal("b forwarded while a was in flight")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		close(svc.release)
+		<-aDone
+		<-bDone
+		assert.Equal(t, len(svc.entered), 0)
+
+		svc.setFailing(false)
+		svc.awaitAttempt(cs)
+		<-svc.attempts
+		<-svc.attempts
+		r.close()
+
+		assert.ArrayEqual(t, svc.names(), []string{"a", "b"})
+	})
+}
+
+func TestAPIRetrierDropsUnreadablePayloads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "api-retry")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	tbntime.WithCurrentTimeFrozen(func(cs tbntime.ControlledSource) {
+		svc := newFakeStatsService()
+		svc.setFailing(true)
+
+		ds := newDeliveryStats("api")
+		r := testAPIRetrier(svc, cs, ds, 1024*1024, dir)
+		assert.Nil(t, r.start())
+
+		r.forward(testPayload("a", "b"))
+		r.forward(testPayload("c"))
+		<-svc.attempts
+
+		r.lock.Lock()
+		assert.Nil(t, ioutil.WriteFile(r.pending[0].path, []byte("{"), 0644))
+		r.lock.Unlock()
+
+		svc.setFailing(false)
+		svc.awaitAttempt(cs)
+		r.close()
+
+		assert.ArrayEqual(t, svc.names(), []string{"c"})
+		assert.Equal(t, ds.dropped, int64(2))
+	})
+}
+
+func TestAPISenderRetries(t *testing.T) {
+	tbntime.WithCurrentTimeFrozen(func(cs tbntime.ControlledSource) {
+		svc := newFakeStatsService()
+		svc.setFailing(true)
+
+		sender := &apiSender{
+			svc:     svc,
+			source:  unspecified,
+			retrier: testAPIRetrier(svc, cs, nil, 1024*1024, ""),
+		}
+		assert.Nil(t, sender.retrier.start())
+
+		sender.Count("a", 1)
+		svc.setFailing(false)
+		assert.Nil(t, sender.Close())
+		assert.ArrayEqual(t, svc.names(), []string{"a"})
+	})
+}
@@ -17,11 +17,15 @@ limitations under the License.
 package stats
 
 import (
+	"fmt"
+	"path"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/turbinelabs/api/service/stats"
 	"github.com/turbinelabs/api/service/stats/v2"
+	"github.com/turbinelabs/nonstdlib/log/console"
 	"github.com/turbinelabs/nonstdlib/ptr"
 	tbnstrings "github.com/turbinelabs/nonstdlib/strings"
 	tbntime "github.com/turbinelabs/nonstdlib/time"
@@ -37,18 +41,55 @@ var (
 		tagDelim:      "=",
 		scopeDelim:    "/",
 	}
+
+	// defaultAPIHistogramLimits are the histogram bucket upper bounds
+	// used by an apiSender without histogramLimits. They must not be
+	// modified.
+	defaultAPIHistogramLimits = exponentialBuckets(
+		DefaultHistogramBaseValue,
+		DefaultHistogramNumBuckets,
+	)
 )
 
+// apiSender forwards stats to a stats.StatsService. The source, zone,
+// proxy, and node of each stat are taken from tags named SourceTag,
+// ZoneTag, ProxyTag, and NodeTag. The sender's source and zone are
+// used for stats without source or zone tags. Fields other than units
+// and batches are not modified once the sender is in use.
 type apiSender struct {
 	svc    stats.StatsService
 	source string
 	zone   string
-	proxy  string
-	node   string
+
+	unitsLock sync.RWMutex
+	units     map[string]string
+
+	// histogramLimits and bucketOverrides determine the buckets of
+	// histograms that are not latched. If histogramLimits is nil,
+	// exponential buckets starting at DefaultHistogramBaseValue are
+	// used.
+	histogramLimits []float64
+	bucketOverrides []bucketOverride
+
+	// batchSize is the number of stats forwarded in a single
+	// payload. Batches are forwarded when full and when flushed. If
+	// less than 2, each stat is forwarded immediately.
+	batchSize int
+	batchLock sync.Mutex
+	batches   map[batchKey]*stats.Payload
+	batchKeys []batchKey
+
+	// deliveryStats, if non-nil, records the delivery of payloads.
+	deliveryStats *deliveryStats
+
+	// retrier, if non-nil, retries payloads that could not be
+	// forwarded.
+	retrier *apiRetrier
 }
 
 type resolvedTags struct {
 	tagMap       map[string]string
+	source       string
 	node         *string
 	proxy        *string
 	proxyVersion *string
@@ -56,12 +97,60 @@ type resolvedTags struct {
 	ts           time.Time
 }
 
-func (s *apiSender) toTagMap(tags []string) resolvedTags {
+// batchKey identifies the stats that may share a payload.
+type batchKey struct {
+	source       string
+	zone         string
+	node         string
+	proxy        string
+	proxyVersion string
+
+	hasNode         bool
+	hasProxy        bool
+	hasProxyVersion bool
+}
+
+func (r resolvedTags) batchKey() batchKey {
+	return batchKey{
+		source:          r.source,
+		zone:            r.zone,
+		node:            ptr.StringValue(r.node),
+		proxy:           ptr.StringValue(r.proxy),
+		proxyVersion:    ptr.StringValue(r.proxyVersion),
+		hasNode:         r.node != nil,
+		hasProxy:        r.proxy != nil,
+		hasProxyVersion: r.proxyVersion != nil,
+	}
+}
+
+// payload returns an empty Payload for the resolved source, node,
+// zone, proxy, and proxy version.
+func (r resolvedTags) payload() *stats.Payload {
+	return &stats.Payload{
+		Source:       r.source,
+		Node:         r.node,
+		Zone:         r.zone,
+		Proxy:        r.proxy,
+		ProxyVersion: r.proxyVersion,
+	}
+}
+
+func (s *apiSender) toTagMap(stat string, tags []string) resolvedTags {
 	var ts *time.Time
 	resolved := resolvedTags{}
 
-	if len(tags) > 0 {
+	s.unitsLock.RLock()
+	unit := s.units[stat]
+	s.unitsLock.RUnlock()
+
+	if unit != "" {
+		resolved.tagMap = make(map[string]string, len(tags)+1)
+		resolved.tagMap[UnitTag] = unit
+	} else if len(tags) > 0 {
 		resolved.tagMap = make(map[string]string, len(tags))
+	}
+
+	if len(tags) > 0 {
 		for _, tag := range tags {
 			k, v := tbnstrings.SplitFirstEqual(tag)
 			switch k {
@@ -74,6 +163,9 @@ func (s *apiSender) toTagMap(tags []string) resolvedTags {
 			case ProxyVersionTag:
 				resolved.proxyVersion = &v
 
+			case SourceTag:
+				resolved.source = v
+
 			case TimestampTag:
 				if tsv, err := strconv.ParseInt(v, 10, 64); err == nil {
 					ts = ptr.Time(tbntime.FromUnixMilli(tsv))
@@ -96,12 +188,8 @@ func (s *apiSender) toTagMap(tags []string) resolvedTags {
 		resolved.ts = time.Now()
 	}
 
-	if resolved.node == nil && s.node != "" {
-		resolved.node = &s.node
-	}
-
-	if resolved.proxy == nil && s.proxy != "" {
-		resolved.proxy = &s.proxy
+	if resolved.source == "" {
+		resolved.source = s.source
 	}
 
 	if resolved.zone == "" && s.zone != "" {
@@ -112,69 +200,56 @@ func (s *apiSender) toTagMap(tags []string) resolvedTags {
 }
 
 func (s *apiSender) Count(stat string, value float64, tags ...string) {
-	resolvedTags := s.toTagMap(tags)
-
-	s.svc.ForwardV2(
-		&stats.Payload{
-			Source:       s.source,
-			Node:         resolvedTags.node,
-			Zone:         resolvedTags.zone,
-			Proxy:        resolvedTags.proxy,
-			ProxyVersion: resolvedTags.proxyVersion,
-			Stats: []stats.Stat{
-				{
-					Name:      stat,
-					Count:     &value,
-					Timestamp: tbntime.ToUnixMilli(resolvedTags.ts),
-					Tags:      resolvedTags.tagMap,
-				},
-			},
+	resolvedTags := s.toTagMap(stat, tags)
+
+	s.add(
+		resolvedTags,
+		stats.Stat{
+			Name:      stat,
+			Count:     &value,
+			Timestamp: tbntime.ToUnixMilli(resolvedTags.ts),
+			Tags:      resolvedTags.tagMap,
 		},
+		nil,
 	)
 }
 
 func (s *apiSender) Gauge(stat string, value float64, tags ...string) {
-	resolvedTags := s.toTagMap(tags)
-
-	s.svc.ForwardV2(
-		&stats.Payload{
-			Source:       s.source,
-			Node:         resolvedTags.node,
-			Zone:         resolvedTags.zone,
-			Proxy:        resolvedTags.proxy,
-			ProxyVersion: resolvedTags.proxyVersion,
-			Stats: []stats.Stat{
-				{
-					Name:      stat,
-					Gauge:     &value,
-					Timestamp: tbntime.ToUnixMilli(resolvedTags.ts),
-					Tags:      resolvedTags.tagMap,
-				},
-			},
+	resolvedTags := s.toTagMap(stat, tags)
+
+	s.add(
+		resolvedTags,
+		stats.Stat{
+			Name:      stat,
+			Gauge:     &value,
+			Timestamp: tbntime.ToUnixMilli(resolvedTags.ts),
+			Tags:      resolvedTags.tagMap,
 		},
+		nil,
 	)
 }
 
+// Histogram forwards the value as a histogram containing a single
+// sample. Latched histograms are forwarded via LatchedHistogram.
 func (s *apiSender) Histogram(stat string, value float64, tags ...string) {
-	resolvedTags := s.toTagMap(tags)
-
-	s.svc.ForwardV2(
-		&stats.Payload{
-			Source:       s.source,
-			Node:         resolvedTags.node,
-			Zone:         resolvedTags.zone,
-			Proxy:        resolvedTags.proxy,
-			ProxyVersion: resolvedTags.proxyVersion,
-			Stats: []stats.Stat{
-				{
-					Name:      stat,
-					Gauge:     &value,
-					Timestamp: tbntime.ToUnixMilli(resolvedTags.ts),
-					Tags:      resolvedTags.tagMap,
-				},
-			},
-		},
-	)
+	h := newHistogram(stat, nil, s.limits(stat))
+	h.add(value)
+	s.LatchedHistogram(stat, h.latch(), tags...)
+}
+
+// limits returns the histogram bucket upper bounds for the given
+// stat.
+func (s *apiSender) limits(stat string) []float64 {
+	for _, o := range s.bucketOverrides {
+		if ok, _ := path.Match(o.pattern, stat); ok {
+			return o.limits
+		}
+	}
+
+	if s.histogramLimits == nil {
+		return defaultAPIHistogramLimits
+	}
+	return s.histogramLimits
 }
 
 func (s *apiSender) Timing(stat string, value time.Duration, tags ...string) {
@@ -182,48 +257,192 @@ func (s *apiSender) Timing(stat string, value time.Duration, tags ...string) {
 }
 
 func (s *apiSender) LatchedHistogram(stat string, h LatchedHistogram, tags ...string) {
-	resolvedTags := s.toTagMap(tags)
+	resolvedTags := s.toTagMap(stat, tags)
 
+	// Values in the overflow bucket are reflected only in the count.
 	histo := &stats.Histogram{
-		Buckets: make([]int64, len(h.Buckets)),
+		Buckets: h.Buckets,
 		Count:   h.Count,
 		Sum:     h.Sum,
 		Minimum: h.Min,
 		Maximum: h.Max,
 	}
 
-	limits := make([]float64, len(h.Buckets))
-
-	accum := h.BaseValue
-
-	for i, c := range h.Buckets {
-		limits[i] = accum
-		histo.Buckets[i] = c
-		accum *= 2.0
-	}
-
-	s.svc.ForwardV2(
-		&stats.Payload{
-			Source:       s.source,
-			Node:         resolvedTags.node,
-			Zone:         resolvedTags.zone,
-			Proxy:        resolvedTags.proxy,
-			ProxyVersion: resolvedTags.proxyVersion,
-			Limits:       map[string][]float64{v2.DefaultLimitName: limits},
-			Stats: []stats.Stat{
-				{
-					Name:      stat,
-					Histogram: histo,
-					Timestamp: tbntime.ToUnixMilli(resolvedTags.ts),
-					Tags:      resolvedTags.tagMap,
-				},
-			},
+	s.add(
+		resolvedTags,
+		stats.Stat{
+			Name:      stat,
+			Histogram: histo,
+			Timestamp: tbntime.ToUnixMilli(resolvedTags.ts),
+			Tags:      resolvedTags.tagMap,
 		},
+		h.Limits,
 	)
 }
 
+// add adds the stat to the batch of stats sharing its source, node,
+// zone, proxy, and proxy version, forwarding the batch once it holds
+// batchSize stats. Limits, if non-nil, are the histogram bucket limits
+// for the stat. If batching is disabled, the stat is forwarded
+// immediately.
+func (s *apiSender) add(resolved resolvedTags, stat stats.Stat, limits []float64) {
+	if s.batchSize <= 1 {
+		payload := resolved.payload()
+		addStat(payload, stat, limits)
+		s.forward(payload)
+		return
+	}
+
+	key := resolved.batchKey()
+
+	s.batchLock.Lock()
+	payload := s.batches[key]
+	if payload == nil {
+		payload = resolved.payload()
+		if s.batches == nil {
+			s.batches = map[batchKey]*stats.Payload{}
+		}
+		s.batches[key] = payload
+		s.batchKeys = append(s.batchKeys, key)
+	}
+
+	addStat(payload, stat, limits)
+
+	full := len(payload.Stats) >= s.batchSize
+	if full {
+		delete(s.batches, key)
+		for i, k := range s.batchKeys {
+			if k == key {
+				s.batchKeys = append(s.batchKeys[:i], s.batchKeys[i+1:]...)
+				break
+			}
+		}
+	}
+	s.batchLock.Unlock()
+
+	if full {
+		s.forward(payload)
+	}
+}
+
+// addStat appends the stat to the payload. If limits is non-nil, they
+// are added to the payload's limits and the stat's histogram refers
+// to them by name. The first limits added to a payload are named
+// v2.DefaultLimitName.
+func addStat(payload *stats.Payload, stat stats.Stat, limits []float64) {
+	if limits != nil && stat.Histogram != nil {
+		name := ""
+		for n, l := range payload.Limits {
+			if floatsEqual(l, limits) {
+				name = n
+				break
+			}
+		}
+
+		if name == "" {
+			name = v2.DefaultLimitName
+			if len(payload.Limits) > 0 {
+				name = fmt.Sprintf("%s-%d", v2.DefaultLimitName, len(payload.Limits))
+			}
+			if payload.Limits == nil {
+				payload.Limits = map[string][]float64{}
+			}
+			payload.Limits[name] = limits
+		}
+
+		if name != v2.DefaultLimitName {
+			stat.Histogram.Limits = name
+		}
+	}
+
+	payload.Stats = append(payload.Stats, stat)
+}
+
+func floatsEqual(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Flush forwards all batched stats.
+func (s *apiSender) Flush() {
+	s.batchLock.Lock()
+	batches, keys := s.batches, s.batchKeys
+	s.batches, s.batchKeys = nil, nil
+	s.batchLock.Unlock()
+
+	for _, key := range keys {
+		s.forward(batches[key])
+	}
+}
+
+// forward sends the payload to the stats service. If the sender has
+// an apiRetrier, failed payloads are retried. Otherwise failures are
+// logged and recorded as dropped stats.
+func (s *apiSender) forward(payload *stats.Payload) {
+	if s.retrier != nil {
+		s.retrier.forward(payload)
+		return
+	}
+
+	if err := sendPayload(s.svc, s.deliveryStats, payload); err != nil {
+		s.deliveryStats.drop(len(payload.Stats))
+	}
+}
+
+// sendPayload sends the payload to the stats service, recording the
+// delivery in ds. Failures are logged.
+func sendPayload(svc stats.StatsService, ds *deliveryStats, payload *stats.Payload) error {
+	start := time.Now()
+	if _, err := svc.ForwardV2(payload); err != nil {
+		console.Error().Printf("could not forward stats: %s", err)
+		ds.sendError()
+		return err
+	}
+
+	ds.sent(0, time.Since(start))
+	return nil
+}
+
+// Describe records the Descriptor's unit, which is subsequently
+// forwarded as the UnitTag of each value of the stat. Timings are
+// forwarded in seconds.
+func (s *apiSender) Describe(d Descriptor) {
+	unit := d.Unit
+	if d.Type == TimingMetric {
+		unit = "seconds"
+	}
+
+	if unit == "" {
+		return
+	}
+
+	s.unitsLock.Lock()
+	defer s.unitsLock.Unlock()
+
+	if s.units == nil {
+		s.units = map[string]string{}
+	}
+	s.units[d.Name] = unit
+}
+
+// Close forwards any batched or buffered stats and closes the stats
+// service.
 func (s *apiSender) Close() error {
+	s.Flush()
+	if s.retrier != nil {
+		s.retrier.close()
+	}
 	return s.svc.Close()
 }
 
-var _ latchableSender = &apiSender{}
+var (
+	_ latchableSender = &apiSender{}
+	_ flushingSender  = &apiSender{}
+)
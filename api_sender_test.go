@@ -17,6 +17,7 @@ limitations under the License.
 package stats
 
 import (
+	"errors"
 	"reflect"
 	"testing"
 	"time"
@@ -47,8 +48,8 @@ func TestNewAPIStats(t *testing.T) {
 	assert.True(t, ok)
 
 	assert.SameInstance(t, apiStatsImpl.apiSender.svc, mockSvc)
-	assert.Equal(t, apiStatsImpl.apiSender.source, "sourcery")
-	assert.Equal(t, apiStatsImpl.apiSender.zone, "zone")
+	assert.Equal(t, apiStatsImpl.identity.source, "sourcery")
+	assert.Equal(t, apiStatsImpl.identity.zone, "zone")
 }
 
 func testAPISender(t *testing.T, f func(Stats)) stats.Payload {
@@ -164,44 +165,122 @@ func TestAPISenderGauge(t *testing.T) {
 	assert.Equal(t, len(st.Tags), 0)
 }
 
+func TestAPISenderHistogram(t *testing.T) {
+	buckets := make([]int64, DefaultHistogramNumBuckets)
+	buckets[2] = 1
+
+	payload := testAPISender(t, func(s Stats) {
+		s.Histogram("metric", 0.003)
+	})
+	st := payload.Stats[0]
+
+	assert.Equal(t, st.Name, "metric")
+	assert.Nil(t, st.Gauge)
+	assert.MapEqual(
+		t,
+		payload.Limits,
+		map[string][]float64{
+			"default": exponentialBuckets(DefaultHistogramBaseValue, DefaultHistogramNumBuckets),
+		},
+	)
+	assert.DeepEqual(
+		t,
+		st.Histogram,
+		&stats.Histogram{
+			Buckets: buckets,
+			Count:   1,
+			Sum:     0.003,
+			Minimum: 0.003,
+			Maximum: 0.003,
+		},
+	)
+
+	// overflow is reflected only in the count
+	st = testAPISender(t, func(s Stats) {
+		s.Histogram("metric", 1000)
+	}).Stats[0]
+
+	assert.ArrayEqual(t, st.Histogram.Buckets, make([]int64, DefaultHistogramNumBuckets))
+	assert.Equal(t, st.Histogram.Count, int64(1))
+	assert.Equal(t, st.Histogram.Maximum, 1000.0)
+}
+
+func TestAPISenderHistogramBucketOverrides(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	payloads := []*stats.Payload{}
+	mockSvc := stats.NewMockStatsService(ctrl)
+	mockSvc.EXPECT().
+		ForwardV2(gomock.Any()).
+		Do(func(p *stats.Payload) { payloads = append(payloads, p) }).
+		Return(nil, nil).
+		Times(2)
+
+	sender := &apiSender{
+		svc:             mockSvc,
+		source:          unspecified,
+		histogramLimits: []float64{1, 2},
+		bucketOverrides: []bucketOverride{{pattern: "x.*", limits: []float64{10, 20}}},
+	}
+
+	sender.Histogram("x.y", 15)
+	sender.Histogram("z", 1.5)
+
+	assert.ArrayEqual(t, payloads[0].Limits["default"], []float64{10, 20})
+	assert.ArrayEqual(t, payloads[0].Stats[0].Histogram.Buckets, []int64{0, 1})
+	assert.ArrayEqual(t, payloads[1].Limits["default"], []float64{1, 2})
+	assert.ArrayEqual(t, payloads[1].Stats[0].Histogram.Buckets, []int64{0, 1})
+}
+
 func TestAPISenderTimingDuration(t *testing.T) {
 	st := testAPISender(t, func(s Stats) {
 		s.Timing("metric", 1234*time.Millisecond)
 	}).Stats[0]
 
 	assert.Equal(t, st.Name, "metric")
-	assert.Equal(t, *st.Gauge, 1.234)
+	assert.Equal(t, st.Histogram.Count, int64(1))
+	assert.Equal(t, st.Histogram.Sum, 1.234)
 
 	st = testAPISender(t, func(s Stats) {
 		s.Timing("a/b/c/metric", 2*time.Second)
 	}).Stats[0]
 
 	assert.Equal(t, st.Name, "a/b/c/metric")
-	assert.Equal(t, *st.Gauge, 2.0)
+	assert.Equal(t, st.Histogram.Sum, 2.0)
 
 	st = testAPISenderWithTimestampTag(t, func(s Stats) {
 		s.Timing("metric", 1234*time.Millisecond, NewKVTag(TimestampTag, "1500000000"))
 	}).Stats[0]
 
 	assert.Equal(t, st.Name, "metric")
-	assert.Equal(t, *st.Gauge, 1.234)
+	assert.Equal(t, st.Histogram.Sum, 1.234)
 	assert.Equal(t, st.Timestamp, int64(1500000000))
 	assert.Equal(t, len(st.Tags), 0)
 }
 
 func TestAPISenderLatchedHistogram(t *testing.T) {
 	latchedHistogram := LatchedHistogram{
-		BaseValue: 0.001,
-		Buckets:   []int64{200, 550, 245, 4},
-		Count:     1000,
-		Sum:       1.778,
-		Min:       0.0005,
-		Max:       0.1,
+		Limits:   []float64{0.001, 0.002, 0.004, 0.008},
+		Buckets:  []int64{200, 550, 245, 4},
+		Overflow: 1,
+		Count:    1000,
+		Sum:      1.778,
+		Min:      0.0005,
+		Max:      0.1,
 	}
 
 	payload := testAPISenderWithTimestampTag(t, func(s Stats) {
+		// the identity of a latched histogram arrives in its tags
 		sender := s.(*apiStats).apiSender
-		sender.LatchedHistogram("histo", latchedHistogram, TimestampTag+"=1500000000")
+		sender.LatchedHistogram(
+			"histo",
+			latchedHistogram,
+			TimestampTag+"=1500000000",
+			SourceTag+"=sourcery",
+			ZoneTag+"=zone",
+			NodeTag+"=node",
+		)
 	})
 	st := payload.Stats[0]
 
@@ -299,10 +378,166 @@ func TestAPISenderTags(t *testing.T) {
 
 	payload = payloadCaptor.V.(*stats.Payload)
 	assert.Equal(t, len(payload.Stats), 1)
-	assert.Equal(t, ptr.Float64Value(payload.Stats[0].Gauge), 2.0)
+	assert.Equal(t, payload.Stats[0].Histogram.Sum, 2.0)
 	assert.MapEqual(t, payload.Stats[0].Tags, map[string]string{"e": "1", "f": "2"})
 }
 
+func TestAPISenderDescribe(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	payloads := []*stats.Payload{}
+
+	mockSvc := stats.NewMockStatsService(ctrl)
+	mockSvc.EXPECT().
+		ForwardV2(gomock.Any()).
+		Do(func(p *stats.Payload) { payloads = append(payloads, p) }).
+		Return(nil, nil).
+		Times(4)
+
+	s := NewAPIStats(mockSvc)
+	s.Describe(
+		NewDescriptor("bytes", CounterMetric, "bytes sent").WithUnit("bytes"),
+		NewDescriptor("latency", TimingMetric, "request latency").WithUnit("ms"),
+		NewDescriptor("plain", GaugeMetric, "no unit"),
+	)
+
+	s.Count("bytes", 100, NewKVTag("a", "b"))
+	s.Timing("latency", time.Second)
+	s.Gauge("plain", 1)
+	s.Count("bytes", 1, NewKVTag(UnitTag, "kilobytes"))
+
+	assert.Equal(t, len(payloads), 4)
+	assert.MapEqual(
+		t,
+		payloads[0].Stats[0].Tags,
+		map[string]string{"a": "b", UnitTag: "bytes"},
+	)
+	assert.MapEqual(
+		t,
+		payloads[1].Stats[0].Tags,
+		map[string]string{UnitTag: "seconds"},
+	)
+	assert.Equal(t, len(payloads[2].Stats[0].Tags), 0)
+	assert.MapEqual(
+		t,
+		payloads[3].Stats[0].Tags,
+		map[string]string{UnitTag: "kilobytes"},
+	)
+}
+
+func TestAPISenderForwardError(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	mockSvc := stats.NewMockStatsService(ctrl)
+	gomock.InOrder(
+		mockSvc.EXPECT().ForwardV2(gomock.Any()).Return(nil, errors.New("boom")),
+		mockSvc.EXPECT().ForwardV2(gomock.Any()).Return(nil, nil),
+	)
+
+	ds := newDeliveryStats("api")
+	sender := &apiSender{svc: mockSvc, source: unspecified, deliveryStats: ds}
+
+	sender.Count("metric", 1)
+	assert.Equal(t, ds.sendErrors, int64(1))
+	assert.Equal(t, ds.dropped, int64(1))
+	assert.Equal(t, ds.packetsSent, int64(0))
+
+	sender.Gauge("metric", 1)
+	assert.Equal(t, ds.sendErrors, int64(1))
+	assert.Equal(t, ds.packetsSent, int64(1))
+}
+
+func TestAPISenderBatching(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	var payloads []*stats.Payload
+	mockSvc := stats.NewMockStatsService(ctrl)
+	mockSvc.EXPECT().
+		ForwardV2(gomock.Any()).
+		Do(func(p *stats.Payload) { payloads = append(payloads, p) }).
+		Return(nil, nil).
+		AnyTimes()
+
+	ds := newDeliveryStats("api")
+	sender := &apiSender{
+		svc:           mockSvc,
+		source:        "sourcery",
+		zone:          "zone",
+		batchSize:     3,
+		deliveryStats: ds,
+	}
+
+	sender.Count("a", 1, NodeTag+"=n1")
+	sender.Count("b", 2, NodeTag+"=n2")
+	sender.Gauge("c", 3, NodeTag+"=n1")
+	assert.Equal(t, len(payloads), 0)
+
+	// fills the n1 batch
+	sender.Histogram("d", 4, NodeTag+"=n1", "x=y")
+	assert.Equal(t, len(payloads), 1)
+	assert.Equal(t, payloads[0].Source, "sourcery")
+	assert.Equal(t, payloads[0].Zone, "zone")
+	assert.Equal(t, ptr.StringValue(payloads[0].Node), "n1")
+	assert.Equal(t, len(payloads[0].Stats), 3)
+	assert.Equal(t, payloads[0].Stats[0].Name, "a")
+	assert.Equal(t, payloads[0].Stats[1].Name, "c")
+	assert.Equal(t, payloads[0].Stats[2].Name, "d")
+	assert.MapEqual(t, payloads[0].Stats[2].Tags, map[string]string{"x": "y"})
+
+	sender.Count("e", 5)
+	sender.Flush()
+	assert.Equal(t, len(payloads), 3)
+	assert.Equal(t, ptr.StringValue(payloads[1].Node), "n2")
+	assert.Equal(t, len(payloads[1].Stats), 1)
+	assert.Nil(t, payloads[2].Node)
+	assert.Equal(t, len(payloads[2].Stats), 1)
+	assert.Equal(t, ds.packetsSent, int64(3))
+
+	// nothing left to flush
+	sender.Flush()
+	assert.Equal(t, len(payloads), 3)
+
+	mockSvc.EXPECT().Close().Return(nil)
+	sender.Gauge("f", 6)
+	assert.Nil(t, sender.Close())
+	assert.Equal(t, len(payloads), 4)
+	assert.Equal(t, payloads[3].Stats[0].Name, "f")
+}
+
+func TestAPISenderBatchingLimits(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	payloadCaptor := matcher.CaptureType(reflect.TypeOf(&stats.Payload{}))
+
+	mockSvc := stats.NewMockStatsService(ctrl)
+	mockSvc.EXPECT().ForwardV2(payloadCaptor).Return(nil, nil)
+
+	sender := &apiSender{svc: mockSvc, source: unspecified, batchSize: 10}
+
+	sender.LatchedHistogram("a", LatchedHistogram{Limits: []float64{1, 2}, Buckets: []int64{1, 0}})
+	sender.LatchedHistogram("b", LatchedHistogram{Limits: []float64{1, 5}, Buckets: []int64{0, 1}})
+	sender.LatchedHistogram("c", LatchedHistogram{Limits: []float64{1, 2}, Buckets: []int64{1, 1}})
+	sender.Flush()
+
+	payload := payloadCaptor.V.(*stats.Payload)
+	assert.MapEqual(
+		t,
+		payload.Limits,
+		map[string][]float64{
+			"default":   {1, 2},
+			"default-1": {1, 5},
+		},
+	)
+	assert.Equal(t, len(payload.Stats), 3)
+	assert.Equal(t, payload.Stats[0].Histogram.Limits, "")
+	assert.Equal(t, payload.Stats[1].Histogram.Limits, "default-1")
+	assert.Equal(t, payload.Stats[2].Histogram.Limits, "")
+}
+
 func TestApiSenderClose(t *testing.T) {
 	ctrl := gomock.NewController(assert.Tracing(t))
 	defer ctrl.Finish()
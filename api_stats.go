@@ -18,14 +18,18 @@ package stats
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	apiflags "github.com/turbinelabs/api/client/flags"
 	"github.com/turbinelabs/api/service/stats"
 	tbnflag "github.com/turbinelabs/nonstdlib/flag"
 	"github.com/turbinelabs/nonstdlib/log/console"
+	tbntime "github.com/turbinelabs/nonstdlib/time"
 )
 
 const (
@@ -33,9 +37,53 @@ const (
 	// client. If a specific clientApp is required, use SetStatsClientFromFlags.
 	DefaultClientApp = "github.com/turbinelabs/stats"
 
+	// DefaultAPIBatchSize is the default maximum number of latched
+	// stats forwarded to the API in a single call.
+	DefaultAPIBatchSize = 500
+
 	unspecified = "unspecified"
 )
 
+// APIScopeMode determines how Stats created for the API backend
+// record scopes.
+type APIScopeMode string
+
+const (
+	// APIScopePrefix prefixes stat names with their scopes, delimited
+	// by "/".
+	APIScopePrefix APIScopeMode = "prefix"
+
+	// APIScopeTag records scopes, delimited by "/", in a tag named
+	// ScopeTag.
+	APIScopeTag APIScopeMode = "tag"
+)
+
+var apiScopeModes = []string{string(APIScopePrefix), string(APIScopeTag)}
+
+// APIOption is an option for configuring Stats created via
+// NewAPIStats and NewLatchingAPIStats.
+type APIOption func(*apiOptions)
+
+type apiOptions struct {
+	scopeMode APIScopeMode
+}
+
+// APIScope sets how scopes are recorded. The default is
+// APIScopePrefix.
+func APIScope(m APIScopeMode) APIOption {
+	return func(o *apiOptions) {
+		o.scopeMode = m
+	}
+}
+
+func newAPIOptions(options []APIOption) apiOptions {
+	o := apiOptions{scopeMode: APIScopePrefix}
+	for _, apply := range options {
+		apply(&o)
+	}
+	return o
+}
+
 // APIStatsOption is a configuration option the the API stats backend.
 type APIStatsOption func(*apiStatsFromFlags)
 
@@ -77,11 +125,49 @@ func newAPIStatsFromFlags(fs tbnflag.FlagSet, options ...APIStatsOption) statsFr
 		flagScope:               fs.GetScope(),
 		latchingSenderFromFlags: newLatchingSenderFromFlags(fs, true),
 	}
+	ff.latchingSenderFromFlags.cumulativeSupported = true
 
 	for _, apply := range options {
 		apply(ff)
 	}
 
+	fs.IntVar(
+		&ff.batchSize,
+		"batch-size",
+		DefaultAPIBatchSize,
+		"Specifies the maximum number of latched stats forwarded to the API in a single call. Batches are forwarded when full, when a latch window completes, and on exit. Must be greater than 0.",
+	)
+	fs.IntVar(
+		&ff.retryBufferSize,
+		"retry-buffer-size",
+		DefaultAPIRetryBufferSize,
+		"Specifies the maximum size, in bytes, of stats buffered for retry while the API is unavailable. Once the buffer is full, the oldest stats are dropped. If 0, stats that cannot be forwarded are dropped without retrying.",
+	)
+	fs.StringVar(
+		&ff.retryDir,
+		"retry-dir",
+		"",
+		"If specified, stats buffered for retry are stored in files in this directory, rather than in memory, and stats that could not be forwarded before exiting are retried when the process restarts with the same directory. Each process must use its own directory.",
+	)
+	fs.DurationVar(
+		&ff.retryInitialBackoff,
+		"retry-initial-backoff",
+		DefaultAPIRetryInitialBackoff,
+		"Specifies the delay before the first retry of stats that could not be forwarded. The delay doubles after each failed retry, and is randomized by up to half.",
+	)
+	fs.DurationVar(
+		&ff.retryMaxBackoff,
+		"retry-max-backoff",
+		DefaultAPIRetryMaxBackoff,
+		"Specifies the maximum delay between retries of stats that could not be forwarded.",
+	)
+	fs.StringVar(
+		&ff.scopeMode,
+		"scope-mode",
+		string(APIScopePrefix),
+		"Specifies how scoped stats are recorded. One of "+strings.Join(apiScopeModes, ", ")+". With prefix, stat names are prefixed with their scopes, delimited by \"/\". With tag, scopes are recorded, delimited by \"/\", in a \""+ScopeTag+"\" tag.",
+	)
+
 	if ff.statsClientFromFlags == nil {
 		apiConfigFromFlags := apiflags.NewAPIConfigFromFlags(
 			fs,
@@ -110,6 +196,12 @@ type apiStatsFromFlags struct {
 	statsClientFromFlags    apiflags.StatsClientFromFlags
 	latchingSenderFromFlags *latchingSenderFromFlags
 	allowEmptyAPIKey        bool
+	batchSize               int
+	retryBufferSize         int
+	retryDir                string
+	retryInitialBackoff     time.Duration
+	retryMaxBackoff         time.Duration
+	scopeMode               string
 }
 
 func (ff *apiStatsFromFlags) Validate() error {
@@ -130,10 +222,45 @@ func (ff *apiStatsFromFlags) Validate() error {
 		return err
 	}
 
+	if ff.batchSize < 1 {
+		return fmt.Errorf("--%sbatch-size must be greater than 0", ff.flagScope)
+	}
+
+	switch APIScopeMode(ff.scopeMode) {
+	case APIScopePrefix, APIScopeTag:
+	default:
+		return fmt.Errorf(
+			"--%sscope-mode must be one of %s",
+			ff.flagScope,
+			strings.Join(apiScopeModes, ", "),
+		)
+	}
+
+	if ff.retryBufferSize < 0 {
+		return fmt.Errorf("--%sretry-buffer-size must not be negative", ff.flagScope)
+	}
+
+	if ff.retryBufferSize > 0 {
+		if ff.retryInitialBackoff <= 0 {
+			return fmt.Errorf("--%sretry-initial-backoff must be greater than 0", ff.flagScope)
+		}
+
+		if ff.retryMaxBackoff < ff.retryInitialBackoff {
+			return fmt.Errorf(
+				"--%sretry-max-backoff must not be less than --%[1]sretry-initial-backoff",
+				ff.flagScope,
+			)
+		}
+	}
+
 	return ff.latchingSenderFromFlags.Validate()
 }
 
 func (ff *apiStatsFromFlags) Make() (Stats, error) {
+	return ff.makeWithDeliveryStats(nil)
+}
+
+func (ff *apiStatsFromFlags) makeWithDeliveryStats(ds *deliveryStats) (Stats, error) {
 	if ff.allowEmptyAPIKey && ff.statsClientFromFlags.APIKey() == "" {
 		console.Info().Println("No API key specified, the API stats backend will not be configured.")
 		return NewNoopStats(), nil
@@ -154,59 +281,253 @@ func (ff *apiStatsFromFlags) Make() (Stats, error) {
 	}
 
 	sender := &apiSender{
-		svc:    statsClient,
-		source: unspecified,
-		zone:   zone,
+		svc:           statsClient,
+		source:        unspecified,
+		zone:          zone,
+		deliveryStats: ds,
+	}
+	if ff.latchingSenderFromFlags.enabled {
+		sender.batchSize = ff.batchSize
+	} else {
+		sender.histogramLimits, sender.bucketOverrides = ff.latchingSenderFromFlags.histogramBuckets()
+	}
+
+	if ff.retryBufferSize > 0 {
+		sender.retrier = &apiRetrier{
+			svc:            statsClient,
+			deliveryStats:  ds,
+			timeSource:     tbntime.NewSource(),
+			maxBytes:       int64(ff.retryBufferSize),
+			initialBackoff: ff.retryInitialBackoff,
+			maxBackoff:     ff.retryMaxBackoff,
+			dir:            ff.retryDir,
+		}
+		if err := sender.retrier.start(); err != nil {
+			return nil, err
+		}
 	}
 
 	wrappedSender := ff.latchingSenderFromFlags.Make(sender, apiCleaner)
 
 	underlying := newFromSender(wrappedSender, apiCleaner, "", nil, false)
 
-	return &apiStats{underlying, sender}, nil
+	return &apiStats{
+		Stats:     underlying,
+		apiSender: sender,
+		scopeMode: APIScopeMode(ff.scopeMode),
+	}, nil
 }
 
 type apiStats struct {
 	Stats
 
 	apiSender *apiSender
+	scopeMode APIScopeMode
+
+	// scope is the scope recorded in the ScopeTag, if scopeMode is
+	// APIScopeTag.
+	scope string
+
+	// lock protects identity and tags, which are replaced, rather
+	// than modified, by AddTags, so that they may be shared by Stats
+	// derived via Scope
+	lock     sync.RWMutex
+	identity *apiIdentity
+	tags     []Tag
 }
 
-// Scope always returns this Stats implementation as API stats do not
-// support scoping.
-func (a *apiStats) Scope(s string, ss ...string) Stats {
-	return a
+// apiIdentity is the source, zone, proxy, and node of the stats
+// recorded by an apiStats. Empty values are left to the apiSender. An
+// apiIdentity is never modified once created, so it may be shared by
+// Stats derived via Scope.
+type apiIdentity struct {
+	source string
+	zone   string
+	proxy  string
+	node   string
 }
 
-// AddTags filters out tags named source, proxy, node, and zone. The source, proxy,
-// and zone tags alter the source, proxy, node, and zone used when making API stats
-// forwarding calls.
-func (a *apiStats) AddTags(tags ...Tag) {
-	for _, tag := range tags {
-		switch tag.K {
-		case NodeTag:
-			a.apiSender.node = tag.V
+// isAPIIdentityTag returns true if the tag sets the source, zone,
+// proxy, or node of API stats.
+func isAPIIdentityTag(tag Tag) bool {
+	switch tag.K {
+	case NodeTag, ProxyTag, SourceTag, ZoneTag:
+		return true
+	default:
+		return false
+	}
+}
 
-		case ProxyTag:
-			a.apiSender.proxy = tag.V
+// with returns a copy of the identity with the given identity tag
+// applied.
+func (id *apiIdentity) with(tag Tag) *apiIdentity {
+	next := apiIdentity{}
+	if id != nil {
+		next = *id
+	}
+
+	switch tag.K {
+	case NodeTag:
+		next.node = tag.V
+
+	case ProxyTag:
+		next.proxy = tag.V
+
+	case SourceTag:
+		next.source = tag.V
+
+	case ZoneTag:
+		next.zone = tag.V
+	}
+
+	return &next
+}
+
+// appendTo returns the given tags followed by the identity's non-empty
+// values as tags. Values for which a tag is given are omitted, so that
+// the given tags take precedence.
+func (id *apiIdentity) appendTo(tags []Tag) []Tag {
+	if id == nil {
+		return tags
+	}
+
+	result := make([]Tag, len(tags), len(tags)+4)
+	copy(result, tags)
+
+	for _, tag := range []Tag{
+		{SourceTag, id.source},
+		{ZoneTag, id.zone},
+		{ProxyTag, id.proxy},
+		{NodeTag, id.node},
+	} {
+		if tag.V == "" {
+			continue
+		}
+
+		overridden := false
+		for _, t := range tags {
+			if t.K == tag.K {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			result = append(result, tag)
+		}
+	}
+
+	return result
+}
+
+func (a *apiStats) getTags() (*apiIdentity, []Tag) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.identity, a.tags
+}
+
+// withTags returns the given tags followed by the tags added via
+// AddTags, the ScopeTag (if any), and the identity tags. Scopes are
+// recorded only here, so that nested scopes produce a single ScopeTag
+// regardless of the underlying Stats.
+func (a *apiStats) withTags(tags []Tag) []Tag {
+	identity, added := a.getTags()
+	if len(added) > 0 || a.scope != "" {
+		tags = append(tags[:len(tags):len(tags)], added...)
+	}
+	if a.scope != "" {
+		tags = append(tags, NewKVTag(ScopeTag, a.scope))
+	}
+	return identity.appendTo(tags)
+}
 
-		case SourceTag:
-			a.apiSender.source = tag.V
+func (a *apiStats) Gauge(stat string, value float64, tags ...Tag) {
+	a.Stats.Gauge(stat, value, a.withTags(tags)...)
+}
+
+func (a *apiStats) Count(stat string, count float64, tags ...Tag) {
+	a.Stats.Count(stat, count, a.withTags(tags)...)
+}
+
+func (a *apiStats) Histogram(stat string, value float64, tags ...Tag) {
+	a.Stats.Histogram(stat, value, a.withTags(tags)...)
+}
+
+func (a *apiStats) Timing(stat string, value time.Duration, tags ...Tag) {
+	a.Stats.Timing(stat, value, a.withTags(tags)...)
+}
+
+// Scope returns a Stats that records stats in the given scopes,
+// according to the APIScopeMode. The returned Stats initially has
+// the same source, zone, proxy, node, and added tags as this Stats.
+func (a *apiStats) Scope(scope string, scopes ...string) Stats {
+	identity, tags := a.getTags()
+
+	if a.scopeMode != APIScopeTag {
+		return &apiStats{
+			Stats:     a.Stats.Scope(scope, scopes...),
+			apiSender: a.apiSender,
+			scopeMode: a.scopeMode,
+			identity:  identity,
+			tags:      tags,
+		}
+	}
+
+	path := strings.Join(append([]string{scope}, scopes...), apiCleaner.scopeDelim)
+	if a.scope != "" {
+		path = a.scope + apiCleaner.scopeDelim + path
+	}
 
-		case ZoneTag:
-			a.apiSender.zone = tag.V
+	return &apiStats{
+		Stats:     a.Stats,
+		apiSender: a.apiSender,
+		scopeMode: a.scopeMode,
+		scope:     path,
+		identity:  identity,
+		tags:      tags,
+	}
+}
+
+// AddTags adds tags to the stats recorded via this Stats and Stats
+// subsequently derived from it via Scope. Tags named source, proxy,
+// node, and zone alter the source, proxy, node, and zone used when
+// forwarding stats. Other Stats sharing the same API stats backend,
+// including the Stats from which this one was derived, are
+// unaffected. Per-call tags with these names take precedence. AddTags
+// is safe for concurrent use with the other methods of this Stats
+// and of any Stats derived from it.
+func (a *apiStats) AddTags(tags ...Tag) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
 
-		default:
-			a.Stats.AddTags(tag)
+	var added []Tag
+	for _, tag := range tags {
+		if isAPIIdentityTag(tag) {
+			a.identity = a.identity.with(tag)
+		} else {
+			if added == nil {
+				added = make([]Tag, len(a.tags), len(a.tags)+len(tags))
+				copy(added, a.tags)
+			}
+			added = append(added, tag)
 		}
 	}
+
+	if added != nil {
+		a.tags = added
+	}
 }
 
 // NewAPIStats creates a Stats that uses the given stats.StatsService
 // to forward arbitrary stats with an unspecified source and zone. The
 // source and zone may be subsequently overridden by invoking AddTags
-// with tags named SourceTag and ZoneTag.
-func NewAPIStats(svc stats.StatsService) Stats {
+// with tags named SourceTag and ZoneTag. Each histogram and timing
+// value is forwarded as a histogram containing a single sample, using
+// DefaultHistogramNumBuckets exponential buckets starting at
+// DefaultHistogramBaseValue. Scopes are recorded according to the
+// APIScope option.
+func NewAPIStats(svc stats.StatsService, options ...APIOption) Stats {
+	opts := newAPIOptions(options)
+
 	sender := &apiSender{
 		svc:    svc,
 		source: unspecified,
@@ -214,20 +535,26 @@ func NewAPIStats(svc stats.StatsService) Stats {
 	}
 	underlying := newFromSender(sender, apiCleaner, "", nil, false)
 
-	return &apiStats{underlying, sender}
+	return &apiStats{Stats: underlying, apiSender: sender, scopeMode: opts.scopeMode}
 }
 
-// NewLatchingAPIStats creates a Stats as in NewAPIStats, but with latching enabled.
+// NewLatchingAPIStats creates a Stats as in NewAPIStats, but with
+// latching enabled. Latched stats are forwarded in batches of up to
+// DefaultAPIBatchSize stats.
 func NewLatchingAPIStats(
 	svc stats.StatsService,
 	window time.Duration,
 	baseValue float64,
 	numBuckets int,
+	options ...APIOption,
 ) Stats {
+	opts := newAPIOptions(options)
+
 	sender := &apiSender{
-		svc:    svc,
-		source: unspecified,
-		zone:   unspecified,
+		svc:       svc,
+		source:    unspecified,
+		zone:      unspecified,
+		batchSize: DefaultAPIBatchSize,
 	}
 
 	wrappedSender := newLatchingSender(
@@ -239,5 +566,5 @@ func NewLatchingAPIStats(
 
 	underlying := newFromSender(wrappedSender, apiCleaner, "", nil, false)
 
-	return &apiStats{underlying, sender}
+	return &apiStats{Stats: underlying, apiSender: sender, scopeMode: opts.scopeMode}
 }
@@ -18,15 +18,20 @@ package stats
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"os"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 
 	apiflags "github.com/turbinelabs/api/client/flags"
 	"github.com/turbinelabs/api/service/stats"
 	tbnflag "github.com/turbinelabs/nonstdlib/flag"
+	"github.com/turbinelabs/nonstdlib/ptr"
 	"github.com/turbinelabs/test/assert"
 )
 
@@ -72,6 +77,47 @@ func TestNewAPIStatsFromFlagsOptions(t *testing.T) {
 	mockStatsClientFromFlags.EXPECT().Validate().Return(nil)
 	assert.Nil(t, ff.Validate())
 
+	ffImpl.batchSize = 0
+	mockStatsClientFromFlags.EXPECT().APIKey().Return("key")
+	mockZoneFromFlags.EXPECT().Name().Return("zone")
+	mockStatsClientFromFlags.EXPECT().Validate().Return(nil)
+	assert.ErrorContains(t, ff.Validate(), "--api.batch-size must be greater than 0")
+	ffImpl.batchSize = DefaultAPIBatchSize
+
+	for _, tc := range []struct {
+		bufferSize            int
+		initialBackoff        time.Duration
+		maxBackoff            time.Duration
+		expectedErrorContains string
+	}{
+		{-1, time.Second, time.Minute, "--api.retry-buffer-size must not be negative"},
+		{1, 0, time.Minute, "--api.retry-initial-backoff must be greater than 0"},
+		{1, time.Minute, time.Second, "--api.retry-max-backoff must not be less than --api.retry-initial-backoff"},
+		{0, 0, 0, ""},
+	} {
+		ffImpl.retryBufferSize = tc.bufferSize
+		ffImpl.retryInitialBackoff = tc.initialBackoff
+		ffImpl.retryMaxBackoff = tc.maxBackoff
+		mockStatsClientFromFlags.EXPECT().APIKey().Return("key")
+		mockZoneFromFlags.EXPECT().Name().Return("zone")
+		mockStatsClientFromFlags.EXPECT().Validate().Return(nil)
+		if tc.expectedErrorContains == "" {
+			assert.Nil(t, ff.Validate())
+		} else {
+			assert.ErrorContains(t, ff.Validate(), tc.expectedErrorContains)
+		}
+	}
+	ffImpl.scopeMode = "nope"
+	mockStatsClientFromFlags.EXPECT().APIKey().Return("key")
+	mockZoneFromFlags.EXPECT().Name().Return("zone")
+	mockStatsClientFromFlags.EXPECT().Validate().Return(nil)
+	assert.ErrorContains(t, ff.Validate(), "--api.scope-mode must be one of prefix, tag")
+	ffImpl.scopeMode = string(APIScopePrefix)
+
+	ffImpl.retryBufferSize = DefaultAPIRetryBufferSize
+	ffImpl.retryInitialBackoff = DefaultAPIRetryInitialBackoff
+	ffImpl.retryMaxBackoff = DefaultAPIRetryMaxBackoff
+
 	mockStatsClientFromFlags.EXPECT().Make(logger).Return(nil, e)
 	_, err := ff.Make()
 	assert.ErrorContains(t, err, "boom")
@@ -131,9 +177,132 @@ func TestAPIStatsScope(t *testing.T) {
 	underlying := NewMockStats(ctrl)
 	sender := &apiSender{source: "unspecified", zone: "unspecified"}
 
-	stats := &apiStats{underlying, sender}
+	scoped := NewMockStats(ctrl)
+	underlying.EXPECT().Scope("XYZ").Return(scoped)
+
+	stats := &apiStats{Stats: underlying, apiSender: sender, scopeMode: APIScopePrefix}
+
+	got, ok := stats.Scope("XYZ").(*apiStats)
+	assert.True(t, ok)
+	assert.SameInstance(t, got.Stats, scoped)
+	assert.SameInstance(t, got.apiSender, sender)
+	assert.Equal(t, got.scopeMode, APIScopePrefix)
+}
+
+func testAPIStatsPayloads(t *testing.T, options []APIOption, f func(Stats)) []*stats.Payload {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	var (
+		lock     sync.Mutex
+		payloads []*stats.Payload
+	)
+	mockSvc := stats.NewMockStatsService(ctrl)
+	mockSvc.EXPECT().ForwardV2(gomock.Any()).AnyTimes().Do(func(p *stats.Payload) {
+		lock.Lock()
+		defer lock.Unlock()
+		payloads = append(payloads, p)
+	}).Return(nil, nil)
+
+	f(NewAPIStats(mockSvc, options...))
+	return payloads
+}
+
+func testAPIStatsScope(t *testing.T, options []APIOption, f func(Stats)) []stats.Stat {
+	var sent []stats.Stat
+	for _, p := range testAPIStatsPayloads(t, options, f) {
+		sent = append(sent, p.Stats...)
+	}
+	return sent
+}
 
-	assert.SameInstance(t, stats.Scope("XYZ"), stats)
+func TestAPIStatsScopePrefix(t *testing.T) {
+	sent := testAPIStatsScope(t, nil, func(s Stats) {
+		s.AddTags(NewKVTag("a", "b"))
+		s.Scope("x").Count("latency", 1)
+
+		scoped := s.Scope("y", "z")
+		scoped.AddTags(NewKVTag("c", "d"))
+		scoped.Scope("w").Gauge("latency", 2)
+		s.Count("latency", 3)
+	})
+
+	assert.Equal(t, len(sent), 3)
+	assert.Equal(t, sent[0].Name, "x/latency")
+	assert.MapEqual(t, sent[0].Tags, map[string]string{"a": "b"})
+	assert.Equal(t, sent[1].Name, "y/z/w/latency")
+	assert.MapEqual(t, sent[1].Tags, map[string]string{"a": "b", "c": "d"})
+	assert.Equal(t, sent[2].Name, "latency")
+	assert.MapEqual(t, sent[2].Tags, map[string]string{"a": "b"})
+}
+
+func TestAPIStatsScopeTag(t *testing.T) {
+	sent := testAPIStatsScope(t, []APIOption{APIScope(APIScopeTag)}, func(s Stats) {
+		s.AddTags(NewKVTag("a", "b"))
+		s.Scope("x").Count("latency", 1)
+
+		scoped := s.Scope("y", "z")
+		scoped.AddTags(NewKVTag("c", "d"))
+		scoped.Scope("w").Gauge("latency", 2)
+		s.Count("latency", 3)
+	})
+
+	assert.Equal(t, len(sent), 3)
+	assert.Equal(t, sent[0].Name, "latency")
+	assert.MapEqual(t, sent[0].Tags, map[string]string{"a": "b", ScopeTag: "x"})
+	assert.Equal(t, sent[1].Name, "latency")
+	assert.MapEqual(
+		t,
+		sent[1].Tags,
+		map[string]string{"a": "b", "c": "d", ScopeTag: "y/z/w"},
+	)
+	assert.Equal(t, sent[2].Name, "latency")
+	assert.MapEqual(t, sent[2].Tags, map[string]string{"a": "b"})
+}
+
+func TestAPIStatsScopeTagSingleTag(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	tagA := NewKVTag("a", "b")
+
+	// the underlying Stats need not be backed by xstats, and nested
+	// scopes produce exactly one ScopeTag
+	underlying := NewMockStats(ctrl)
+	underlying.EXPECT().Count("latency", 1.0, tagA, NewKVTag(ScopeTag, "x/y/z"))
+
+	s := &apiStats{Stats: underlying, scopeMode: APIScopeTag}
+	s.Scope("x").Scope("y", "z").Count("latency", 1, tagA)
+}
+
+func TestNewLatchingAPIStatsScopeTag(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	var sent []stats.Stat
+	mockSvc := stats.NewMockStatsService(ctrl)
+	mockSvc.EXPECT().ForwardV2(gomock.Any()).AnyTimes().Do(func(p *stats.Payload) {
+		sent = append(sent, p.Stats...)
+	}).Return(nil, nil)
+	mockSvc.EXPECT().Close().Return(nil)
+
+	s := NewLatchingAPIStats(
+		mockSvc,
+		time.Hour,
+		DefaultHistogramBaseValue,
+		DefaultHistogramNumBuckets,
+		APIScope(APIScopeTag),
+	)
+	s.Scope("x").Count("latency", 1, NewKVTag(TimestampTag, "1500000000000"))
+	assert.Nil(t, s.Close())
+
+	for _, st := range sent {
+		if st.Name == "latency" {
+			assert.MapEqual(t, st.Tags, map[string]string{ScopeTag: "x"})
+			return
+		}
+	}
+	t.Errorf("latency not sent: %+v", sent)
 }
 
 func TestAPIStatsAddTags(t *testing.T) {
@@ -145,17 +314,24 @@ func TestAPIStatsAddTags(t *testing.T) {
 	tagC := NewKVTag("c", "c")
 	tagD := NewKVTag("d", "d")
 
+	// tags are added per call rather than to the underlying Stats
 	underlying := NewMockStats(ctrl)
-	gomock.InOrder(
-		underlying.EXPECT().AddTags(tagA),
-		underlying.EXPECT().AddTags(tagB),
-		underlying.EXPECT().AddTags(tagC),
-		underlying.EXPECT().AddTags(tagD),
+	underlying.EXPECT().Count(
+		"x",
+		1.0,
+		tagA,
+		tagB,
+		tagC,
+		tagD,
+		NewKVTag(SourceTag, "s"),
+		NewKVTag(ZoneTag, "z"),
+		NewKVTag(ProxyTag, "p"),
 	)
 	sender := &apiSender{source: "unspecified", zone: "unspecified"}
 
-	stats := &apiStats{underlying, sender}
+	stats := &apiStats{Stats: underlying, apiSender: sender}
 	stats.AddTags(tagA, tagB)
+	added := stats.tags
 	stats.AddTags(
 		tagC,
 		NewKVTag("proxy", "p"),
@@ -163,10 +339,112 @@ func TestAPIStatsAddTags(t *testing.T) {
 		NewKVTag("zone", "z"),
 		tagD,
 	)
+	stats.Count("x", 1)
 
-	assert.Equal(t, sender.proxy, "p")
-	assert.Equal(t, sender.source, "s")
-	assert.Equal(t, sender.zone, "z")
+	assert.DeepEqual(t, stats.identity, &apiIdentity{source: "s", zone: "z", proxy: "p"})
+	assert.ArrayEqual(t, stats.tags, []Tag{tagA, tagB, tagC, tagD})
+
+	// previously added tags are replaced, not modified
+	assert.ArrayEqual(t, added, []Tag{tagA, tagB})
+
+	// the shared sender is unchanged
+	assert.Equal(t, sender.source, "unspecified")
+	assert.Equal(t, sender.zone, "unspecified")
+}
+
+func TestAPIStatsIdentity(t *testing.T) {
+	payloads := testAPIStatsPayloads(t, nil, func(s Stats) {
+		s.AddTags(NewKVTag(SourceTag, "src"), NewKVTag(NodeTag, "n1"))
+
+		scoped := s.Scope("x")
+		scoped.AddTags(NewKVTag(NodeTag, "n2"), NewKVTag(ProxyTag, "p"))
+
+		s.Count("a", 1)
+		scoped.Count("b", 1)
+		scoped.Count("c", 1, NewKVTag(NodeTag, "n3"), NewKVTag(SourceTag, "other"))
+
+		// changes after Scope are not inherited
+		s.AddTags(NewKVTag(ZoneTag, "z"))
+		scoped.Gauge("d", 1)
+		s.Scope("y").Timing("e", time.Second)
+	})
+
+	type identity struct {
+		name, source, zone, proxy, node string
+	}
+
+	got := make([]identity, len(payloads))
+	for i, p := range payloads {
+		assert.Equal(t, len(p.Stats), 1)
+		assert.Equal(t, len(p.Stats[0].Tags), 0)
+		got[i] = identity{
+			name:   p.Stats[0].Name,
+			source: p.Source,
+			zone:   p.Zone,
+			proxy:  ptr.StringValue(p.Proxy),
+			node:   ptr.StringValue(p.Node),
+		}
+	}
+
+	assert.ArrayEqual(
+		t,
+		got,
+		[]identity{
+			{"a", "src", "unspecified", "", "n1"},
+			{"x/b", "src", "unspecified", "p", "n2"},
+			{"x/c", "other", "unspecified", "p", "n3"},
+			{"x/d", "src", "unspecified", "p", "n2"},
+			{"y/e", "src", "z", "", "n1"},
+		},
+	)
+}
+
+func TestAPIStatsIdentityConcurrency(t *testing.T) {
+	const (
+		goroutines = 8
+		iterations = 100
+	)
+
+	payloads := testAPIStatsPayloads(t, nil, func(s Stats) {
+		s.AddTags(NewKVTag(SourceTag, "src"))
+
+		var wg sync.WaitGroup
+		for i := 0; i < goroutines; i++ {
+			wg.Add(1)
+			go func(node string) {
+				defer wg.Done()
+
+				scoped := s.Scope(node)
+				for j := 0; j < iterations; j++ {
+					scoped.AddTags(NewKVTag(NodeTag, node), NewKVTag("id", node))
+					scoped.Count("c", 1)
+
+					// concurrent changes to the shared parent
+					s.AddTags(NewKVTag(ZoneTag, node), NewKVTag("parent", node))
+					s.Count("p", 1)
+				}
+			}(fmt.Sprintf("n%d", i))
+		}
+		wg.Wait()
+	})
+
+	assert.Equal(t, len(payloads), 2*goroutines*iterations)
+	for _, p := range payloads {
+		assert.Equal(t, p.Source, "src")
+
+		name := p.Stats[0].Name
+		tags := p.Stats[0].Tags
+		if name == "p" {
+			assert.Nil(t, p.Node)
+			assert.Equal(t, tags["id"], "")
+			continue
+		}
+
+		// each scoped Stats sees only its own node and tags
+		node := ptr.StringValue(p.Node)
+		assert.Equal(t, name, node+"/c")
+		assert.Equal(t, tags["id"], node)
+	}
 }
 
 func TestNewLatchingAPIStats(t *testing.T) {
@@ -197,3 +475,71 @@ func TestNewLatchingAPIStats(t *testing.T) {
 
 	assert.SameInstance(t, statsImpl.apiSender, wrappedAPISender)
 }
+
+func TestLatchingAPIStatsFractionalCounts(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	mockSvc := stats.NewMockStatsService(ctrl)
+
+	var counts []float64
+	mockSvc.EXPECT().ForwardV2(gomock.Any()).AnyTimes().Do(func(p *stats.Payload) {
+		for _, stat := range p.Stats {
+			if stat.Count != nil {
+				counts = append(counts, *stat.Count)
+			}
+		}
+	}).Return(nil, nil)
+	mockSvc.EXPECT().Close().Return(nil)
+
+	s := NewLatchingAPIStats(
+		mockSvc,
+		time.Hour,
+		DefaultHistogramBaseValue,
+		DefaultHistogramNumBuckets,
+	)
+
+	s.Count("kib", 0.5)
+	s.Count("kib", 0.25)
+	s.Count("sampled", 1.0, NewKVTag(SampleRateTag, "0.3"))
+	s.Count("large", 1e300)
+	s.Count("large", 1e300)
+	assert.Nil(t, s.Close())
+
+	sort.Float64s(counts)
+	assert.ArrayEqual(t, counts, []float64{0.75, 1.0 / 0.3, 2e300})
+}
+
+func TestLatchingAPIStatsBatching(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	mockSvc := stats.NewMockStatsService(ctrl)
+
+	var payloads []*stats.Payload
+	gomock.InOrder(
+		mockSvc.EXPECT().ForwardV2(gomock.Any()).Do(func(p *stats.Payload) {
+			payloads = append(payloads, p)
+		}).Return(nil, nil),
+		mockSvc.EXPECT().Close().Return(nil),
+	)
+
+	s := NewLatchingAPIStats(
+		mockSvc,
+		time.Hour,
+		DefaultHistogramBaseValue,
+		DefaultHistogramNumBuckets,
+	)
+
+	tsTag := NewKVTag(TimestampTag, "1500000000000")
+	for i := 0; i < 10; i++ {
+		s.Count(fmt.Sprintf("c%d", i), 1.0, tsTag)
+	}
+	s.Timing("t", time.Millisecond, tsTag)
+	assert.Nil(t, s.Close())
+
+	// 10 counters, a histogram, and latched_at
+	assert.Equal(t, len(payloads), 1)
+	assert.Equal(t, len(payloads[0].Stats), 12)
+	assert.Equal(t, len(payloads[0].Limits), 1)
+}
@@ -0,0 +1,465 @@
+/*
+Copyright 2018 Turbine Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAsyncQueueSize is the default number of calls queued by
+	// an AsyncStats.
+	DefaultAsyncQueueSize = 4096
+
+	// DefaultAsyncWorkers is the default number of goroutines that
+	// forward calls queued by an AsyncStats.
+	DefaultAsyncWorkers = 1
+
+	// DefaultAsyncCloseTimeout is the default maximum time an
+	// AsyncStats waits for queued calls to be forwarded when closed.
+	DefaultAsyncCloseTimeout = 5 * time.Second
+)
+
+// AsyncOverflowPolicy determines how an AsyncStats handles calls made
+// while its queue is full.
+type AsyncOverflowPolicy int
+
+const (
+	// AsyncDropOldest discards the oldest queued call to make room
+	// for the new call. If no queued call may be discarded, the new
+	// call is discarded.
+	AsyncDropOldest AsyncOverflowPolicy = iota
+
+	// AsyncDropNewest discards the new call.
+	AsyncDropNewest
+
+	// AsyncBlock blocks the caller until the queue has room for the
+	// new call.
+	AsyncBlock
+)
+
+// String returns the name of the AsyncOverflowPolicy.
+func (p AsyncOverflowPolicy) String() string {
+	switch p {
+	case AsyncDropOldest:
+		return "drop-oldest"
+	case AsyncDropNewest:
+		return "drop-newest"
+	case AsyncBlock:
+		return "block"
+	default:
+		return "unknown"
+	}
+}
+
+// AsyncStats is a Stats that forwards calls to an underlying Stats
+// asynchronously.
+type AsyncStats interface {
+	ExtendedStats
+
+	// Dropped returns the number of calls that were discarded
+	// without being forwarded, either because the queue was full or
+	// because the AsyncStats was closed. The count is shared by all
+	// Stats derived from the AsyncStats via Scope.
+	Dropped() int64
+}
+
+// AsyncOption is an option for configuring Stats created via
+// NewAsyncStats.
+type AsyncOption func(*asyncOptions)
+
+type asyncOptions struct {
+	queueSize    int
+	workers      int
+	policy       AsyncOverflowPolicy
+	closeTimeout time.Duration
+}
+
+// AsyncQueueSize sets the maximum number of queued calls. Values less
+// than 1 are ignored. The default is DefaultAsyncQueueSize.
+func AsyncQueueSize(n int) AsyncOption {
+	return func(o *asyncOptions) {
+		if n > 0 {
+			o.queueSize = n
+		}
+	}
+}
+
+// AsyncWorkers sets the number of goroutines that forward queued
+// calls. Values less than 1 are ignored. The default is
+// DefaultAsyncWorkers.
+func AsyncWorkers(n int) AsyncOption {
+	return func(o *asyncOptions) {
+		if n > 0 {
+			o.workers = n
+		}
+	}
+}
+
+// AsyncOverflow sets the policy applied to calls made while the queue
+// is full. The default is AsyncDropOldest.
+func AsyncOverflow(p AsyncOverflowPolicy) AsyncOption {
+	return func(o *asyncOptions) {
+		o.policy = p
+	}
+}
+
+// AsyncCloseTimeout sets the maximum time Close waits for queued
+// calls to be forwarded. Values less than or equal to zero are
+// ignored. The default is DefaultAsyncCloseTimeout.
+func AsyncCloseTimeout(d time.Duration) AsyncOption {
+	return func(o *asyncOptions) {
+		if d > 0 {
+			o.closeTimeout = d
+		}
+	}
+}
+
+// NewAsyncStats creates an AsyncStats that queues all calls and
+// forwards them to the given Stats from a fixed pool of worker
+// goroutines. The queue is bounded: calls made while it is full are
+// handled according to the AsyncOverflowPolicy, except that AddTags,
+// Describe, and Scope calls are never dropped (the caller blocks
+// until there is room). Scoped Stats instances created by this Stats
+// share its queue and workers.
+//
+// With a single worker (the default), calls are forwarded in the
+// order they were made. With more than one worker, calls may be
+// forwarded out of order.
+//
+// Closing the AsyncStats, or any Stats derived from it, stops
+// accepting calls, waits up to the close timeout for queued calls to
+// be forwarded, discards any that remain, and closes the given Stats.
+func NewAsyncStats(s Stats, options ...AsyncOption) AsyncStats {
+	opts := asyncOptions{
+		queueSize:    DefaultAsyncQueueSize,
+		workers:      DefaultAsyncWorkers,
+		policy:       AsyncDropOldest,
+		closeTimeout: DefaultAsyncCloseTimeout,
+	}
+	for _, apply := range options {
+		apply(&opts)
+	}
+
+	root := &asyncRoot{
+		queue:        newAsyncQueue(opts.queueSize, opts.policy),
+		closeTimeout: opts.closeTimeout,
+		underlying:   s,
+		done:         make(chan struct{}),
+	}
+
+	root.workers.Add(opts.workers)
+	for i := 0; i < opts.workers; i++ {
+		go root.work()
+	}
+
+	go func() {
+		root.workers.Wait()
+		close(root.done)
+	}()
+
+	return &async{root: root, target: newResolvedAsyncTarget(s)}
+}
+
+// asyncRoot is the state shared by an AsyncStats and the Stats
+// derived from it.
+type asyncRoot struct {
+	queue        *asyncQueue
+	closeTimeout time.Duration
+	underlying   Stats
+
+	workers sync.WaitGroup
+	done    chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (r *asyncRoot) work() {
+	defer r.workers.Done()
+
+	for {
+		op, ok := r.queue.pop()
+		if !ok {
+			return
+		}
+
+		<-op.target.ready
+		op.f(op.target.stats)
+	}
+}
+
+func (r *asyncRoot) close() error {
+	r.closeOnce.Do(func() {
+		r.queue.close()
+
+		timer := time.NewTimer(r.closeTimeout)
+		defer timer.Stop()
+
+		select {
+		case <-r.done:
+		case <-timer.C:
+			r.queue.discard()
+		}
+
+		r.closeErr = r.underlying.Close()
+	})
+
+	return r.closeErr
+}
+
+// asyncTarget is the Stats a queued call is forwarded to. The Stats
+// of a scope is resolved by a queued call, so that it reflects any
+// previously queued AddTags calls.
+type asyncTarget struct {
+	stats Stats
+	ready chan struct{}
+}
+
+func newResolvedAsyncTarget(s Stats) *asyncTarget {
+	t := &asyncTarget{stats: s, ready: make(chan struct{})}
+	close(t.ready)
+	return t
+}
+
+// asyncOp is a queued call. Essential calls are never dropped due to
+// a full queue.
+type asyncOp struct {
+	target    *asyncTarget
+	f         func(Stats)
+	essential bool
+}
+
+type async struct {
+	root   *asyncRoot
+	target *asyncTarget
+}
+
+func (a *async) enqueue(f func(Stats)) {
+	a.root.queue.push(asyncOp{target: a.target, f: f})
+}
+
+func (a *async) enqueueEssential(f func(Stats)) {
+	a.root.queue.push(asyncOp{target: a.target, f: f, essential: true})
+}
+
+func (a *async) Gauge(stat string, value float64, tags ...Tag) {
+	a.enqueue(func(s Stats) { s.Gauge(stat, value, tags...) })
+}
+
+func (a *async) Count(stat string, value float64, tags ...Tag) {
+	a.enqueue(func(s Stats) { s.Count(stat, value, tags...) })
+}
+
+func (a *async) Histogram(stat string, value float64, tags ...Tag) {
+	a.enqueue(func(s Stats) { s.Histogram(stat, value, tags...) })
+}
+
+func (a *async) Timing(stat string, value time.Duration, tags ...Tag) {
+	a.enqueue(func(s Stats) { s.Timing(stat, value, tags...) })
+}
+
+func (a *async) Distribution(stat string, value float64, tags ...Tag) {
+	a.enqueue(func(s Stats) { Distribution(s, stat, value, tags...) })
+}
+
+func (a *async) Set(stat string, value string, tags ...Tag) {
+	a.enqueue(func(s Stats) { Set(s, stat, value, tags...) })
+}
+
+func (a *async) ServiceCheck(
+	name string,
+	status ServiceCheckStatus,
+	message string,
+	tags ...Tag,
+) {
+	a.enqueue(func(s Stats) { ServiceCheck(s, name, status, message, tags...) })
+}
+
+func (a *async) Event(stat string, fields ...Field) {
+	a.enqueue(func(s Stats) { s.Event(stat, fields...) })
+}
+
+func (a *async) Describe(descriptors ...Descriptor) {
+	a.enqueueEssential(func(s Stats) { s.Describe(descriptors...) })
+}
+
+func (a *async) AddTags(tags ...Tag) {
+	a.enqueueEssential(func(s Stats) { s.AddTags(tags...) })
+}
+
+func (a *async) Scope(scope string, scopes ...string) Stats {
+	child := &asyncTarget{ready: make(chan struct{})}
+
+	a.enqueueEssential(func(s Stats) {
+		child.stats = s.Scope(scope, scopes...)
+		close(child.ready)
+	})
+
+	return &async{root: a.root, target: child}
+}
+
+func (a *async) Dropped() int64 {
+	return a.root.queue.droppedCount()
+}
+
+func (a *async) Close() error {
+	return a.root.close()
+}
+
+var _ AsyncStats = &async{}
+
+// asyncQueue is a bounded FIFO queue of asyncOps.
+type asyncQueue struct {
+	lock     sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+
+	policy AsyncOverflowPolicy
+
+	// ops is a ring buffer of count ops, starting at head.
+	ops   []asyncOp
+	head  int
+	count int
+
+	closed  bool
+	dropped int64
+}
+
+func newAsyncQueue(size int, policy AsyncOverflowPolicy) *asyncQueue {
+	q := &asyncQueue{
+		policy: policy,
+		ops:    make([]asyncOp, size),
+	}
+	q.notEmpty = sync.NewCond(&q.lock)
+	q.notFull = sync.NewCond(&q.lock)
+	return q
+}
+
+// push adds op to the queue, applying the overflow policy if the
+// queue is full. Ops pushed after the queue is closed are dropped.
+func (q *asyncQueue) push(op asyncOp) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for q.count == len(q.ops) && !q.closed {
+		if !op.essential {
+			if q.policy == AsyncDropNewest {
+				q.dropped++
+				return
+			}
+
+			if q.policy == AsyncDropOldest {
+				q.dropped++
+				if q.removeOldest() {
+					break
+				}
+
+				// every queued op is essential
+				return
+			}
+		}
+
+		q.notFull.Wait()
+	}
+
+	if q.closed {
+		q.dropped++
+		return
+	}
+
+	q.ops[(q.head+q.count)%len(q.ops)] = op
+	q.count++
+	q.notEmpty.Signal()
+}
+
+// removeOldest removes the oldest op that is not essential. Returns
+// false if every queued op is essential. Must be called with the lock
+// held.
+func (q *asyncQueue) removeOldest() bool {
+	n := len(q.ops)
+	for i := 0; i < q.count; i++ {
+		if q.ops[(q.head+i)%n].essential {
+			continue
+		}
+
+		for j := i; j > 0; j-- {
+			q.ops[(q.head+j)%n] = q.ops[(q.head+j-1)%n]
+		}
+		q.ops[q.head] = asyncOp{}
+		q.head = (q.head + 1) % n
+		q.count--
+		return true
+	}
+
+	return false
+}
+
+// pop removes and returns the oldest op, blocking until one is
+// available. Returns false once the queue is closed and empty.
+func (q *asyncQueue) pop() (asyncOp, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for q.count == 0 && !q.closed {
+		q.notEmpty.Wait()
+	}
+
+	if q.count == 0 {
+		return asyncOp{}, false
+	}
+
+	op := q.ops[q.head]
+	q.ops[q.head] = asyncOp{}
+	q.head = (q.head + 1) % len(q.ops)
+	q.count--
+	q.notFull.Signal()
+
+	return op, true
+}
+
+// close causes subsequent pushes to be dropped and wakes any blocked
+// callers. Queued ops remain available to pop.
+func (q *asyncQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+// discard drops all queued ops.
+func (q *asyncQueue) discard() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for q.count > 0 {
+		q.ops[q.head] = asyncOp{}
+		q.head = (q.head + 1) % len(q.ops)
+		q.count--
+		q.dropped++
+	}
+}
+
+func (q *asyncQueue) droppedCount() int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.dropped
+}
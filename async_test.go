@@ -0,0 +1,280 @@
+/*
+Copyright 2018 Turbine Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+
+	"github.com/turbinelabs/test/assert"
+)
+
+func TestAsyncOverflowPolicyString(t *testing.T) {
+	assert.Equal(t, AsyncDropOldest.String(), "drop-oldest")
+	assert.Equal(t, AsyncDropNewest.String(), "drop-newest")
+	assert.Equal(t, AsyncBlock.String(), "block")
+	assert.Equal(t, AsyncOverflowPolicy(100).String(), "unknown")
+}
+
+func TestAsyncStatsOrdering(t *testing.T) {
+	abTag := NewKVTag("a", "b")
+	xyTag := NewKVTag("x", "y")
+
+	ch := make(chan Recorded, 10)
+	s := NewAsyncStats(NewRecordingStats(ch))
+
+	s.Count("a", 1.0)
+	s.AddTags(xyTag)
+	scoped := s.Scope("s")
+	scoped.Gauge("b", 2.0, abTag)
+	s.Count("c", 3.0)
+
+	assert.DeepEqual(t, <-ch, Recorded{Method: "count", Metric: "a", Value: 1.0})
+	assert.DeepEqual(t, <-ch, Recorded{
+		Method: "gauge",
+		Scope:  "s",
+		Metric: "b",
+		Value:  2.0,
+		Tags:   []Tag{xyTag, abTag},
+	})
+	assert.DeepEqual(t, <-ch, Recorded{
+		Method: "count",
+		Metric: "c",
+		Value:  3.0,
+		Tags:   []Tag{xyTag},
+	})
+
+	assert.Nil(t, scoped.Close())
+	assert.Equal(t, s.Dropped(), int64(0))
+
+	// the recorder closes its channel on Close
+	_, ok := <-ch
+	assert.False(t, ok)
+}
+
+// testBlockedAsyncStats returns an AsyncStats whose single worker is
+// blocked forwarding a Count of 0 until release is closed.
+func testBlockedAsyncStats(
+	t *testing.T,
+	mockStats *MockStats,
+	options ...AsyncOption,
+) (AsyncStats, chan struct{}) {
+	release := make(chan struct{})
+	blocked := make(chan struct{})
+
+	mockStats.EXPECT().Count("x", 0.0).Do(func(string, float64, ...Tag) {
+		close(blocked)
+		<-release
+	})
+
+	s := NewAsyncStats(mockStats, append(options, AsyncQueueSize(1))...)
+	s.Count("x", 0.0)
+	<-blocked
+
+	return s, release
+}
+
+func TestAsyncStatsDropNewest(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	mockStats := NewMockStats(ctrl)
+	s, release := testBlockedAsyncStats(t, mockStats, AsyncOverflow(AsyncDropNewest))
+
+	s.Count("x", 1.0)
+	s.Count("x", 2.0)
+	assert.Equal(t, s.Dropped(), int64(1))
+
+	gomock.InOrder(
+		mockStats.EXPECT().Count("x", 1.0),
+		mockStats.EXPECT().Close().Return(nil),
+	)
+	close(release)
+	assert.Nil(t, s.Close())
+}
+
+func TestAsyncStatsDropOldest(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	mockStats := NewMockStats(ctrl)
+	s, release := testBlockedAsyncStats(t, mockStats, AsyncOverflow(AsyncDropOldest))
+
+	s.Count("x", 1.0)
+	s.Count("x", 2.0)
+	assert.Equal(t, s.Dropped(), int64(1))
+
+	gomock.InOrder(
+		mockStats.EXPECT().Count("x", 2.0),
+		mockStats.EXPECT().Close().Return(nil),
+	)
+	close(release)
+	assert.Nil(t, s.Close())
+}
+
+func TestAsyncStatsBlock(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	mockStats := NewMockStats(ctrl)
+	s, release := testBlockedAsyncStats(t, mockStats, AsyncOverflow(AsyncBlock))
+
+	s.Count("x", 1.0)
+
+	done := make(chan struct{})
+	go func() {
+		s.Count("x", 2.0)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("expected Count to block")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	gomock.InOrder(
+		mockStats.EXPECT().Count("x", 1.0),
+		mockStats.EXPECT().Count("x", 2.0),
+		mockStats.EXPECT().Close().Return(nil),
+	)
+	close(release)
+	<-done
+
+	assert.Nil(t, s.Close())
+	assert.Equal(t, s.Dropped(), int64(0))
+}
+
+func TestAsyncStatsNeverDropsEssentialCalls(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	tagA := NewKVTag("a", "b")
+	tagC := NewKVTag("c", "d")
+
+	mockStats := NewMockStats(ctrl)
+	s, release := testBlockedAsyncStats(t, mockStats, AsyncOverflow(AsyncDropOldest))
+
+	s.AddTags(tagA)
+
+	done := make(chan struct{})
+	go func() {
+		// the queue holds only AddTags, which cannot be dropped
+		s.AddTags(tagC)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("expected AddTags to block")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	gomock.InOrder(
+		mockStats.EXPECT().AddTags(tagA),
+		mockStats.EXPECT().AddTags(tagC),
+		mockStats.EXPECT().Close().Return(nil),
+	)
+	close(release)
+	<-done
+
+	assert.Nil(t, s.Close())
+	assert.Equal(t, s.Dropped(), int64(0))
+}
+
+func TestAsyncStatsDropOldestWithOnlyEssentialCallsQueued(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	tag := NewKVTag("a", "b")
+
+	mockStats := NewMockStats(ctrl)
+	s, release := testBlockedAsyncStats(t, mockStats, AsyncOverflow(AsyncDropOldest))
+
+	s.AddTags(tag)
+
+	// the queue holds only AddTags, which cannot be dropped, so the
+	// new call is dropped rather than blocking the caller
+	s.Count("x", 1.0)
+	assert.Equal(t, s.Dropped(), int64(1))
+
+	gomock.InOrder(
+		mockStats.EXPECT().AddTags(tag),
+		mockStats.EXPECT().Close().Return(nil),
+	)
+	close(release)
+
+	assert.Nil(t, s.Close())
+	assert.Equal(t, s.Dropped(), int64(1))
+}
+
+func TestAsyncStatsCloseTimeout(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	mockStats := NewMockStats(ctrl)
+	s, release := testBlockedAsyncStats(
+		t,
+		mockStats,
+		AsyncCloseTimeout(10*time.Millisecond),
+	)
+	defer close(release)
+
+	s.Count("x", 1.0)
+
+	mockStats.EXPECT().Close().Return(nil)
+	assert.Nil(t, s.Close())
+	assert.Equal(t, s.Dropped(), int64(1))
+
+	// calls after Close are dropped
+	s.Gauge("x", 1.0)
+	assert.Equal(t, s.Dropped(), int64(2))
+
+	// subsequent calls to Close do nothing
+	assert.Nil(t, s.Close())
+}
+
+func TestAsyncStatsExtended(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	tag := NewKVTag("a", "b")
+	field := NewField("f", 1)
+	descriptor := Descriptor{Name: "d"}
+
+	mockStats := NewMockStats(ctrl)
+	gomock.InOrder(
+		mockStats.EXPECT().Histogram("h", 1.0, tag),
+		mockStats.EXPECT().Timing("t", time.Second, tag),
+		mockStats.EXPECT().Histogram("d", 2.0, tag),
+		mockStats.EXPECT().Event("e", field),
+		mockStats.EXPECT().Describe(descriptor),
+		mockStats.EXPECT().Close().Return(nil),
+	)
+
+	s := NewAsyncStats(mockStats)
+	s.Histogram("h", 1.0, tag)
+	s.Timing("t", time.Second, tag)
+	s.Distribution("d", 2.0, tag)
+	s.Set("s", "v", tag)
+	s.ServiceCheck("c", ServiceCheckOK, "", tag)
+	s.Event("e", field)
+	s.Describe(descriptor)
+	assert.Nil(t, s.Close())
+}
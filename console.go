@@ -60,7 +60,6 @@ func (cs *consoleSender) AddTags(tags ...Tag) {
 }
 
 func (cs *consoleSender) Event(stat string, fields ...Field) {
-	now := time.Now()
 	consoleFields := []string{}
 	for _, tag := range cs.tags {
 		consoleFields = append(consoleFields, fmt.Sprintf("%v: %v", tag.K, tag.V))
@@ -69,6 +68,31 @@ func (cs *consoleSender) Event(stat string, fields ...Field) {
 	for _, field := range fields {
 		consoleFields = append(consoleFields, fmt.Sprintf("%v: %v", field.K, field.V))
 	}
+	cs.write(consoleFields)
+}
+
+// Describe writes each Descriptor to the console.
+func (cs *consoleSender) Describe(descriptors ...Descriptor) {
+	for _, d := range descriptors {
+		consoleFields := []string{d.Name, fmt.Sprintf("type: %v", d.Type)}
+		if d.Unit != "" {
+			consoleFields = append(consoleFields, fmt.Sprintf("unit: %v", d.Unit))
+		}
+		if d.TagKeys != nil {
+			consoleFields = append(
+				consoleFields,
+				fmt.Sprintf("tags: %v", strings.Join(d.TagKeys, ",")),
+			)
+		}
+		if d.Help != "" {
+			consoleFields = append(consoleFields, fmt.Sprintf("help: %v", d.Help))
+		}
+		cs.write(consoleFields)
+	}
+}
+
+func (cs *consoleSender) write(consoleFields []string) {
+	now := time.Now()
 	consoleLine := ""
 	if len(cs.eventSender.scopes) > 0 {
 		consoleLine = fmt.Sprintf("%v - %v - %v\n", now.Format(time.RFC3339),
@@ -83,3 +83,30 @@ func TestConsoleTags(t *testing.T) {
 	stats.Event("foo", NewField("hi", "there"))
 	assert.MatchesRegex(t, consoleBuffer.String(), "^.\\S* - tag-1: v1 - tag-2:  - foo - hi: there")
 }
+
+func TestConsoleDescribe(t *testing.T) {
+	consoleBuffer := &bytes.Buffer{}
+	cff := &consoleFromFlags{
+		consoleBuffer,
+		"flag-scope",
+	}
+
+	stats, err := cff.Make()
+	assert.Nil(t, err)
+	defer stats.Close()
+
+	stats.Describe(
+		NewDescriptor("foo", CounterMetric, "foos seen").
+			WithUnit("requests").
+			WithTagKeys("a", "b"),
+	)
+	assert.MatchesRegex(
+		t,
+		consoleBuffer.String(),
+		"^\\S* - foo - type: counter - unit: requests - tags: a,b - help: foos seen\n$",
+	)
+
+	consoleBuffer.Reset()
+	stats.Scope("x").Describe(Descriptor{Name: "bar"})
+	assert.MatchesRegex(t, consoleBuffer.String(), "^\\S* - x - bar - type: untyped\n$")
+}
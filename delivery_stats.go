@@ -0,0 +1,273 @@
+/*
+Copyright 2018 Turbine Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+
+	tbntime "github.com/turbinelabs/nonstdlib/time"
+)
+
+const (
+	// ClientStatsScope is the scope of the stats that report the
+	// delivery health of each backend. See NewFromFlags.
+	ClientStatsScope = "stats_client"
+
+	// BackendTag is the tag identifying the backend in the
+	// ClientStatsScope stats.
+	BackendTag = "backend"
+
+	// DefaultClientStatsInterval is the default interval at which
+	// ClientStatsScope stats are reported.
+	DefaultClientStatsInterval = 30 * time.Second
+
+	packetsSentStat  = "packets_sent"  // packets (or requests) sent count
+	bytesSentStat    = "bytes_sent"    // bytes sent count
+	sendErrorsStat   = "send_errors"   // failed send count
+	droppedStat      = "dropped"       // dropped stats count
+	flushLatencyStat = "flush_latency" // mean send latency timing
+)
+
+// ClientStats returns a list of all possible stats generated in the
+// ClientStatsScope.
+func ClientStats() []string {
+	return []string{
+		packetsSentStat,
+		bytesSentStat,
+		sendErrorsStat,
+		droppedStat,
+		flushLatencyStat,
+	}
+}
+
+// deliveryTrackingFromFlags is implemented by statsFromFlags whose
+// backends can report their delivery health.
+type deliveryTrackingFromFlags interface {
+	// makeWithDeliveryStats constructs a Stats that records its
+	// delivery health to the given deliveryStats.
+	makeWithDeliveryStats(ds *deliveryStats) (Stats, error)
+}
+
+// deliveryStats tracks the delivery health of a single backend. Its
+// methods are safe for concurrent use and do nothing when invoked on
+// a nil *deliveryStats, allowing backends to record delivery health
+// unconditionally.
+type deliveryStats struct {
+	backend string
+
+	lock         sync.Mutex
+	packetsSent  int64
+	bytesSent    int64
+	sendErrors   int64
+	dropped      int64
+	sends        int64
+	sendDuration time.Duration
+}
+
+func newDeliveryStats(backend string) *deliveryStats {
+	return &deliveryStats{backend: backend}
+}
+
+// sent records a packet of the given size that was sent successfully
+// in the given duration. Backends without a natural packet size may
+// pass a size of 0.
+func (d *deliveryStats) sent(size int, latency time.Duration) {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.packetsSent++
+	d.bytesSent += int64(size)
+	d.sends++
+	d.sendDuration += latency
+}
+
+// sendError records a failed attempt to send.
+func (d *deliveryStats) sendError() {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.sendErrors++
+}
+
+// drop records that n stats were discarded without being sent.
+func (d *deliveryStats) drop(n int) {
+	if d == nil || n <= 0 {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.dropped += int64(n)
+}
+
+// report records the delivery health accumulated since the previous
+// report to the given Stats and resets it.
+func (d *deliveryStats) report(s Stats) {
+	d.lock.Lock()
+	packetsSent, bytesSent, sendErrors, dropped := d.packetsSent, d.bytesSent, d.sendErrors, d.dropped
+	sends, sendDuration := d.sends, d.sendDuration
+	d.packetsSent, d.bytesSent, d.sendErrors, d.dropped = 0, 0, 0, 0
+	d.sends, d.sendDuration = 0, 0
+	d.lock.Unlock()
+
+	tag := NewKVTag(BackendTag, d.backend)
+
+	s.Count(packetsSentStat, float64(packetsSent), tag)
+	s.Count(bytesSentStat, float64(bytesSent), tag)
+	s.Count(sendErrorsStat, float64(sendErrors), tag)
+	s.Count(droppedStat, float64(dropped), tag)
+	if sends > 0 {
+		s.Timing(flushLatencyStat, sendDuration/time.Duration(sends), tag)
+	}
+}
+
+// countStats returns the number of newline-terminated stats in p.
+func countStats(p []byte) int {
+	return bytes.Count(p, []byte{'\n'})
+}
+
+// deliveryWriter is an io.Writer that records each Write to a
+// deliveryStats. Failed writes are recorded as send errors; the stats
+// they contain are recorded as dropped by the packetBuffer that
+// discards them.
+type deliveryWriter struct {
+	w          io.Writer
+	ds         *deliveryStats
+	timeSource tbntime.Source
+}
+
+func (dw *deliveryWriter) Write(p []byte) (int, error) {
+	start := dw.timeSource.Now()
+	n, err := dw.w.Write(p)
+	if err != nil {
+		dw.ds.sendError()
+		return n, err
+	}
+
+	dw.ds.sent(n, dw.timeSource.Now().Sub(start))
+	return n, nil
+}
+
+// Close closes the underlying Writer, if it is an io.Closer.
+func (dw *deliveryWriter) Close() error {
+	if c, ok := dw.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// clientStatsReporter periodically reports the delivery health of
+// one or more backends.
+type clientStatsReporter struct {
+	stats         Stats
+	deliveryStats []*deliveryStats
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// newClientStatsReporter starts reporting the given deliveryStats to
+// the ClientStatsScope of the given Stats at the given interval.
+func newClientStatsReporter(
+	s Stats,
+	deliveryStats []*deliveryStats,
+	interval time.Duration,
+	source tbntime.Source,
+) *clientStatsReporter {
+	r := &clientStatsReporter{
+		stats:         s.Scope(ClientStatsScope),
+		deliveryStats: deliveryStats,
+		quit:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+
+	go r.run(source.NewTimer(interval), interval)
+
+	return r
+}
+
+func (r *clientStatsReporter) run(tmr tbntime.Timer, interval time.Duration) {
+	defer close(r.done)
+	defer tmr.Stop()
+
+	for {
+		select {
+		case <-tmr.C():
+			r.report()
+			tmr.Reset(interval)
+
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+func (r *clientStatsReporter) report() {
+	for _, ds := range r.deliveryStats {
+		ds.report(r.stats)
+	}
+}
+
+// Close stops periodic reporting and makes a final report.
+func (r *clientStatsReporter) Close() {
+	close(r.quit)
+	<-r.done
+	r.report()
+}
+
+// clientStatsReportingStats is a Stats that stops a
+// clientStatsReporter before it is closed.
+type clientStatsReportingStats struct {
+	Stats
+	reporter *clientStatsReporter
+}
+
+func (s *clientStatsReportingStats) Distribution(stat string, value float64, tags ...Tag) {
+	Distribution(s.Stats, stat, value, tags...)
+}
+
+func (s *clientStatsReportingStats) Set(stat string, value string, tags ...Tag) {
+	Set(s.Stats, stat, value, tags...)
+}
+
+func (s *clientStatsReportingStats) ServiceCheck(
+	name string,
+	status ServiceCheckStatus,
+	message string,
+	tags ...Tag,
+) {
+	ServiceCheck(s.Stats, name, status, message, tags...)
+}
+
+func (s *clientStatsReportingStats) Close() error {
+	s.reporter.Close()
+	return s.Stats.Close()
+}
+
+var _ ExtendedStats = &clientStatsReportingStats{}
@@ -0,0 +1,215 @@
+/*
+Copyright 2018 Turbine Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+
+	tbntime "github.com/turbinelabs/nonstdlib/time"
+	"github.com/turbinelabs/test/assert"
+)
+
+type failingWriter struct {
+	err error
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	return 0, w.err
+}
+
+func expectDeliveryReport(
+	mockStats *MockStats,
+	backend string,
+	packets, bytes, errors, dropped float64,
+) {
+	tag := NewKVTag(BackendTag, backend)
+	gomock.InOrder(
+		mockStats.EXPECT().Count(packetsSentStat, packets, tag),
+		mockStats.EXPECT().Count(bytesSentStat, bytes, tag),
+		mockStats.EXPECT().Count(sendErrorsStat, errors, tag),
+		mockStats.EXPECT().Count(droppedStat, dropped, tag),
+	)
+}
+
+func TestDeliveryStatsNil(t *testing.T) {
+	var ds *deliveryStats
+	ds.sent(10, time.Second)
+	ds.sendError()
+	ds.drop(1)
+}
+
+func TestDeliveryStatsReport(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	mockStats := NewMockStats(ctrl)
+
+	ds := newDeliveryStats("statsd")
+	ds.sent(100, 10*time.Millisecond)
+	ds.sent(50, 30*time.Millisecond)
+	ds.sendError()
+	ds.drop(3)
+	ds.drop(0)
+
+	expectDeliveryReport(mockStats, "statsd", 2, 150, 1, 3)
+	mockStats.EXPECT().Timing(
+		flushLatencyStat,
+		20*time.Millisecond,
+		NewKVTag(BackendTag, "statsd"),
+	)
+	ds.report(mockStats)
+
+	// counters are reset and no latency is reported without sends
+	expectDeliveryReport(mockStats, "statsd", 0, 0, 0, 0)
+	ds.report(mockStats)
+}
+
+func TestDeliveryWriter(t *testing.T) {
+	tbntime.WithCurrentTimeFrozen(func(cs tbntime.ControlledSource) {
+		buf := &bytes.Buffer{}
+		ds := newDeliveryStats("statsd")
+		w := &deliveryWriter{w: buf, ds: ds, timeSource: cs}
+
+		n, err := w.Write([]byte("a:1|c\nb:2|c\n"))
+		assert.Equal(t, n, 12)
+		assert.Nil(t, err)
+		assert.Equal(t, buf.String(), "a:1|c\nb:2|c\n")
+		assert.Equal(t, ds.packetsSent, int64(1))
+		assert.Equal(t, ds.bytesSent, int64(12))
+		assert.Equal(t, ds.sends, int64(1))
+
+		w.w = &failingWriter{errors.New("boom")}
+		_, err = w.Write([]byte("a:1|c\nb:2|c\n"))
+		assert.ErrorContains(t, err, "boom")
+		assert.Equal(t, ds.packetsSent, int64(1))
+		assert.Equal(t, ds.sendErrors, int64(1))
+		assert.Equal(t, ds.dropped, int64(0))
+
+		assert.Nil(t, w.Close())
+	})
+}
+
+func TestClientStatsReporter(t *testing.T) {
+	tbntime.WithCurrentTimeFrozen(func(cs tbntime.ControlledSource) {
+		ctrl := gomock.NewController(assert.Tracing(t))
+		defer ctrl.Finish()
+
+		mockStats := NewMockStats(ctrl)
+		mockScopedStats := NewMockStats(ctrl)
+		mockStats.EXPECT().Scope(ClientStatsScope).Return(mockScopedStats)
+
+		ds1 := newDeliveryStats("statsd")
+		ds2 := newDeliveryStats("wavefront")
+
+		reported := make(chan struct{})
+
+		r := newClientStatsReporter(
+			mockStats,
+			[]*deliveryStats{ds1, ds2},
+			time.Minute,
+			cs,
+		)
+
+		ds1.drop(1)
+		ds2.sendError()
+
+		expectDeliveryReport(mockScopedStats, "statsd", 0, 0, 0, 1)
+		wavefrontTag := NewKVTag(BackendTag, "wavefront")
+		gomock.InOrder(
+			mockScopedStats.EXPECT().Count(packetsSentStat, 0.0, wavefrontTag),
+			mockScopedStats.EXPECT().Count(bytesSentStat, 0.0, wavefrontTag),
+			mockScopedStats.EXPECT().Count(sendErrorsStat, 1.0, wavefrontTag),
+			mockScopedStats.EXPECT().
+				Count(droppedStat, 0.0, wavefrontTag).
+				Do(func(string, float64, ...Tag) { close(reported) }),
+		)
+
+		cs.Advance(time.Minute)
+		<-reported
+
+		// Close makes a final report
+		ds1.sent(10, time.Millisecond)
+		expectDeliveryReport(mockScopedStats, "statsd", 1, 10, 0, 0)
+		mockScopedStats.EXPECT().Timing(
+			flushLatencyStat,
+			time.Millisecond,
+			NewKVTag(BackendTag, "statsd"),
+		)
+		expectDeliveryReport(mockScopedStats, "wavefront", 0, 0, 0, 0)
+		r.Close()
+	})
+}
+
+func TestClientStatsReportingStatsClose(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	mockStats := NewMockStats(ctrl)
+	mockScopedStats := NewMockStats(ctrl)
+	mockStats.EXPECT().Scope(ClientStatsScope).Return(mockScopedStats)
+
+	ds := newDeliveryStats("statsd")
+	s := &clientStatsReportingStats{
+		Stats:    mockStats,
+		reporter: newClientStatsReporter(mockStats, []*deliveryStats{ds}, time.Hour, tbntime.NewSource()),
+	}
+
+	gomock.InOrder(
+		mockScopedStats.EXPECT().Count(packetsSentStat, 0.0, gomock.Any()),
+		mockScopedStats.EXPECT().Count(bytesSentStat, 0.0, gomock.Any()),
+		mockScopedStats.EXPECT().Count(sendErrorsStat, 0.0, gomock.Any()),
+		mockScopedStats.EXPECT().Count(droppedStat, 0.0, gomock.Any()),
+		mockStats.EXPECT().Close().Return(nil),
+	)
+
+	assert.Nil(t, s.Close())
+}
+
+func TestDeliveryHandler(t *testing.T) {
+	ds := newDeliveryStats("prometheus")
+
+	status := http.StatusOK
+	h := newDeliveryHandler(
+		http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(status)
+			w.Write([]byte("metrics"))
+		}),
+		ds,
+		tbntime.NewSource(),
+	)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, rec.Body.String(), "metrics")
+	assert.Equal(t, ds.packetsSent, int64(1))
+	assert.Equal(t, ds.bytesSent, int64(7))
+	assert.Equal(t, ds.sendErrors, int64(0))
+
+	status = http.StatusInternalServerError
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, rec.Code, http.StatusInternalServerError)
+	assert.Equal(t, ds.packetsSent, int64(1))
+	assert.Equal(t, ds.sendErrors, int64(1))
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2018 Turbine Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+// MetricType identifies the kind of stat described by a Descriptor.
+type MetricType int
+
+const (
+	// UntypedMetric is used for Descriptors that do not declare a type.
+	UntypedMetric MetricType = iota
+
+	// GaugeMetric describes stats recorded via Stats.Gauge.
+	GaugeMetric
+
+	// CounterMetric describes stats recorded via Stats.Count.
+	CounterMetric
+
+	// HistogramMetric describes stats recorded via Stats.Histogram.
+	HistogramMetric
+
+	// TimingMetric describes stats recorded via Stats.Timing.
+	TimingMetric
+)
+
+// String returns the name of the MetricType.
+func (t MetricType) String() string {
+	switch t {
+	case GaugeMetric:
+		return "gauge"
+	case CounterMetric:
+		return "counter"
+	case HistogramMetric:
+		return "histogram"
+	case TimingMetric:
+		return "timing"
+	default:
+		return "untyped"
+	}
+}
+
+// Descriptor declares metadata for a stat. Descriptors are passed to
+// Stats.Describe before the stat is first recorded so that backends
+// which support metadata can make their output self-describing.
+type Descriptor struct {
+	// Name is the stat's name, relative to the scope of the Stats
+	// on which Describe is invoked.
+	Name string
+
+	// Type is the kind of stat.
+	Type MetricType
+
+	// Help is a human-readable description of the stat.
+	Help string
+
+	// Unit is the unit of the stat's values (e.g. "bytes" or
+	// "requests"). Timings are always reported in the unit native
+	// to each backend.
+	Unit string
+
+	// TagKeys lists the tag keys that may be used with the stat. If
+	// nil, any tags are permitted. Backends that require a fixed set
+	// of tags may drop tags not listed.
+	TagKeys []string
+}
+
+// NewDescriptor produces a new Descriptor with the given name, type
+// and help text.
+func NewDescriptor(name string, typ MetricType, help string) Descriptor {
+	return Descriptor{Name: name, Type: typ, Help: help}
+}
+
+// WithUnit returns a copy of the Descriptor with the given unit.
+func (d Descriptor) WithUnit(unit string) Descriptor {
+	d.Unit = unit
+	return d
+}
+
+// WithTagKeys returns a copy of the Descriptor with the given
+// allowed tag keys.
+func (d Descriptor) WithTagKeys(keys ...string) Descriptor {
+	d.TagKeys = append([]string{}, keys...)
+	return d
+}
+
+// describingSender is implemented by xstats Senders that accept
+// Descriptors. The Descriptor's name and tag keys have already been
+// cleaned and scoped.
+type describingSender interface {
+	Describe(Descriptor)
+}
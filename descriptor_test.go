@@ -0,0 +1,53 @@
+/*
+Copyright 2018 Turbine Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"testing"
+
+	"github.com/turbinelabs/test/assert"
+)
+
+func TestMetricTypeString(t *testing.T) {
+	assert.Equal(t, UntypedMetric.String(), "untyped")
+	assert.Equal(t, GaugeMetric.String(), "gauge")
+	assert.Equal(t, CounterMetric.String(), "counter")
+	assert.Equal(t, HistogramMetric.String(), "histogram")
+	assert.Equal(t, TimingMetric.String(), "timing")
+	assert.Equal(t, MetricType(100).String(), "untyped")
+}
+
+func TestDescriptor(t *testing.T) {
+	keys := []string{"a", "b"}
+
+	d := NewDescriptor("x", GaugeMetric, "help")
+	d2 := d.WithUnit("bytes").WithTagKeys(keys...)
+	keys[0] = "z"
+
+	assert.DeepEqual(t, d, Descriptor{Name: "x", Type: GaugeMetric, Help: "help"})
+	assert.DeepEqual(
+		t,
+		d2,
+		Descriptor{
+			Name:    "x",
+			Type:    GaugeMetric,
+			Help:    "help",
+			Unit:    "bytes",
+			TagKeys: []string{"a", "b"},
+		},
+	)
+}
@@ -17,13 +17,57 @@ limitations under the License.
 package stats
 
 import (
-	"github.com/rs/xstats/dogstatsd"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/xstats"
 
 	tbnflag "github.com/turbinelabs/nonstdlib/flag"
 )
 
+// Event fields with special meaning to the dogstatsd backend. Other
+// backends record them as ordinary fields.
+const (
+	// EventTextField is the body of the event.
+	EventTextField = "text"
+
+	// EventTimestampField is the time of the event, either as a
+	// time.Time or as an integer number of milliseconds since the
+	// Unix epoch.
+	EventTimestampField = "timestamp"
+
+	// EventHostnameField is the host the event pertains to.
+	EventHostnameField = "hostname"
+
+	// EventAggregationKeyField groups related events.
+	EventAggregationKeyField = "aggregation_key"
+
+	// EventPriorityField is the priority of the event: "normal" or
+	// "low".
+	EventPriorityField = "priority"
+
+	// EventSourceTypeField is the name of the event's source type.
+	EventSourceTypeField = "source_type_name"
+
+	// EventAlertTypeField is the alert type of the event: "info",
+	// "warning", "error", or "success".
+	EventAlertTypeField = "alert_type"
+)
+
 var (
 	replaceColonsCommasAndPipes = mkReplace(":|,", '_')
+
+	// Event and service check metadata and set values are delimited
+	// by pipes and cannot contain line breaks.
+	stripPipesAndLineBreaks = mkStrip("|\r\n")
+
+	// Event text and service check messages may contain escaped
+	// line breaks.
+	escapeDogstatsdText = strings.NewReplacer("\r", "", "\n", `\n`).Replace
 )
 
 // Based on review of data dog's dd-agent (aggregator.py), none of the
@@ -42,6 +86,174 @@ var dogstatsdCleaner = cleaner{
 	scopeDelim:    ".",
 }
 
+// newDogstatsdSender constructs an xstats Sender that emits stats in
+// the dogstatsd format to the given io.Writer. Stats are buffered for
+// the flush interval or until the buffer would exceed maxPacketLen
+// bytes, whichever comes first.
+//
+// In addition to gauges, counts, histograms, and timings, the sender
+// supports distributions, sets, service checks and events. Stats
+// carrying a SampleRateTag are sent with the sample rate, so that the
+// agent can scale them. Latched histograms are sent as distributions.
+func newDogstatsdSender(
+	w io.Writer,
+	flushInterval time.Duration,
+	maxPacketLen int,
+	options ...packetBufferOption,
+) *dogstatsdSender {
+	return &dogstatsdSender{
+		&statsdSender{
+			packetBuffer: newPacketBuffer(w, flushInterval, maxPacketLen, options...),
+			tagDelim:     dogstatsdCleaner.tagDelim,
+			tagged:       true,
+		},
+	}
+}
+
+type dogstatsdSender struct {
+	*statsdSender
+}
+
+// Distribution emits a distribution value.
+func (s *dogstatsdSender) Distribution(stat string, value float64, tags ...string) {
+	s.metric(stat, formatStatsdValue(value), "d", tags)
+}
+
+// LatchedHistogram emits the histogram as a distribution. Each
+// bucket is represented by a single value (see
+// LatchedHistogram.centroids) sent with a sample rate of one over the
+// bucket's count, so that the agent weights the value by the count.
+func (s *dogstatsdSender) LatchedHistogram(stat string, h LatchedHistogram, tags ...string) {
+	_, _, tags = splitSampleRate(tags, s.tagDelim)
+
+	for _, c := range h.centroids() {
+		centroidTags := tags
+		if c.count > 1 {
+			centroidTags = append(
+				tags[:len(tags):len(tags)],
+				sampleRateTagString(1.0/float64(c.count), s.tagDelim),
+			)
+		}
+
+		s.metric(stat, formatStatsdValue(c.value), "d", centroidTags)
+	}
+}
+
+// Set emits a set value.
+func (s *dogstatsdSender) Set(stat string, value string, tags ...string) {
+	s.metric(stat, stripPipesAndLineBreaks(value), "s", tags)
+}
+
+// ServiceCheck emits a service check. The message, if any, is sent
+// last, as required by the dogstatsd format.
+func (s *dogstatsdSender) ServiceCheck(
+	name string,
+	status ServiceCheckStatus,
+	message string,
+	tags ...string,
+) {
+	_, _, tags = splitSampleRate(tags, s.tagDelim)
+
+	line := &bytes.Buffer{}
+	fmt.Fprintf(line, "_sc|%s|%d", stripPipesAndLineBreaks(name), status)
+	s.writeTags(line, tags)
+	if message != "" {
+		fmt.Fprintf(line, "|m:%s", escapeDogstatsdText(message))
+	}
+	line.WriteByte('\n')
+
+	s.write(line.Bytes())
+}
+
+// Event emits an event with the given title. Fields with the keys
+// declared above (e.g. EventTextField) are sent as the event's text
+// and metadata. Other fields are appended to the event's text, one
+// per line.
+func (s *dogstatsdSender) Event(title string, fields []Field, tags ...string) {
+	_, _, tags = splitSampleRate(tags, s.tagDelim)
+
+	var (
+		text     string
+		extra    []string
+		metadata = map[string]string{}
+	)
+
+	for _, f := range fields {
+		switch f.K {
+		case EventTextField:
+			text = fmt.Sprintf("%v", f.V)
+
+		case EventTimestampField:
+			if ts, ok := dogstatsdEventTimestamp(f.V); ok {
+				metadata["d"] = strconv.FormatInt(ts, 10)
+			} else {
+				extra = append(extra, fmt.Sprintf("%s: %v", f.K, f.V))
+			}
+
+		case EventHostnameField:
+			metadata["h"] = fmt.Sprintf("%v", f.V)
+
+		case EventAggregationKeyField:
+			metadata["k"] = fmt.Sprintf("%v", f.V)
+
+		case EventPriorityField:
+			metadata["p"] = fmt.Sprintf("%v", f.V)
+
+		case EventSourceTypeField:
+			metadata["s"] = fmt.Sprintf("%v", f.V)
+
+		case EventAlertTypeField:
+			metadata["t"] = fmt.Sprintf("%v", f.V)
+
+		default:
+			extra = append(extra, fmt.Sprintf("%s: %v", f.K, f.V))
+		}
+	}
+
+	if len(extra) > 0 {
+		if text != "" {
+			extra = append([]string{text}, extra...)
+		}
+		text = strings.Join(extra, "\n")
+	}
+
+	title = escapeDogstatsdText(title)
+	text = escapeDogstatsdText(text)
+
+	line := &bytes.Buffer{}
+	fmt.Fprintf(line, "_e{%d,%d}:%s|%s", len(title), len(text), title, text)
+	for _, k := range []string{"d", "h", "k", "p", "s", "t"} {
+		if v := stripPipesAndLineBreaks(metadata[k]); v != "" {
+			fmt.Fprintf(line, "|%s:%s", k, v)
+		}
+	}
+	s.writeTags(line, tags)
+	line.WriteByte('\n')
+
+	s.write(line.Bytes())
+}
+
+// dogstatsdEventTimestamp converts a time.Time or integer milliseconds
+// since the Unix epoch to seconds since the Unix epoch.
+func dogstatsdEventTimestamp(v interface{}) (int64, bool) {
+	switch ts := v.(type) {
+	case time.Time:
+		return ts.Unix(), true
+	case int64:
+		return ts / 1000, true
+	case int:
+		return int64(ts) / 1000, true
+	default:
+		return 0, false
+	}
+}
+
+var (
+	_ xstats.Sender   = &dogstatsdSender{}
+	_ extendedSender  = &dogstatsdSender{}
+	_ latchableSender = &dogstatsdSender{}
+)
+
 type dogstatsdFromFlags struct {
 	*statsdFromFlags
 }
@@ -51,5 +263,20 @@ func newDogstatsdFromFlags(fs tbnflag.FlagSet) statsFromFlags {
 }
 
 func (ff *dogstatsdFromFlags) Make() (Stats, error) {
-	return ff.makeInternal(dogstatsd.NewMaxPacket, dogstatsdCleaner)
+	return ff.makeWithDeliveryStats(nil)
+}
+
+func (ff *dogstatsdFromFlags) makeWithDeliveryStats(ds *deliveryStats) (Stats, error) {
+	return ff.makeInternal(
+		func(w io.Writer, flushInterval time.Duration, maxPacketLen int) xstats.Sender {
+			return newDogstatsdSender(
+				w,
+				flushInterval,
+				maxPacketLen,
+				packetBufferDeliveryStats(ds),
+			)
+		},
+		dogstatsdCleaner,
+		ds,
+	)
 }
@@ -18,9 +18,12 @@ package stats
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/rs/xstats"
+
 	tbnstrings "github.com/turbinelabs/nonstdlib/strings"
 	"github.com/turbinelabs/test/assert"
 )
@@ -124,6 +127,238 @@ func TestDogstatsdBackendWithTagTransform(t *testing.T) {
 	assert.Equal(t, <-l.Msgs, fmt.Sprintf("x.prefix.timing:%f|h|#taggity:tag,t:t\n", 5.0))
 }
 
+func testDogstatsdSender(t *testing.T, f func(*dogstatsdSender)) string {
+	w := &testWriter{}
+	s := newDogstatsdSender(w, time.Hour, defaultMaxPacketLen)
+	f(s)
+	assert.Nil(t, s.Close())
+	return w.String()
+}
+
+func TestDogstatsdSenderMetrics(t *testing.T) {
+	got := testDogstatsdSender(t, func(s *dogstatsdSender) {
+		s.Gauge("g", 1.5, "a:b")
+		s.Count("c", 2)
+		s.Histogram("h", 3, "a:b", "c:d")
+		s.Timing("t", 1500*time.Microsecond)
+		s.Distribution("d", 4.25, "a:b")
+		s.Set("s", "user|1\n")
+	})
+	assert.Equal(
+		t,
+		got,
+		"g:1.500000|g|#a:b\n"+
+			"c:2.000000|c\n"+
+			"h:3.000000|h|#a:b,c:d\n"+
+			"t:1.500000|ms\n"+
+			"d:4.250000|d|#a:b\n"+
+			"s:user1|s\n",
+	)
+}
+
+func TestDogstatsdSenderSampleRate(t *testing.T) {
+	got := testDogstatsdSender(t, func(s *dogstatsdSender) {
+		tags := []string{"a:b", SampleRateTag + ":0.1", "c:d"}
+		s.Count("c", 1, tags...)
+		s.Distribution("d", 1, SampleRateTag+":0.25")
+
+		// rates outside (0, 1) are not annotated
+		s.Count("all", 1, SampleRateTag+":1")
+		s.Count("invalid", 1, SampleRateTag+":nope", "a:b")
+
+		assert.ArrayEqual(t, tags, []string{"a:b", SampleRateTag + ":0.1", "c:d"})
+	})
+	assert.Equal(
+		t,
+		got,
+		"c:1.000000|c|@0.1|#a:b,c:d\n"+
+			"d:1.000000|d|@0.25\n"+
+			"all:1.000000|c\n"+
+			"invalid:1.000000|c|#a:b\n",
+	)
+}
+
+func TestDogstatsdSenderServiceCheck(t *testing.T) {
+	got := testDogstatsdSender(t, func(s *dogstatsdSender) {
+		s.ServiceCheck("svc.up", ServiceCheckOK, "")
+		s.ServiceCheck("svc.up", ServiceCheckCritical, "line 1\nline 2", "a:b")
+	})
+	assert.Equal(
+		t,
+		got,
+		"_sc|svc.up|0\n"+
+			"_sc|svc.up|2|#a:b|m:line 1\\nline 2\n",
+	)
+}
+
+func TestDogstatsdSenderEvent(t *testing.T) {
+	ts := time.Unix(1500000000, 0)
+	got := testDogstatsdSender(t, func(s *dogstatsdSender) {
+		s.Event("deploy", nil)
+		s.Event(
+			"deploy",
+			[]Field{
+				NewField(EventTextField, "it's\nalive"),
+				NewField("version", 2),
+				NewField(EventAlertTypeField, "success"),
+				NewField(EventTimestampField, ts),
+				NewField(EventAggregationKeyField, "agg|key"),
+				NewField(EventPriorityField, "low"),
+				NewField(EventSourceTypeField, "src"),
+				NewField(EventHostnameField, "host"),
+			},
+			"a:b",
+			"c:d",
+		)
+		s.Event("ms", []Field{NewField(EventTimestampField, int64(1500000000123))})
+	})
+	assert.Equal(
+		t,
+		got,
+		"_e{6,0}:deploy|\n"+
+			"_e{6,23}:deploy|it's\\nalive\\nversion: 2"+
+			"|d:1500000000|h:host|k:aggkey|p:low|s:src|t:success|#a:b,c:d\n"+
+			"_e{2,0}:ms||d:1500000000\n",
+	)
+}
+
+func TestDogstatsdSenderMaxPacketLen(t *testing.T) {
+	w := &testWriter{}
+	s := newDogstatsdSender(w, time.Hour, 30)
+
+	s.Count("a", 1)
+	s.Count("b", 2)
+	s.Count("c", 3)
+	assert.Nil(t, s.Close())
+
+	assert.ArrayEqual(
+		t,
+		w.writes,
+		[]string{"a:1.000000|c\nb:2.000000|c\n", "c:3.000000|c\n"},
+	)
+}
+
+func TestDogstatsdExtendedStats(t *testing.T) {
+	w := &testWriter{}
+	sender := newDogstatsdSender(w, time.Hour, defaultMaxPacketLen)
+	stats := newFromSender(sender, dogstatsdCleaner, "x", nil, true)
+	stats.AddTags(NewKVTag("node", "n"))
+
+	scope := stats.Scope("y")
+	Distribution(scope, "d", 1.0, NewKVTag("a", "b"))
+	Set(scope, "s:et", "v")
+	ServiceCheck(scope, "sc", ServiceCheckWarning, "hmm", NewKVTag("status_code", "503"))
+	scope.Event("ev", NewField("k", "v"))
+	assert.Nil(t, stats.Close())
+
+	assert.Equal(
+		t,
+		w.String(),
+		"x.y.d:1.000000|d|#a:b,node:n\n"+
+			"x.y.set:v|s|#node:n\n"+
+			"_sc|x.y.sc|1|#status_code:503,status_class:server_error,node:n|m:hmm\n"+
+			"_e{6,4}:x.y.ev|k: v|#node:n\n",
+	)
+}
+
+func TestXStatsExtendedFallback(t *testing.T) {
+	rec := &recordingXstatsSender{}
+	stats := newFromSender(rec, statsdCleaner, "", nil, false)
+
+	Distribution(stats, "d", 1.0)
+	Set(stats, "s", "v")
+	ServiceCheck(stats, "sc", ServiceCheckOK, "")
+	stats.Event("ev")
+
+	assert.ArrayEqual(t, rec.calls, []string{"h d 1"})
+}
+
+func TestLatchingSenderExtended(t *testing.T) {
+	w := &testWriter{}
+	underlying := newDogstatsdSender(w, time.Hour, defaultMaxPacketLen)
+	s := newLatchingSender(underlying, dogstatsdCleaner).(*latchingSender)
+
+	s.Distribution("d", 1.0, "a:b")
+	s.Set("s", "v")
+	s.ServiceCheck("sc", ServiceCheckUnknown, "")
+	s.Event("ev", nil)
+	assert.Nil(t, underlying.Close())
+
+	assert.Equal(
+		t,
+		w.String(),
+		"d:1.000000|d|#a:b\ns:v|s\n_sc|sc|3\n_e{2,0}:ev|\n",
+	)
+}
+
+func TestDogstatsdSenderLatchedHistogram(t *testing.T) {
+	w := &testWriter{}
+	s := newDogstatsdSender(w, time.Hour, defaultMaxPacketLen)
+
+	s.LatchedHistogram(
+		"h",
+		LatchedHistogram{
+			Limits:   []float64{1, 2, 4, 8},
+			Buckets:  []int64{1, 0, 4, 2},
+			Overflow: 3,
+			Count:    10,
+			Sum:      60,
+			Min:      0.5,
+			Max:      20,
+		},
+		"a:b",
+		"",
+	)
+	s.LatchedHistogram("empty", LatchedHistogram{Limits: []float64{1}, Buckets: []int64{0}})
+	assert.Nil(t, s.Close())
+
+	assert.Equal(
+		t,
+		w.String(),
+		"h:0.750000|d|#a:b\n"+
+			"h:3.000000|d|@0.25|#a:b\n"+
+			"h:6.000000|d|@0.5|#a:b\n"+
+			"h:20.000000|d|@0.3333333333333333|#a:b\n",
+	)
+}
+
+func TestLatchingDogstatsdSender(t *testing.T) {
+	w := &testWriter{}
+	underlying := newDogstatsdSender(w, time.Hour, defaultMaxPacketLen)
+	s := newLatchingSender(
+		underlying,
+		dogstatsdCleaner,
+		latchBucketLimits([]float64{1, 2}),
+	).(*latchingSender)
+
+	s.Histogram("h", 0.5, "a:b")
+	s.Histogram("h", 1.5, "a:b")
+	s.Histogram("h", 1.5, "a:b")
+	assert.Nil(t, s.Close())
+
+	lines := strings.Split(w.String(), "\n")
+	assert.Equal(t, lines[0], "h:0.750000|d|#a:b")
+	assert.Equal(t, lines[1], "h:1.500000|d|@0.5|#a:b")
+	assert.True(t, strings.HasPrefix(lines[2], "latched_at:"))
+}
+
+// recordingXstatsSender records calls to its Histogram method.
+type recordingXstatsSender struct {
+	calls []string
+}
+
+func (s *recordingXstatsSender) Gauge(string, float64, ...string) {}
+
+func (s *recordingXstatsSender) Count(string, float64, ...string) {}
+
+func (s *recordingXstatsSender) Histogram(stat string, value float64, tags ...string) {
+	s.calls = append(s.calls, fmt.Sprintf("h %s %v", stat, value))
+}
+
+func (s *recordingXstatsSender) Timing(string, time.Duration, ...string) {}
+
+var _ xstats.Sender = &recordingXstatsSender{}
+
 func TestDogstatsdCleanerCleanStatName(t *testing.T) {
 	testCases := [][]string{
 		{"ok", "ok"},
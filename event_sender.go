@@ -21,7 +21,7 @@ import (
 )
 
 // eventSender is a mixin that provides noop implementations of Gauge,
-// Histogram, Timing and Count, as structured event backends typically
+// Histogram, Timing, Count and Describe, as structured event backends typically
 // use Event in the Stats interface
 type eventSender struct {
 	scopes []string
@@ -35,6 +35,8 @@ func (es *eventSender) Timing(stat string, value time.Duration, tags ...Tag) {}
 
 func (es *eventSender) Count(stat string, count float64, tags ...Tag) {}
 
+func (es *eventSender) Describe(descriptors ...Descriptor) {}
+
 func (es *eventSender) scope(scope string, scopes ...string) eventSender {
 	newScopes := make([]string, 0, len(es.scopes)+1+len(scopes))
 	newScopes = append(newScopes, es.scopes...)
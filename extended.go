@@ -0,0 +1,109 @@
+/*
+Copyright 2018 Turbine Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+// ServiceCheckStatus is the status reported by a service check.
+type ServiceCheckStatus int
+
+const (
+	// ServiceCheckOK indicates the service is healthy.
+	ServiceCheckOK ServiceCheckStatus = iota
+
+	// ServiceCheckWarning indicates the service is degraded.
+	ServiceCheckWarning
+
+	// ServiceCheckCritical indicates the service is unhealthy.
+	ServiceCheckCritical
+
+	// ServiceCheckUnknown indicates the service's health could not
+	// be determined.
+	ServiceCheckUnknown
+)
+
+// String returns the name of the ServiceCheckStatus.
+func (s ServiceCheckStatus) String() string {
+	switch s {
+	case ServiceCheckOK:
+		return "ok"
+	case ServiceCheckWarning:
+		return "warning"
+	case ServiceCheckCritical:
+		return "critical"
+	default:
+		return "unknown"
+	}
+}
+
+// ExtendedStats is implemented by Stats that support stat types
+// beyond those of the Stats interface. Not all backends support these
+// types. Use the Distribution, Set, and ServiceCheck functions to
+// record them on any Stats.
+type ExtendedStats interface {
+	Stats
+
+	// Distribution tracks the statistical distribution of a set of
+	// values, aggregated by the backend across all sources. Backends
+	// that do not support distributions record a histogram.
+	Distribution(stat string, value float64, tags ...Tag)
+
+	// Set counts the number of unique values seen over a period,
+	// like the number of distinct users of a system.
+	Set(stat string, value string, tags ...Tag)
+
+	// ServiceCheck reports the status of a service, with an
+	// optional message.
+	ServiceCheck(name string, status ServiceCheckStatus, message string, tags ...Tag)
+}
+
+// Distribution records a distribution value on the given Stats. If
+// the Stats does not implement ExtendedStats, the value is recorded
+// as a histogram.
+func Distribution(s Stats, stat string, value float64, tags ...Tag) {
+	if es, ok := s.(ExtendedStats); ok {
+		es.Distribution(stat, value, tags...)
+		return
+	}
+
+	s.Histogram(stat, value, tags...)
+}
+
+// Set records a set value on the given Stats. If the Stats does not
+// implement ExtendedStats, the value is ignored.
+func Set(s Stats, stat string, value string, tags ...Tag) {
+	if es, ok := s.(ExtendedStats); ok {
+		es.Set(stat, value, tags...)
+	}
+}
+
+// ServiceCheck records a service check on the given Stats. If the
+// Stats does not implement ExtendedStats, the service check is
+// ignored.
+func ServiceCheck(s Stats, name string, status ServiceCheckStatus, message string, tags ...Tag) {
+	if es, ok := s.(ExtendedStats); ok {
+		es.ServiceCheck(name, status, message, tags...)
+	}
+}
+
+// extendedSender is implemented by xstats Senders that support the
+// stat types of ExtendedStats and events. Stat names and tags have
+// already been cleaned and scoped.
+type extendedSender interface {
+	Distribution(stat string, value float64, tags ...string)
+	Set(stat string, value string, tags ...string)
+	ServiceCheck(name string, status ServiceCheckStatus, message string, tags ...string)
+	Event(title string, fields []Field, tags ...string)
+}
@@ -21,11 +21,13 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/turbinelabs/idgen"
 	tbnflag "github.com/turbinelabs/nonstdlib/flag"
 	"github.com/turbinelabs/nonstdlib/ptr"
 	tbnstrings "github.com/turbinelabs/nonstdlib/strings"
+	tbntime "github.com/turbinelabs/nonstdlib/time"
 )
 
 //go:generate mockgen -source $GOFILE -destination mock_$GOFILE -package $GOPACKAGE --write_package_comment=false
@@ -164,15 +166,17 @@ func NewFromFlags(fs tbnflag.FlagSet, options ...Option) FromFlags {
 }
 
 type fromFlags struct {
-	statsFromFlagses  map[string]statsFromFlags
-	eventsFromFlagses map[string]statsFromFlags
-	flagScope         string
-	backends          tbnflag.Strings
-	eventBackends     tbnflag.Strings
-	nodeTag           string
-	sourceTag         string
-	uniqueSourceTag   string
-	tags              tbnflag.Strings
+	statsFromFlagses    map[string]statsFromFlags
+	eventsFromFlagses   map[string]statsFromFlags
+	flagScope           string
+	backends            tbnflag.Strings
+	eventBackends       tbnflag.Strings
+	nodeTag             string
+	sourceTag           string
+	uniqueSourceTag     string
+	tags                tbnflag.Strings
+	clientStats         bool
+	clientStatsInterval time.Duration
 
 	resolved          bool
 	resolvedNodeTag   string
@@ -226,6 +230,20 @@ func (ff *fromFlags) initFlags(fs tbnflag.FlagSet) {
 		"tags",
 		`Tags to be included with every stat. May be comma-delimited or specified more than once. Should be of the form "<key>=<value>" or "tag"`,
 	)
+
+	fs.BoolVar(
+		&ff.clientStats,
+		"client-stats",
+		false,
+		`If enabled, each backend reports its own delivery health (packets and bytes sent, send errors, dropped stats, and send latency) as stats in the "`+ClientStatsScope+`" scope, tagged with the backend's name.`,
+	)
+
+	fs.DurationVar(
+		&ff.clientStatsInterval,
+		"client-stats-interval",
+		DefaultClientStatsInterval,
+		"Specifies the `duration` between reports of backend delivery health. Ignored unless --{{PREFIX}}client-stats is enabled.",
+	)
 }
 
 func (ff *fromFlags) Validate() error {
@@ -249,6 +267,10 @@ func (ff *fromFlags) Validate() error {
 		}
 	}
 
+	if ff.clientStats && ff.clientStatsInterval <= 0 {
+		return fmt.Errorf("--%sclient-stats-interval must be greater than zero", ff.flagScope)
+	}
+
 	sourceTag, nodeTag, _, err := ff.parseTags()
 	if err != nil {
 		return err
@@ -330,26 +352,34 @@ func (ff *fromFlags) parseTags() (*string, *string, []Tag, error) {
 }
 
 func (ff *fromFlags) Make() (Stats, error) {
+	var deliveryStatses []*deliveryStats
+
 	statses := make([]Stats, 0, len(ff.statsFromFlagses))
 	for _, backend := range ff.backends.Strings {
 		if sff, ok := ff.statsFromFlagses[backend]; ok {
-			sender, err := sff.Make()
+			sender, ds, err := ff.makeBackend(backend, sff)
 			if err != nil {
 				return nil, err
 			}
 
 			statses = append(statses, sender)
+			if ds != nil {
+				deliveryStatses = append(deliveryStatses, ds)
+			}
 		}
 	}
 
 	for _, backend := range ff.eventBackends.Strings {
 		if eff, ok := ff.eventsFromFlagses[backend]; ok {
-			sender, err := eff.Make()
+			sender, ds, err := ff.makeBackend(backend, eff)
 			if err != nil {
 				return nil, err
 			}
 
 			statses = append(statses, sender)
+			if ds != nil {
+				deliveryStatses = append(deliveryStatses, ds)
+			}
 		}
 	}
 
@@ -399,9 +429,41 @@ func (ff *fromFlags) Make() (Stats, error) {
 		stats.AddTags(NewKVTag(SourceTag, ff.resolvedSourceTag))
 	}
 
+	if len(deliveryStatses) > 0 {
+		return &clientStatsReportingStats{
+			Stats: stats,
+			reporter: newClientStatsReporter(
+				stats,
+				deliveryStatses,
+				ff.clientStatsInterval,
+				tbntime.NewSource(),
+			),
+		}, nil
+	}
+
 	return stats, nil
 }
 
+// makeBackend constructs the Stats for the named backend. If client
+// stats are enabled and the backend can report its delivery health,
+// the deliveryStats recording it is also returned.
+func (ff *fromFlags) makeBackend(
+	backend string,
+	sff statsFromFlags,
+) (Stats, *deliveryStats, error) {
+	if dff, ok := sff.(deliveryTrackingFromFlags); ok && ff.clientStats {
+		ds := newDeliveryStats(backend)
+		s, err := dff.makeWithDeliveryStats(ds)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, ds, nil
+	}
+
+	s, err := sff.Make()
+	return s, nil, err
+}
+
 func (ff *fromFlags) Node() string {
 	return ff.resolvedNodeTag
 }
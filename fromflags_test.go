@@ -203,6 +203,109 @@ func TestFromFlagsValidate(t *testing.T) {
 			},
 			expectErrorContains: "--dogstatsd.latch.buckets must be greater than 1",
 		},
+		{
+			args: []string{
+				"--backends=dogstatsd",
+				"--dogstatsd.latch=true",
+				"--dogstatsd.latch.bucket-strategy=linear:0:1",
+			},
+			expectErrorContains: "--dogstatsd.latch.bucket-strategy invalid",
+		},
+		{
+			args: []string{
+				"--backends=dogstatsd",
+				"--dogstatsd.latch=true",
+				"--dogstatsd.latch.bucket-overrides=a*",
+			},
+			expectErrorContains: "--dogstatsd.latch.bucket-overrides invalid",
+		},
+		{
+			args: []string{
+				"--backends=dogstatsd",
+				"--dogstatsd.latch=true",
+				"--dogstatsd.latch.bucket-strategy=log-linear:0.001:10:9",
+				"--dogstatsd.latch.bucket-overrides=a.*=explicit:1:5:10,b=linear:0:10:5",
+				"--dogstatsd.latch.quantiles=0.5,0.99",
+				"--dogstatsd.latch.gauge-aggregations=queue.*=min:max,conns=sum",
+				"--dogstatsd.latch.open-windows=3",
+				"--dogstatsd.latch.late-policy=forward",
+				"--dogstatsd.latch.max-series=1000",
+				"--dogstatsd.latch.max-node-series=100",
+				"--dogstatsd.latch.series-overflow=drop",
+			},
+		},
+		{
+			args: []string{
+				"--backends=dogstatsd",
+				"--dogstatsd.latch=true",
+				"--dogstatsd.latch.quantiles=0.5,1.5",
+			},
+			expectErrorContains: "--dogstatsd.latch.quantiles invalid",
+		},
+		{
+			args: []string{
+				"--backends=dogstatsd",
+				"--dogstatsd.latch=true",
+				"--dogstatsd.latch.grace-period=-1s",
+			},
+			expectErrorContains: "--dogstatsd.latch.grace-period must not be negative",
+		},
+		{
+			args: []string{
+				"--backends=dogstatsd",
+				"--dogstatsd.latch=true",
+				"--dogstatsd.latch.open-windows=0",
+			},
+			expectErrorContains: "--dogstatsd.latch.open-windows must be at least 1",
+		},
+		{
+			args: []string{
+				"--backends=dogstatsd",
+				"--dogstatsd.latch=true",
+				"--dogstatsd.latch.late-policy=merge",
+			},
+			expectErrorContains: "--dogstatsd.latch.late-policy must be one of drop, forward",
+		},
+		{
+			args: []string{
+				"--backends=dogstatsd",
+				"--dogstatsd.latch=true",
+				"--dogstatsd.latch.gauge-aggregations=queue.*=median",
+			},
+			expectErrorContains: "--dogstatsd.latch.gauge-aggregations invalid",
+		},
+		{
+			args: []string{
+				"--backends=dogstatsd",
+				"--dogstatsd.latch=true",
+				"--dogstatsd.latch.max-series=-1",
+			},
+			expectErrorContains: "--dogstatsd.latch.max-series must not be negative",
+		},
+		{
+			args: []string{
+				"--backends=dogstatsd",
+				"--dogstatsd.latch=true",
+				"--dogstatsd.latch.max-node-series=-1",
+			},
+			expectErrorContains: "--dogstatsd.latch.max-node-series must not be negative",
+		},
+		{
+			args: []string{
+				"--backends=dogstatsd",
+				"--dogstatsd.latch=true",
+				"--dogstatsd.latch.series-overflow=evict",
+			},
+			expectErrorContains: "--dogstatsd.latch.series-overflow must be one of drop, collapse",
+		},
+		{
+			args: []string{
+				"--backends=dogstatsd",
+				"--dogstatsd.latch=true",
+				"--dogstatsd.latch.cumulative=true",
+			},
+			expectErrorContains: "--dogstatsd.latch.cumulative is not supported by this backend",
+		},
 		{
 			args: []string{
 				"--backends=dogstatsd",
@@ -241,6 +344,54 @@ func TestFromFlagsValidate(t *testing.T) {
 			},
 			expectErrorContains: "--statsd.host or --statsd.port is invalid",
 		},
+		{
+			args: []string{
+				"--backends=statsd",
+				"--statsd.transport=tcp",
+			},
+		},
+		{
+			args: []string{
+				"--backends=statsd",
+				"--statsd.transport=smoke-signals",
+			},
+			expectErrorContains: "--statsd.transport must be one of",
+		},
+		{
+			args: []string{
+				"--backends=statsd",
+				"--statsd.transport=unixgram",
+			},
+			expectErrorContains: "--statsd.socket must be specified for the unixgram transport",
+		},
+		{
+			args: []string{
+				"--backends=statsd",
+				"--statsd.transport=unixgram",
+				"--statsd.socket=/var/run/statsd.sock",
+			},
+		},
+		{
+			args: []string{
+				"--backends=statsd",
+				"--statsd.sample-rate=0",
+			},
+			expectErrorContains: "--statsd.sample-rate must be greater than 0 and at most 1",
+		},
+		{
+			args: []string{
+				"--backends=statsd",
+				"--statsd.sample-rates=requests.*=2",
+			},
+			expectErrorContains: "--statsd.sample-rates invalid: sample rate \"requests.*=2\" must have a rate",
+		},
+		{
+			args: []string{
+				"--backends=dogstatsd",
+				"--dogstatsd.sample-rate=0.5",
+				"--dogstatsd.sample-rates=requests.*=0.1,latency=0.25",
+			},
+		},
 		{
 			args: []string{
 				"--backends=statsd",
@@ -432,6 +583,27 @@ func TestFromFlagsValidate(t *testing.T) {
 				"--api.latch.buckets=8",
 			},
 		},
+		{
+			args: []string{
+				"--backends=api",
+				"--api.key=keyzor",
+				"--api.zone-name=zoner",
+				"--api.latch=true",
+				"--api.latch.cumulative=true",
+				"--api.latch.cumulative-stale-after=10m",
+			},
+		},
+		{
+			args: []string{
+				"--backends=api",
+				"--api.key=keyzor",
+				"--api.zone-name=zoner",
+				"--api.latch=true",
+				"--api.latch.cumulative=true",
+				"--api.latch.cumulative-stale-after=0",
+			},
+			expectErrorContains: "--api.latch.cumulative-stale-after must be greater than 0",
+		},
 		// honeycomb
 		{
 			args: []string{
@@ -583,6 +755,15 @@ func TestFromFlagsValidate(t *testing.T) {
 			},
 			expectErrorContains: "--unique-source may not be longer than 256 bytes",
 		},
+		// client stats
+		{
+			args: []string{
+				"--backends=dogstatsd",
+				"--client-stats",
+				"--client-stats-interval=0",
+			},
+			expectErrorContains: "--client-stats-interval must be greater than zero",
+		},
 	}
 
 	for _, tc := range testCases {
@@ -597,7 +778,12 @@ func getXstatsSenderType(t *testing.T, s Stats) string {
 		return ""
 	}
 
-	return reflect.TypeOf(xstats.sender).String()
+	sender := xstats.sender
+	if ss, ok := sender.(*samplingSender); ok {
+		sender = ss.underlying
+	}
+
+	return reflect.TypeOf(sender).String()
 }
 
 func TestFromFlagsMake(t *testing.T) {
@@ -619,8 +805,8 @@ func TestFromFlagsMake(t *testing.T) {
 	multiStats, ok := stats.(multiStats)
 	assert.True(t, ok)
 	assert.Equal(t, len(multiStats), 2)
-	assert.Equal(t, getXstatsSenderType(t, multiStats[0]), "*dogstatsd.sender")
-	assert.Equal(t, getXstatsSenderType(t, multiStats[1]), "*statsd.sender")
+	assert.Equal(t, getXstatsSenderType(t, multiStats[0]), "*stats.dogstatsdSender")
+	assert.Equal(t, getXstatsSenderType(t, multiStats[1]), "*stats.statsdSender")
 	assert.Nil(t, multiStats.Close())
 
 	assert.Equal(t, ff.Node(), "")
@@ -733,10 +919,41 @@ func TestFromFlagsMakeWithLatching(t *testing.T) {
 	assert.True(t, ok)
 	assert.Equal(t, len(multiStats), 2)
 	assert.Equal(t, getXstatsSenderType(t, multiStats[0]), "*stats.latchingSender")
-	assert.Equal(t, getXstatsSenderType(t, multiStats[1]), "*statsd.sender")
+	assert.Equal(t, getXstatsSenderType(t, multiStats[1]), "*stats.statsdSender")
 	assert.Nil(t, multiStats.Close())
 }
 
+func TestFromFlagsMakeWithClientStats(t *testing.T) {
+	fs := tbnflag.NewTestFlagSet()
+	ff := NewFromFlags(fs)
+	err := fs.Parse([]string{
+		"--backends=dogstatsd,statsd",
+		"--dogstatsd.host=localhost",
+		"--dogstatsd.port=8000",
+		"--statsd.host=localhost",
+		"--statsd.port=9000",
+		"--client-stats",
+	})
+	assert.Nil(t, err)
+
+	assert.Nil(t, ff.Validate())
+	stats, err := ff.Make()
+	assert.Nil(t, err)
+
+	reportingStats, ok := stats.(*clientStatsReportingStats)
+	assert.True(t, ok)
+	assert.Equal(t, len(reportingStats.reporter.deliveryStats), 2)
+	assert.Equal(t, reportingStats.reporter.deliveryStats[0].backend, dogstatsdName)
+	assert.Equal(t, reportingStats.reporter.deliveryStats[1].backend, statsdName)
+
+	multiStats, ok := reportingStats.Stats.(multiStats)
+	assert.True(t, ok)
+	assert.Equal(t, len(multiStats), 2)
+	assert.Equal(t, getXstatsSenderType(t, multiStats[0]), "*stats.dogstatsdSender")
+	assert.Equal(t, getXstatsSenderType(t, multiStats[1]), "*stats.statsdSender")
+	assert.Nil(t, stats.Close())
+}
+
 type makeAddTagsTestCase struct {
 	tags            []string
 	node            string
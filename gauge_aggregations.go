@@ -0,0 +1,103 @@
+/*
+Copyright 2018 Turbine Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	tbnstrings "github.com/turbinelabs/nonstdlib/strings"
+)
+
+// gaugeAggregation determines how the values of a latched gauge are
+// combined over the latch window.
+type gaugeAggregation string
+
+const (
+	gaugeLast gaugeAggregation = "last"
+	gaugeMin  gaugeAggregation = "min"
+	gaugeMax  gaugeAggregation = "max"
+	gaugeMean gaugeAggregation = "mean"
+	gaugeSum  gaugeAggregation = "sum"
+)
+
+var gaugeAggregations = []string{
+	string(gaugeLast),
+	string(gaugeMin),
+	string(gaugeMax),
+	string(gaugeMean),
+	string(gaugeSum),
+}
+
+// defaultGaugeAggregations is used for gauges matching no override.
+var defaultGaugeAggregations = []gaugeAggregation{gaugeLast}
+
+// gaugeAggregationOverride is the aggregations used for gauges whose
+// names match a pattern.
+type gaugeAggregationOverride struct {
+	pattern      string
+	aggregations []gaugeAggregation
+}
+
+// parseGaugeAggregations parses gauge aggregation overrides of the
+// form "<pattern>=<aggregation>:<aggregation>...". Patterns use the
+// syntax of path.Match.
+func parseGaugeAggregations(strs []string) ([]gaugeAggregationOverride, error) {
+	overrides := make([]gaugeAggregationOverride, 0, len(strs))
+	for _, str := range strs {
+		pattern, spec := tbnstrings.SplitFirstEqual(str)
+		if pattern == "" || spec == "" {
+			return nil, fmt.Errorf(
+				"gauge aggregation %q must be of the form <pattern>=<aggregation>:<aggregation>...",
+				str,
+			)
+		}
+
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("gauge aggregation %q has an invalid pattern: %s", str, err)
+		}
+
+		seen := map[gaugeAggregation]bool{}
+		aggregations := []gaugeAggregation{}
+		for _, name := range strings.Split(spec, ":") {
+			a := gaugeAggregation(strings.TrimSpace(name))
+			switch a {
+			case gaugeLast, gaugeMin, gaugeMax, gaugeMean, gaugeSum:
+			default:
+				return nil, fmt.Errorf(
+					"gauge aggregation %q has unknown aggregation %q, must be one of %s",
+					str,
+					name,
+					strings.Join(gaugeAggregations, ", "),
+				)
+			}
+
+			if !seen[a] {
+				seen[a] = true
+				aggregations = append(aggregations, a)
+			}
+		}
+
+		overrides = append(
+			overrides,
+			gaugeAggregationOverride{pattern: pattern, aggregations: aggregations},
+		)
+	}
+
+	return overrides, nil
+}
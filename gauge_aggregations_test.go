@@ -0,0 +1,53 @@
+/*
+Copyright 2018 Turbine Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"testing"
+
+	"github.com/turbinelabs/test/assert"
+)
+
+func TestParseGaugeAggregations(t *testing.T) {
+	overrides, err := parseGaugeAggregations(
+		[]string{"queue.*=min:max:mean:max", "conns=sum"},
+	)
+	assert.Nil(t, err)
+	assert.DeepEqual(t, overrides, []gaugeAggregationOverride{
+		{
+			pattern:      "queue.*",
+			aggregations: []gaugeAggregation{gaugeMin, gaugeMax, gaugeMean},
+		},
+		{
+			pattern:      "conns",
+			aggregations: []gaugeAggregation{gaugeSum},
+		},
+	})
+
+	overrides, err = parseGaugeAggregations(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, len(overrides), 0)
+
+	_, err = parseGaugeAggregations([]string{"queue.*"})
+	assert.ErrorContains(t, err, "must be of the form <pattern>=<aggregation>")
+
+	_, err = parseGaugeAggregations([]string{"[=min"})
+	assert.ErrorContains(t, err, "invalid pattern")
+
+	_, err = parseGaugeAggregations([]string{"a=min:median"})
+	assert.ErrorContains(t, err, `unknown aggregation "median", must be one of last, min, max, mean, sum`)
+}
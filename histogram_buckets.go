@@ -0,0 +1,216 @@
+/*
+Copyright 2018 Turbine Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+
+	tbnstrings "github.com/turbinelabs/nonstdlib/strings"
+)
+
+const (
+	exponentialBucketStrategy = "exponential"
+	linearBucketStrategy      = "linear"
+	logLinearBucketStrategy   = "log-linear"
+	explicitBucketStrategy    = "explicit"
+
+	// maxHistogramBuckets limits the number of buckets a bucket
+	// strategy may produce.
+	maxHistogramBuckets = 1000
+)
+
+var bucketStrategies = []string{
+	exponentialBucketStrategy,
+	linearBucketStrategy,
+	logLinearBucketStrategy,
+	explicitBucketStrategy,
+}
+
+// bucketStrategiesDesc describes the bucket strategy syntax for use
+// in flag usage strings.
+const bucketStrategiesDesc = `Bucket strategies are of the form "<strategy>:<arg>:<arg>...". The "exponential:<base>:<count>" strategy produces count buckets, each with an upper bound double the previous bucket's, starting with base. The "linear:<start>:<width>:<count>" strategy produces count buckets starting with start, each width greater than the previous. The "log-linear:<min>:<max>:<n>" strategy divides each power of ten from min up to max into n equal-width buckets, approximating a fixed relative error. The "explicit:<bound>:<bound>..." strategy uses the given upper bounds, which must be in increasing order. For timings, bounds are in units of seconds.`
+
+// exponentialBuckets returns numBuckets upper bounds of the form
+// 2^N * baseValue, where N is in the range [0, numBuckets).
+func exponentialBuckets(baseValue float64, numBuckets int) []float64 {
+	limits := make([]float64, numBuckets)
+	limit := baseValue
+	for i := range limits {
+		limits[i] = limit
+		limit *= 2.0
+	}
+	return limits
+}
+
+// linearBuckets returns numBuckets upper bounds, starting with start
+// and increasing by width.
+func linearBuckets(start, width float64, numBuckets int) []float64 {
+	limits := make([]float64, numBuckets)
+	for i := range limits {
+		limits[i] = start + float64(i)*width
+	}
+	return limits
+}
+
+// logLinearBuckets divides each power of ten, starting at min, into
+// subBuckets equal-width buckets. The last bucket's upper bound is the
+// first bound greater than or equal to max.
+func logLinearBuckets(min, max float64, subBuckets int) []float64 {
+	limits := []float64{min}
+	for magnitude := min; limits[len(limits)-1] < max; magnitude *= 10.0 {
+		width := (magnitude*10.0 - magnitude) / float64(subBuckets)
+		for i := 1; i <= subBuckets && limits[len(limits)-1] < max; i++ {
+			limits = append(limits, magnitude+float64(i)*width)
+		}
+	}
+	return limits
+}
+
+// parseBucketStrategy parses a bucket strategy, as described by
+// bucketStrategiesDesc, and returns the resulting bucket upper bounds.
+func parseBucketStrategy(spec string) ([]float64, error) {
+	parts := strings.Split(spec, ":")
+	strategy, args := parts[0], parts[1:]
+
+	floats := make([]float64, len(args))
+	for i, arg := range args {
+		f, err := strconv.ParseFloat(strings.TrimSpace(arg), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s bucket argument %q", strategy, arg)
+		}
+		floats[i] = f
+	}
+
+	var limits []float64
+	switch strategy {
+	case exponentialBucketStrategy:
+		if len(floats) != 2 {
+			return nil, errors.New(`exponential buckets must be of the form "exponential:<base>:<count>"`)
+		}
+		base, count := floats[0], int(floats[1])
+		if base <= 0.0 {
+			return nil, errors.New("exponential buckets must have a base greater than 0")
+		}
+		if count <= 1 || count > maxHistogramBuckets {
+			return nil, fmt.Errorf("exponential buckets must have a count greater than 1 and at most %d", maxHistogramBuckets)
+		}
+		limits = exponentialBuckets(base, count)
+
+	case linearBucketStrategy:
+		if len(floats) != 3 {
+			return nil, errors.New(`linear buckets must be of the form "linear:<start>:<width>:<count>"`)
+		}
+		start, width, count := floats[0], floats[1], int(floats[2])
+		if width <= 0.0 {
+			return nil, errors.New("linear buckets must have a width greater than 0")
+		}
+		if count <= 1 || count > maxHistogramBuckets {
+			return nil, fmt.Errorf("linear buckets must have a count greater than 1 and at most %d", maxHistogramBuckets)
+		}
+		limits = linearBuckets(start, width, count)
+
+	case logLinearBucketStrategy:
+		if len(floats) != 3 {
+			return nil, errors.New(`log-linear buckets must be of the form "log-linear:<min>:<max>:<n>"`)
+		}
+		min, max, subBuckets := floats[0], floats[1], int(floats[2])
+		if min <= 0.0 || max <= min {
+			return nil, errors.New("log-linear buckets must have a min greater than 0 and a max greater than min")
+		}
+		if subBuckets < 1 {
+			return nil, errors.New("log-linear buckets must have at least 1 bucket per power of ten")
+		}
+		if float64(subBuckets)*(math.Log10(max/min)+1) > maxHistogramBuckets {
+			return nil, fmt.Errorf("log-linear buckets may not produce more than %d buckets", maxHistogramBuckets)
+		}
+		limits = logLinearBuckets(min, max, subBuckets)
+
+	case explicitBucketStrategy:
+		if len(floats) == 0 || len(floats) > maxHistogramBuckets {
+			return nil, fmt.Errorf("explicit buckets must have between 1 and %d bounds", maxHistogramBuckets)
+		}
+		for i := 1; i < len(floats); i++ {
+			if floats[i] <= floats[i-1] {
+				return nil, errors.New("explicit buckets must be in increasing order")
+			}
+		}
+		limits = floats
+
+	default:
+		return nil, fmt.Errorf(
+			"unknown bucket strategy %q, must be one of %s",
+			strategy,
+			strings.Join(bucketStrategies, ", "),
+		)
+	}
+
+	return limits, nil
+}
+
+// bucketOverride is the bucket upper bounds used for histograms whose
+// names match a pattern.
+type bucketOverride struct {
+	pattern string
+	limits  []float64
+}
+
+// parseBucketOverrides parses bucket overrides of the form
+// "<pattern>=<strategy>". Patterns use the syntax of path.Match.
+func parseBucketOverrides(strs []string) ([]bucketOverride, error) {
+	overrides := make([]bucketOverride, 0, len(strs))
+	for _, str := range strs {
+		pattern, spec := tbnstrings.SplitFirstEqual(str)
+		if pattern == "" || spec == "" {
+			return nil, fmt.Errorf("bucket override %q must be of the form <pattern>=<strategy>", str)
+		}
+
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bucket override %q has an invalid pattern: %s", str, err)
+		}
+
+		limits, err := parseBucketStrategy(spec)
+		if err != nil {
+			return nil, fmt.Errorf("bucket override %q is invalid: %s", str, err)
+		}
+
+		overrides = append(overrides, bucketOverride{pattern: pattern, limits: limits})
+	}
+
+	return overrides, nil
+}
+
+// parseQuantiles parses quantiles, each in the range (0, 1).
+func parseQuantiles(strs []string) ([]float64, error) {
+	quantiles := make([]float64, 0, len(strs))
+	for _, str := range strs {
+		q, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quantile %q", str)
+		}
+		if q <= 0.0 || q >= 1.0 {
+			return nil, fmt.Errorf("quantile %q must be greater than 0 and less than 1", str)
+		}
+		quantiles = append(quantiles, q)
+	}
+
+	return quantiles, nil
+}
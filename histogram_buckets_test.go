@@ -0,0 +1,152 @@
+/*
+Copyright 2018 Turbine Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"testing"
+
+	"github.com/turbinelabs/test/assert"
+)
+
+func TestParseBucketStrategy(t *testing.T) {
+	testCases := []struct {
+		spec                string
+		expectedLimits      []float64
+		expectErrorContains string
+	}{
+		{
+			spec:           "exponential:0.5:4",
+			expectedLimits: []float64{0.5, 1, 2, 4},
+		},
+		{
+			spec:           "linear:10:5:3",
+			expectedLimits: []float64{10, 15, 20},
+		},
+		{
+			spec:           "log-linear:1:100:3",
+			expectedLimits: []float64{1, 4, 7, 10, 40, 70, 100},
+		},
+		{
+			spec:           "log-linear:1:50:3",
+			expectedLimits: []float64{1, 4, 7, 10, 40, 70},
+		},
+		{
+			spec:           "explicit:1:2.5: 10",
+			expectedLimits: []float64{1, 2.5, 10},
+		},
+		{
+			spec:                "nope:1",
+			expectErrorContains: `unknown bucket strategy "nope"`,
+		},
+		{
+			spec:                "exponential:x:4",
+			expectErrorContains: `invalid exponential bucket argument "x"`,
+		},
+		{
+			spec:                "exponential:1",
+			expectErrorContains: "must be of the form",
+		},
+		{
+			spec:                "exponential:0:4",
+			expectErrorContains: "base greater than 0",
+		},
+		{
+			spec:                "exponential:1:1",
+			expectErrorContains: "count greater than 1",
+		},
+		{
+			spec:                "linear:0:0:4",
+			expectErrorContains: "width greater than 0",
+		},
+		{
+			spec:                "linear:0:1:1001",
+			expectErrorContains: "at most 1000",
+		},
+		{
+			spec:                "log-linear:10:1:9",
+			expectErrorContains: "max greater than min",
+		},
+		{
+			spec:                "log-linear:1:10:0",
+			expectErrorContains: "at least 1 bucket",
+		},
+		{
+			spec:                "log-linear:0.000001:1000000:100",
+			expectErrorContains: "more than 1000 buckets",
+		},
+		{
+			spec:                "explicit",
+			expectErrorContains: "between 1 and 1000 bounds",
+		},
+		{
+			spec:                "explicit:1:3:2",
+			expectErrorContains: "increasing order",
+		},
+	}
+
+	for _, tc := range testCases {
+		assert.Group(tc.spec, t, func(g *assert.G) {
+			limits, err := parseBucketStrategy(tc.spec)
+			if tc.expectErrorContains != "" {
+				assert.ErrorContains(g, err, tc.expectErrorContains)
+				assert.Nil(g, limits)
+			} else {
+				assert.Nil(g, err)
+				assert.ArrayEqual(g, limits, tc.expectedLimits)
+			}
+		})
+	}
+}
+
+func TestParseBucketOverrides(t *testing.T) {
+	overrides, err := parseBucketOverrides(
+		[]string{"a.*=explicit:1:2", "b=linear:0:1:2"},
+	)
+	assert.Nil(t, err)
+	assert.DeepEqual(t, overrides, []bucketOverride{
+		{pattern: "a.*", limits: []float64{1, 2}},
+		{pattern: "b", limits: []float64{0, 1}},
+	})
+
+	overrides, err = parseBucketOverrides(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, len(overrides), 0)
+
+	_, err = parseBucketOverrides([]string{"a.*"})
+	assert.ErrorContains(t, err, "must be of the form <pattern>=<strategy>")
+
+	_, err = parseBucketOverrides([]string{"[=explicit:1"})
+	assert.ErrorContains(t, err, "invalid pattern")
+
+	_, err = parseBucketOverrides([]string{"a=explicit:2:1"})
+	assert.ErrorContains(t, err, "increasing order")
+}
+
+func TestParseQuantiles(t *testing.T) {
+	quantiles, err := parseQuantiles([]string{"0.5", " 0.99"})
+	assert.Nil(t, err)
+	assert.ArrayEqual(t, quantiles, []float64{0.5, 0.99})
+
+	_, err = parseQuantiles([]string{"x"})
+	assert.ErrorContains(t, err, `invalid quantile "x"`)
+
+	_, err = parseQuantiles([]string{"1"})
+	assert.ErrorContains(t, err, "less than 1")
+
+	_, err = parseQuantiles([]string{"0"})
+	assert.ErrorContains(t, err, "greater than 0")
+}
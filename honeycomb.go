@@ -96,6 +96,10 @@ func (ff *honeycombFromFlags) Validate() error {
 }
 
 func (ff *honeycombFromFlags) Make() (Stats, error) {
+	return ff.makeWithDeliveryStats(nil)
+}
+
+func (ff *honeycombFromFlags) makeWithDeliveryStats(ds *deliveryStats) (Stats, error) {
 	honeyConf := libhoney.Config{
 		WriteKey:   ff.writeKey,
 		Dataset:    ff.dataset,
@@ -108,16 +112,36 @@ func (ff *honeycombFromFlags) Make() (Stats, error) {
 	}
 
 	libhoney.Init(honeyConf)
+
+	if ds != nil {
+		go recordHoneycombResponses(libhoney.Responses(), ds)
+	}
+
 	return &honeySender{
-		builder: libhoney.NewBuilder(),
-		tags:    []Tag{},
+		builder:       libhoney.NewBuilder(),
+		tags:          []Tag{},
+		deliveryStats: ds,
 	}, nil
 }
 
+// recordHoneycombResponses records the delivery of each event to the
+// given deliveryStats until the responses channel is closed.
+func recordHoneycombResponses(responses <-chan libhoney.Response, ds *deliveryStats) {
+	for r := range responses {
+		if r.Err != nil || r.StatusCode >= 300 {
+			ds.sendError()
+			ds.drop(1)
+		} else {
+			ds.sent(0, r.Duration)
+		}
+	}
+}
+
 type honeySender struct {
 	eventSender
-	builder *libhoney.Builder
-	tags    []Tag
+	builder       *libhoney.Builder
+	tags          []Tag
+	deliveryStats *deliveryStats
 }
 
 func (hs *honeySender) AddTags(tags ...Tag) {
@@ -135,6 +159,8 @@ func (hs *honeySender) Event(stat string, fields ...Field) {
 	}
 	err := evt.Send()
 	if err != nil {
+		hs.deliveryStats.sendError()
+		hs.deliveryStats.drop(1)
 		console.Error().Printf("error sending event: %v\n", err)
 	} else {
 		console.Debug().Println("sent event")
@@ -146,9 +172,10 @@ func (hs *honeySender) Scope(scope string, scopes ...string) Stats {
 	newBuilder := hs.builder.Clone()
 	newBuilder.AddField("scopes", nes.scopes)
 	return &honeySender{
-		eventSender: nes,
-		builder:     newBuilder,
-		tags:        hs.tags,
+		eventSender:   nes,
+		builder:       newBuilder,
+		tags:          hs.tags,
+		deliveryStats: hs.deliveryStats,
 	}
 }
 
@@ -0,0 +1,178 @@
+/*
+Copyright 2018 Turbine Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/turbinelabs/nonstdlib/log/console"
+	tbntime "github.com/turbinelabs/nonstdlib/time"
+)
+
+const (
+	journalSuffix = ".wal"
+
+	journalCount     = "c"
+	journalGauge     = "g"
+	journalHistogram = "h"
+)
+
+// latchJournal is an on-disk write-ahead journal of latched stats.
+// Each open window of each node has a segment file in the journal's
+// directory, to which each stat latched in the window is appended as
+// a line of JSON. A window's segment is removed when the window is
+// completed. Segments remaining when a latching sender is created are
+// replayed into the sender.
+//
+// Writes are not synced to disk, so the journal survives process
+// crashes, but not necessarily operating system crashes.
+type latchJournal struct {
+	dir string
+}
+
+// journalEntry is a latched stat, as recorded in a journal segment.
+type journalEntry struct {
+	Type      string   `json:"t"`
+	Stat      string   `json:"s"`
+	Value     float64  `json:"v"`
+	Weight    float64  `json:"n,omitempty"`
+	Tags      []string `json:"g,omitempty"`
+	Timestamp int64    `json:"ts"`
+}
+
+func newLatchJournal(dir string) (*latchJournal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &latchJournal{dir: dir}, nil
+}
+
+// segmentPath returns the path of the segment for the given node's
+// window. Segment names are the hex-encoded node tag and the window
+// start in milliseconds since the Unix epoch.
+func (j *latchJournal) segmentPath(nodeTag string, latchStart time.Time) string {
+	name := fmt.Sprintf("%x-%d%s", nodeTag, tbntime.ToUnixMilli(latchStart), journalSuffix)
+	return filepath.Join(j.dir, name)
+}
+
+// append records the entry in the window's segment, opening the
+// segment if necessary. Failures are logged.
+func (j *latchJournal) append(w *latchingWindow, nodeTag string, e journalEntry) {
+	if w.journal == nil {
+		f, err := os.OpenFile(
+			j.segmentPath(nodeTag, w.latchStart),
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+			0644,
+		)
+		if err != nil {
+			console.Error().Printf("could not open stats journal: %s", err)
+			return
+		}
+		w.journal = f
+	}
+
+	e.Timestamp = tbntime.ToUnixMilli(w.latchStart)
+	b, err := json.Marshal(e)
+	if err != nil {
+		console.Error().Printf("could not encode stats journal entry: %s", err)
+		return
+	}
+
+	if _, err := w.journal.Write(append(b, '\n')); err != nil {
+		console.Error().Printf("could not write stats journal: %s", err)
+	}
+}
+
+// remove closes and removes the window's segment, if any.
+func (j *latchJournal) remove(w *latchingWindow, nodeTag string) {
+	if w.journal != nil {
+		w.journal.Close()
+		w.journal = nil
+	}
+
+	path := j.segmentPath(nodeTag, w.latchStart)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		console.Error().Printf("could not remove stats journal: %s", err)
+	}
+}
+
+// replay invokes f for each entry in the journal's segments. Segments
+// are replayed in order of their windows' start times. Entries that
+// cannot be decoded, such as a final entry truncated by a crash, are
+// skipped. Segments without any valid entries are removed.
+func (j *latchJournal) replay(f func(journalEntry)) error {
+	paths, err := filepath.Glob(filepath.Join(j.dir, "*"+journalSuffix))
+	if err != nil {
+		return err
+	}
+
+	starts := make(map[string]int64, len(paths))
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), journalSuffix)
+		start, _ := strconv.ParseInt(name[strings.LastIndex(name, "-")+1:], 10, 64)
+		starts[path] = start
+	}
+	sort.SliceStable(paths, func(a, b int) bool {
+		return starts[paths[a]] < starts[paths[b]]
+	})
+
+	for _, path := range paths {
+		if err := j.replaySegment(path, f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (j *latchJournal) replaySegment(path string, f func(journalEntry)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	replayed := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 4096), 1024*1024)
+	for scanner.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		f(e)
+		replayed++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if replayed == 0 {
+		return os.Remove(path)
+	}
+
+	return nil
+}
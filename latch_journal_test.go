@@ -0,0 +1,148 @@
+/*
+Copyright 2018 Turbine Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+
+	tbntime "github.com/turbinelabs/nonstdlib/time"
+	"github.com/turbinelabs/test/assert"
+)
+
+func testJournalDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "latch-journal")
+	assert.Nil(t, err)
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func journalSegments(t *testing.T, dir string) []string {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+journalSuffix))
+	assert.Nil(t, err)
+	return paths
+}
+
+func TestLatchJournalReplay(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	dir, cleanup := testJournalDir(t)
+	defer cleanup()
+
+	start := time.Unix(1500000000, 0)
+	tsTag := func(n int) string {
+		return fmt.Sprintf(
+			"%s=%d",
+			TimestampTag,
+			tbntime.ToUnixMilli(start.Add(time.Duration(n)*time.Second)),
+		)
+	}
+	node := NodeTag + "=n"
+
+	crashed := newMockXstatsSender(ctrl)
+	gomock.InOrder(
+		crashed.EXPECT().Count("c", 1.5, tsTag(0)),
+		crashed.EXPECT().Gauge("latched_at", float64(start.Unix()), tsTag(0)),
+	)
+
+	s := newLatchingSender(
+		crashed,
+		testCleaner,
+		latchWindow(time.Second),
+		latchBucketLimits([]float64{1, 2}),
+		latchJournalDir(dir),
+	)
+	s.Count("c", 1.5, tsTag(0))
+	s.Count("c", 1.0, tsTag(1))
+	s.Count("c", 2.0, tsTag(1), node, "a=b")
+	s.Gauge("g", 3.0, tsTag(1), node)
+	s.Gauge("g", 4.0, tsTag(1), node)
+	s.Histogram("h", 1.5, tsTag(1), SampleRateTag+"=0.5")
+	assert.Equal(t, len(journalSegments(t, dir)), 2)
+
+	// simulate a crash: s is never closed
+	underlying := newMockXstatsSender(ctrl)
+	replayed := newLatchingSender(
+		underlying,
+		testCleaner,
+		latchWindow(time.Second),
+		latchBucketLimits([]float64{1, 2}),
+		latchJournalDir(dir),
+	)
+	replayed.Count("c", 1.0, tsTag(1))
+	assert.Equal(t, len(journalSegments(t, dir)), 2)
+
+	underlying.EXPECT().Count("c", 2.0, tsTag(1))
+	underlying.EXPECT().Count("h.1", 0.0, tsTag(1))
+	underlying.EXPECT().Count("h.2", 2.0, tsTag(1))
+	underlying.EXPECT().Count("h.overflow", 0.0, tsTag(1))
+	underlying.EXPECT().Count("h.count", 2.0, tsTag(1))
+	underlying.EXPECT().Count("h.sum", 3.0, tsTag(1))
+	underlying.EXPECT().Gauge("h.min", 1.5, tsTag(1))
+	underlying.EXPECT().Gauge("h.max", 1.5, tsTag(1))
+	underlying.EXPECT().Gauge("latched_at", float64(start.Unix()+1), tsTag(1))
+	underlying.EXPECT().Count("c", 2.0, "a=b", node, tsTag(1))
+	underlying.EXPECT().Gauge("g", 4.0, node, tsTag(1))
+	underlying.EXPECT().Gauge("latched_at", float64(start.Unix()+1), node, tsTag(1))
+
+	assert.Nil(t, replayed.(*latchingSender).Close())
+	assert.Equal(t, len(journalSegments(t, dir)), 0)
+}
+
+func TestLatchJournalReplaySkipsInvalidEntries(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	dir, cleanup := testJournalDir(t)
+	defer cleanup()
+
+	start := time.Unix(1500000000, 0)
+	tsTag := fmt.Sprintf("%s=%d", TimestampTag, tbntime.ToUnixMilli(start))
+
+	j, err := newLatchJournal(dir)
+	assert.Nil(t, err)
+
+	valid := j.segmentPath("", start)
+	assert.Nil(t, ioutil.WriteFile(
+		valid,
+		[]byte(`{"t":"c","s":"c","v":1,"ts":1500000000000}`+"\n"+`{"t":"c","s":"c","v"`),
+		0644,
+	))
+
+	invalid := j.segmentPath("x", start)
+	assert.Nil(t, ioutil.WriteFile(invalid, []byte("nope\n"), 0644))
+
+	underlying := newMockXstatsSender(ctrl)
+	s := newLatchingSender(
+		underlying,
+		testCleaner,
+		latchWindow(time.Second),
+		latchJournalDir(dir),
+	)
+	assert.ArrayEqual(t, journalSegments(t, dir), []string{valid})
+
+	underlying.EXPECT().Count("c", 1.0, tsTag)
+	underlying.EXPECT().Gauge("latched_at", float64(start.Unix()), tsTag)
+	assert.Nil(t, s.(*latchingSender).Close())
+	assert.Equal(t, len(journalSegments(t, dir)), 0)
+}
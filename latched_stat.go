@@ -16,65 +16,195 @@ limitations under the License.
 
 package stats
 
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/beorn7/perks/quantile"
+)
+
+// LatchedHistogram is a histogram aggregated over a latch window.
+// Buckets[i] counts the values less than or equal to Limits[i] and
+// greater than the previous limit. Overflow counts the values greater
+// than the last limit. Count includes the values in every bucket and
+// the overflow bucket. When values are sampled, each count is rounded
+// separately, so Count may differ slightly from the sum of the
+// buckets.
 type LatchedHistogram struct {
-	BaseValue float64
-	Buckets   []int64
-	Count     int64
-	Sum       float64
-	Min       float64
-	Max       float64
+	Limits   []float64
+	Buckets  []int64
+	Overflow int64
+	Count    int64
+	Sum      float64
+	Min      float64
+	Max      float64
+}
+
+// latchedCentroid is a value representing count values in a
+// LatchedHistogram.
+type latchedCentroid struct {
+	value float64
+	count int64
+}
+
+// centroids approximates the histogram's values as a centroid for
+// each non-empty bucket. Each centroid is at the bucket's midpoint,
+// clamped to the histogram's minimum and maximum values. Values in the
+// overflow bucket are represented by a centroid at the maximum value.
+func (h LatchedHistogram) centroids() []latchedCentroid {
+	var centroids []latchedCentroid
+
+	lower := h.Min
+	for i, c := range h.Buckets {
+		upper := h.Limits[i]
+		if c > 0 {
+			value := (lower + upper) / 2
+			if value < h.Min {
+				value = h.Min
+			} else if value > h.Max {
+				value = h.Max
+			}
+
+			centroids = append(centroids, latchedCentroid{value, c})
+		}
+
+		lower = upper
+	}
+
+	if h.Overflow > 0 {
+		centroids = append(centroids, latchedCentroid{h.Max, h.Overflow})
+	}
+
+	return centroids
 }
 
 // counter handles counts over the latch window. All values added are
 // summed and returned as a single stat.
 type counter struct {
 	stat  string
-	value int64
+	value float64
 	tags  []string
 }
 
-func (c *counter) add(v int64) { c.value += v }
+func (c *counter) add(v float64) { c.value += v }
 
-// gauge handles gauges over the latch window. The last value added is
-// returned as a single stat.
+// gauge handles gauges over the latch window. The values added are
+// combined by one or more aggregations, each returned as a stat. By
+// default, the last value added is returned as a single stat.
 type gauge struct {
-	stat  string
-	value float64
-	tags  []string
+	stat         string
+	value        float64
+	tags         []string
+	aggregations []gaugeAggregation
+	count        int64
+	sum          float64
+	min          float64
+	max          float64
+}
+
+func (g *gauge) set(v float64) {
+	if g.count == 0 || v < g.min {
+		g.min = v
+	}
+	if g.count == 0 || v > g.max {
+		g.max = v
+	}
+	g.value = v
+	g.sum += v
+	g.count++
 }
 
-func (g *gauge) set(v float64) { g.value = v }
+// aggregate returns the result of the given aggregation over the
+// values added.
+func (g *gauge) aggregate(a gaugeAggregation) float64 {
+	switch a {
+	case gaugeMin:
+		return g.min
+	case gaugeMax:
+		return g.max
+	case gaugeMean:
+		if g.count == 0 {
+			return 0.0
+		}
+		return g.sum / float64(g.count)
+	case gaugeSum:
+		return g.sum
+	default:
+		return g.value
+	}
+}
 
-// histogram buckets added values into bins and produces a stat for
-// each bucket, the total count, the total sum, and the minimum and
-// maximum values.
+// histogram buckets added values into bins with the given upper
+// bounds and produces a stat for each bucket, the overflow bucket,
+// the total count, the total sum, and the minimum and maximum values.
+// Optionally, it estimates quantiles of the added values (see
+// trackQuantiles). Occurrences are weighted, so that a sampled value
+// may represent a fractional number of occurrences; weights are
+// rounded only when the histogram is latched.
 type histogram struct {
-	stat    string
-	tags    []string
-	buckets []int64
-	count   int64
-	sum     float64
-	min     float64
-	max     float64
-}
-
-func (h *histogram) add(v, baseValue float64) {
-	accum := baseValue
-	idx := 0
-	n := len(h.buckets)
-
-	for v > accum && idx < n {
-		idx++
-		accum *= 2.0
+	stat     string
+	tags     []string
+	limits   []float64
+	buckets  []float64
+	overflow float64
+	count    float64
+	sum      float64
+	min      float64
+	max      float64
+	stream   *quantile.Stream
+}
+
+func newHistogram(stat string, tags []string, limits []float64) *histogram {
+	return &histogram{
+		stat:    stat,
+		tags:    tags,
+		limits:  limits,
+		buckets: make([]float64, len(limits)),
 	}
+}
 
-	if idx < n {
-		h.buckets[idx]++
+// trackQuantiles causes the histogram to maintain a streaming
+// estimate of the given quantiles, each in the range (0, 1). The
+// error allowed for each quantile is a tenth of its distance from 1
+// (e.g. 0.001 for 0.99).
+func (h *histogram) trackQuantiles(quantiles []float64) {
+	targets := make(map[float64]float64, len(quantiles))
+	for _, q := range quantiles {
+		targets[q] = (1.0 - q) / 10.0
 	}
+	h.stream = quantile.NewTargeted(targets)
+}
+
+// quantile returns the estimated value of the given quantile, which
+// must have been passed to trackQuantiles.
+func (h *histogram) quantile(q float64) float64 {
+	return h.stream.Query(q)
+}
 
-	h.count++
-	h.sum += v
-	if h.count == 1 {
+func (h *histogram) add(v float64) {
+	h.addN(v, 1)
+}
+
+// addN adds n occurrences of v, where n need not be an integer.
+// Quantile estimates are unaffected by uniform sampling, so v is
+// inserted into the quantile stream once.
+func (h *histogram) addN(v float64, n float64) {
+	if h.stream != nil {
+		h.stream.Insert(v)
+	}
+
+	if idx := sort.SearchFloat64s(h.limits, v); idx < len(h.buckets) {
+		h.buckets[idx] += n
+	} else {
+		h.overflow += n
+	}
+
+	first := h.count == 0
+	h.count += n
+	h.sum += v * n
+	if first {
 		h.min = v
 		h.max = v
 	} else {
@@ -87,13 +217,38 @@ func (h *histogram) add(v, baseValue float64) {
 	}
 }
 
-func (h *histogram) latch(baseValue float64) LatchedHistogram {
+// latch rounds the weighted occurrences in each bucket, the overflow
+// bucket, and in total to the nearest integer.
+func (h *histogram) latch() LatchedHistogram {
+	buckets := make([]int64, len(h.buckets))
+	for i, n := range h.buckets {
+		buckets[i] = roundWeight(n)
+	}
+
 	return LatchedHistogram{
-		BaseValue: baseValue,
-		Buckets:   h.buckets,
-		Count:     h.count,
-		Sum:       h.sum,
-		Min:       h.min,
-		Max:       h.max,
+		Limits:   h.limits,
+		Buckets:  buckets,
+		Overflow: roundWeight(h.overflow),
+		Count:    roundWeight(h.count),
+		Sum:      h.sum,
+		Min:      h.min,
+		Max:      h.max,
+	}
+}
+
+// roundWeight rounds a number of weighted occurrences to the nearest
+// integer.
+func roundWeight(n float64) int64 {
+	return int64(math.Floor(n + 0.5))
+}
+
+// quantileSuffix returns the stat name suffix for a quantile: "p"
+// followed by the quantile's fractional digits, padded to at least
+// two digits (e.g. "p50" for 0.5, "p999" for 0.999).
+func quantileSuffix(q float64) string {
+	digits := strings.TrimPrefix(strconv.FormatFloat(q, 'f', -1, 64), "0.")
+	if len(digits) < 2 {
+		digits += "0"
 	}
+	return "p" + digits
 }
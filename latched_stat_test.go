@@ -27,73 +27,146 @@ func TestCounter(t *testing.T) {
 
 	c := &counter{"abc", 0, tags}
 	c.add(1)
-	assert.Equal(t, c.value, int64(1))
+	assert.Equal(t, c.value, 1.0)
 	assert.Equal(t, c.stat, "abc")
 	assert.ArrayEqual(t, c.tags, tags)
 
 	c = &counter{"abc", 100, tags}
 	c.add(50)
-	assert.Equal(t, c.value, int64(150))
-
+	assert.Equal(t, c.value, 150.0)
+
+	c = &counter{"abc", 0, tags}
+	c.add(0.25)
+	c.add(0.5)
+	c.add(1.25)
+	assert.Equal(t, c.value, 2.0)
+
+	c = &counter{"abc", 0, tags}
+	c.add(1e20)
+	c.add(1e20)
+	assert.Equal(t, c.value, 2e20)
 }
 
 func TestGauge(t *testing.T) {
 	tags := []string{"abc=def"}
 
-	g := &gauge{"abc", 0.0, tags}
+	g := &gauge{stat: "abc", tags: tags}
 	g.set(1.0)
 	assert.Equal(t, g.value, 1.0)
 	assert.Equal(t, g.stat, "abc")
 	assert.ArrayEqual(t, g.tags, tags)
 
-	g = &gauge{"abc", 100.0, tags}
+	g = &gauge{stat: "abc", value: 100.0, tags: tags}
 	g.set(50.0)
 	assert.Equal(t, g.value, 50.0)
 	g.set(150.0)
 	assert.Equal(t, g.value, 150.0)
+	g.set(100.0)
+
+	assert.Equal(t, g.aggregate(gaugeLast), 100.0)
+	assert.Equal(t, g.aggregate(gaugeMin), 50.0)
+	assert.Equal(t, g.aggregate(gaugeMax), 150.0)
+	assert.Equal(t, g.aggregate(gaugeMean), 100.0)
+	assert.Equal(t, g.aggregate(gaugeSum), 300.0)
+
+	g = &gauge{stat: "abc", tags: tags}
+	assert.Equal(t, g.aggregate(gaugeMean), 0.0)
 }
 
 func TestHistogram(t *testing.T) {
 	tags := []string{"abc=def"}
 
-	baseValue := 1.0
-
-	h := &histogram{"abc", tags, make([]int64, 4), 0, 0, 0, 0}
+	h := newHistogram("abc", tags, exponentialBuckets(1.0, 4))
 
-	h.add(3.0, baseValue)
+	h.add(3.0)
 	assert.Equal(t, h.stat, "abc")
 	assert.ArrayEqual(t, h.tags, tags)
-	assert.ArrayEqual(t, h.buckets, []int64{0, 0, 1, 0})
-	assert.Equal(t, h.count, int64(1))
+	assert.ArrayEqual(t, h.buckets, []float64{0, 0, 1, 0})
+	assert.Equal(t, h.count, 1.0)
 	assert.Equal(t, h.sum, 3.0)
 	assert.Equal(t, h.min, 3.0)
 	assert.Equal(t, h.max, 3.0)
 
-	h.add(5.0, baseValue)
-	assert.ArrayEqual(t, h.buckets, []int64{0, 0, 1, 1})
-	assert.Equal(t, h.count, int64(2))
+	h.add(5.0)
+	assert.ArrayEqual(t, h.buckets, []float64{0, 0, 1, 1})
+	assert.Equal(t, h.count, 2.0)
 	assert.Equal(t, h.sum, 8.0)
 	assert.Equal(t, h.min, 3.0)
 	assert.Equal(t, h.max, 5.0)
 
-	h.add(1.0, baseValue)
-	assert.ArrayEqual(t, h.buckets, []int64{1, 0, 1, 1})
-	assert.Equal(t, h.count, int64(3))
+	h.add(1.0)
+	assert.ArrayEqual(t, h.buckets, []float64{1, 0, 1, 1})
+	assert.Equal(t, h.count, 3.0)
 	assert.Equal(t, h.sum, 9.0)
 	assert.Equal(t, h.min, 1.0)
 	assert.Equal(t, h.max, 5.0)
 
-	h.add(4.0, baseValue)
-	assert.ArrayEqual(t, h.buckets, []int64{1, 0, 2, 1})
-	assert.Equal(t, h.count, int64(4))
+	h.add(4.0)
+	assert.ArrayEqual(t, h.buckets, []float64{1, 0, 2, 1})
+	assert.Equal(t, h.count, 4.0)
 	assert.Equal(t, h.sum, 13.0)
 	assert.Equal(t, h.min, 1.0)
 	assert.Equal(t, h.max, 5.0)
 
-	h.add(10.0, baseValue)
-	assert.ArrayEqual(t, h.buckets, []int64{1, 0, 2, 1})
-	assert.Equal(t, h.count, int64(5))
+	h.add(10.0)
+	assert.ArrayEqual(t, h.buckets, []float64{1, 0, 2, 1})
+	assert.Equal(t, h.overflow, 1.0)
+	assert.Equal(t, h.count, 5.0)
 	assert.Equal(t, h.sum, 23.0)
 	assert.Equal(t, h.min, 1.0)
 	assert.Equal(t, h.max, 10.0)
+
+	h.addN(0.5, 3)
+	assert.ArrayEqual(t, h.buckets, []float64{4, 0, 2, 1})
+	assert.Equal(t, h.overflow, 1.0)
+	assert.Equal(t, h.count, 8.0)
+	assert.Equal(t, h.min, 0.5)
+
+	latched := h.latch()
+	assert.ArrayEqual(t, latched.Limits, []float64{1.0, 2.0, 4.0, 8.0})
+	assert.ArrayEqual(t, latched.Buckets, []int64{4, 0, 2, 1})
+	assert.Equal(t, latched.Overflow, int64(1))
+	assert.Equal(t, latched.Count, int64(8))
+	assert.Equal(t, latched.Sum, 24.5)
+	assert.Equal(t, latched.Min, 0.5)
+	assert.Equal(t, latched.Max, 10.0)
+}
+
+func TestHistogramFractionalWeights(t *testing.T) {
+	h := newHistogram("abc", nil, []float64{1.0, 2.0})
+
+	// three values sampled at 0.3 represent 10 occurrences
+	weight := sampleWeight(0.3)
+	h.addN(0.5, weight)
+	h.addN(1.5, weight)
+	h.addN(1.5, weight)
+	h.addN(3.0, 0.25)
+
+	latched := h.latch()
+	assert.ArrayEqual(t, latched.Buckets, []int64{3, 7})
+	assert.Equal(t, latched.Overflow, int64(0))
+	assert.Equal(t, latched.Count, int64(10))
+	assert.Equal(t, latched.Max, 3.0)
+}
+
+func TestHistogramQuantiles(t *testing.T) {
+	h := newHistogram("abc", nil, exponentialBuckets(1.0, 4))
+	h.trackQuantiles([]float64{0.5, 0.9, 0.99})
+
+	for i := 1; i <= 100; i++ {
+		h.add(float64(i))
+	}
+
+	assert.Equal(t, h.quantile(0.5), 50.0)
+	assert.Equal(t, h.quantile(0.9), 90.0)
+	assert.Equal(t, h.quantile(0.99), 99.0)
+	assert.Equal(t, h.count, 100.0)
+}
+
+func TestQuantileSuffix(t *testing.T) {
+	assert.Equal(t, quantileSuffix(0.5), "p50")
+	assert.Equal(t, quantileSuffix(0.05), "p05")
+	assert.Equal(t, quantileSuffix(0.95), "p95")
+	assert.Equal(t, quantileSuffix(0.99), "p99")
+	assert.Equal(t, quantileSuffix(0.999), "p999")
 }
@@ -22,6 +22,8 @@ package stats
 import (
 	"crypto/md5"
 	"fmt"
+	"os"
+	"path"
 	"sort"
 	"strconv"
 	"sync"
@@ -29,6 +31,7 @@ import (
 
 	"github.com/rs/xstats"
 
+	"github.com/turbinelabs/nonstdlib/log/console"
 	"github.com/turbinelabs/nonstdlib/ptr"
 	tbnstrings "github.com/turbinelabs/nonstdlib/strings"
 	tbntime "github.com/turbinelabs/nonstdlib/time"
@@ -47,11 +50,71 @@ const (
 	// when aggregating timing/histogram values.
 	DefaultHistogramBaseValue = 0.001 // 1 millisecond in fractional seconds
 
+	// DefaultLatchGracePeriod specifies the default period of time after the
+	// end of a window before the window is flushed in the background.
+	DefaultLatchGracePeriod = 5 * time.Second
+
+	// DefaultCumulativeStaleAfter specifies the default period of time after
+	// which a cumulative counter that has not been updated is no longer
+	// emitted.
+	DefaultCumulativeStaleAfter = 5 * time.Minute
+
+	// DefaultLatchOpenWindows specifies the default number of recent windows
+	// that accept stats.
+	DefaultLatchOpenWindows = 1
+
 	// LatchedAtMetric is the name of the synthetic metric used to report when the
 	// latch occurred.
 	LatchedAtMetric = "latched_at"
+
+	// LatchedLateMetric is the name of the synthetic metric used to report the
+	// number of stats that arrived too late to be latched in their window.
+	LatchedLateMetric = "latched_late"
+
+	// LatchedRejectedMetric is the name of the synthetic metric used to report
+	// the number of stats rejected because they would have exceeded a series
+	// limit.
+	LatchedRejectedMetric = "latched_rejected"
+
+	// OtherTagValue replaces tag values when series are collapsed.
+	OtherTagValue = "__other__"
 )
 
+// lateStatPolicy determines how the latching sender handles stats
+// timestamped earlier than its oldest open window.
+type lateStatPolicy string
+
+const (
+	// lateStatDrop drops late stats.
+	lateStatDrop lateStatPolicy = "drop"
+
+	// lateStatForward forwards late stats to the underlying sender
+	// without latching them. Their timestamps are preserved.
+	lateStatForward lateStatPolicy = "forward"
+)
+
+var lateStatPolicies = []string{string(lateStatDrop), string(lateStatForward)}
+
+// seriesOverflowPolicy determines how the latching sender handles
+// stats that would exceed a series limit.
+type seriesOverflowPolicy string
+
+const (
+	// seriesOverflowDrop drops the stat.
+	seriesOverflowDrop seriesOverflowPolicy = "drop"
+
+	// seriesOverflowCollapse latches the stat in a series with the
+	// same name, whose tag values, other than those identifying the
+	// stat's origin (see collapsedTags), are OtherTagValue. The
+	// collapsed series is created even if it exceeds the limit.
+	seriesOverflowCollapse seriesOverflowPolicy = "collapse"
+)
+
+var seriesOverflowPolicies = []string{
+	string(seriesOverflowDrop),
+	string(seriesOverflowCollapse),
+}
+
 // latchableSender provides an interface that allows client-aggregated
 // histogram data to be provided to the sender in a single call.
 type latchableSender interface {
@@ -62,14 +125,31 @@ type latchableSender interface {
 	LatchedHistogram(string, LatchedHistogram, ...string)
 }
 
+// flushingSender is implemented by senders that buffer stats. The
+// latchingSender flushes its underlying sender after completing
+// windows.
+type flushingSender interface {
+	// Flush sends any buffered stats.
+	Flush()
+}
+
 // newLatchingSender constructs an xstats Sender instance that latches
 // stats. For each counter, it periodically emits a single value
 // containing the count for the entire period. For each gauge, it
-// emits the last value seen during the period. For timings and
+// emits the last value seen during the period, or other aggregations
+// of the values for gauges whose names match a pattern (see
+// latchGaugeAggregations). For timings and
 // histogram values it computes a bucketed histogram over the window
-// and emits the bucketed values, a total sum, a total count, a
-// minimum value, and a maximum value. Stats are considered equivalent
-// when they have the same type, name, and tags.
+// and emits the bucketed values, the number of values exceeding the
+// largest bucket, a total sum, a total count, a minimum value, and a
+// maximum value. Stats are considered equivalent when they have the
+// same type, name, and tags. By default, histogram buckets have
+// exponentially increasing upper bounds (see latchBuckets). The
+// bounds may be changed for all histograms or for histograms whose
+// names match a pattern (see latchBucketLimits and
+// latchBucketOverrides). If the underlying sender does not accept
+// latched histograms, configured quantiles are estimated for each
+// histogram and emitted as gauges (see latchQuantiles).
 //
 // The latching Sender implementation uses TimestampTag to allow
 // provision of explicit timestamps. Timestamps are expected to be
@@ -77,28 +157,74 @@ type latchableSender interface {
 // underlying sender may not be able to store data with the given
 // timestamp (and may pass it on as a tag).
 //
+// Counts, histogram values and timings carrying a SampleRateTag (see
+// newSamplingSender) are scaled by the inverse of the sample rate, so
+// that the latched values estimate the unsampled values. Counts are
+// accumulated as float64 values, so fractional counts and scaled
+// sampled counts are not truncated.
+//
 // At the end of each latching period, a gauge named "latched_at" is
 // emitted with the latch time in seconds.
+//
+// Stats are latched into the window containing their timestamp. By
+// default only the most recent window is open, and it is completed
+// when a stat arrives for a later window. More windows may be kept
+// open to accommodate out-of-order stats (see latchOpenWindows).
+// Stats timestamped before the oldest open window are too late to be
+// latched. By default, they are forwarded to the underlying sender,
+// but they may be dropped instead (see latchLatePolicy). Either way,
+// their number is emitted as a count named "latched_late" with the
+// window in which they arrived.
+//
+// By default, counters are reset at the end of each window, so that
+// each window's value is the sum of the counts in that window. With
+// latchCumulative, counters instead emit the sum of all counts since
+// the counter's start, which is given by a StartTimestampTag.
+//
+// The number of series (distinct stat types, names and tags) latched
+// in a window may be limited (see latchMaxSeries and
+// latchMaxNodeSeries). Stats that would exceed a limit are dropped or
+// collapsed (see latchSeriesOverflow), and their number is emitted as
+// a count named "latched_rejected".
+//
+// Optionally, latched stats are journaled to disk until their windows
+// are completed, so that they survive a restart (see
+// latchJournalDir).
+//
+// By default, a window is completed only when a stat arrives for a
+// later window or when the Sender is closed. With latchBackgroundFlush,
+// windows are also completed on a timer, so that stats from quiet
+// nodes are emitted promptly.
 func newLatchingSender(
 	underlying xstatsSender,
 	c cleaner,
 	options ...latchingSenderOption,
 ) xstatsSender {
 	s := &latchingSender{
-		lock:                &sync.Mutex{},
-		underlying:          underlying,
-		cleaner:             c,
-		latchWindow:         DefaultLatchWindow,
-		numHistogramBuckets: DefaultHistogramNumBuckets,
-		baseHistogramValue:  DefaultHistogramBaseValue,
-		timeSource:          tbntime.NewSource(),
-		latchingNodes:       map[string]*latchingNode{},
+		lock:            &sync.Mutex{},
+		underlying:      underlying,
+		cleaner:         c,
+		latchWindow:     DefaultLatchWindow,
+		openWindows:     DefaultLatchOpenWindows,
+		latePolicy:      lateStatForward,
+		seriesOverflow:  seriesOverflowCollapse,
+		histogramLimits: exponentialBuckets(DefaultHistogramBaseValue, DefaultHistogramNumBuckets),
+		timeSource:      tbntime.NewSource(),
+		latchingNodes:   map[string]*latchingNode{},
 	}
 
 	for _, opt := range options {
 		opt(s)
 	}
 
+	if s.journalDir != "" {
+		s.openJournal()
+	}
+
+	if s.backgroundFlush {
+		s.flusher = newLatchFlusher(s)
+	}
+
 	return s
 }
 
@@ -118,9 +244,127 @@ func latchWindow(d time.Duration) latchingSenderOption {
 // latchBuckets controls generation of histograms. Each bucket of the histogram has
 // an upper bound of 2^N * baseValue where N is in the range [0, numBuckets).
 func latchBuckets(baseValue float64, numBuckets int) latchingSenderOption {
+	return latchBucketLimits(exponentialBuckets(baseValue, numBuckets))
+}
+
+// latchBucketLimits sets the upper bounds of the buckets of each
+// histogram. The limits must be in increasing order. Values greater
+// than the last limit are counted in an overflow bucket.
+func latchBucketLimits(limits []float64) latchingSenderOption {
 	return func(f *latchingSender) {
-		f.baseHistogramValue = baseValue
-		f.numHistogramBuckets = numBuckets
+		f.histogramLimits = limits
+	}
+}
+
+// latchBucketOverrides sets the upper bounds of the buckets of
+// histograms whose names match a pattern. The first matching override
+// is used. Histograms matching no override use the default limits.
+func latchBucketOverrides(overrides []bucketOverride) latchingSenderOption {
+	return func(f *latchingSender) {
+		f.bucketOverrides = overrides
+	}
+}
+
+// latchGaugeAggregations sets the aggregations used for gauges whose
+// names match a pattern. The first matching override is used. Gauges
+// matching no override emit their last value. If an override has a
+// single aggregation, its result is emitted with the gauge's name.
+// Otherwise, each result is emitted with the aggregation's name as a
+// suffix (e.g. "<stat>.max").
+func latchGaugeAggregations(overrides []gaugeAggregationOverride) latchingSenderOption {
+	return func(f *latchingSender) {
+		f.gaugeOverrides = overrides
+	}
+}
+
+// latchQuantiles sets the quantiles, each in the range (0, 1),
+// estimated for each histogram. At the end of each latching period,
+// each quantile is emitted as a gauge named for the histogram and the
+// quantile (e.g. "<stat>.p99" for 0.99). Quantiles are not estimated
+// if the underlying sender accepts latched histograms.
+func latchQuantiles(quantiles []float64) latchingSenderOption {
+	return func(f *latchingSender) {
+		f.quantiles = quantiles
+	}
+}
+
+// latchOpenWindows sets the number of most recent windows that accept
+// stats. A window is completed when a stat arrives for a window at
+// least n windows later. Must be at least 1.
+func latchOpenWindows(n int) latchingSenderOption {
+	return func(f *latchingSender) {
+		f.openWindows = n
+	}
+}
+
+// latchLatePolicy sets the handling of stats timestamped earlier than
+// the oldest open window.
+func latchLatePolicy(p lateStatPolicy) latchingSenderOption {
+	return func(f *latchingSender) {
+		f.latePolicy = p
+	}
+}
+
+// latchMaxSeries limits the number of series latched in each window,
+// across all nodes. Zero means no limit.
+func latchMaxSeries(n int) latchingSenderOption {
+	return func(f *latchingSender) {
+		f.maxSeries = n
+	}
+}
+
+// latchMaxNodeSeries limits the number of series latched for each
+// node in each window. Zero means no limit.
+func latchMaxNodeSeries(n int) latchingSenderOption {
+	return func(f *latchingSender) {
+		f.maxNodeSeries = n
+	}
+}
+
+// latchSeriesOverflow sets the handling of stats that would exceed a
+// series limit.
+func latchSeriesOverflow(p seriesOverflowPolicy) latchingSenderOption {
+	return func(f *latchingSender) {
+		f.seriesOverflow = p
+	}
+}
+
+// latchCumulative causes counters to be emitted as cumulative values:
+// the sum of all counts since the counter was first latched. Each
+// cumulative counter carries a StartTimestampTag with its start time
+// in milliseconds since the Unix epoch. A cumulative counter is
+// emitted with each completed window until staleAfter has elapsed
+// since the last window in which it was counted, after which it is
+// forgotten and restarted if counted again. Live cumulative counters
+// are subject to the series limits (see latchMaxSeries and
+// latchMaxNodeSeries): a counter that would exceed a limit is not
+// started and is handled according to latchSeriesOverflow.
+func latchCumulative(staleAfter time.Duration) latchingSenderOption {
+	return func(f *latchingSender) {
+		f.cumulative = true
+		f.cumulativeStaleAfter = staleAfter
+	}
+}
+
+// latchJournalDir enables an on-disk journal of latched stats in the
+// given directory (see latchJournal). Stats journaled by a previous
+// sender using the same directory, but never emitted, are replayed
+// into their windows when the sender is created.
+func latchJournalDir(dir string) latchingSenderOption {
+	return func(f *latchingSender) {
+		f.journalDir = dir
+	}
+}
+
+// latchBackgroundFlush causes windows to be completed by a background
+// goroutine once the given grace period has elapsed after the end of
+// the window. Until then, stats timestamped within the window
+// continue to be latched in it, unless it was completed early because
+// stats arrived for a later window (see latchOpenWindows).
+func latchBackgroundFlush(gracePeriod time.Duration) latchingSenderOption {
+	return func(f *latchingSender) {
+		f.backgroundFlush = true
+		f.gracePeriod = gracePeriod
 	}
 }
 
@@ -133,86 +377,462 @@ func timeSource(src tbntime.Source) latchingSenderOption {
 }
 
 type latchingSender struct {
-	lock                *sync.Mutex
-	underlying          xstatsSender
-	cleaner             cleaner
-	latchWindow         time.Duration
-	numHistogramBuckets int
-	baseHistogramValue  float64
-	timeSource          tbntime.Source
+	lock            *sync.Mutex
+	underlying      xstatsSender
+	cleaner         cleaner
+	latchWindow     time.Duration
+	openWindows     int
+	latePolicy      lateStatPolicy
+	maxSeries       int
+	maxNodeSeries   int
+	seriesOverflow  seriesOverflowPolicy
+	histogramLimits []float64
+
+	cumulative           bool
+	cumulativeStaleAfter time.Duration
+
+	journalDir string
+	journal    *latchJournal
+	replaying  bool
+
+	bucketOverrides []bucketOverride
+	gaugeOverrides  []gaugeAggregationOverride
+	quantiles       []float64
+	backgroundFlush bool
+	gracePeriod     time.Duration
+	timeSource      tbntime.Source
+	flusher         *latchFlusher
 
 	latchingNodes map[string]*latchingNode
+
+	// seriesLock protects windowSeries, which counts the series
+	// latched in each window across all nodes when maxSeries is set,
+	// and cumulativeSeries, which counts the live cumulative counters
+	// across all nodes
+	seriesLock       sync.Mutex
+	windowSeries     map[time.Time]int
+	cumulativeSeries int
 }
 
 type latchingNode struct {
 	lock *sync.Mutex
+	tag  string
+
+	// windows contains the open windows, oldest first
+	windows []*latchingWindow
+
+	// horizon is the start of the oldest window that may accept
+	// stats; stats timestamped earlier are late
+	horizon time.Time
+
+	// late is the number of late stats since the last window was
+	// completed
+	late int64
+
+	// rejected is the number of stats rejected due to series limits
+	// since the last window was completed
+	rejected int64
 
+	// cumulative contains the node's live cumulative counters, if
+	// the sender emits cumulative counters
+	cumulative map[string]*cumulativeCounter
+}
+
+// cumulativeCounter is a counter that accumulates across windows.
+type cumulativeCounter struct {
+	counter
+	start   time.Time
+	updated time.Time
+}
+
+type latchingWindow struct {
 	latchStart time.Time
+	journal    *os.File
+	series     int
 	counters   map[string]*counter
 	gauges     map[string]*gauge
 	histograms map[string]*histogram
 }
 
+func newLatchingWindow(latchStart time.Time) *latchingWindow {
+	return &latchingWindow{
+		latchStart: latchStart,
+		counters:   map[string]*counter{},
+		gauges:     map[string]*gauge{},
+		histograms: map[string]*histogram{},
+	}
+}
+
 func (s *latchingSender) Count(stat string, count float64, tags ...string) {
-	latchingNode, statID, latchedTags := s.prepareLatch(stat, tags)
+	rate, _, tags := splitSampleRate(tags, s.cleaner.tagDelim)
+	if rate < 1.0 {
+		count /= rate
+	}
+
+	latchingNode, window, statID, latchedTags := s.prepareLatch(stat, tags)
 	defer latchingNode.lock.Unlock()
 
-	c := latchingNode.counters[statID]
+	if window == nil {
+		if s.latePolicy == lateStatForward {
+			s.underlying.Count(stat, count, latchedTags...)
+		}
+		return
+	}
+
+	c := window.counters[statID]
 	if c == nil {
-		c = &counter{
-			stat: stat,
-			tags: latchedTags,
+		var ok bool
+		statID, latchedTags, ok = s.admitSeries(
+			latchingNode,
+			window,
+			stat,
+			latchedTags,
+			func(id string) bool { return window.counters[id] != nil },
+		)
+		if !ok {
+			return
+		}
+
+		c = window.counters[statID]
+		if c == nil {
+			c = &counter{
+				stat: stat,
+				tags: latchedTags,
+			}
+			window.counters[statID] = c
 		}
-		latchingNode.counters[statID] = c
 	}
 
-	c.add(int64(count))
+	c.add(count)
+	s.journalStat(latchingNode, window, journalEntry{
+		Type:  journalCount,
+		Stat:  stat,
+		Value: count,
+		Tags:  latchedTags,
+	})
 }
 
 func (s *latchingSender) Gauge(stat string, value float64, tags ...string) {
-	latchingNode, statID, latchedTags := s.prepareLatch(stat, tags)
+	latchingNode, window, statID, latchedTags := s.prepareLatch(stat, tags)
 	defer latchingNode.lock.Unlock()
 
-	g := latchingNode.gauges[statID]
+	if window == nil {
+		if s.latePolicy == lateStatForward {
+			s.underlying.Gauge(stat, value, latchedTags...)
+		}
+		return
+	}
+
+	g := window.gauges[statID]
 	if g == nil {
-		g = &gauge{
-			stat: stat,
-			tags: latchedTags,
+		var ok bool
+		statID, latchedTags, ok = s.admitSeries(
+			latchingNode,
+			window,
+			stat,
+			latchedTags,
+			func(id string) bool { return window.gauges[id] != nil },
+		)
+		if !ok {
+			return
+		}
+
+		g = window.gauges[statID]
+		if g == nil {
+			g = &gauge{
+				stat:         stat,
+				tags:         latchedTags,
+				aggregations: s.gaugeAggregations(stat),
+			}
+			window.gauges[statID] = g
 		}
-		latchingNode.gauges[statID] = g
 	}
 
 	g.set(value)
+	s.journalStat(latchingNode, window, journalEntry{
+		Type:  journalGauge,
+		Stat:  stat,
+		Value: value,
+		Tags:  latchedTags,
+	})
 }
 
 func (s *latchingSender) Histogram(stat string, value float64, tags ...string) {
-	latchingNode, statID, latchedTags := s.prepareLatch(stat, tags)
+	rate, _, tags := splitSampleRate(tags, s.cleaner.tagDelim)
+
+	latchingNode, window, statID, latchedTags := s.prepareLatch(stat, tags)
 	defer latchingNode.lock.Unlock()
 
-	h := latchingNode.histograms[statID]
+	if window == nil {
+		if s.latePolicy == lateStatForward {
+			if rate < 1.0 {
+				latchedTags = append(latchedTags, sampleRateTagString(rate, s.cleaner.tagDelim))
+			}
+			s.underlying.Histogram(stat, value, latchedTags...)
+		}
+		return
+	}
+
+	h := window.histograms[statID]
 	if h == nil {
-		h = &histogram{
-			stat:    stat,
-			tags:    latchedTags,
-			buckets: make([]int64, s.numHistogramBuckets),
+		var ok bool
+		statID, latchedTags, ok = s.admitSeries(
+			latchingNode,
+			window,
+			stat,
+			latchedTags,
+			func(id string) bool { return window.histograms[id] != nil },
+		)
+		if !ok {
+			return
+		}
+
+		h = window.histograms[statID]
+		if h == nil {
+			h = newHistogram(stat, latchedTags, s.limits(stat))
+			if len(s.quantiles) > 0 && !s.latchable() {
+				h.trackQuantiles(s.quantiles)
+			}
+			window.histograms[statID] = h
+		}
+	}
+
+	weight := sampleWeight(rate)
+	h.addN(value, weight)
+	s.journalStat(latchingNode, window, journalEntry{
+		Type:   journalHistogram,
+		Stat:   stat,
+		Value:  value,
+		Weight: weight,
+		Tags:   latchedTags,
+	})
+}
+
+// journalStat records a latched stat in the journal, if any.
+func (s *latchingSender) journalStat(node *latchingNode, window *latchingWindow, e journalEntry) {
+	if s.journal != nil && !s.replaying {
+		s.journal.append(window, node.tag, e)
+	}
+}
+
+// openJournal opens the journal and replays stats journaled by a
+// previous sender. Failures are logged and disable the journal.
+func (s *latchingSender) openJournal() {
+	journal, err := newLatchJournal(s.journalDir)
+	if err != nil {
+		console.Error().Printf("could not open stats journal: %s", err)
+		return
+	}
+	s.journal = journal
+
+	s.replaying = true
+	defer func() { s.replaying = false }()
+
+	err = journal.replay(func(e journalEntry) {
+		tags := append(
+			e.Tags[:len(e.Tags):len(e.Tags)],
+			TimestampTag+s.cleaner.tagDelim+strconv.FormatInt(e.Timestamp, 10),
+		)
+
+		switch e.Type {
+		case journalCount:
+			s.Count(e.Stat, e.Value, tags...)
+		case journalGauge:
+			s.Gauge(e.Stat, e.Value, tags...)
+		case journalHistogram:
+			if e.Weight > 1 {
+				tags = append(tags, sampleRateTagString(1.0/e.Weight, s.cleaner.tagDelim))
+			}
+			s.Histogram(e.Stat, e.Value, tags...)
+		}
+	})
+	if err != nil {
+		console.Error().Printf("could not replay stats journal: %s", err)
+	}
+}
+
+// admitSeries is invoked before a new series is latched in a window.
+// It returns the ID and tags of the series in which the stat should
+// be latched, or false if the stat is rejected. If the new series
+// would exceed a series limit, the stat is rejected or, if the series
+// overflow policy is seriesOverflowCollapse, latched in a collapsed
+// series. The exists function reports whether a series with the given
+// ID is already latched in the window.
+func (s *latchingSender) admitSeries(
+	node *latchingNode,
+	window *latchingWindow,
+	stat string,
+	tags []string,
+	exists func(string) bool,
+) (string, []string, bool) {
+	if s.reserveSeries(window, false) {
+		return s.seriesID(stat, tags), tags, true
+	}
+
+	node.rejected++
+	if s.seriesOverflow != seriesOverflowCollapse {
+		return "", nil, false
+	}
+
+	tags = s.collapsedTags(tags)
+	id := s.seriesID(stat, tags)
+	if !exists(id) {
+		s.reserveSeries(window, true)
+	}
+	return id, tags, true
+}
+
+// reserveSeries counts a new series in the window, returning false
+// if doing so would exceed a series limit, unless force is true.
+func (s *latchingSender) reserveSeries(window *latchingWindow, force bool) bool {
+	if !force && s.maxNodeSeries > 0 && window.series >= s.maxNodeSeries {
+		return false
+	}
+
+	if s.maxSeries > 0 {
+		s.seriesLock.Lock()
+		defer s.seriesLock.Unlock()
+
+		if !force && s.windowSeries[window.latchStart] >= s.maxSeries {
+			return false
+		}
+
+		if s.windowSeries == nil {
+			s.windowSeries = map[time.Time]int{}
 		}
-		latchingNode.histograms[statID] = h
+		s.windowSeries[window.latchStart]++
 	}
 
-	h.add(value, s.baseHistogramValue)
+	window.series++
+	return true
+}
+
+// releaseSeries stops counting the window's series.
+func (s *latchingSender) releaseSeries(window *latchingWindow) {
+	if s.maxSeries <= 0 || window.series == 0 {
+		return
+	}
+
+	s.seriesLock.Lock()
+	defer s.seriesLock.Unlock()
+
+	if n := s.windowSeries[window.latchStart] - window.series; n > 0 {
+		s.windowSeries[window.latchStart] = n
+	} else {
+		delete(s.windowSeries, window.latchStart)
+	}
+}
+
+// collapsedTags returns sorted tags with every value, other than
+// those of NodeTag, ProxyTag, ProxyVersionTag, SourceTag, and ZoneTag,
+// replaced by OtherTagValue.
+func (s *latchingSender) collapsedTags(tags []string) []string {
+	collapsed := make([]string, len(tags))
+	for i, tag := range tags {
+		k, _ := tbnstrings.Split2(tag, s.cleaner.tagDelim)
+		switch k {
+		case NodeTag, ProxyTag, ProxyVersionTag, SourceTag, ZoneTag:
+			collapsed[i] = tag
+		default:
+			collapsed[i] = k + s.cleaner.tagDelim + OtherTagValue
+		}
+	}
+	sort.Strings(collapsed)
+	return collapsed
+}
+
+// limits returns the histogram bucket limits for the given stat.
+func (s *latchingSender) limits(stat string) []float64 {
+	for _, o := range s.bucketOverrides {
+		if ok, _ := path.Match(o.pattern, stat); ok {
+			return o.limits
+		}
+	}
+	return s.histogramLimits
+}
+
+// gaugeAggregations returns the gauge aggregations for the given stat.
+func (s *latchingSender) gaugeAggregations(stat string) []gaugeAggregation {
+	for _, o := range s.gaugeOverrides {
+		if ok, _ := path.Match(o.pattern, stat); ok {
+			return o.aggregations
+		}
+	}
+	return defaultGaugeAggregations
+}
+
+// latchable returns true if the underlying sender accepts latched
+// histograms.
+func (s *latchingSender) latchable() bool {
+	_, ok := s.underlying.(latchableSender)
+	return ok
 }
 
 func (s *latchingSender) Timing(stat string, value time.Duration, tags ...string) {
 	s.Histogram(stat, value.Seconds(), tags...)
 }
 
+// Describe forwards the Descriptor to the underlying sender, if it
+// accepts Descriptors.
+func (s *latchingSender) Describe(d Descriptor) {
+	if ds, ok := s.underlying.(describingSender); ok {
+		ds.Describe(d)
+	}
+}
+
+// Distribution forwards the value to the underlying sender, if it
+// supports distributions. Distributions are aggregated by the
+// backend and are not latched. Otherwise, the value is latched as a
+// histogram.
+func (s *latchingSender) Distribution(stat string, value float64, tags ...string) {
+	if es, ok := s.underlying.(extendedSender); ok {
+		es.Distribution(stat, value, tags...)
+		return
+	}
+
+	s.Histogram(stat, value, tags...)
+}
+
+// Set forwards the value to the underlying sender, if it supports
+// sets.
+func (s *latchingSender) Set(stat string, value string, tags ...string) {
+	if es, ok := s.underlying.(extendedSender); ok {
+		es.Set(stat, value, tags...)
+	}
+}
+
+// ServiceCheck forwards the service check to the underlying sender,
+// if it supports service checks.
+func (s *latchingSender) ServiceCheck(
+	name string,
+	status ServiceCheckStatus,
+	message string,
+	tags ...string,
+) {
+	if es, ok := s.underlying.(extendedSender); ok {
+		es.ServiceCheck(name, status, message, tags...)
+	}
+}
+
+// Event forwards the event to the underlying sender, if it supports
+// events.
+func (s *latchingSender) Event(title string, fields []Field, tags ...string) {
+	if es, ok := s.underlying.(extendedSender); ok {
+		es.Event(title, fields, tags...)
+	}
+}
+
 func (s *latchingSender) Close() error {
+	if s.flusher != nil {
+		s.flusher.stop()
+	}
+
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
 	for nodeTag, latchingNode := range s.latchingNodes {
 		latchingNode.lock.Lock()
-		latchingNode.completeLatch(s.timeSource.Now(), nodeTag, s)
+		latchingNode.completeWindows(len(latchingNode.windows), nodeTag, s)
 		latchingNode.lock.Unlock()
 	}
 	s.latchingNodes = nil
@@ -220,23 +840,105 @@ func (s *latchingSender) Close() error {
 	return xstats.CloseSender(s.underlying)
 }
 
+// flushExpired completes each window that ended at least gracePeriod
+// before now. Only the node being completed is locked while its
+// windows are sent, so that stats for other nodes may be recorded
+// concurrently.
+func (s *latchingSender) flushExpired(now time.Time) {
+	s.lock.Lock()
+	nodes := make([]*latchingNode, 0, len(s.latchingNodes))
+	for _, node := range s.latchingNodes {
+		nodes = append(nodes, node)
+	}
+	s.lock.Unlock()
+
+	expiredStart := now.Add(-s.gracePeriod).Truncate(s.latchWindow)
+	for _, node := range nodes {
+		node.lock.Lock()
+		node.completeBefore(expiredStart, node.tag, s)
+		node.lock.Unlock()
+	}
+}
+
+// nextFlush returns the duration from now until the next window
+// plus the grace period has elapsed.
+func (s *latchingSender) nextFlush(now time.Time) time.Duration {
+	next := now.Truncate(s.latchWindow).Add(s.gracePeriod)
+	for !next.After(now) {
+		next = next.Add(s.latchWindow)
+	}
+	return next.Sub(now)
+}
+
+// latchFlusher periodically completes expired windows of a
+// latchingSender.
+type latchFlusher struct {
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func newLatchFlusher(s *latchingSender) *latchFlusher {
+	f := &latchFlusher{
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	// create the timer before starting the goroutine, so that its
+	// deadline is relative to the time of construction
+	timer := s.timeSource.NewTimer(s.nextFlush(s.timeSource.Now()))
+	go f.run(s, timer)
+
+	return f
+}
+
+func (f *latchFlusher) run(s *latchingSender, timer tbntime.Timer) {
+	defer close(f.stopped)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-f.done:
+			return
+
+		case <-timer.C():
+			now := s.timeSource.Now()
+			s.flushExpired(now)
+			timer.Reset(s.nextFlush(now))
+		}
+	}
+}
+
+// stop stops the flusher and waits for any flush in progress to
+// complete.
+func (f *latchFlusher) stop() {
+	f.once.Do(func() {
+		close(f.done)
+		<-f.stopped
+	})
+}
+
 func (s *latchingSender) latchingNode(nodeTag string) *latchingNode {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
 	node := s.latchingNodes[nodeTag]
 	if node == nil {
-		node = &latchingNode{lock: &sync.Mutex{}}
+		node = &latchingNode{lock: &sync.Mutex{}, tag: nodeTag}
 		s.latchingNodes[nodeTag] = node
 	}
 
 	return node
 }
 
+// prepareLatch locks and returns the latchingNode and open window for
+// the given stat, completing windows as necessary. If the stat is
+// too late to be latched, the returned window is nil and the returned
+// tags include the stat's timestamp.
 func (s *latchingSender) prepareLatch(
 	stat string,
 	tags []string,
-) (*latchingNode, string, []string) {
+) (*latchingNode, *latchingWindow, string, []string) {
 	var (
 		nodeTag string
 		ts      *time.Time
@@ -246,6 +948,20 @@ func (s *latchingSender) prepareLatch(
 		ts = ptr.Time(s.timeSource.Now())
 	}
 
+	node := s.latchingNode(nodeTag)
+	node.lock.Lock()
+
+	window := node.window(ts.Truncate(s.latchWindow), nodeTag, s)
+	if window == nil {
+		node.late++
+		return node, nil, "", append(tags, s.cleaner.tagToString(timestampTag(*ts)))
+	}
+
+	return node, window, s.seriesID(stat, tags), tags
+}
+
+// seriesID returns an ID for the stat name and sorted tags.
+func (s *latchingSender) seriesID(stat string, tags []string) string {
 	hasher := md5.New()
 	hasher.Write([]byte(stat))
 
@@ -253,105 +969,294 @@ func (s *latchingSender) prepareLatch(
 		hasher.Write([]byte{'|'})
 		hasher.Write([]byte(tag))
 	}
-	id := string(hasher.Sum(make([]byte, 0, md5.Size)))
+	return string(hasher.Sum(make([]byte, 0, md5.Size)))
+}
 
-	node := s.latchingNode(nodeTag)
-	node.lock.Lock()
+func (s *latchingSender) stat(stat, suffix string) string {
+	return fmt.Sprintf("%s%s%s", stat, s.cleaner.scopeDelim, suffix)
+}
 
-	newStart := ts.Truncate(s.latchWindow)
-	if !newStart.Equal(node.latchStart) {
-		if node.latchStart.IsZero() {
-			node.completeLatch(newStart, nodeTag, s)
-		} else {
-			nextStart := node.latchStart.Add(s.latchWindow)
-			for nextStart.Before(newStart) || nextStart.Equal(newStart) {
-				node.completeLatch(nextStart, nodeTag, s)
-				nextStart = nextStart.Add(s.latchWindow)
-			}
+// window returns the open window starting at latchStart, opening it
+// if necessary. Opening a window completes windows that are no longer
+// among the s.openWindows most recent. Returns nil if latchStart is
+// before the horizon.
+func (n *latchingNode) window(
+	latchStart time.Time,
+	nodeTag string,
+	s *latchingSender,
+) *latchingWindow {
+	if latchStart.Before(n.horizon) {
+		return nil
+	}
+
+	idx := sort.Search(len(n.windows), func(i int) bool {
+		return !n.windows[i].latchStart.Before(latchStart)
+	})
+	if idx < len(n.windows) && n.windows[idx].latchStart.Equal(latchStart) {
+		return n.windows[idx]
+	}
+
+	w := newLatchingWindow(latchStart)
+	n.windows = append(n.windows, nil)
+	copy(n.windows[idx+1:], n.windows[idx:])
+	n.windows[idx] = w
+
+	if idx == len(n.windows)-1 {
+		// a new most recent window
+		openWindows := s.openWindows
+		if openWindows < 1 {
+			openWindows = 1
 		}
+		horizon := latchStart.Add(-time.Duration(openWindows-1) * s.latchWindow)
+		n.completeBefore(horizon, nodeTag, s)
 	}
 
-	return node, id, tags
+	return w
 }
 
-func (s *latchingSender) stat(stat, suffix string) string {
-	return fmt.Sprintf("%s%s%s", stat, s.cleaner.scopeDelim, suffix)
+// completeBefore completes the open windows starting before horizon
+// and advances the node's horizon.
+func (n *latchingNode) completeBefore(horizon time.Time, nodeTag string, s *latchingSender) {
+	if !horizon.After(n.horizon) {
+		return
+	}
+	n.horizon = horizon
+
+	num := sort.Search(len(n.windows), func(i int) bool {
+		return !n.windows[i].latchStart.Before(horizon)
+	})
+	n.completeWindows(num, nodeTag, s)
 }
 
-// Complete the current latch window by:
+// completeWindows completes the oldest num open windows.
+func (n *latchingNode) completeWindows(num int, nodeTag string, s *latchingSender) {
+	for _, w := range n.windows[:num] {
+		w.complete(n, nodeTag, s)
+		s.releaseSeries(w)
+		if s.journal != nil {
+			s.journal.remove(w, nodeTag)
+		}
+	}
+	n.windows = n.windows[num:]
+
+	if fs, ok := s.underlying.(flushingSender); ok && num > 0 {
+		fs.Flush()
+	}
+}
+
+// Complete the window by:
 // 1. Computing results for all stats in the window,
-// 2. Generating a latched_at gauge, and
-// 3. Sending all stats metrics via the underlying Stats. Initializes
-//    the next latch window with the given time.
-func (n *latchingNode) completeLatch(nextLatchStart time.Time, nodeTag string, s *latchingSender) {
+// 2. Generating a latched_at gauge and, if any stats arrived too late
+//    to be latched or were rejected due to series limits, latched_late
+//    and latched_rejected counts, and
+// 3. Sending all stats metrics via the underlying Stats.
+func (w *latchingWindow) complete(n *latchingNode, nodeTag string, s *latchingSender) {
 	sent := 0
-	for _, c := range n.counters {
-		s.underlying.Count(c.stat, float64(c.value), n.tagsWithTimestamp(s, c.tags)...)
-		sent++
+	if s.cumulative {
+		sent += n.completeCumulative(w, s)
+	} else {
+		for _, c := range w.counters {
+			s.underlying.Count(c.stat, c.value, w.tagsWithTimestamp(s, c.tags)...)
+			sent++
+		}
 	}
 
-	for _, g := range n.gauges {
-		s.underlying.Gauge(g.stat, g.value, n.tagsWithTimestamp(s, g.tags)...)
+	for _, g := range w.gauges {
+		tags := w.tagsWithTimestamp(s, g.tags)
+		if len(g.aggregations) == 1 {
+			s.underlying.Gauge(g.stat, g.aggregate(g.aggregations[0]), tags...)
+		} else {
+			for _, a := range g.aggregations {
+				s.underlying.Gauge(s.stat(g.stat, string(a)), g.aggregate(a), tags...)
+			}
+		}
 		sent++
 	}
 
 	if latchableSender, ok := s.underlying.(latchableSender); ok {
-		for _, h := range n.histograms {
-			tags := n.tagsWithTimestamp(s, h.tags)
-			latched := h.latch(s.baseHistogramValue)
+		for _, h := range w.histograms {
+			tags := w.tagsWithTimestamp(s, h.tags)
+			latched := h.latch()
 
 			latchableSender.LatchedHistogram(h.stat, latched, tags...)
 			sent++
 		}
 	} else {
-		for _, h := range n.histograms {
-			tags := n.tagsWithTimestamp(s, h.tags)
+		for _, h := range w.histograms {
+			tags := w.tagsWithTimestamp(s, h.tags)
 
-			baseValue := s.baseHistogramValue
-			total := int64(0)
-			for _, c := range h.buckets {
-				v := float64(c)
+			for i, c := range h.buckets {
 				s.underlying.Count(
-					s.stat(h.stat, strconv.FormatFloat(baseValue, 'g', -1, 64)),
-					v,
+					s.stat(h.stat, strconv.FormatFloat(h.limits[i], 'g', -1, 64)),
+					float64(c),
 					tags...,
 				)
-				baseValue = baseValue * 2.0
-				total += c
 			}
 
+			s.underlying.Count(s.stat(h.stat, "overflow"), float64(h.overflow), tags...)
 			s.underlying.Count(s.stat(h.stat, "count"), float64(h.count), tags...)
 			s.underlying.Count(s.stat(h.stat, "sum"), h.sum, tags...)
 			s.underlying.Gauge(s.stat(h.stat, "min"), h.min, tags...)
 			s.underlying.Gauge(s.stat(h.stat, "max"), h.max, tags...)
+			if h.stream != nil {
+				for _, q := range s.quantiles {
+					s.underlying.Gauge(s.stat(h.stat, quantileSuffix(q)), h.quantile(q), tags...)
+				}
+			}
 			sent++
 		}
 	}
 
+	var nodeTags []string
+	if nodeTag != "" {
+		nodeTags = []string{fmt.Sprintf("%s=%s", NodeTag, nodeTag)}
+	}
+
+	if n.late > 0 {
+		s.underlying.Count(
+			LatchedLateMetric,
+			float64(n.late),
+			w.tagsWithTimestamp(s, nodeTags)...,
+		)
+		n.late = 0
+		sent++
+	}
+
+	if n.rejected > 0 {
+		s.underlying.Count(
+			LatchedRejectedMetric,
+			float64(n.rejected),
+			w.tagsWithTimestamp(s, nodeTags)...,
+		)
+		n.rejected = 0
+		sent++
+	}
+
 	if sent > 0 {
-		var latchedAtTags []string
-		if nodeTag != "" {
-			latchedAtTags = []string{fmt.Sprintf("%s=%s", NodeTag, nodeTag)}
-		}
 		s.underlying.Gauge(
 			LatchedAtMetric,
-			float64(n.latchStart.Unix()),
-			n.tagsWithTimestamp(s, latchedAtTags)...,
+			float64(w.latchStart.Unix()),
+			w.tagsWithTimestamp(s, nodeTags)...,
 		)
 	}
+}
+
+// completeCumulative adds the window's counters to the node's
+// cumulative counters, forgets stale cumulative counters and emits
+// the rest. Returns the number of counters emitted.
+func (n *latchingNode) completeCumulative(w *latchingWindow, s *latchingSender) int {
+	if n.cumulative == nil {
+		n.cumulative = map[string]*cumulativeCounter{}
+	}
+
+	for id, c := range w.counters {
+		cc := n.cumulative[id]
+		if cc == nil {
+			if cc = n.startCumulative(id, c, w, s); cc == nil {
+				continue
+			}
+		}
+		cc.add(c.value)
+		cc.updated = w.latchStart
+	}
+
+	sent := 0
+	for id, cc := range n.cumulative {
+		if w.latchStart.Sub(cc.updated) >= s.cumulativeStaleAfter {
+			delete(n.cumulative, id)
+			s.releaseCumulativeSeries()
+			continue
+		}
 
-	n.latchStart = nextLatchStart
-	n.counters = map[string]*counter{}
-	n.gauges = map[string]*gauge{}
-	n.histograms = map[string]*histogram{}
+		tags := make([]string, 0, len(cc.tags)+2)
+		tags = append(tags, cc.tags...)
+		tags = append(
+			tags,
+			s.cleaner.tagToString(
+				NewKVTag(StartTimestampTag, strconv.FormatInt(tbntime.ToUnixMilli(cc.start), 10)),
+			),
+		)
+		s.underlying.Count(cc.stat, cc.value, w.tagsWithTimestamp(s, tags)...)
+		sent++
+	}
+
+	return sent
 }
 
-func (n *latchingNode) tagsWithTimestamp(s *latchingSender, tags []string) []string {
-	ts := tbntime.ToUnixMilli(n.latchStart)
-	return append(
-		tags,
-		s.cleaner.tagToString(NewKVTag(TimestampTag, strconv.FormatInt(ts, 10))),
-	)
+// startCumulative starts a cumulative counter for the window's
+// counter with the given ID. If the new counter would exceed a series
+// limit, the counter is rejected, returning nil, or, if the series
+// overflow policy is collapse, the counter with collapsed tags is
+// returned, starting it if necessary.
+func (n *latchingNode) startCumulative(
+	id string,
+	c *counter,
+	w *latchingWindow,
+	s *latchingSender,
+) *cumulativeCounter {
+	tags := c.tags
+	if !s.reserveCumulativeSeries(n, false) {
+		n.rejected++
+		if s.seriesOverflow != seriesOverflowCollapse {
+			return nil
+		}
+
+		tags = s.collapsedTags(tags)
+		id = s.seriesID(c.stat, tags)
+		if cc := n.cumulative[id]; cc != nil {
+			return cc
+		}
+		s.reserveCumulativeSeries(n, true)
+	}
+
+	cc := &cumulativeCounter{
+		counter: counter{stat: c.stat, tags: tags},
+		start:   w.latchStart,
+	}
+	n.cumulative[id] = cc
+	return cc
+}
+
+// reserveCumulativeSeries counts a new cumulative counter for the
+// node, returning false if doing so would exceed a series limit,
+// unless force is true.
+func (s *latchingSender) reserveCumulativeSeries(n *latchingNode, force bool) bool {
+	if !force && s.maxNodeSeries > 0 && len(n.cumulative) >= s.maxNodeSeries {
+		return false
+	}
+
+	if s.maxSeries > 0 {
+		s.seriesLock.Lock()
+		defer s.seriesLock.Unlock()
+
+		if !force && s.cumulativeSeries >= s.maxSeries {
+			return false
+		}
+		s.cumulativeSeries++
+	}
+
+	return true
+}
+
+// releaseCumulativeSeries stops counting a forgotten cumulative
+// counter.
+func (s *latchingSender) releaseCumulativeSeries() {
+	if s.maxSeries <= 0 {
+		return
+	}
+
+	s.seriesLock.Lock()
+	defer s.seriesLock.Unlock()
+	s.cumulativeSeries--
+}
+
+func (w *latchingWindow) tagsWithTimestamp(s *latchingSender, tags []string) []string {
+	return append(tags, s.cleaner.tagToString(timestampTag(w.latchStart)))
+}
+
+// timestampTag returns a TimestampTag for the given time.
+func timestampTag(t time.Time) Tag {
+	return NewKVTag(TimestampTag, strconv.FormatInt(tbntime.ToUnixMilli(t), 10))
 }
 
 // Returns sorted tags, with TimestampTag removed. If NodeTag is present, it's value
@@ -18,17 +18,36 @@ package stats
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	tbnflag "github.com/turbinelabs/nonstdlib/flag"
 )
 
 type latchingSenderFromFlags struct {
-	flagScope   string
-	enabled     bool
-	latchWindow time.Duration
-	minBucket   float64
-	numBuckets  int
+	flagScope       string
+	enabled         bool
+	latchWindow     time.Duration
+	minBucket       float64
+	numBuckets      int
+	bucketStrategy  string
+	bucketOverrides tbnflag.Strings
+	quantiles       tbnflag.Strings
+	gauges          tbnflag.Strings
+	backgroundFlush bool
+	gracePeriod     time.Duration
+	openWindows     int
+	latePolicy      string
+	maxSeries       int
+	maxNodeSeries   int
+	seriesOverflow  string
+	cumulative      bool
+	staleAfter      time.Duration
+	journalDir      string
+
+	// cumulativeSupported is set by backends that accept cumulative
+	// counters. Others sum the counts they receive as deltas.
+	cumulativeSupported bool
 }
 
 func newLatchingSenderFromFlags(
@@ -37,7 +56,12 @@ func newLatchingSenderFromFlags(
 ) *latchingSenderFromFlags {
 	scoped := fs.Scope("latch", "")
 
-	ff := &latchingSenderFromFlags{flagScope: scoped.GetScope()}
+	ff := &latchingSenderFromFlags{
+		flagScope:       scoped.GetScope(),
+		bucketOverrides: tbnflag.NewStrings(),
+		quantiles:       tbnflag.NewStrings(),
+		gauges:          tbnflag.NewStrings(),
+	}
 
 	fs.BoolVar(
 		&ff.enabled,
@@ -45,7 +69,6 @@ func newLatchingSenderFromFlags(
 		enableLatchingDefault,
 		"Specifies whether stats are accumulated over a window before being sent to the backend.",
 	)
-
 	scoped.DurationVar(
 		&ff.latchWindow,
 		"window",
@@ -64,6 +87,87 @@ func newLatchingSenderFromFlags(
 		DefaultHistogramNumBuckets,
 		"Specifies the number of buckets used for accumulating histograms. Must be greater than 1.",
 	)
+	scoped.StringVar(
+		&ff.bucketStrategy,
+		"bucket-strategy",
+		"",
+		"If specified, the strategy used to compute the upper bounds of the buckets used for accumulating histograms, overriding --{{PREFIX}}base-value and --{{PREFIX}}buckets. Values greater than the largest bound are accumulated in an overflow bucket. "+bucketStrategiesDesc,
+	)
+	scoped.Var(
+		&ff.bucketOverrides,
+		"bucket-overrides",
+		`Specifies bucket strategies for histograms whose names match a pattern, in the form "<pattern>=<strategy>" (e.g. "latency.*=log-linear:0.001:10:9"). Patterns apply to the full stat name, including any scope, and may use the wildcards supported by Go's path.Match function. The first matching pattern is used; histograms matching no pattern use the default buckets. May be comma-delimited or specified more than once.`,
+	)
+	scoped.Var(
+		&ff.quantiles,
+		"quantiles",
+		`Specifies quantiles, each greater than 0 and less than 1, estimated for each histogram and emitted as gauges at the end of each latch window. Gauges are named for the histogram and quantile (e.g. "<stat>.p99" for 0.99). Ignored by backends that accept latched histograms directly. May be comma-delimited or specified more than once.`,
+	)
+	scoped.Var(
+		&ff.gauges,
+		"gauge-aggregations",
+		`Specifies how the values of gauges whose names match a pattern are aggregated over each window, in the form "<pattern>=<aggregation>:<aggregation>..." (e.g. "queue.*=min:max:mean"). Aggregations are `+strings.Join(gaugeAggregations, ", ")+`. With a single aggregation, its result is sent using the gauge's name. With several, each result is sent with the aggregation as a suffix (e.g. "<stat>.max"). Patterns apply to the full stat name, including any scope, and may use the wildcards supported by Go's path.Match function. The first matching pattern is used; gauges matching no pattern send their last value. May be comma-delimited or specified more than once.`,
+	)
+	scoped.BoolVar(
+		&ff.cumulative,
+		"cumulative",
+		false,
+		"If true, counters are sent as cumulative values, the sum of all counts since the counter's start time, which is sent as the "+StartTimestampTag+" tag in milliseconds since the Unix epoch. Otherwise, counters are sent as the sum of the counts in each window. Only supported by the api backend; others sum counts as deltas.",
+	)
+	scoped.DurationVar(
+		&ff.staleAfter,
+		"cumulative-stale-after",
+		DefaultCumulativeStaleAfter,
+		"Specifies the period of time after which a cumulative counter that has not been incremented is no longer sent. If incremented again, the counter restarts from zero with a new start time. Must be greater than 0.",
+	)
+	scoped.StringVar(
+		&ff.journalDir,
+		"journal-dir",
+		"",
+		"If specified, latched stats are journaled to files in this directory until they are sent to the backend. Stats journaled but not sent before a crash are restored when the process restarts with the same directory. Each process must use its own directory.",
+	)
+	scoped.BoolVar(
+		&ff.backgroundFlush,
+		"background-flush",
+		false,
+		"If true, each window is flushed to the backend once --{{PREFIX}}grace-period has elapsed after the end of the window, even if no further stats are recorded. Otherwise, a window is flushed only when a stat is recorded in a later window or on shutdown.",
+	)
+	scoped.DurationVar(
+		&ff.gracePeriod,
+		"grace-period",
+		DefaultLatchGracePeriod,
+		"Specifies the period of time after the end of a window before it is flushed in the background, allowing late stats with explicit timestamps to be included. Must not be negative.",
+	)
+	scoped.IntVar(
+		&ff.openWindows,
+		"open-windows",
+		DefaultLatchOpenWindows,
+		"Specifies the number of most recent windows that accept stats with explicit timestamps. A window is flushed when a stat arrives for a window this many windows later. Must be at least 1.",
+	)
+	scoped.StringVar(
+		&ff.latePolicy,
+		"late-policy",
+		string(lateStatForward),
+		"Specifies how stats timestamped before the oldest open window are handled. One of "+strings.Join(lateStatPolicies, ", ")+". With forward, late stats are sent to the backend immediately, with their timestamps, without being latched. Either way, the number of late stats is reported as "+LatchedLateMetric+".",
+	)
+	scoped.IntVar(
+		&ff.maxSeries,
+		"max-series",
+		0,
+		"If greater than 0, specifies the maximum number of distinct stats, by type, name and tags, latched in each window across all nodes. With --{{PREFIX}}cumulative, also limits the number of live cumulative counters across all nodes. Stats exceeding the limit are handled according to --{{PREFIX}}series-overflow.",
+	)
+	scoped.IntVar(
+		&ff.maxNodeSeries,
+		"max-node-series",
+		0,
+		"If greater than 0, specifies the maximum number of distinct stats, by type, name and tags, latched in each window for each node. With --{{PREFIX}}cumulative, also limits the number of live cumulative counters for each node. Stats exceeding the limit are handled according to --{{PREFIX}}series-overflow.",
+	)
+	scoped.StringVar(
+		&ff.seriesOverflow,
+		"series-overflow",
+		string(seriesOverflowCollapse),
+		"Specifies how stats exceeding --{{PREFIX}}max-series or --{{PREFIX}}max-node-series are handled. One of "+strings.Join(seriesOverflowPolicies, ", ")+". With collapse, the stat's tag values, other than the node, proxy, proxy version, source, and zone tags, are replaced with "+OtherTagValue+". Either way, the number of such stats is reported as "+LatchedRejectedMetric+".",
+	)
 
 	return ff
 }
@@ -73,6 +177,53 @@ func (ff *latchingSenderFromFlags) Validate() error {
 		return fmt.Errorf("--%swindow must be greater than 0", ff.flagScope)
 	}
 
+	if ff.openWindows < 1 {
+		return fmt.Errorf("--%sopen-windows must be at least 1", ff.flagScope)
+	}
+
+	switch lateStatPolicy(ff.latePolicy) {
+	case lateStatDrop, lateStatForward:
+	default:
+		return fmt.Errorf(
+			"--%slate-policy must be one of %s",
+			ff.flagScope,
+			strings.Join(lateStatPolicies, ", "),
+		)
+	}
+
+	if ff.maxSeries < 0 {
+		return fmt.Errorf("--%smax-series must not be negative", ff.flagScope)
+	}
+
+	if ff.maxNodeSeries < 0 {
+		return fmt.Errorf("--%smax-node-series must not be negative", ff.flagScope)
+	}
+
+	switch seriesOverflowPolicy(ff.seriesOverflow) {
+	case seriesOverflowDrop, seriesOverflowCollapse:
+	default:
+		return fmt.Errorf(
+			"--%sseries-overflow must be one of %s",
+			ff.flagScope,
+			strings.Join(seriesOverflowPolicies, ", "),
+		)
+	}
+
+	if ff.cumulative && !ff.cumulativeSupported {
+		return fmt.Errorf(
+			"--%scumulative is not supported by this backend, which sums counts as deltas",
+			ff.flagScope,
+		)
+	}
+
+	if ff.cumulative && ff.staleAfter <= 0 {
+		return fmt.Errorf("--%scumulative-stale-after must be greater than 0", ff.flagScope)
+	}
+
+	if ff.gracePeriod < 0 {
+		return fmt.Errorf("--%sgrace-period must not be negative", ff.flagScope)
+	}
+
 	if ff.minBucket <= 0.0 {
 		return fmt.Errorf("--%sbase-value must be greater than 0", ff.flagScope)
 	}
@@ -81,18 +232,70 @@ func (ff *latchingSenderFromFlags) Validate() error {
 		return fmt.Errorf("--%sbuckets must be greater than 1", ff.flagScope)
 	}
 
+	if ff.bucketStrategy != "" {
+		if _, err := parseBucketStrategy(ff.bucketStrategy); err != nil {
+			return fmt.Errorf("--%sbucket-strategy invalid: %s", ff.flagScope, err.Error())
+		}
+	}
+
+	if _, err := parseBucketOverrides(ff.bucketOverrides.Strings); err != nil {
+		return fmt.Errorf("--%sbucket-overrides invalid: %s", ff.flagScope, err.Error())
+	}
+
+	if _, err := parseGaugeAggregations(ff.gauges.Strings); err != nil {
+		return fmt.Errorf("--%sgauge-aggregations invalid: %s", ff.flagScope, err.Error())
+	}
+
+	if _, err := parseQuantiles(ff.quantiles.Strings); err != nil {
+		return fmt.Errorf("--%squantiles invalid: %s", ff.flagScope, err.Error())
+	}
+
 	return nil
 }
 
 func (ff *latchingSenderFromFlags) Make(underlying xstatsSender, c cleaner) xstatsSender {
 	if ff.enabled {
-		return newLatchingSender(
-			underlying,
-			c,
+		// Validate guarantees the gauge aggregations and quantiles parse
+		limits, overrides := ff.histogramBuckets()
+		gauges, _ := parseGaugeAggregations(ff.gauges.Strings)
+		quantiles, _ := parseQuantiles(ff.quantiles.Strings)
+
+		options := []latchingSenderOption{
 			latchWindow(ff.latchWindow),
-			latchBuckets(ff.minBucket, ff.numBuckets),
-		)
+			latchOpenWindows(ff.openWindows),
+			latchLatePolicy(lateStatPolicy(ff.latePolicy)),
+			latchMaxSeries(ff.maxSeries),
+			latchMaxNodeSeries(ff.maxNodeSeries),
+			latchSeriesOverflow(seriesOverflowPolicy(ff.seriesOverflow)),
+			latchBucketLimits(limits),
+			latchBucketOverrides(overrides),
+			latchGaugeAggregations(gauges),
+			latchQuantiles(quantiles),
+		}
+		if ff.journalDir != "" {
+			options = append(options, latchJournalDir(ff.journalDir))
+		}
+		if ff.cumulative {
+			options = append(options, latchCumulative(ff.staleAfter))
+		}
+		if ff.backgroundFlush {
+			options = append(options, latchBackgroundFlush(ff.gracePeriod))
+		}
+
+		return newLatchingSender(underlying, c, options...)
 	}
 
 	return underlying
 }
+
+// histogramBuckets returns the default histogram bucket upper bounds
+// and the bucket overrides. Validate guarantees the strategy and
+// overrides parse.
+func (ff *latchingSenderFromFlags) histogramBuckets() ([]float64, []bucketOverride) {
+	limits := exponentialBuckets(ff.minBucket, ff.numBuckets)
+	if ff.bucketStrategy != "" {
+		limits, _ = parseBucketStrategy(ff.bucketStrategy)
+	}
+	overrides, _ := parseBucketOverrides(ff.bucketOverrides.Strings)
+	return limits, overrides
+}
@@ -29,11 +29,12 @@ import (
 )
 
 type testHistogram struct {
-	buckets []int64
-	count   int64
-	sum     float64
-	min     float64
-	max     float64
+	buckets  []int64
+	overflow int64
+	count    int64
+	sum      float64
+	min      float64
+	max      float64
 }
 
 var (
@@ -104,22 +105,41 @@ func TestNewLatchingSender(t *testing.T) {
 	assert.SameInstance(t, sImpl.underlying, underlying)
 	assert.NonNil(t, sImpl.lock)
 	assert.Equal(t, sImpl.latchWindow, DefaultLatchWindow)
-	assert.Equal(t, sImpl.numHistogramBuckets, DefaultHistogramNumBuckets)
-	assert.Equal(t, sImpl.baseHistogramValue, DefaultHistogramBaseValue)
+	assert.ArrayEqual(
+		t,
+		sImpl.histogramLimits,
+		exponentialBuckets(DefaultHistogramBaseValue, DefaultHistogramNumBuckets),
+	)
+	assert.Equal(t, len(sImpl.bucketOverrides), 0)
 	assert.NonNil(t, sImpl.timeSource)
 	assert.NonNil(t, sImpl.latchingNodes)
 
 	s = newLatchingSender(underlying, testCleaner, latchWindow(10*time.Second))
 	sImpl = s.(*latchingSender)
 	assert.Equal(t, sImpl.latchWindow, 10*time.Second)
-	assert.Equal(t, sImpl.numHistogramBuckets, DefaultHistogramNumBuckets)
-	assert.Equal(t, sImpl.baseHistogramValue, DefaultHistogramBaseValue)
+	assert.Equal(t, len(sImpl.histogramLimits), DefaultHistogramNumBuckets)
 
 	s = newLatchingSender(underlying, testCleaner, latchBuckets(1000000000.0, 5))
 	sImpl = s.(*latchingSender)
 	assert.Equal(t, sImpl.latchWindow, DefaultLatchWindow)
-	assert.Equal(t, sImpl.numHistogramBuckets, 5)
-	assert.Equal(t, sImpl.baseHistogramValue, 1000000000.0)
+	assert.ArrayEqual(
+		t,
+		sImpl.histogramLimits,
+		[]float64{1e9, 2e9, 4e9, 8e9, 16e9},
+	)
+
+	overrides := []bucketOverride{{pattern: "x.*", limits: []float64{1, 2}}}
+	s = newLatchingSender(
+		underlying,
+		testCleaner,
+		latchBucketLimits([]float64{1, 5, 10}),
+		latchBucketOverrides(overrides),
+	)
+	sImpl = s.(*latchingSender)
+	assert.ArrayEqual(t, sImpl.histogramLimits, []float64{1, 5, 10})
+	assert.DeepEqual(t, sImpl.bucketOverrides, overrides)
+	assert.ArrayEqual(t, sImpl.limits("x.y"), []float64{1, 2})
+	assert.ArrayEqual(t, sImpl.limits("y"), []float64{1, 5, 10})
 
 	tbntime.WithCurrentTimeFrozen(func(tc tbntime.ControlledSource) {
 		s := newLatchingSender(underlying, testCleaner, timeSource(tc))
@@ -347,12 +367,13 @@ func runHistogramLatchTestBase(
 			}
 
 			latchedHisto := LatchedHistogram{
-				BaseValue: DefaultHistogramBaseValue,
-				Buckets:   h.buckets,
-				Count:     h.count,
-				Sum:       h.sum,
-				Min:       h.min,
-				Max:       h.max,
+				Limits:   exponentialBuckets(DefaultHistogramBaseValue, len(h.buckets)),
+				Buckets:  h.buckets,
+				Overflow: h.overflow,
+				Count:    h.count,
+				Sum:      h.sum,
+				Min:      h.min,
+				Max:      h.max,
 			}
 
 			mock.EXPECT().LatchedHistogram(stat, latchedHisto, tags...)
@@ -377,6 +398,8 @@ func runHistogramLatchTestBase(
 				accum *= 2.0
 			}
 
+			mock.EXPECT().Count(fmt.Sprintf("%s.overflow", stat), float64(h.overflow), tags...)
+
 			mock.EXPECT().Count(fmt.Sprintf("%s.count", stat), float64(h.count), tags...)
 			mock.EXPECT().Count(fmt.Sprintf("%s.sum", stat), float64(h.sum), tags...)
 			mock.EXPECT().Gauge(fmt.Sprintf("%s.min", stat), float64(h.min), tags...)
@@ -627,3 +650,664 @@ func TestLatchingSenderLatchesOverMultipleNodes(t *testing.T) {
 		assert.Nil(t, s.(io.Closer).Close())
 	})
 }
+
+func TestLatchingSenderBucketOverrides(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	underlying := newMockXstatsSender(ctrl)
+
+	start := time.Now().Truncate(time.Second)
+	tags := []interface{}{
+		fmt.Sprintf("%s=%d", TimestampTag, tbntime.ToUnixMilli(start)),
+	}
+
+	underlying.EXPECT().Count("a.10", 1.0, tags...)
+	underlying.EXPECT().Count("a.20", 0.0, tags...)
+	underlying.EXPECT().Count("a.overflow", 2.0, tags...)
+	underlying.EXPECT().Count("a.count", 3.0, tags...)
+	underlying.EXPECT().Count("a.sum", 85.0, tags...)
+	underlying.EXPECT().Gauge("a.min", 5.0, tags...)
+	underlying.EXPECT().Gauge("a.max", 50.0, tags...)
+
+	underlying.EXPECT().Count("b.100", 1.0, tags...)
+	underlying.EXPECT().Count("b.overflow", 0.0, tags...)
+	underlying.EXPECT().Count("b.count", 1.0, tags...)
+	underlying.EXPECT().Count("b.sum", 5.0, tags...)
+	underlying.EXPECT().Gauge("b.min", 5.0, tags...)
+	underlying.EXPECT().Gauge("b.max", 5.0, tags...)
+
+	underlying.EXPECT().Gauge("latched_at", float64(start.Unix()), tags...)
+
+	tbntime.WithTimeAt(start, func(tc tbntime.ControlledSource) {
+		s := newLatchingSender(
+			underlying,
+			testCleaner,
+			latchWindow(time.Second),
+			latchBucketLimits([]float64{10, 20}),
+			latchBucketOverrides([]bucketOverride{{pattern: "b*", limits: []float64{100}}}),
+			timeSource(tc),
+		)
+
+		s.Histogram("a", 5)
+		s.Histogram("a", 30)
+		s.Histogram("a", 50)
+		s.Histogram("b", 5)
+
+		assert.Nil(t, s.(io.Closer).Close())
+	})
+}
+
+func TestLatchingSenderQuantiles(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	underlying := newMockXstatsSender(ctrl)
+
+	start := time.Now().Truncate(time.Second)
+	tags := []interface{}{
+		fmt.Sprintf("%s=%d", TimestampTag, tbntime.ToUnixMilli(start)),
+	}
+
+	underlying.EXPECT().Count("a.100", 100.0, tags...)
+	underlying.EXPECT().Count("a.overflow", 0.0, tags...)
+	underlying.EXPECT().Count("a.count", 100.0, tags...)
+	underlying.EXPECT().Count("a.sum", 5050.0, tags...)
+	underlying.EXPECT().Gauge("a.min", 1.0, tags...)
+	underlying.EXPECT().Gauge("a.max", 100.0, tags...)
+	underlying.EXPECT().Gauge("a.p50", 50.0, tags...)
+	underlying.EXPECT().Gauge("a.p99", 99.0, tags...)
+	underlying.EXPECT().Gauge("latched_at", float64(start.Unix()), tags...)
+
+	tbntime.WithTimeAt(start, func(tc tbntime.ControlledSource) {
+		s := newLatchingSender(
+			underlying,
+			testCleaner,
+			latchWindow(time.Second),
+			latchBucketLimits([]float64{100}),
+			latchQuantiles([]float64{0.5, 0.99}),
+			timeSource(tc),
+		)
+
+		for i := 1; i <= 100; i++ {
+			s.Histogram("a", float64(i))
+		}
+
+		assert.Nil(t, s.(io.Closer).Close())
+	})
+}
+
+func TestLatchingSenderQuantilesIgnoredForLatchableSender(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	underlying := newMockLatchableSender(ctrl)
+
+	s := newLatchingSender(
+		underlying,
+		testCleaner,
+		latchQuantiles([]float64{0.5}),
+	).(*latchingSender)
+
+	s.Histogram("a", 1.0)
+	for _, node := range s.latchingNodes {
+		for _, w := range node.windows {
+			for _, h := range w.histograms {
+				assert.Nil(t, h.stream)
+			}
+		}
+	}
+
+	underlying.EXPECT().LatchedHistogram("a", gomock.Any(), gomock.Any())
+	underlying.EXPECT().Gauge("latched_at", gomock.Any(), gomock.Any())
+	assert.Nil(t, s.Close())
+}
+
+func TestLatchingSenderNextFlush(t *testing.T) {
+	s := &latchingSender{latchWindow: time.Minute, gracePeriod: 5 * time.Second}
+
+	start := time.Unix(1500000000, 0).Truncate(time.Minute)
+	assert.Equal(t, s.nextFlush(start), 5*time.Second)
+	assert.Equal(t, s.nextFlush(start.Add(5*time.Second)), time.Minute)
+	assert.Equal(t, s.nextFlush(start.Add(10*time.Second)), 55*time.Second)
+
+	s.gracePeriod = 0
+	assert.Equal(t, s.nextFlush(start), time.Minute)
+	assert.Equal(t, s.nextFlush(start.Add(10*time.Second)), 50*time.Second)
+}
+
+func TestLatchingSenderBackgroundFlush(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	underlying := newMockXstatsSender(ctrl)
+
+	start := time.Unix(1500000000, 0).Truncate(time.Minute)
+	tags := []interface{}{
+		fmt.Sprintf("%s=%d", TimestampTag, tbntime.ToUnixMilli(start)),
+	}
+
+	tbntime.WithTimeAt(start, func(tc tbntime.ControlledSource) {
+		s := newLatchingSender(
+			underlying,
+			testCleaner,
+			latchWindow(time.Minute),
+			latchBackgroundFlush(5*time.Second),
+			timeSource(tc),
+		)
+
+		s.Count("a", 1.0)
+
+		// the window is held open during the grace period
+		tc.Advance(time.Minute)
+		s.Count("a", 2.0, fmt.Sprintf("%s=%d", TimestampTag, tbntime.ToUnixMilli(start)))
+
+		flushed := make(chan struct{})
+		gomock.InOrder(
+			underlying.EXPECT().Count("a", 3.0, tags...),
+			underlying.EXPECT().
+				Gauge("latched_at", float64(start.Unix()), tags...).
+				Do(func(string, float64, ...string) { close(flushed) }),
+		)
+
+		tc.Advance(5 * time.Second)
+		<-flushed
+
+		// quiet windows produce no stats; the next window is
+		// flushed without further stats
+		s.Count("b", 1.0)
+
+		nextTags := []interface{}{
+			fmt.Sprintf("%s=%d", TimestampTag, tbntime.ToUnixMilli(start.Add(time.Minute))),
+		}
+		flushed = make(chan struct{})
+		gomock.InOrder(
+			underlying.EXPECT().Count("b", 1.0, nextTags...),
+			underlying.EXPECT().
+				Gauge("latched_at", float64(start.Add(time.Minute).Unix()), nextTags...).
+				Do(func(string, float64, ...string) { close(flushed) }),
+		)
+
+		tc.Advance(time.Minute)
+		<-flushed
+
+		assert.Nil(t, s.(io.Closer).Close())
+	})
+}
+
+func TestLatchingSenderFlushExpiredLocksEachNode(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	underlying := newMockXstatsSender(ctrl)
+
+	start := time.Unix(1500000000, 0).Truncate(time.Minute)
+
+	tbntime.WithTimeAt(start, func(tc tbntime.ControlledSource) {
+		s := newLatchingSender(
+			underlying,
+			testCleaner,
+			latchWindow(time.Minute),
+			timeSource(tc),
+		).(*latchingSender)
+
+		s.Count("a", 1.0, NodeTag+"=a")
+
+		blocked := make(chan struct{})
+		release := make(chan struct{})
+		gomock.InOrder(
+			underlying.EXPECT().Count("a", 1.0, gomock.Any()).Do(
+				func(string, float64, ...string) {
+					close(blocked)
+					<-release
+				},
+			),
+			underlying.EXPECT().Gauge("latched_at", float64(start.Unix()), gomock.Any()),
+		)
+
+		flushed := make(chan struct{})
+		go func() {
+			defer close(flushed)
+			s.flushExpired(start.Add(time.Minute))
+		}()
+
+		// stats for other nodes are recorded while node a is flushed
+		<-blocked
+		s.Count("b", 2.0, NodeTag+"=b")
+		close(release)
+		<-flushed
+
+		gomock.InOrder(
+			underlying.EXPECT().Count("b", 2.0, gomock.Any()),
+			underlying.EXPECT().Gauge("latched_at", float64(start.Unix()), gomock.Any()),
+		)
+		assert.Nil(t, s.Close())
+	})
+}
+
+func TestLatchingSenderOutOfOrderStats(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	underlying := newMockXstatsSender(ctrl)
+
+	start := time.Unix(1500000000, 0)
+	tsTag := func(n int) string {
+		return fmt.Sprintf(
+			"%s=%d",
+			TimestampTag,
+			tbntime.ToUnixMilli(start.Add(time.Duration(n)*time.Second)),
+		)
+	}
+
+	s := newLatchingSender(
+		underlying,
+		testCleaner,
+		latchWindow(time.Second),
+		latchOpenWindows(2),
+		latchLatePolicy(lateStatDrop),
+	)
+
+	s.Count("c", 1.0, tsTag(1))
+	s.Count("c", 2.0, tsTag(0))
+	s.Count("c", 3.0, tsTag(1))
+	s.Count("c", 4.0, tsTag(0))
+
+	// opening window 2 completes window 0
+	gomock.InOrder(
+		underlying.EXPECT().Count("c", 6.0, tsTag(0)),
+		underlying.EXPECT().Gauge("latched_at", float64(start.Unix()), tsTag(0)),
+	)
+	s.Count("c", 5.0, tsTag(2))
+
+	// window 0 is closed; window 1 remains open
+	s.Count("c", 6.0, tsTag(0))
+	s.Count("c", 7.0, tsTag(1))
+
+	gomock.InOrder(
+		underlying.EXPECT().Count("c", 11.0, tsTag(1)),
+		underlying.EXPECT().Count(LatchedLateMetric, 1.0, tsTag(1)),
+		underlying.EXPECT().Gauge("latched_at", float64(start.Unix()+1), tsTag(1)),
+		underlying.EXPECT().Count("c", 5.0, tsTag(2)),
+		underlying.EXPECT().Gauge("latched_at", float64(start.Unix()+2), tsTag(2)),
+	)
+	assert.Nil(t, s.(io.Closer).Close())
+}
+
+func TestLatchingSenderForwardsLateStats(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	underlying := newMockXstatsSender(ctrl)
+
+	start := time.Unix(1500000000, 0)
+	tsTag := func(n int) string {
+		return fmt.Sprintf(
+			"%s=%d",
+			TimestampTag,
+			tbntime.ToUnixMilli(start.Add(time.Duration(n)*time.Second)),
+		)
+	}
+	lateTag := fmt.Sprintf(
+		"%s=%d",
+		TimestampTag,
+		tbntime.ToUnixMilli(start.Add(500*time.Millisecond)),
+	)
+
+	s := newLatchingSender(
+		underlying,
+		testCleaner,
+		latchWindow(time.Second),
+		latchLatePolicy(lateStatForward),
+	)
+
+	s.Count("c", 1.0, tsTag(1))
+
+	underlying.EXPECT().Count("c", 2.0, "a=b", lateTag)
+	underlying.EXPECT().Gauge("g", 3.0, lateTag)
+	underlying.EXPECT().Histogram("h", 4.0, lateTag, SampleRateTag+"=0.5")
+	s.Count("c", 2.0, lateTag, "a=b")
+	s.Gauge("g", 3.0, lateTag)
+	s.Histogram("h", 4.0, lateTag, SampleRateTag+"=0.5")
+
+	gomock.InOrder(
+		underlying.EXPECT().Count("c", 1.0, tsTag(1)),
+		underlying.EXPECT().Count(LatchedLateMetric, 3.0, tsTag(1)),
+		underlying.EXPECT().Gauge("latched_at", float64(start.Unix()+1), tsTag(1)),
+	)
+	assert.Nil(t, s.(io.Closer).Close())
+}
+
+func TestLatchingSenderGaugeAggregations(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	underlying := newMockXstatsSender(ctrl)
+
+	start := time.Unix(1500000000, 0)
+	tsTag := fmt.Sprintf("%s=%d", TimestampTag, tbntime.ToUnixMilli(start))
+
+	s := newLatchingSender(
+		underlying,
+		testCleaner,
+		latchWindow(time.Second),
+		latchGaugeAggregations([]gaugeAggregationOverride{
+			{
+				pattern:      "queue.*",
+				aggregations: []gaugeAggregation{gaugeMin, gaugeMax, gaugeMean},
+			},
+			{
+				pattern:      "conns",
+				aggregations: []gaugeAggregation{gaugeSum},
+			},
+		}),
+	)
+
+	for _, v := range []float64{3, 1, 2} {
+		s.Gauge("queue.depth", v, tsTag)
+		s.Gauge("conns", v, tsTag)
+		s.Gauge("other", v, tsTag)
+	}
+
+	underlying.EXPECT().Gauge("queue.depth.min", 1.0, tsTag)
+	underlying.EXPECT().Gauge("queue.depth.max", 3.0, tsTag)
+	underlying.EXPECT().Gauge("queue.depth.mean", 2.0, tsTag)
+	underlying.EXPECT().Gauge("conns", 6.0, tsTag)
+	underlying.EXPECT().Gauge("other", 2.0, tsTag)
+	underlying.EXPECT().Gauge("latched_at", float64(start.Unix()), tsTag)
+
+	assert.Nil(t, s.(io.Closer).Close())
+}
+
+func TestLatchingSenderMaxNodeSeriesDrop(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	underlying := newMockXstatsSender(ctrl)
+
+	start := time.Unix(1500000000, 0)
+	tsTag := fmt.Sprintf("%s=%d", TimestampTag, tbntime.ToUnixMilli(start))
+
+	s := newLatchingSender(
+		underlying,
+		testCleaner,
+		latchWindow(time.Second),
+		latchMaxNodeSeries(2),
+		latchSeriesOverflow(seriesOverflowDrop),
+	)
+
+	node1 := NodeTag + "=1"
+	node2 := NodeTag + "=2"
+	for i := 0; i < 4; i++ {
+		id := fmt.Sprintf("id=%d", i)
+		s.Count("c", 1.0, tsTag, node1, id)
+		s.Count("c", 1.0, tsTag, node2, id)
+	}
+	// existing series are still latched
+	s.Count("c", 1.0, tsTag, node1, "id=0")
+
+	underlying.EXPECT().Count("c", 2.0, "id=0", node1, tsTag)
+	underlying.EXPECT().Count("c", 1.0, "id=1", node1, tsTag)
+	underlying.EXPECT().Count(LatchedRejectedMetric, 2.0, node1, tsTag)
+	underlying.EXPECT().Gauge("latched_at", float64(start.Unix()), node1, tsTag)
+	underlying.EXPECT().Count("c", 1.0, "id=0", node2, tsTag)
+	underlying.EXPECT().Count("c", 1.0, "id=1", node2, tsTag)
+	underlying.EXPECT().Count(LatchedRejectedMetric, 2.0, node2, tsTag)
+	underlying.EXPECT().Gauge("latched_at", float64(start.Unix()), node2, tsTag)
+
+	assert.Nil(t, s.(io.Closer).Close())
+}
+
+func TestLatchingSenderMaxSeriesCollapse(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	underlying := newMockXstatsSender(ctrl)
+
+	start := time.Unix(1500000000, 0)
+	tsTag := func(n int) string {
+		return fmt.Sprintf(
+			"%s=%d",
+			TimestampTag,
+			tbntime.ToUnixMilli(start.Add(time.Duration(n)*time.Second)),
+		)
+	}
+
+	s := newLatchingSender(
+		underlying,
+		testCleaner,
+		latchWindow(time.Second),
+		latchMaxSeries(2),
+	).(*latchingSender)
+
+	node1 := NodeTag + "=1"
+	node2 := NodeTag + "=2"
+	s.Count("c", 1.0, tsTag(0), node1, "id=1", "x=y")
+	s.Gauge("g", 1.0, tsTag(0), node2, "id=2")
+	s.Count("c", 1.0, tsTag(0), node1, "id=3", "x=y")
+	s.Count("c", 2.0, tsTag(0), node2, "id=4")
+	s.Count("c", 3.0, tsTag(0), node2, "id=5")
+	s.Gauge("g", 6.0, tsTag(0), node2, "id=6")
+	assert.Equal(t, s.windowSeries[start], 5)
+
+	other := "id=" + OtherTagValue
+	underlying.EXPECT().Count("c", 1.0, "id=1", node1, "x=y", tsTag(0))
+	underlying.EXPECT().Count("c", 1.0, other, node1, "x="+OtherTagValue, tsTag(0))
+	underlying.EXPECT().Count(LatchedRejectedMetric, 1.0, node1, tsTag(0))
+	underlying.EXPECT().Gauge("latched_at", float64(start.Unix()), node1, tsTag(0))
+
+	// the limit applies to each window
+	s.Count("c", 1.0, tsTag(1), node1, "id=7", "x=y")
+	assert.Equal(t, s.windowSeries[start], 3)
+	assert.Equal(t, s.windowSeries[start.Add(time.Second)], 1)
+
+	underlying.EXPECT().Gauge("g", 1.0, "id=2", node2, tsTag(0))
+	underlying.EXPECT().Count("c", 5.0, other, node2, tsTag(0))
+	underlying.EXPECT().Gauge("g", 6.0, other, node2, tsTag(0))
+	underlying.EXPECT().Count(LatchedRejectedMetric, 3.0, node2, tsTag(0))
+	underlying.EXPECT().Gauge("latched_at", float64(start.Unix()), node2, tsTag(0))
+	underlying.EXPECT().Count("c", 1.0, "id=7", node1, "x=y", tsTag(1))
+	underlying.EXPECT().Gauge("latched_at", float64(start.Unix()+1), node1, tsTag(1))
+
+	assert.Nil(t, s.Close())
+	assert.Equal(t, len(s.windowSeries), 0)
+}
+
+func TestLatchingSenderMaxSeriesCollapsePreservesOriginTags(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	underlying := newMockXstatsSender(ctrl)
+
+	start := time.Unix(1500000000, 0)
+	tsTag := fmt.Sprintf("%s=%d", TimestampTag, tbntime.ToUnixMilli(start))
+
+	s := newLatchingSender(
+		underlying,
+		testCleaner,
+		latchWindow(time.Second),
+		latchMaxSeries(1),
+	).(*latchingSender)
+
+	node := NodeTag + "=1"
+	proxy := ProxyTag + "=p"
+	proxyVersion := ProxyVersionTag + "=1.0"
+	source := SourceTag + "=s"
+	zone := ZoneTag + "=z"
+	s.Count("c", 1.0, tsTag, node, proxy, proxyVersion, source, zone, "id=1")
+	s.Count("c", 2.0, tsTag, node, proxy, proxyVersion, source, zone, "id=2")
+	s.Count("c", 3.0, tsTag, node, proxy, proxyVersion, source, zone, "id=3")
+
+	other := "id=" + OtherTagValue
+	underlying.EXPECT().Count("c", 1.0, "id=1", node, proxyVersion, proxy, source, zone, tsTag)
+	underlying.EXPECT().Count("c", 5.0, other, node, proxyVersion, proxy, source, zone, tsTag)
+	underlying.EXPECT().Count(LatchedRejectedMetric, 2.0, node, tsTag)
+	underlying.EXPECT().Gauge("latched_at", float64(start.Unix()), node, tsTag)
+
+	assert.Nil(t, s.Close())
+}
+
+func TestLatchingSenderCumulativeCounters(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	underlying := newMockXstatsSender(ctrl)
+
+	start := time.Unix(1500000000, 0)
+	tsTag := func(n int) string {
+		return fmt.Sprintf(
+			"%s=%d",
+			TimestampTag,
+			tbntime.ToUnixMilli(start.Add(time.Duration(n)*time.Second)),
+		)
+	}
+	startTag := func(n int) string {
+		return fmt.Sprintf(
+			"%s=%d",
+			StartTimestampTag,
+			tbntime.ToUnixMilli(start.Add(time.Duration(n)*time.Second)),
+		)
+	}
+	latchedAt := func(n int) {
+		underlying.EXPECT().Gauge("latched_at", float64(start.Unix()+int64(n)), tsTag(n))
+	}
+
+	s := newLatchingSender(
+		underlying,
+		testCleaner,
+		latchWindow(time.Second),
+		latchCumulative(2*time.Second),
+	)
+
+	s.Count("a", 1.0, tsTag(0))
+	s.Count("a", 0.5, tsTag(0))
+
+	underlying.EXPECT().Count("a", 1.5, startTag(0), tsTag(0))
+	latchedAt(0)
+	s.Count("a", 2.0, tsTag(1))
+	s.Count("b", 1.0, tsTag(1))
+
+	underlying.EXPECT().Count("a", 3.5, startTag(0), tsTag(1))
+	underlying.EXPECT().Count("b", 1.0, startTag(1), tsTag(1))
+	latchedAt(1)
+	s.Count("b", 1.0, tsTag(2))
+
+	// a is still live, but was not counted
+	underlying.EXPECT().Count("a", 3.5, startTag(0), tsTag(2))
+	underlying.EXPECT().Count("b", 2.0, startTag(1), tsTag(2))
+	latchedAt(2)
+	s.Count("b", 1.0, tsTag(3))
+
+	// a is stale and forgotten
+	underlying.EXPECT().Count("b", 3.0, startTag(1), tsTag(3))
+	latchedAt(3)
+	s.Count("a", 1.0, tsTag(4))
+
+	// a restarts
+	underlying.EXPECT().Count("a", 1.0, startTag(4), tsTag(4))
+	underlying.EXPECT().Count("b", 3.0, startTag(1), tsTag(4))
+	latchedAt(4)
+	assert.Nil(t, s.(io.Closer).Close())
+}
+
+func TestLatchingSenderCumulativeCountersSeriesLimit(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	underlying := newMockXstatsSender(ctrl)
+
+	start := time.Unix(1500000000, 0)
+	tsTag := func(n int) string {
+		return fmt.Sprintf(
+			"%s=%d",
+			TimestampTag,
+			tbntime.ToUnixMilli(start.Add(time.Duration(n)*time.Second)),
+		)
+	}
+	startTag := func(n int) string {
+		return fmt.Sprintf(
+			"%s=%d",
+			StartTimestampTag,
+			tbntime.ToUnixMilli(start.Add(time.Duration(n)*time.Second)),
+		)
+	}
+	latchedAt := func(n int) {
+		underlying.EXPECT().Gauge("latched_at", float64(start.Unix()+int64(n)), tsTag(n))
+	}
+
+	s := newLatchingSender(
+		underlying,
+		testCleaner,
+		latchWindow(time.Second),
+		latchCumulative(time.Minute),
+		latchMaxSeries(1),
+	).(*latchingSender)
+
+	other := "id=" + OtherTagValue
+
+	s.Count("a", 1.0, tsTag(0), "id=1")
+
+	underlying.EXPECT().Count("a", 1.0, "id=1", startTag(0), tsTag(0))
+	latchedAt(0)
+	s.Count("a", 2.0, tsTag(1), "id=2")
+
+	// each window admits a new series, but the live cumulative
+	// counters are also limited, so id=2 is collapsed
+	underlying.EXPECT().Count("a", 1.0, "id=1", startTag(0), tsTag(1))
+	underlying.EXPECT().Count("a", 2.0, other, startTag(1), tsTag(1))
+	underlying.EXPECT().Count(LatchedRejectedMetric, 1.0, tsTag(1))
+	latchedAt(1)
+	s.Count("a", 3.0, tsTag(2), "id=3")
+
+	underlying.EXPECT().Count("a", 1.0, "id=1", startTag(0), tsTag(2))
+	underlying.EXPECT().Count("a", 5.0, other, startTag(1), tsTag(2))
+	underlying.EXPECT().Count(LatchedRejectedMetric, 1.0, tsTag(2))
+	latchedAt(2)
+	assert.Nil(t, s.Close())
+
+	assert.Equal(t, s.cumulativeSeries, 2)
+}
+
+func TestLatchingSenderScalesSampledStats(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	underlying := newMockLatchableSender(ctrl)
+
+	start := time.Now().Truncate(time.Second)
+	tags := []interface{}{
+		fmt.Sprintf("%s=%d", TimestampTag, tbntime.ToUnixMilli(start)),
+	}
+
+	underlying.EXPECT().Count("c", 11.0, tags...)
+	underlying.EXPECT().LatchedHistogram(
+		"h",
+		LatchedHistogram{
+			Limits:  []float64{0.001, 0.002, 0.004, 0.008, 0.016},
+			Buckets: []int64{0, 0, 0, 4, 1},
+			Count:   5,
+			Sum:     0.005*4 + 0.012,
+			Min:     0.005,
+			Max:     0.012,
+		},
+		tags...,
+	)
+	underlying.EXPECT().Gauge("latched_at", float64(start.Unix()), tags...)
+
+	tbntime.WithTimeAt(start, func(tc tbntime.ControlledSource) {
+		s := newLatchingSender(
+			underlying,
+			testCleaner,
+			latchWindow(time.Second),
+			latchBuckets(0.001, 5),
+			timeSource(tc),
+		)
+
+		s.Count("c", 1, SampleRateTag+"=0.1")
+		s.Count("c", 1)
+		s.Histogram("h", 0.005, SampleRateTag+"=0.25")
+		s.Histogram("h", 0.012)
+
+		assert.Nil(t, s.(io.Closer).Close())
+	})
+}
@@ -100,11 +100,11 @@ func TestAPIStatsEqual(t *testing.T) {
 		scopeDelim:    "/",
 	}
 
-	x1a := &apiStats{newFromSender(sender1, testCleaner, "s", nil, true), sender1}
-	x1b := &apiStats{newFromSender(sender1, testCleaner, "s", nil, true).(*xStats), sender1}
-	x2 := &apiStats{newFromSender(sender2, testCleaner, "s", nil, true).(*xStats), sender2}
-	x3a := &apiStats{newFromSender(sender1, cleaner1, "s", nil, true).(*xStats), sender1}
-	x3b := &apiStats{newFromSender(sender1, cleaner2, "s", nil, true).(*xStats), sender1}
+	x1a := &apiStats{Stats: newFromSender(sender1, testCleaner, "s", nil, true), apiSender: sender1}
+	x1b := &apiStats{Stats: newFromSender(sender1, testCleaner, "s", nil, true).(*xStats), apiSender: sender1}
+	x2 := &apiStats{Stats: newFromSender(sender2, testCleaner, "s", nil, true).(*xStats), apiSender: sender2}
+	x3a := &apiStats{Stats: newFromSender(sender1, cleaner1, "s", nil, true).(*xStats), apiSender: sender1}
+	x3b := &apiStats{Stats: newFromSender(sender1, cleaner2, "s", nil, true).(*xStats), apiSender: sender1}
 
 	assert.True(t, apiStatsEqual{x1a}.Matches(x1b))
 	assert.False(t, apiStatsEqual{x1a}.Matches(x2))
@@ -107,6 +107,20 @@ func (mr *MockStatsMockRecorder) Event(stat interface{}, fields ...interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Event", reflect.TypeOf((*MockStats)(nil).Event), varargs...)
 }
 
+// Describe mocks base method
+func (m *MockStats) Describe(descriptors ...Descriptor) {
+	varargs := []interface{}{}
+	for _, a := range descriptors {
+		varargs = append(varargs, a)
+	}
+	m.ctrl.Call(m, "Describe", varargs...)
+}
+
+// Describe indicates an expected call of Describe
+func (mr *MockStatsMockRecorder) Describe(descriptors ...interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Describe", reflect.TypeOf((*MockStats)(nil).Describe), descriptors...)
+}
+
 // AddTags mocks base method
 func (m *MockStats) AddTags(tags ...Tag) {
 	varargs := []interface{}{}
@@ -79,12 +79,41 @@ func (ms multiStats) Timing(stat string, value time.Duration, tags ...Tag) {
 	}
 }
 
+func (ms multiStats) Distribution(stat string, value float64, tags ...Tag) {
+	for _, s := range ms {
+		Distribution(s, stat, value, tags...)
+	}
+}
+
+func (ms multiStats) Set(stat string, value string, tags ...Tag) {
+	for _, s := range ms {
+		Set(s, stat, value, tags...)
+	}
+}
+
+func (ms multiStats) ServiceCheck(
+	name string,
+	status ServiceCheckStatus,
+	message string,
+	tags ...Tag,
+) {
+	for _, s := range ms {
+		ServiceCheck(s, name, status, message, tags...)
+	}
+}
+
 func (ms multiStats) Event(stat string, fields ...Field) {
 	for _, s := range ms {
 		s.Event(stat, fields...)
 	}
 }
 
+func (ms multiStats) Describe(descriptors ...Descriptor) {
+	for _, s := range ms {
+		s.Describe(descriptors...)
+	}
+}
+
 func (ms multiStats) AddTags(tags ...Tag) {
 	for _, s := range ms {
 		s.AddTags(tags...)
@@ -145,6 +174,32 @@ func (hs *rollUpStats) Timing(stat string, value time.Duration, tags ...Tag) {
 	hs.self.Timing(stat, value, tags...)
 }
 
+func (hs *rollUpStats) Distribution(stat string, value float64, tags ...Tag) {
+	if hs.parent != nil {
+		Distribution(hs.parent, stat, value, tags...)
+	}
+	Distribution(hs.self, stat, value, tags...)
+}
+
+func (hs *rollUpStats) Set(stat string, value string, tags ...Tag) {
+	if hs.parent != nil {
+		Set(hs.parent, stat, value, tags...)
+	}
+	Set(hs.self, stat, value, tags...)
+}
+
+func (hs *rollUpStats) ServiceCheck(
+	name string,
+	status ServiceCheckStatus,
+	message string,
+	tags ...Tag,
+) {
+	if hs.parent != nil {
+		ServiceCheck(hs.parent, name, status, message, tags...)
+	}
+	ServiceCheck(hs.self, name, status, message, tags...)
+}
+
 func (hs *rollUpStats) Event(stat string, fields ...Field) {
 	if hs.parent != nil {
 		hs.parent.Event(stat, fields...)
@@ -152,6 +207,13 @@ func (hs *rollUpStats) Event(stat string, fields ...Field) {
 	hs.self.Event(stat, fields...)
 }
 
+func (hs *rollUpStats) Describe(descriptors ...Descriptor) {
+	if hs.parent != nil {
+		hs.parent.Describe(descriptors...)
+	}
+	hs.self.Describe(descriptors...)
+}
+
 func (hs *rollUpStats) AddTags(tags ...Tag) {
 	hs.self.AddTags(tags...)
 }
@@ -110,6 +110,27 @@ func testMultiTiming(
 	s.Timing("foo", time.Second, NewKVTag("a", "b"))
 }
 
+func testMultiDistribution(
+	t *testing.T,
+	mk func(ctrl *gomock.Controller) (Stats, *MockStats, *MockStats),
+) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	// MockStats is not an ExtendedStats, so distributions fall back
+	// to histograms and sets are ignored.
+	s, a, b := mk(ctrl)
+	if a != nil {
+		a.EXPECT().Histogram("foo", 1.0, NewKVTag("a", "b"))
+	}
+	if b != nil {
+		b.EXPECT().Histogram("foo", 1.0, NewKVTag("a", "b"))
+	}
+	Distribution(s, "foo", 1.0, NewKVTag("a", "b"))
+	Set(s, "foo", "x", NewKVTag("a", "b"))
+	ServiceCheck(s, "foo", ServiceCheckOK, "", NewKVTag("a", "b"))
+}
+
 func TestNewMulti(t *testing.T) {
 	ctrl := gomock.NewController(assert.Tracing(t))
 	defer ctrl.Finish()
@@ -147,6 +168,7 @@ func TestMultiStats(t *testing.T) {
 	testMultiCount(t, mkMulti)
 	testMultiHistogram(t, mkMulti)
 	testMultiTiming(t, mkMulti)
+	testMultiDistribution(t, mkMulti)
 }
 
 func TestMultiStatsAddTags(t *testing.T) {
@@ -199,6 +221,7 @@ func TestRollUpStats(t *testing.T) {
 	testMultiCount(t, mkRollUp)
 	testMultiHistogram(t, mkRollUp)
 	testMultiTiming(t, mkRollUp)
+	testMultiDistribution(t, mkRollUp)
 }
 
 func TestRollUpStatsRoot(t *testing.T) {
@@ -206,6 +229,7 @@ func TestRollUpStatsRoot(t *testing.T) {
 	testMultiCount(t, mkRootRollUp)
 	testMultiHistogram(t, mkRootRollUp)
 	testMultiTiming(t, mkRootRollUp)
+	testMultiDistribution(t, mkRootRollUp)
 }
 
 func TestRollUpStatsScope(t *testing.T) {
@@ -0,0 +1,193 @@
+/*
+Copyright 2018 Turbine Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// defaultMaxQueuedPackets is the number of full packets a
+// packetBuffer queues for writing before dropping them.
+const defaultMaxQueuedPackets = 64
+
+// flusher is implemented by writers that buffer data internally.
+type flusher interface {
+	Flush() error
+}
+
+// packetBuffer accumulates newline-terminated stats and writes them
+// to an io.Writer in batches. Stats are buffered for the flush
+// interval or until the buffer would exceed maxPacketLen bytes,
+// whichever comes first. Each write to the io.Writer contains only
+// complete stats. A single stat longer than maxPacketLen is written
+// by itself.
+//
+// Writes to the io.Writer, which may block while it reconnects, are
+// made by a separate goroutine, in order. At most maxQueuedPackets
+// full packets are queued for it; further packets are dropped. If a
+// deliveryStats is configured, it records the stats in dropped
+// packets and those not written due to a failed write.
+type packetBuffer struct {
+	lock          *sync.Mutex
+	w             io.Writer
+	maxPacketLen  int
+	buf           *bytes.Buffer
+	packets       chan []byte
+	deliveryStats *deliveryStats
+
+	quit     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+	closeErr error
+}
+
+// packetBufferOption is an option for configuring packetBuffer
+// instances created via newPacketBuffer.
+type packetBufferOption func(*packetBuffer)
+
+// packetBufferDeliveryStats sets the deliveryStats used to record
+// stats that the packetBuffer fails to write.
+func packetBufferDeliveryStats(ds *deliveryStats) packetBufferOption {
+	return func(b *packetBuffer) {
+		b.deliveryStats = ds
+	}
+}
+
+func newPacketBuffer(
+	w io.Writer,
+	flushInterval time.Duration,
+	maxPacketLen int,
+	options ...packetBufferOption,
+) *packetBuffer {
+	b := &packetBuffer{
+		lock:         &sync.Mutex{},
+		w:            w,
+		maxPacketLen: maxPacketLen,
+		buf:          &bytes.Buffer{},
+		packets:      make(chan []byte, defaultMaxQueuedPackets),
+		quit:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+
+	for _, opt := range options {
+		opt(b)
+	}
+
+	go b.flushPeriodically(flushInterval)
+
+	return b
+}
+
+// write buffers a single newline-terminated stat. If the buffer is
+// full, its contents are queued for writing.
+func (b *packetBuffer) write(line []byte) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.buf.Len()+len(line) > b.maxPacketLen {
+		if packet := b.take(); packet != nil {
+			select {
+			case b.packets <- packet:
+			default:
+				b.deliveryStats.drop(countStats(packet))
+			}
+		}
+	}
+
+	b.buf.Write(line)
+}
+
+// take returns the buffered stats, if any, and replaces the buffer.
+// Must be called with the lock held.
+func (b *packetBuffer) take() []byte {
+	if b.buf.Len() == 0 {
+		return nil
+	}
+
+	packet := b.buf.Bytes()
+	b.buf = &bytes.Buffer{}
+	return packet
+}
+
+// flush writes queued packets, followed by the buffered stats. Only
+// packets queued before the buffer is taken are written first, which
+// preserves the order in which stats were written.
+func (b *packetBuffer) flush() {
+	b.lock.Lock()
+	packet := b.take()
+	queued := len(b.packets)
+	b.lock.Unlock()
+
+	for i := 0; i < queued; i++ {
+		b.send(<-b.packets)
+	}
+	b.send(packet)
+}
+
+// send writes a packet. Stats not written due to an error are
+// recorded as dropped.
+func (b *packetBuffer) send(packet []byte) {
+	if len(packet) == 0 {
+		return
+	}
+
+	if n, err := b.w.Write(packet); err != nil {
+		b.deliveryStats.drop(countStats(packet[n:]))
+	}
+}
+
+func (b *packetBuffer) flushPeriodically(flushInterval time.Duration) {
+	defer close(b.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case packet := <-b.packets:
+			b.send(packet)
+
+		case <-ticker.C:
+			b.flush()
+			if f, ok := b.w.(flusher); ok {
+				f.Flush()
+			}
+
+		case <-b.quit:
+			b.flush()
+			return
+		}
+	}
+}
+
+// Close flushes buffered stats and closes the underlying io.Writer,
+// if it is an io.Closer. Subsequent calls have no effect and return
+// the result of the first.
+func (b *packetBuffer) Close() error {
+	b.once.Do(func() {
+		close(b.quit)
+		<-b.done
+
+		if c, ok := b.w.(io.Closer); ok {
+			b.closeErr = c.Close()
+		}
+	})
+	return b.closeErr
+}
@@ -17,12 +17,23 @@ limitations under the License.
 package stats
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"unicode"
 
-	"github.com/rs/xstats/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
 
 	tbnflag "github.com/turbinelabs/nonstdlib/flag"
+	"github.com/turbinelabs/nonstdlib/log/console"
+	tbnstrings "github.com/turbinelabs/nonstdlib/strings"
+	tbntime "github.com/turbinelabs/nonstdlib/time"
 )
 
 // CleanPrometheusTagName strips characters which prometheus considers
@@ -95,14 +106,121 @@ var prometheusCleaner = cleaner{
 	tagDelim:      ":",
 }
 
+// PrometheusStats is a Stats that records stats as prometheus
+// metrics.
+type PrometheusStats interface {
+	Stats
+
+	// Handler returns an http.Handler that serves the metrics
+	// registered with the underlying prometheus registry in the
+	// prometheus exposition format. It may be mounted on an
+	// existing mux (e.g. at "/metrics").
+	Handler() http.Handler
+}
+
+// NewPrometheusStats creates a PrometheusStats that registers metrics
+// with the given prometheus.Registerer. No listener is started:
+// callers are expected to serve the result of Handler. If registerer
+// also implements prometheus.Gatherer (as *prometheus.Registry does),
+// Handler serves its metrics. Otherwise Handler serves
+// prometheus.DefaultGatherer. Closing the returned Stats unregisters
+// all metrics it created.
+func NewPrometheusStats(
+	registerer prometheus.Registerer,
+	options ...PrometheusOption,
+) PrometheusStats {
+	gatherer, ok := registerer.(prometheus.Gatherer)
+	if !ok {
+		gatherer = prometheus.DefaultGatherer
+	}
+
+	return newPrometheusStats(registerer, gatherer, "", options...)
+}
+
+func newPrometheusStats(
+	registerer prometheus.Registerer,
+	gatherer prometheus.Gatherer,
+	scope string,
+	options ...PrometheusOption,
+) *prometheusStats {
+	sender := newPrometheusSender(registerer, options...)
+
+	return &prometheusStats{
+		Stats:   newFromSender(sender, prometheusCleaner, scope, nil, true),
+		sender:  sender,
+		handler: newPrometheusHandler(gatherer),
+	}
+}
+
+type prometheusStats struct {
+	Stats
+
+	sender  *prometheusSender
+	handler http.Handler
+}
+
+func (ps *prometheusStats) Handler() http.Handler {
+	return ps.handler
+}
+
+// newPrometheusHandler creates an http.Handler that serves the
+// metrics collected by the given prometheus.Gatherer in the format
+// negotiated with the scraper.
+func newPrometheusHandler(gatherer prometheus.Gatherer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		families, err := gatherer.Gather()
+		if err != nil && len(families) == 0 {
+			http.Error(
+				w,
+				"error collecting metrics: "+err.Error(),
+				http.StatusInternalServerError,
+			)
+			return
+		}
+
+		contentType := expfmt.Negotiate(req.Header)
+		buf := &bytes.Buffer{}
+		encoder := expfmt.NewEncoder(buf, contentType)
+		for _, family := range families {
+			if err := encoder.Encode(family); err != nil {
+				http.Error(
+					w,
+					"error encoding metrics: "+err.Error(),
+					http.StatusInternalServerError,
+				)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", string(contentType))
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.Write(buf.Bytes())
+	})
+}
+
+const (
+	prometheusHistogramType = "histogram"
+	prometheusSummaryType   = "summary"
+
+	defaultPrometheusObjectives = "0.5:0.05,0.9:0.01,0.99:0.001"
+)
+
 type prometheusFromFlags struct {
-	flagScope string
-	addr      tbnflag.HostPort
-	scope     string
+	flagScope          string
+	addr               tbnflag.HostPort
+	scope              string
+	histogramType      string
+	buckets            tbnflag.Strings
+	exponentialBuckets string
+	linearBuckets      string
+	objectives         string
 }
 
 func newPrometheusFromFlags(fs tbnflag.FlagSet) statsFromFlags {
-	ff := &prometheusFromFlags{flagScope: fs.GetScope()}
+	ff := &prometheusFromFlags{
+		flagScope: fs.GetScope(),
+		buckets:   tbnflag.NewStrings(),
+	}
 
 	fs.HostPortVar(
 		&ff.addr,
@@ -118,15 +236,302 @@ func newPrometheusFromFlags(fs tbnflag.FlagSet) statsFromFlags {
 		"If specified, prepends the given scope to metric names.",
 	)
 
+	fs.StringVar(
+		&ff.histogramType,
+		"histogram-type",
+		prometheusHistogramType,
+		`Specifies how histograms and timings are recorded. Must be "histogram" or "summary".`,
+	)
+
+	fs.Var(
+		&ff.buckets,
+		"buckets",
+		"Specifies the upper bounds of the buckets used for histograms and timings, in increasing order. May be comma-delimited or specified more than once. Timing buckets are in units of seconds. Cannot be combined with --{{PREFIX}}exponential-buckets or --{{PREFIX}}linear-buckets. If no buckets are specified, prometheus' default buckets are used.",
+	)
+
+	fs.StringVar(
+		&ff.exponentialBuckets,
+		"exponential-buckets",
+		"",
+		`Specifies exponentially-sized buckets for histograms and timings in the form "<start>,<factor>,<count>". The first bucket's upper bound is start and each subsequent bucket's upper bound is factor times the previous bucket's. Start must be greater than 0 and factor must be greater than 1.`,
+	)
+
+	fs.StringVar(
+		&ff.linearBuckets,
+		"linear-buckets",
+		"",
+		`Specifies linearly-sized buckets for histograms and timings in the form "<start>,<width>,<count>". The first bucket's upper bound is start and each subsequent bucket's upper bound is width greater than the previous bucket's.`,
+	)
+
+	fs.StringVar(
+		&ff.objectives,
+		"summary-objectives",
+		defaultPrometheusObjectives,
+		`Specifies the quantiles computed when --{{PREFIX}}histogram-type is "summary", in the form "<quantile>:<error>,...". The error is the allowed absolute error in each quantile.`,
+	)
+
 	return ff
 }
 
 func (ff *prometheusFromFlags) Validate() error {
+	switch ff.histogramType {
+	case prometheusHistogramType, prometheusSummaryType:
+	default:
+		return fmt.Errorf(
+			`--%shistogram-type must be "%s" or "%s"`,
+			ff.flagScope,
+			prometheusHistogramType,
+			prometheusSummaryType,
+		)
+	}
+
+	if _, err := ff.parseBuckets(); err != nil {
+		return err
+	}
+
+	if _, err := parsePrometheusObjectives(ff.objectives); err != nil {
+		return fmt.Errorf("--%ssummary-objectives invalid: %s", ff.flagScope, err.Error())
+	}
+
 	return nil
 }
 
 func (ff *prometheusFromFlags) Make() (Stats, error) {
-	return newFromSender(
-		prometheus.New(ff.addr.Addr()), prometheusCleaner, ff.scope, nil, true,
-	), nil
+	return ff.makeWithDeliveryStats(nil)
+}
+
+func (ff *prometheusFromFlags) makeWithDeliveryStats(ds *deliveryStats) (Stats, error) {
+	options, err := ff.senderOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	if ds != nil {
+		options = append(options, prometheusDeliveryStats(ds))
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(os.Getpid(), ""),
+	)
+
+	listener, err := net.Listen("tcp", ff.addr.Addr())
+	if err != nil {
+		return nil, fmt.Errorf("could not start prometheus listener: %s", err.Error())
+	}
+
+	stats := newPrometheusStats(registry, registry, ff.scope, options...)
+
+	handler := stats.handler
+	if ds != nil {
+		handler = newDeliveryHandler(handler, ds, tbntime.NewSource())
+	}
+
+	server := &http.Server{Handler: handler}
+	stats.sender.server = server
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			console.Error().Printf("prometheus listener failed: %s", err)
+			ds.sendError()
+		}
+	}()
+
+	return stats, nil
+}
+
+// newDeliveryHandler wraps an http.Handler, recording each response
+// as a packet sent to the given deliveryStats. Server error responses
+// are recorded as send errors.
+func newDeliveryHandler(
+	handler http.Handler,
+	ds *deliveryStats,
+	timeSource tbntime.Source,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := timeSource.Now()
+
+		dw := &deliveryResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(dw, req)
+
+		if dw.status >= http.StatusInternalServerError {
+			ds.sendError()
+		} else {
+			ds.sent(dw.size, timeSource.Now().Sub(start))
+		}
+	})
+}
+
+// deliveryResponseWriter records the status and size of a response.
+type deliveryResponseWriter struct {
+	http.ResponseWriter
+
+	status int
+	size   int
+}
+
+func (w *deliveryResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *deliveryResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.size += n
+	return n, err
+}
+
+func (ff *prometheusFromFlags) senderOptions() ([]PrometheusOption, error) {
+	if ff.histogramType == prometheusSummaryType {
+		objectives, err := parsePrometheusObjectives(ff.objectives)
+		if err != nil {
+			return nil, err
+		}
+
+		return []PrometheusOption{PrometheusSummaries(objectives)}, nil
+	}
+
+	buckets, err := ff.parseBuckets()
+	if err != nil {
+		return nil, err
+	}
+
+	if buckets == nil {
+		return nil, nil
+	}
+
+	return []PrometheusOption{PrometheusBuckets(buckets)}, nil
+}
+
+// parseBuckets returns the buckets specified by the buckets,
+// exponential-buckets, or linear-buckets flags. Returns nil if none
+// were specified.
+func (ff *prometheusFromFlags) parseBuckets() ([]float64, error) {
+	numSpecified := 0
+	for _, specified := range []bool{
+		len(ff.buckets.Strings) > 0,
+		ff.exponentialBuckets != "",
+		ff.linearBuckets != "",
+	} {
+		if specified {
+			numSpecified++
+		}
+	}
+
+	if numSpecified > 1 {
+		return nil, fmt.Errorf(
+			"only one of --%sbuckets, --%[1]sexponential-buckets, or --%[1]slinear-buckets may be specified",
+			ff.flagScope,
+		)
+	}
+
+	switch {
+	case len(ff.buckets.Strings) > 0:
+		buckets := make([]float64, len(ff.buckets.Strings))
+		for i, b := range ff.buckets.Strings {
+			v, err := strconv.ParseFloat(strings.TrimSpace(b), 64)
+			if err != nil {
+				return nil, fmt.Errorf("--%sbuckets invalid: %q is not a number", ff.flagScope, b)
+			}
+
+			if i > 0 && v <= buckets[i-1] {
+				return nil, fmt.Errorf("--%sbuckets must be in increasing order", ff.flagScope)
+			}
+			buckets[i] = v
+		}
+		return buckets, nil
+
+	case ff.exponentialBuckets != "":
+		start, factor, count, err := parseBucketSpec(ff.exponentialBuckets)
+		if err != nil {
+			return nil, fmt.Errorf("--%sexponential-buckets invalid: %s", ff.flagScope, err.Error())
+		}
+
+		if start <= 0 {
+			return nil, fmt.Errorf("--%sexponential-buckets start must be greater than 0", ff.flagScope)
+		}
+
+		if factor <= 1 {
+			return nil, fmt.Errorf("--%sexponential-buckets factor must be greater than 1", ff.flagScope)
+		}
+
+		return prometheus.ExponentialBuckets(start, factor, count), nil
+
+	case ff.linearBuckets != "":
+		start, width, count, err := parseBucketSpec(ff.linearBuckets)
+		if err != nil {
+			return nil, fmt.Errorf("--%slinear-buckets invalid: %s", ff.flagScope, err.Error())
+		}
+
+		if width <= 0 {
+			return nil, fmt.Errorf("--%slinear-buckets width must be greater than 0", ff.flagScope)
+		}
+
+		return prometheus.LinearBuckets(start, width, count), nil
+	}
+
+	return nil, nil
+}
+
+// parseBucketSpec parses a string of the form "<start>,<x>,<count>"
+// where count must be greater than 0.
+func parseBucketSpec(spec string) (float64, float64, int, error) {
+	parts := strings.Split(spec, ",")
+	if len(parts) != 3 {
+		return 0, 0, 0, fmt.Errorf("expected 3 comma-delimited values, got %q", spec)
+	}
+
+	start, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("%q is not a number", parts[0])
+	}
+
+	x, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("%q is not a number", parts[1])
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(parts[2]))
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("%q is not an integer", parts[2])
+	}
+
+	if count < 1 {
+		return 0, 0, 0, errors.New("count must be greater than 0")
+	}
+
+	return start, x, count, nil
+}
+
+// parsePrometheusObjectives parses a string of the form
+// "<quantile>:<error>,..." into a map of quantile to allowed
+// absolute error.
+func parsePrometheusObjectives(s string) (map[float64]float64, error) {
+	objectives := map[float64]float64{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		q, e := tbnstrings.Split2(part, ":")
+		quantile, err := strconv.ParseFloat(q, 64)
+		if err != nil || quantile < 0 || quantile > 1 {
+			return nil, fmt.Errorf("%q is not a quantile between 0 and 1", q)
+		}
+
+		allowedErr, err := strconv.ParseFloat(e, 64)
+		if err != nil || allowedErr < 0 {
+			return nil, fmt.Errorf("%q is not a valid error for quantile %s", e, q)
+		}
+
+		objectives[quantile] = allowedErr
+	}
+
+	if len(objectives) == 0 {
+		return nil, errors.New("at least one objective must be specified")
+	}
+
+	return objectives, nil
 }
@@ -0,0 +1,461 @@
+/*
+Copyright 2018 Turbine Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/turbinelabs/nonstdlib/log/console"
+	tbnstrings "github.com/turbinelabs/nonstdlib/strings"
+)
+
+const (
+	// PrometheusConflictsMetric is the name of the counter used by
+	// the prometheus backend to report stats that conflict with
+	// previously registered metrics of the same name. It is tagged
+	// with the name of the conflicting stat and the reason for the
+	// conflict ("labels", "type", or "registration").
+	PrometheusConflictsMetric = "stats_prometheus_conflicts"
+
+	prometheusStatLabel   = "stat"
+	prometheusReasonLabel = "reason"
+
+	prometheusLabelsConflict       = "labels"
+	prometheusTypeConflict         = "type"
+	prometheusRegistrationConflict = "registration"
+)
+
+// prometheusObserver is the common interface of prometheus.Histogram
+// and prometheus.Summary.
+type prometheusObserver interface {
+	Observe(float64)
+}
+
+// newPrometheusSender constructs an xstats Sender that records stats
+// as prometheus metrics registered with the given
+// prometheus.Registerer. Counts and gauges become CounterVecs and
+// GaugeVecs. Histograms and timings become HistogramVecs (or
+// SummaryVecs, see PrometheusSummaries). Timings are recorded in
+// seconds. Tags are expected to be of the form "key:value". Metric
+// help text, types, and label names may be declared in advance via
+// Describe.
+//
+// Prometheus requires every metric with a given name to have the same
+// label names. The label names of a stat are fixed by the first call
+// for that stat. Subsequent calls that omit some of those tags are
+// recorded with empty values for the missing labels. Tags not present
+// in the first call are dropped. Dropped tags, and stats that cannot
+// be recorded because their name was previously used for a different
+// type of metric, are counted by the PrometheusConflictsMetric
+// counter.
+func newPrometheusSender(
+	registerer prometheus.Registerer,
+	options ...PrometheusOption,
+) *prometheusSender {
+	s := &prometheusSender{
+		lock:        &sync.RWMutex{},
+		registerer:  registerer,
+		buckets:     prometheus.DefBuckets,
+		metrics:     map[string]*prometheusMetric{},
+		descriptors: map[string]Descriptor{},
+	}
+
+	for _, opt := range options {
+		opt(s)
+	}
+
+	conflicts, owned, err := s.register(
+		prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: PrometheusConflictsMetric,
+				Help: "Number of stats whose tags or type conflicted with a previously registered metric.",
+			},
+			[]string{prometheusStatLabel, prometheusReasonLabel},
+		),
+	)
+	if err != nil {
+		console.Error().Printf(
+			"could not register prometheus metric %s: %s",
+			PrometheusConflictsMetric,
+			err,
+		)
+	} else {
+		s.conflicts = conflicts.(*prometheus.CounterVec)
+		s.ownsConflicts = owned
+	}
+
+	return s
+}
+
+// PrometheusOption is an option for configuring Stats created via
+// NewPrometheusStats.
+type PrometheusOption func(*prometheusSender)
+
+// PrometheusBuckets sets the upper bounds of the buckets used for
+// histograms and timings. Timing buckets are in units of seconds. The
+// buckets must be in increasing order. By default, prometheus'
+// DefBuckets are used.
+func PrometheusBuckets(buckets []float64) PrometheusOption {
+	return func(s *prometheusSender) {
+		s.buckets = buckets
+	}
+}
+
+// PrometheusSummaries causes histograms and timings to be recorded
+// as summaries with the given quantile objectives (a map of quantile
+// to allowed absolute error) instead of histograms.
+func PrometheusSummaries(objectives map[float64]float64) PrometheusOption {
+	return func(s *prometheusSender) {
+		s.useSummaries = true
+		s.objectives = objectives
+	}
+}
+
+// prometheusDeliveryStats sets the deliveryStats used to count stats
+// that could not be recorded.
+func prometheusDeliveryStats(ds *deliveryStats) PrometheusOption {
+	return func(s *prometheusSender) {
+		s.deliveryStats = ds
+	}
+}
+
+type prometheusSender struct {
+	lock         *sync.RWMutex
+	registerer   prometheus.Registerer
+	buckets      []float64
+	useSummaries bool
+	objectives   map[float64]float64
+	conflicts    *prometheus.CounterVec
+
+	// ownsConflicts indicates that conflicts was registered by this
+	// sender, rather than by another sender sharing the registerer.
+	ownsConflicts bool
+
+	// deliveryStats, if non-nil, counts stats dropped due to type
+	// conflicts.
+	deliveryStats *deliveryStats
+
+	metrics     map[string]*prometheusMetric
+	descriptors map[string]Descriptor
+
+	// server, if non-nil, is an HTTP server owned by this sender.
+	server *http.Server
+}
+
+// prometheusMetric is a registered prometheus collector and its
+// label names.
+type prometheusMetric struct {
+	// collector is nil if registration failed.
+	collector prometheus.Collector
+
+	// labels are the collector's label names, sorted.
+	labels []string
+
+	// owned indicates that the collector was registered by this
+	// sender, rather than by another sender sharing the registerer.
+	owned bool
+}
+
+// Gauge implements xstats.Sender interface
+func (s *prometheusSender) Gauge(stat string, value float64, tags ...string) {
+	m := s.metric(stat, GaugeMetric, tags)
+
+	vec, ok := m.collector.(*prometheus.GaugeVec)
+	if !ok {
+		s.typeConflict(stat, m)
+		return
+	}
+
+	if g, err := vec.GetMetricWithLabelValues(s.labelValues(stat, m, tags)...); err == nil {
+		g.Set(value)
+	}
+}
+
+// Count implements xstats.Sender interface
+func (s *prometheusSender) Count(stat string, count float64, tags ...string) {
+	m := s.metric(stat, CounterMetric, tags)
+
+	vec, ok := m.collector.(*prometheus.CounterVec)
+	if !ok {
+		s.typeConflict(stat, m)
+		return
+	}
+
+	if c, err := vec.GetMetricWithLabelValues(s.labelValues(stat, m, tags)...); err == nil {
+		c.Add(count)
+	}
+}
+
+// Histogram implements xstats.Sender interface
+func (s *prometheusSender) Histogram(stat string, value float64, tags ...string) {
+	m := s.metric(stat, HistogramMetric, tags)
+
+	var o prometheusObserver
+	switch vec := m.collector.(type) {
+	case *prometheus.SummaryVec:
+		o, _ = vec.GetMetricWithLabelValues(s.labelValues(stat, m, tags)...)
+	case *prometheus.HistogramVec:
+		o, _ = vec.GetMetricWithLabelValues(s.labelValues(stat, m, tags)...)
+	default:
+		s.typeConflict(stat, m)
+		return
+	}
+
+	if o != nil {
+		o.Observe(value)
+	}
+}
+
+// Timing implements xstats.Sender interface. Timings are recorded in
+// seconds.
+func (s *prometheusSender) Timing(stat string, duration time.Duration, tags ...string) {
+	s.Histogram(stat, duration.Seconds(), tags...)
+}
+
+// Describe records the Descriptor's help text, unit, and tag keys
+// for use when the stat's collector is created. If the Descriptor
+// declares a type, the collector is registered immediately. A
+// Descriptor has no effect on a stat that has already been recorded.
+func (s *prometheusSender) Describe(d Descriptor) {
+	s.lock.Lock()
+	s.descriptors[d.Name] = d
+	s.lock.Unlock()
+
+	if d.Type != UntypedMetric {
+		s.metric(d.Name, d.Type, nil)
+	}
+}
+
+// metric returns the prometheusMetric for stat, creating and
+// registering a collector of the given type if necessary. The
+// collector's label names are taken from the stat's Descriptor, if
+// it declares tag keys, and otherwise from tags.
+func (s *prometheusSender) metric(stat string, typ MetricType, tags []string) *prometheusMetric {
+	s.lock.RLock()
+	m, ok := s.metrics[stat]
+	s.lock.RUnlock()
+
+	if ok {
+		return m
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if m, ok = s.metrics[stat]; ok {
+		return m
+	}
+
+	help := stat
+	var labels []string
+
+	if d, ok := s.descriptors[stat]; ok {
+		if d.Type != UntypedMetric {
+			typ = d.Type
+		}
+
+		if d.Help != "" {
+			help = d.Help
+		}
+
+		unit := d.Unit
+		if typ == TimingMetric {
+			unit = "seconds"
+		}
+		if unit != "" {
+			help = fmt.Sprintf("%s (%s)", help, unit)
+		}
+
+		if d.TagKeys != nil {
+			labels = prometheusLabelNames(d.TagKeys)
+		}
+	}
+
+	if labels == nil {
+		labels = prometheusLabelNames(prometheusTagKeys(tags))
+	}
+
+	c, owned, err := s.register(s.newCollector(stat, typ, help, labels))
+	if err != nil {
+		console.Error().Printf("could not register prometheus metric %s: %s", stat, err)
+	}
+
+	m = &prometheusMetric{collector: c, labels: labels, owned: owned}
+	s.metrics[stat] = m
+	return m
+}
+
+func (s *prometheusSender) newCollector(
+	stat string,
+	typ MetricType,
+	help string,
+	labels []string,
+) prometheus.Collector {
+	switch typ {
+	case GaugeMetric:
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: stat, Help: help}, labels)
+
+	case CounterMetric:
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Name: stat, Help: help}, labels)
+
+	default:
+		if s.useSummaries {
+			return prometheus.NewSummaryVec(
+				prometheus.SummaryOpts{Name: stat, Help: help, Objectives: s.objectives},
+				labels,
+			)
+		}
+
+		return prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{Name: stat, Help: help, Buckets: s.buckets},
+			labels,
+		)
+	}
+}
+
+// labelValues returns the values of the given tags ordered to match
+// the metric's label names. Labels without a corresponding tag are
+// given empty values. Tags without a corresponding label are dropped
+// and counted as conflicts.
+func (s *prometheusSender) labelValues(stat string, m *prometheusMetric, tags []string) []string {
+	values := make([]string, len(m.labels))
+
+	dropped := false
+	for _, tag := range tags {
+		k, v := tbnstrings.Split2(tag, prometheusCleaner.tagDelim)
+
+		idx := sort.SearchStrings(m.labels, k)
+		if idx < len(m.labels) && m.labels[idx] == k {
+			values[idx] = v
+		} else {
+			dropped = true
+		}
+	}
+
+	if dropped {
+		s.conflict(stat, prometheusLabelsConflict)
+	}
+
+	return values
+}
+
+// typeConflict counts a stat that could not be recorded because its
+// name was previously registered as a different type of metric or
+// could not be registered at all.
+func (s *prometheusSender) typeConflict(stat string, m *prometheusMetric) {
+	s.deliveryStats.drop(1)
+
+	if m.collector == nil {
+		s.conflict(stat, prometheusRegistrationConflict)
+	} else {
+		s.conflict(stat, prometheusTypeConflict)
+	}
+}
+
+func (s *prometheusSender) conflict(stat, reason string) {
+	s.lock.RLock()
+	conflicts := s.conflicts
+	s.lock.RUnlock()
+
+	if conflicts == nil {
+		return
+	}
+
+	if c, err := conflicts.GetMetricWithLabelValues(stat, reason); err == nil {
+		c.Inc()
+	}
+}
+
+// register registers the given collector. If an equivalent collector
+// of the same type was previously registered, it is returned instead.
+// Returns true if the returned collector was registered by this call.
+func (s *prometheusSender) register(c prometheus.Collector) (prometheus.Collector, bool, error) {
+	if err := s.registerer.Register(c); err != nil {
+		are, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok || reflect.TypeOf(are.ExistingCollector) != reflect.TypeOf(c) {
+			return nil, false, err
+		}
+
+		return are.ExistingCollector, false, nil
+	}
+
+	return c, true, nil
+}
+
+// Close implements io.Closer interface. It unregisters all
+// collectors registered by this sender and shuts down the HTTP server
+// it owns, if any. Collectors previously registered by other senders
+// and reused by this one remain registered.
+func (s *prometheusSender) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, m := range s.metrics {
+		if m.owned {
+			s.registerer.Unregister(m.collector)
+		}
+	}
+	s.metrics = map[string]*prometheusMetric{}
+
+	if s.ownsConflicts {
+		s.registerer.Unregister(s.conflicts)
+	}
+	s.conflicts = nil
+	s.ownsConflicts = false
+
+	if s.server != nil {
+		server := s.server
+		s.server = nil
+		return server.Close()
+	}
+
+	return nil
+}
+
+// prometheusTagKeys returns the keys of tags of the form
+// "key:value".
+func prometheusTagKeys(tags []string) []string {
+	keys := make([]string, len(tags))
+	for i, tag := range tags {
+		keys[i], _ = tbnstrings.Split2(tag, prometheusCleaner.tagDelim)
+	}
+	return keys
+}
+
+// prometheusLabelNames returns a sorted copy of keys with duplicates
+// removed.
+func prometheusLabelNames(keys []string) []string {
+	labels := append(make([]string, 0, len(keys)), keys...)
+
+	sort.Strings(labels)
+
+	unique := labels[:0]
+	for i, label := range labels {
+		if i == 0 || label != labels[i-1] {
+			unique = append(unique, label)
+		}
+	}
+
+	return unique
+}
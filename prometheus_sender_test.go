@@ -0,0 +1,333 @@
+/*
+Copyright 2018 Turbine Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/turbinelabs/test/assert"
+)
+
+func gatherPrometheusFamily(t *testing.T, g prometheus.Gatherer, name string) *dto.MetricFamily {
+	families, err := g.Gather()
+	assert.Nil(t, err)
+
+	for _, family := range families {
+		if family.GetName() == name {
+			return family
+		}
+	}
+
+	return nil
+}
+
+func prometheusLabels(m *dto.Metric) map[string]string {
+	labels := map[string]string{}
+	for _, lp := range m.GetLabel() {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+	return labels
+}
+
+func prometheusConflicts(t *testing.T, g prometheus.Gatherer, stat, reason string) float64 {
+	family := gatherPrometheusFamily(t, g, PrometheusConflictsMetric)
+	if family == nil {
+		return 0
+	}
+
+	for _, m := range family.GetMetric() {
+		labels := prometheusLabels(m)
+		if labels[prometheusStatLabel] == stat && labels[prometheusReasonLabel] == reason {
+			return m.GetCounter().GetValue()
+		}
+	}
+
+	return 0
+}
+
+func TestPrometheusSenderCount(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	s := newPrometheusSender(registry)
+
+	s.Count("c", 1, "a:b")
+	s.Count("c", 2.5, "a:b")
+	s.Count("c", 1, "a:c")
+
+	family := gatherPrometheusFamily(t, registry, "c")
+	assert.NonNil(t, family)
+	assert.Equal(t, family.GetType(), dto.MetricType_COUNTER)
+	assert.Equal(t, len(family.GetMetric()), 2)
+
+	for _, m := range family.GetMetric() {
+		switch prometheusLabels(m)["a"] {
+		case "b":
+			assert.Equal(t, m.GetCounter().GetValue(), 3.5)
+		case "c":
+			assert.Equal(t, m.GetCounter().GetValue(), 1.0)
+		default:
+			t.Errorf("unexpected labels: %v", m.GetLabel())
+		}
+	}
+}
+
+func TestPrometheusSenderGauge(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	s := newPrometheusSender(registry)
+
+	s.Gauge("g", 1, "a:b")
+	s.Gauge("g", 5, "a:b")
+
+	family := gatherPrometheusFamily(t, registry, "g")
+	assert.NonNil(t, family)
+	assert.Equal(t, family.GetType(), dto.MetricType_GAUGE)
+	assert.Equal(t, len(family.GetMetric()), 1)
+	assert.Equal(t, family.GetMetric()[0].GetGauge().GetValue(), 5.0)
+	assert.MapEqual(t, prometheusLabels(family.GetMetric()[0]), map[string]string{"a": "b"})
+}
+
+func TestPrometheusSenderTimingIsHistogramInSeconds(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	s := newPrometheusSender(registry, PrometheusBuckets([]float64{0.1, 1, 10}))
+
+	s.Timing("t", 50*time.Millisecond)
+	s.Timing("t", 500*time.Millisecond)
+	s.Timing("t", 2*time.Second)
+	s.Timing("t", time.Minute)
+
+	family := gatherPrometheusFamily(t, registry, "t")
+	assert.NonNil(t, family)
+	assert.Equal(t, family.GetType(), dto.MetricType_HISTOGRAM)
+	assert.Equal(t, len(family.GetMetric()), 1)
+
+	h := family.GetMetric()[0].GetHistogram()
+	assert.Equal(t, h.GetSampleCount(), uint64(4))
+	assert.Equal(t, h.GetSampleSum(), 62.55)
+
+	buckets := h.GetBucket()
+	assert.Equal(t, len(buckets), 3)
+	assert.Equal(t, buckets[0].GetUpperBound(), 0.1)
+	assert.Equal(t, buckets[0].GetCumulativeCount(), uint64(1))
+	assert.Equal(t, buckets[1].GetUpperBound(), 1.0)
+	assert.Equal(t, buckets[1].GetCumulativeCount(), uint64(2))
+	assert.Equal(t, buckets[2].GetUpperBound(), 10.0)
+	assert.Equal(t, buckets[2].GetCumulativeCount(), uint64(3))
+}
+
+func TestPrometheusSenderHistogramDefaultBuckets(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	s := newPrometheusSender(registry)
+
+	s.Histogram("h", 0.2)
+
+	family := gatherPrometheusFamily(t, registry, "h")
+	assert.NonNil(t, family)
+	assert.Equal(t, family.GetType(), dto.MetricType_HISTOGRAM)
+	assert.Equal(t, len(family.GetMetric()[0].GetHistogram().GetBucket()), len(prometheus.DefBuckets))
+}
+
+func TestPrometheusSenderSummaries(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	s := newPrometheusSender(registry, PrometheusSummaries(map[float64]float64{0.5: 0.05}))
+
+	for i := 1; i <= 100; i++ {
+		s.Timing("t", time.Duration(i)*time.Millisecond)
+	}
+
+	family := gatherPrometheusFamily(t, registry, "t")
+	assert.NonNil(t, family)
+	assert.Equal(t, family.GetType(), dto.MetricType_SUMMARY)
+
+	summary := family.GetMetric()[0].GetSummary()
+	assert.Equal(t, summary.GetSampleCount(), uint64(100))
+	assert.Equal(t, len(summary.GetQuantile()), 1)
+	assert.Equal(t, summary.GetQuantile()[0].GetQuantile(), 0.5)
+	assert.GreaterThanEqual(t, summary.GetQuantile()[0].GetValue(), 0.045)
+	assert.LessThanEqual(t, summary.GetQuantile()[0].GetValue(), 0.055)
+}
+
+func TestPrometheusSenderTypeConflict(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	s := newPrometheusSender(registry)
+
+	s.Count("x", 1)
+	s.Gauge("x", 2)
+
+	family := gatherPrometheusFamily(t, registry, "x")
+	assert.NonNil(t, family)
+	assert.Equal(t, family.GetType(), dto.MetricType_COUNTER)
+	assert.Equal(t, family.GetMetric()[0].GetCounter().GetValue(), 1.0)
+
+	assert.Equal(t, prometheusConflicts(t, registry, "x", prometheusTypeConflict), 1.0)
+}
+
+func TestPrometheusSenderRegistrationConflict(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "x", Help: "x"}))
+
+	s := newPrometheusSender(registry)
+	s.Count("x", 1)
+	s.Count("x", 1)
+
+	assert.Equal(t, prometheusConflicts(t, registry, "x", prometheusRegistrationConflict), 2.0)
+}
+
+func TestPrometheusSenderMissingLabels(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	s := newPrometheusSender(registry)
+
+	s.Count("c", 1, "a:1", "b:2")
+	s.Count("c", 1, "b:2")
+	s.Count("c", 1)
+
+	family := gatherPrometheusFamily(t, registry, "c")
+	assert.NonNil(t, family)
+	assert.Equal(t, len(family.GetMetric()), 3)
+
+	got := map[string]float64{}
+	for _, m := range family.GetMetric() {
+		labels := prometheusLabels(m)
+		got[labels["a"]+"/"+labels["b"]] = m.GetCounter().GetValue()
+	}
+	assert.MapEqual(t, got, map[string]float64{"1/2": 1, "/2": 1, "/": 1})
+
+	assert.Nil(t, gatherPrometheusFamily(t, registry, PrometheusConflictsMetric))
+}
+
+func TestPrometheusSenderNewLabels(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	s := newPrometheusSender(registry)
+
+	s.Gauge("g", 1)
+	s.Gauge("g", 2, "a:b")
+
+	family := gatherPrometheusFamily(t, registry, "g")
+	assert.NonNil(t, family)
+	assert.Equal(t, len(family.GetMetric()), 1)
+	assert.Equal(t, family.GetMetric()[0].GetGauge().GetValue(), 2.0)
+	assert.Equal(t, len(family.GetMetric()[0].GetLabel()), 0)
+
+	s.Histogram("h", 1, "a:b")
+	s.Histogram("h", 2, "a:c", "z:y")
+
+	family = gatherPrometheusFamily(t, registry, "h")
+	assert.NonNil(t, family)
+	assert.Equal(t, len(family.GetMetric()), 2)
+	for _, m := range family.GetMetric() {
+		assert.Equal(t, len(m.GetLabel()), 1)
+	}
+
+	assert.Equal(t, prometheusConflicts(t, registry, "g", prometheusLabelsConflict), 1.0)
+	assert.Equal(t, prometheusConflicts(t, registry, "h", prometheusLabelsConflict), 1.0)
+}
+
+func TestPrometheusSenderLabelOrder(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	s := newPrometheusSender(registry)
+
+	s.Count("c", 1, "b:2", "a:1")
+	s.Count("c", 1, "a:1", "b:2")
+	s.Count("c", 1, "a:x", "b:2", "a:1")
+
+	family := gatherPrometheusFamily(t, registry, "c")
+	assert.NonNil(t, family)
+	assert.Equal(t, len(family.GetMetric()), 1)
+	assert.Equal(t, family.GetMetric()[0].GetCounter().GetValue(), 3.0)
+	assert.MapEqual(
+		t,
+		prometheusLabels(family.GetMetric()[0]),
+		map[string]string{"a": "1", "b": "2"},
+	)
+}
+
+func TestPrometheusSenderReusesRegisteredCollectors(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	s1 := newPrometheusSender(registry)
+	s2 := newPrometheusSender(registry)
+
+	s1.Count("c", 1)
+	s2.Count("c", 2)
+
+	family := gatherPrometheusFamily(t, registry, "c")
+	assert.NonNil(t, family)
+	assert.Equal(t, family.GetMetric()[0].GetCounter().GetValue(), 3.0)
+}
+
+func TestPrometheusSenderCloseKeepsReusedCollectors(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	s1 := newPrometheusSender(registry)
+	s2 := newPrometheusSender(registry)
+
+	s1.Count("c", 1)
+	s2.Count("c", 2)
+	s2.Gauge("g", 3)
+	s1.Count("c", 1, "x:y")
+
+	// s2 reused the collectors registered by s1
+	assert.Nil(t, s2.Close())
+
+	family := gatherPrometheusFamily(t, registry, "c")
+	assert.NonNil(t, family)
+	assert.Equal(t, family.GetMetric()[0].GetCounter().GetValue(), 4.0)
+	assert.NonNil(t, gatherPrometheusFamily(t, registry, PrometheusConflictsMetric))
+	assert.Nil(t, gatherPrometheusFamily(t, registry, "g"))
+
+	assert.Nil(t, s1.Close())
+	assert.Nil(t, gatherPrometheusFamily(t, registry, "c"))
+	assert.Nil(t, gatherPrometheusFamily(t, registry, PrometheusConflictsMetric))
+}
+
+func TestPrometheusSenderDescribe(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	s := newPrometheusSender(registry)
+
+	s.Describe(
+		NewDescriptor("c", CounterMetric, "things counted").
+			WithUnit("requests").
+			WithTagKeys("b", "a"),
+	)
+	s.Describe(NewDescriptor("t", TimingMetric, "time taken"))
+	s.Describe(NewDescriptor("g", UntypedMetric, "gauged"))
+
+	// typed descriptors are registered eagerly
+	s.Count("c", 1, "a:1", "z:2")
+	s.Gauge("t", 1)
+	s.Timing("t", time.Second)
+	s.Gauge("g", 1)
+
+	family := gatherPrometheusFamily(t, registry, "c")
+	assert.NonNil(t, family)
+	assert.Equal(t, family.GetType(), dto.MetricType_COUNTER)
+	assert.Equal(t, family.GetHelp(), "things counted (requests)")
+	assert.MapEqual(t, prometheusLabels(family.GetMetric()[0]), map[string]string{"a": "1", "b": ""})
+
+	family = gatherPrometheusFamily(t, registry, "t")
+	assert.NonNil(t, family)
+	assert.Equal(t, family.GetType(), dto.MetricType_HISTOGRAM)
+	assert.Equal(t, family.GetHelp(), "time taken (seconds)")
+
+	family = gatherPrometheusFamily(t, registry, "g")
+	assert.NonNil(t, family)
+	assert.Equal(t, family.GetType(), dto.MetricType_GAUGE)
+	assert.Equal(t, family.GetHelp(), "gauged")
+
+	assert.Equal(t, prometheusConflicts(t, registry, "c", prometheusLabelsConflict), 1.0)
+	assert.Equal(t, prometheusConflicts(t, registry, "t", prometheusTypeConflict), 1.0)
+}
@@ -17,7 +17,14 @@ limitations under the License.
 package stats
 
 import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 
 	tbnflag "github.com/turbinelabs/nonstdlib/flag"
 	"github.com/turbinelabs/test/assert"
@@ -88,12 +95,202 @@ func TestPrometheusCleanerTagToString(t *testing.T) {
 
 func TestPrometheusMake(t *testing.T) {
 	flags := &prometheusFromFlags{
-		flagScope: "prometheus",
-		addr:      tbnflag.NewHostPort(":0"),
-		scope:     "",
+		flagScope:     "prometheus",
+		addr:          tbnflag.NewHostPort("127.0.0.1:0"),
+		scope:         "",
+		histogramType: prometheusHistogramType,
+		objectives:    defaultPrometheusObjectives,
 	}
 
 	s, err := flags.Make()
 	assert.NonNil(t, s)
 	assert.Nil(t, err)
+
+	psImpl, ok := s.(*prometheusStats)
+	assert.True(t, ok)
+	assert.NonNil(t, psImpl.sender.server)
+
+	assert.Nil(t, s.Close())
+	assert.Nil(t, psImpl.sender.server)
+}
+
+func TestPrometheusMakeReportsListenerErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	flags := &prometheusFromFlags{
+		flagScope:     "prometheus",
+		addr:          tbnflag.NewHostPort(l.Addr().String()),
+		histogramType: prometheusHistogramType,
+		objectives:    defaultPrometheusObjectives,
+	}
+
+	s, err := flags.Make()
+	assert.Nil(t, s)
+	assert.ErrorContains(t, err, "could not start prometheus listener")
+}
+
+func TestNewPrometheusStats(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	s := NewPrometheusStats(registry, PrometheusBuckets([]float64{1, 2}))
+	s.Count("requests", 2, NewKVTag("method", "GET"))
+	s.Scope("backend").Timing("latency", 1500*time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, rec.Code, http.StatusOK)
+
+	body := rec.Body.String()
+	assert.True(t, strings.Contains(body, "# TYPE requests counter\n"))
+	assert.True(t, strings.Contains(body, `requests{method="GET"} 2`))
+	assert.True(t, strings.Contains(body, "# TYPE backend:latency histogram\n"))
+	assert.True(t, strings.Contains(body, `backend:latency_bucket{le="1"} 0`))
+	assert.True(t, strings.Contains(body, `backend:latency_bucket{le="2"} 1`))
+	assert.True(t, strings.Contains(body, `backend:latency_sum 1.5`))
+
+	assert.NonNil(t, gatherPrometheusFamily(t, registry, "requests"))
+	assert.Nil(t, s.Close())
+	assert.Nil(t, gatherPrometheusFamily(t, registry, "requests"))
+	assert.Nil(t, gatherPrometheusFamily(t, registry, "backend:latency"))
+
+	// metrics may be registered again after close
+	s = NewPrometheusStats(registry)
+	s.Count("requests", 1, NewKVTag("method", "GET"))
+	family := gatherPrometheusFamily(t, registry, "requests")
+	assert.NonNil(t, family)
+	assert.Equal(t, family.GetMetric()[0].GetCounter().GetValue(), 1.0)
+	assert.Nil(t, s.Close())
+}
+
+func TestPrometheusFromFlagsValidate(t *testing.T) {
+	testCases := []struct {
+		args                []string
+		expectErrorContains string
+	}{
+		{},
+		{args: []string{"--prometheus.histogram-type=summary"}},
+		{
+			args:                []string{"--prometheus.histogram-type=nope"},
+			expectErrorContains: `--prometheus.histogram-type must be "histogram" or "summary"`,
+		},
+		{args: []string{"--prometheus.buckets=0.1,1,10"}},
+		{
+			args:                []string{"--prometheus.buckets=0.1,x"},
+			expectErrorContains: `--prometheus.buckets invalid: "x" is not a number`,
+		},
+		{
+			args:                []string{"--prometheus.buckets=1,0.1"},
+			expectErrorContains: "--prometheus.buckets must be in increasing order",
+		},
+		{args: []string{"--prometheus.exponential-buckets=0.001,2,10"}},
+		{
+			args:                []string{"--prometheus.exponential-buckets=0.001,2"},
+			expectErrorContains: "--prometheus.exponential-buckets invalid: expected 3 comma-delimited values",
+		},
+		{
+			args:                []string{"--prometheus.exponential-buckets=0,2,10"},
+			expectErrorContains: "--prometheus.exponential-buckets start must be greater than 0",
+		},
+		{
+			args:                []string{"--prometheus.exponential-buckets=1,1,10"},
+			expectErrorContains: "--prometheus.exponential-buckets factor must be greater than 1",
+		},
+		{
+			args:                []string{"--prometheus.exponential-buckets=1,2,0"},
+			expectErrorContains: "--prometheus.exponential-buckets invalid: count must be greater than 0",
+		},
+		{args: []string{"--prometheus.linear-buckets=0,0.5,10"}},
+		{
+			args:                []string{"--prometheus.linear-buckets=0,0,10"},
+			expectErrorContains: "--prometheus.linear-buckets width must be greater than 0",
+		},
+		{
+			args:                []string{"--prometheus.linear-buckets=0,1,x"},
+			expectErrorContains: `--prometheus.linear-buckets invalid: "x" is not an integer`,
+		},
+		{
+			args: []string{
+				"--prometheus.buckets=1",
+				"--prometheus.linear-buckets=0,1,10",
+			},
+			expectErrorContains: "only one of --prometheus.buckets, --prometheus.exponential-buckets, or --prometheus.linear-buckets may be specified",
+		},
+		{args: []string{"--prometheus.summary-objectives=0.5:0.01,0.999:0.0001"}},
+		{
+			args:                []string{"--prometheus.summary-objectives=1.5:0.01"},
+			expectErrorContains: `--prometheus.summary-objectives invalid: "1.5" is not a quantile between 0 and 1`,
+		},
+		{
+			args:                []string{"--prometheus.summary-objectives=0.5:x"},
+			expectErrorContains: `--prometheus.summary-objectives invalid: "x" is not a valid error for quantile 0.5`,
+		},
+		{
+			args:                []string{"--prometheus.summary-objectives="},
+			expectErrorContains: "--prometheus.summary-objectives invalid: at least one objective must be specified",
+		},
+	}
+
+	for _, tc := range testCases {
+		assert.Group(strings.Join(tc.args, " "), t, func(g *assert.G) {
+			fs := tbnflag.NewTestFlagSet()
+			ff := newPrometheusFromFlags(fs.Scope("prometheus", ""))
+			assert.Nil(g, fs.Parse(tc.args))
+
+			if tc.expectErrorContains != "" {
+				assert.ErrorContains(g, ff.Validate(), tc.expectErrorContains)
+			} else {
+				assert.Nil(g, ff.Validate())
+			}
+		})
+	}
+}
+
+func TestPrometheusFromFlagsSenderOptions(t *testing.T) {
+	testCases := []struct {
+		args               []string
+		expectedBuckets    []float64
+		expectedObjectives map[float64]float64
+	}{
+		{
+			expectedBuckets: prometheus.DefBuckets,
+		},
+		{
+			args:            []string{"--prometheus.buckets=0.25,0.5", "--prometheus.buckets=1"},
+			expectedBuckets: []float64{0.25, 0.5, 1},
+		},
+		{
+			args:            []string{"--prometheus.exponential-buckets=0.001,10,3"},
+			expectedBuckets: []float64{0.001, 0.01, 0.1},
+		},
+		{
+			args:            []string{"--prometheus.linear-buckets=1,2,3"},
+			expectedBuckets: []float64{1, 3, 5},
+		},
+		{
+			args:               []string{"--prometheus.histogram-type=summary"},
+			expectedBuckets:    prometheus.DefBuckets,
+			expectedObjectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		},
+	}
+
+	for _, tc := range testCases {
+		assert.Group(strings.Join(tc.args, " "), t, func(g *assert.G) {
+			fs := tbnflag.NewTestFlagSet()
+			ff := newPrometheusFromFlags(fs.Scope("prometheus", "")).(*prometheusFromFlags)
+			assert.Nil(g, fs.Parse(tc.args))
+			assert.Nil(g, ff.Validate())
+
+			options, err := ff.senderOptions()
+			assert.Nil(g, err)
+
+			s := newPrometheusSender(prometheus.NewRegistry(), options...)
+			assert.ArrayEqual(g, s.buckets, tc.expectedBuckets)
+			assert.Equal(g, s.useSummaries, tc.expectedObjectives != nil)
+			if tc.expectedObjectives != nil {
+				assert.MapEqual(g, s.objectives, tc.expectedObjectives)
+			}
+		})
+	}
 }
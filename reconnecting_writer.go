@@ -0,0 +1,285 @@
+/*
+Copyright 2018 Turbine Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/turbinelabs/nonstdlib/log/console"
+	tbntime "github.com/turbinelabs/nonstdlib/time"
+)
+
+const (
+	// defaultMaxBufferSize is the default number of bytes buffered by a
+	// reconnectingWriter while its connection is unavailable.
+	defaultMaxBufferSize = 1 << 20
+
+	// defaultReconnectDelay is the default minimum time between
+	// connection attempts made by a reconnectingWriter.
+	defaultReconnectDelay = time.Second
+
+	// defaultDialTimeout is the timeout applied when dialing
+	// connections for a reconnectingWriter.
+	defaultDialTimeout = 5 * time.Second
+)
+
+var errWriterClosed = errors.New("writer closed")
+
+// dialFunc opens a new connection.
+type dialFunc func() (net.Conn, error)
+
+// mkDialFunc returns a dialFunc that dials addr on the given network.
+func mkDialFunc(network, addr string) dialFunc {
+	return func() (net.Conn, error) {
+		return net.DialTimeout(network, addr, defaultDialTimeout)
+	}
+}
+
+// reconnectingWriter is an io.WriteCloser that writes to a
+// connection obtained from a dialFunc. Each Write is treated as a
+// record: if the connection cannot be established or a write fails,
+// the connection is discarded and the record is buffered and retried
+// on a new connection. A partially written record is retried from
+// the first stat not yet written.
+// Buffered records are retried on the next Write or Flush. At most
+// maxBufferSize bytes are buffered; the oldest records are dropped to
+// make room for new ones. Connection attempts are made at most once
+// per reconnectDelay. If a deliveryStats is configured, it records
+// the records written, failed connection attempts and writes, and
+// the stats in buffered records that are dropped.
+type reconnectingWriter struct {
+	lock *sync.Mutex
+
+	dial           dialFunc
+	maxBufferSize  int
+	reconnectDelay time.Duration
+	timeSource     tbntime.Source
+	deliveryStats  *deliveryStats
+
+	conn          net.Conn
+	nextDial      time.Time
+	pending       [][]byte
+	pendingBytes  int
+	droppedWrites int64
+	closed        bool
+}
+
+// reconnectingWriterOption is an option for configuring
+// reconnectingWriter instances created via newReconnectingWriter.
+type reconnectingWriterOption func(*reconnectingWriter)
+
+// maxBufferSize sets the maximum number of bytes buffered while the
+// connection is unavailable.
+func maxBufferSize(n int) reconnectingWriterOption {
+	return func(w *reconnectingWriter) {
+		w.maxBufferSize = n
+	}
+}
+
+// reconnectDelay sets the minimum time between connection attempts.
+func reconnectDelay(d time.Duration) reconnectingWriterOption {
+	return func(w *reconnectingWriter) {
+		w.reconnectDelay = d
+	}
+}
+
+// writerTimeSource sets the tbntime.Source used to schedule
+// connection attempts for testing purposes.
+func writerTimeSource(src tbntime.Source) reconnectingWriterOption {
+	return func(w *reconnectingWriter) {
+		w.timeSource = src
+	}
+}
+
+// writerDeliveryStats sets the deliveryStats used to record the
+// writer's delivery health.
+func writerDeliveryStats(ds *deliveryStats) reconnectingWriterOption {
+	return func(w *reconnectingWriter) {
+		w.deliveryStats = ds
+	}
+}
+
+// newReconnectingWriter constructs a reconnectingWriter using the
+// given dialFunc. No connection is made until the first Write.
+func newReconnectingWriter(
+	dial dialFunc,
+	options ...reconnectingWriterOption,
+) *reconnectingWriter {
+	w := &reconnectingWriter{
+		lock:           &sync.Mutex{},
+		dial:           dial,
+		maxBufferSize:  defaultMaxBufferSize,
+		reconnectDelay: defaultReconnectDelay,
+		timeSource:     tbntime.NewSource(),
+	}
+
+	for _, opt := range options {
+		opt(w)
+	}
+
+	return w
+}
+
+// Write buffers p and attempts to write all buffered records to the
+// connection. Failure to deliver p is not considered an error so long
+// as p remains buffered. If p is not buffered, an error is returned
+// and the caller is responsible for recording its stats as dropped.
+func (w *reconnectingWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return 0, errWriterClosed
+	}
+
+	if len(p) > w.maxBufferSize {
+		w.droppedWrites++
+		return 0, io.ErrShortBuffer
+	}
+
+	record := make([]byte, len(p))
+	copy(record, p)
+
+	w.pending = append(w.pending, record)
+	w.pendingBytes += len(record)
+
+	for w.pendingBytes > w.maxBufferSize {
+		w.pendingBytes -= len(w.pending[0])
+		w.deliveryStats.drop(countStats(w.pending[0]))
+		w.pending[0] = nil
+		w.pending = w.pending[1:]
+		w.droppedWrites++
+	}
+
+	w.flush()
+
+	return len(p), nil
+}
+
+// Flush attempts to write any buffered records to the connection.
+func (w *reconnectingWriter) Flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return errWriterClosed
+	}
+
+	return w.flush()
+}
+
+// flush must be called with the lock held.
+func (w *reconnectingWriter) flush() error {
+	for len(w.pending) > 0 {
+		if w.conn == nil {
+			now := w.timeSource.Now()
+			if now.Before(w.nextDial) {
+				return nil
+			}
+
+			conn, err := w.dial()
+			if err != nil {
+				w.nextDial = now.Add(w.reconnectDelay)
+				w.deliveryStats.sendError()
+				console.Error().Printf("could not connect: %s", err)
+				return err
+			}
+
+			w.conn = conn
+		}
+
+		start := w.timeSource.Now()
+		if n, err := w.conn.Write(w.pending[0]); err != nil {
+			w.deliveryStats.sendError()
+			console.Error().Printf("could not write to %s: %s", w.conn.RemoteAddr(), err)
+			w.conn.Close()
+			w.conn = nil
+			if n > 0 {
+				w.resume(n)
+			}
+			return err
+		}
+		w.deliveryStats.sent(len(w.pending[0]), w.timeSource.Now().Sub(start))
+
+		w.pendingBytes -= len(w.pending[0])
+		w.pending[0] = nil
+		w.pending = w.pending[1:]
+	}
+
+	return nil
+}
+
+// resume discards the first n bytes of the oldest record, which were
+// written before its connection failed, so that they are not written
+// again. If n falls within a stat, the remainder of that stat cannot
+// be delivered intact and is dropped as well. Must be called with the
+// lock held.
+func (w *reconnectingWriter) resume(n int) {
+	record := w.pending[0]
+	if record[n-1] != '\n' {
+		w.deliveryStats.drop(1)
+		if i := bytes.IndexByte(record[n:], '\n'); i >= 0 {
+			n += i + 1
+		} else {
+			n = len(record)
+		}
+	}
+
+	w.pendingBytes -= n
+	if n == len(record) {
+		w.pending[0] = nil
+		w.pending = w.pending[1:]
+	} else {
+		w.pending[0] = record[n:]
+	}
+}
+
+// Close makes a final attempt to write buffered records and closes
+// the connection. Subsequent writes fail.
+func (w *reconnectingWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return nil
+	}
+
+	w.closed = true
+	w.nextDial = time.Time{}
+
+	err := w.flush()
+
+	if w.conn != nil {
+		if cerr := w.conn.Close(); err == nil {
+			err = cerr
+		}
+		w.conn = nil
+	}
+
+	for _, record := range w.pending {
+		w.deliveryStats.drop(countStats(record))
+	}
+	w.pending = nil
+	w.pendingBytes = 0
+
+	return err
+}
@@ -0,0 +1,295 @@
+/*
+Copyright 2018 Turbine Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	tbntime "github.com/turbinelabs/nonstdlib/time"
+	"github.com/turbinelabs/test/assert"
+)
+
+// testConn is a net.Conn that records writes and fails them on
+// demand.
+type testConn struct {
+	net.Conn
+
+	writes     []string
+	writeErr   error
+	writeLimit int
+	closed     bool
+}
+
+func (c *testConn) Write(b []byte) (int, error) {
+	if c.writeErr != nil {
+		if c.writeLimit > 0 && c.writeLimit < len(b) {
+			c.writes = append(c.writes, string(b[:c.writeLimit]))
+			return c.writeLimit, c.writeErr
+		}
+		return 0, c.writeErr
+	}
+	c.writes = append(c.writes, string(b))
+	return len(b), nil
+}
+
+func (c *testConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+}
+
+func (c *testConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+// testDialer returns queued connections or errors.
+type testDialer struct {
+	conns []*testConn
+	errs  []error
+	dials int
+}
+
+func (d *testDialer) dial() (net.Conn, error) {
+	d.dials++
+	if len(d.errs) > 0 {
+		err := d.errs[0]
+		d.errs = d.errs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	conn := d.conns[0]
+	d.conns = d.conns[1:]
+	return conn, nil
+}
+
+func TestReconnectingWriterWrites(t *testing.T) {
+	conn := &testConn{}
+	dialer := &testDialer{conns: []*testConn{conn}}
+
+	w := newReconnectingWriter(dialer.dial)
+	assert.Equal(t, dialer.dials, 0)
+
+	n, err := w.Write([]byte("a\n"))
+	assert.Equal(t, n, 2)
+	assert.Nil(t, err)
+
+	n, err = w.Write([]byte("b\n"))
+	assert.Equal(t, n, 2)
+	assert.Nil(t, err)
+
+	assert.Equal(t, dialer.dials, 1)
+	assert.ArrayEqual(t, conn.writes, []string{"a\n", "b\n"})
+
+	assert.Nil(t, w.Close())
+	assert.True(t, conn.closed)
+
+	_, err = w.Write([]byte("c\n"))
+	assert.DeepEqual(t, err, errWriterClosed)
+}
+
+func TestReconnectingWriterBuffersUntilReconnect(t *testing.T) {
+	tbntime.WithCurrentTimeFrozen(func(cs tbntime.ControlledSource) {
+		conn1 := &testConn{}
+		conn2 := &testConn{}
+		dialer := &testDialer{
+			conns: []*testConn{conn1, conn2},
+			errs:  []error{nil, errors.New("refused")},
+		}
+
+		w := newReconnectingWriter(
+			dialer.dial,
+			reconnectDelay(time.Second),
+			writerTimeSource(cs),
+		)
+
+		w.Write([]byte("a\n"))
+		assert.ArrayEqual(t, conn1.writes, []string{"a\n"})
+
+		// connection breaks: record is retained, redial fails
+		conn1.writeErr = io.ErrClosedPipe
+		n, err := w.Write([]byte("b\n"))
+		assert.Equal(t, n, 2)
+		assert.Nil(t, err)
+		assert.True(t, conn1.closed)
+
+		assert.NonNil(t, w.Flush())
+		assert.Equal(t, dialer.dials, 2)
+
+		// no redial until the delay passes
+		w.Write([]byte("c\n"))
+		assert.Nil(t, w.Flush())
+		assert.Equal(t, dialer.dials, 2)
+
+		cs.Advance(time.Second)
+		assert.Nil(t, w.Flush())
+		assert.Equal(t, dialer.dials, 3)
+		assert.ArrayEqual(t, conn2.writes, []string{"b\n", "c\n"})
+		assert.Equal(t, w.pendingBytes, 0)
+	})
+}
+
+func TestReconnectingWriterResumesPartialWrite(t *testing.T) {
+	conn1 := &testConn{}
+	conn2 := &testConn{}
+	conn3 := &testConn{}
+	dialer := &testDialer{conns: []*testConn{conn1, conn2, conn3}}
+
+	ds := newDeliveryStats("statsd")
+	w := newReconnectingWriter(
+		dialer.dial,
+		reconnectDelay(0),
+		writerDeliveryStats(ds),
+	)
+
+	// the write fails on a stat boundary
+	conn1.writeErr = io.ErrClosedPipe
+	conn1.writeLimit = 2
+	w.Write([]byte("a\nb\nc\n"))
+	assert.ArrayEqual(t, conn1.writes, []string{"a\n"})
+	assert.Equal(t, w.pendingBytes, 4)
+
+	// the write fails within a stat, which is dropped
+	conn2.writeErr = io.ErrClosedPipe
+	conn2.writeLimit = 1
+	assert.NonNil(t, w.Flush())
+	assert.ArrayEqual(t, conn2.writes, []string{"b"})
+	assert.Equal(t, w.pendingBytes, 2)
+	assert.Equal(t, ds.dropped, int64(1))
+
+	assert.Nil(t, w.Flush())
+	assert.ArrayEqual(t, conn3.writes, []string{"c\n"})
+	assert.Equal(t, w.pendingBytes, 0)
+	assert.Equal(t, ds.sendErrors, int64(2))
+}
+
+func TestReconnectingWriterResumesPartialFinalStat(t *testing.T) {
+	conn1 := &testConn{}
+	conn2 := &testConn{}
+	dialer := &testDialer{conns: []*testConn{conn1, conn2}}
+
+	ds := newDeliveryStats("statsd")
+	w := newReconnectingWriter(
+		dialer.dial,
+		reconnectDelay(0),
+		writerDeliveryStats(ds),
+	)
+
+	// the write fails within the final, unterminated stat, which is
+	// dropped along with the rest of the record
+	conn1.writeErr = io.ErrClosedPipe
+	conn1.writeLimit = 3
+	w.Write([]byte("a\nbc"))
+	assert.ArrayEqual(t, conn1.writes, []string{"a\nb"})
+	assert.Equal(t, w.pendingBytes, 0)
+	assert.Equal(t, ds.dropped, int64(1))
+
+	w.Write([]byte("d\n"))
+	assert.ArrayEqual(t, conn2.writes, []string{"d\n"})
+	assert.Equal(t, ds.dropped, int64(1))
+}
+
+func TestReconnectingWriterDropsOldest(t *testing.T) {
+	dialer := &testDialer{errs: []error{errors.New("refused")}}
+
+	w := newReconnectingWriter(dialer.dial, maxBufferSize(6))
+
+	w.Write([]byte("aa\n"))
+	w.Write([]byte("bb\n"))
+	w.Write([]byte("cc\n"))
+
+	assert.Equal(t, w.droppedWrites, int64(1))
+	assert.Equal(t, w.pendingBytes, 6)
+	assert.Equal(t, len(w.pending), 2)
+	assert.Equal(t, string(w.pending[0]), "bb\n")
+
+	n, err := w.Write([]byte(strings.Repeat("x", 7)))
+	assert.Equal(t, n, 0)
+	assert.DeepEqual(t, err, io.ErrShortBuffer)
+	assert.Equal(t, w.droppedWrites, int64(2))
+
+	conn := &testConn{}
+	dialer.conns = []*testConn{conn}
+	assert.Nil(t, w.Close())
+	assert.ArrayEqual(t, conn.writes, []string{"bb\n", "cc\n"})
+}
+
+func TestReconnectingWriterDeliveryStats(t *testing.T) {
+	conn := &testConn{}
+	dialer := &testDialer{
+		conns: []*testConn{conn},
+		errs:  []error{errors.New("refused"), nil},
+	}
+
+	ds := newDeliveryStats("statsd")
+	w := newReconnectingWriter(
+		dialer.dial,
+		maxBufferSize(6),
+		reconnectDelay(0),
+		writerDeliveryStats(ds),
+	)
+
+	w.Write([]byte("a\nb\n"))
+	assert.Equal(t, ds.sendErrors, int64(1))
+
+	// drops the oldest record, then connects and writes the rest
+	w.Write([]byte("cc\n"))
+	assert.Equal(t, ds.dropped, int64(2))
+	assert.Equal(t, ds.packetsSent, int64(1))
+	assert.Equal(t, ds.bytesSent, int64(3))
+
+	// rejected records are left to the caller to record
+	_, err := w.Write([]byte(strings.Repeat("x\n", 4)))
+	assert.DeepEqual(t, err, io.ErrShortBuffer)
+	assert.Equal(t, ds.dropped, int64(2))
+
+	conn.writeErr = io.ErrClosedPipe
+	w.Write([]byte("d\n"))
+	assert.Equal(t, ds.sendErrors, int64(2))
+
+	// unsent records are dropped on close
+	dialer.errs = []error{errors.New("refused")}
+	assert.NonNil(t, w.Close())
+	assert.Equal(t, ds.sendErrors, int64(3))
+	assert.Equal(t, ds.dropped, int64(3))
+	assert.Equal(t, ds.packetsSent, int64(1))
+}
+
+func TestReconnectingWriterTCP(t *testing.T) {
+	l, port, lines := mkTCPListener(t)
+	defer l.Close()
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	w := newReconnectingWriter(mkDialFunc("tcp", addr), reconnectDelay(0))
+	defer w.Close()
+
+	w.Write([]byte("a\n"))
+	assert.Equal(t, <-lines, "a")
+
+	// break the connection
+	w.conn.Close()
+
+	w.Write([]byte("b\n"))
+	assert.Nil(t, w.Flush())
+	assert.Equal(t, <-lines, "b")
+}
@@ -0,0 +1,284 @@
+/*
+Copyright 2018 Turbine Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"fmt"
+	"math/rand"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/xstats"
+)
+
+// sampleRate is the sample rate applied to stats whose names match
+// a pattern.
+type sampleRate struct {
+	pattern string
+	rate    float64
+}
+
+// parseSampleRates parses sample rates of the form
+// "<pattern>=<rate>". Patterns use the syntax of path.Match and rates
+// must be in the range (0, 1].
+func parseSampleRates(strs []string) ([]sampleRate, error) {
+	rates := make([]sampleRate, 0, len(strs))
+	for _, str := range strs {
+		idx := strings.LastIndex(str, "=")
+		if idx <= 0 {
+			return nil, fmt.Errorf("sample rate %q must be of the form <pattern>=<rate>", str)
+		}
+
+		pattern := str[0:idx]
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("sample rate %q has an invalid pattern: %s", str, err)
+		}
+
+		rate, err := strconv.ParseFloat(str[idx+1:], 64)
+		if err != nil || !validSampleRate(rate) {
+			return nil, fmt.Errorf("sample rate %q must have a rate greater than 0 and at most 1", str)
+		}
+
+		rates = append(rates, sampleRate{pattern: pattern, rate: rate})
+	}
+
+	return rates, nil
+}
+
+func validSampleRate(rate float64) bool {
+	return rate > 0.0 && rate <= 1.0
+}
+
+// newSamplingSender constructs an xstats Sender that samples counts,
+// histograms, timings and distributions before passing them to the
+// underlying Sender. The sample rate for a stat is taken from its
+// SampleRateTag, if present, and otherwise from the first pattern
+// matching the stat's name, falling back to defaultRate. Stats that
+// are sent with a rate less than 1 carry a SampleRateTag with the
+// rate, which the statsd senders annotate and the latching sender
+// uses to scale the stat. Gauges, sets, service checks and events are
+// never sampled. A defaultRate outside the range (0, 1] is treated as
+// 1.
+func newSamplingSender(
+	underlying xstatsSender,
+	c cleaner,
+	defaultRate float64,
+	rates []sampleRate,
+) *samplingSender {
+	if !validSampleRate(defaultRate) {
+		defaultRate = 1.0
+	}
+
+	return &samplingSender{
+		underlying:  underlying,
+		cleaner:     c,
+		defaultRate: defaultRate,
+		rates:       rates,
+		random:      rand.Float64,
+	}
+}
+
+type samplingSender struct {
+	underlying  xstatsSender
+	cleaner     cleaner
+	defaultRate float64
+	rates       []sampleRate
+
+	// random returns a pseudo-random number in [0.0, 1.0).
+	random func() float64
+}
+
+func (s *samplingSender) Gauge(stat string, value float64, tags ...string) {
+	_, _, tags = splitSampleRate(tags, s.cleaner.tagDelim)
+	s.underlying.Gauge(stat, value, tags...)
+}
+
+func (s *samplingSender) Count(stat string, count float64, tags ...string) {
+	if tags, ok := s.sample(stat, tags); ok {
+		s.underlying.Count(stat, count, tags...)
+	}
+}
+
+func (s *samplingSender) Histogram(stat string, value float64, tags ...string) {
+	if tags, ok := s.sample(stat, tags); ok {
+		s.underlying.Histogram(stat, value, tags...)
+	}
+}
+
+func (s *samplingSender) Timing(stat string, value time.Duration, tags ...string) {
+	if tags, ok := s.sample(stat, tags); ok {
+		s.underlying.Timing(stat, value, tags...)
+	}
+}
+
+// Describe forwards the Descriptor to the underlying sender, if it
+// accepts Descriptors.
+func (s *samplingSender) Describe(d Descriptor) {
+	if ds, ok := s.underlying.(describingSender); ok {
+		ds.Describe(d)
+	}
+}
+
+// Distribution samples the value and forwards it to the underlying
+// sender, if it supports distributions. Otherwise, the value is
+// recorded as a histogram.
+func (s *samplingSender) Distribution(stat string, value float64, tags ...string) {
+	tags, ok := s.sample(stat, tags)
+	if !ok {
+		return
+	}
+
+	if es, ok := s.underlying.(extendedSender); ok {
+		es.Distribution(stat, value, tags...)
+	} else {
+		s.underlying.Histogram(stat, value, tags...)
+	}
+}
+
+func (s *samplingSender) Set(stat string, value string, tags ...string) {
+	if es, ok := s.underlying.(extendedSender); ok {
+		_, _, tags = splitSampleRate(tags, s.cleaner.tagDelim)
+		es.Set(stat, value, tags...)
+	}
+}
+
+func (s *samplingSender) ServiceCheck(
+	name string,
+	status ServiceCheckStatus,
+	message string,
+	tags ...string,
+) {
+	if es, ok := s.underlying.(extendedSender); ok {
+		_, _, tags = splitSampleRate(tags, s.cleaner.tagDelim)
+		es.ServiceCheck(name, status, message, tags...)
+	}
+}
+
+func (s *samplingSender) Event(title string, fields []Field, tags ...string) {
+	if es, ok := s.underlying.(extendedSender); ok {
+		_, _, tags = splitSampleRate(tags, s.cleaner.tagDelim)
+		es.Event(title, fields, tags...)
+	}
+}
+
+func (s *samplingSender) Close() error {
+	return xstats.CloseSender(s.underlying)
+}
+
+// sample determines whether the stat should be sent. If so, it
+// returns the stat's tags, including a SampleRateTag if the rate is
+// less than 1.
+func (s *samplingSender) sample(stat string, tags []string) ([]string, bool) {
+	rate, explicit, tags := splitSampleRate(tags, s.cleaner.tagDelim)
+	if !explicit {
+		rate = s.rate(stat)
+	}
+
+	if rate >= 1.0 {
+		return tags, true
+	}
+
+	if s.random() >= rate {
+		return nil, false
+	}
+
+	return append(tags[:len(tags):len(tags)], sampleRateTagString(rate, s.cleaner.tagDelim)), true
+}
+
+func (s *samplingSender) rate(stat string) float64 {
+	for _, r := range s.rates {
+		if ok, _ := path.Match(r.pattern, stat); ok {
+			return r.rate
+		}
+	}
+	return s.defaultRate
+}
+
+// reservedSampleRateDelim separates the SampleRateTag from its value
+// for cleaners without a tag delimiter, such as statsdCleaner. Such
+// cleaners remove tag names, so no other tag contains it.
+const reservedSampleRateDelim = "="
+
+// sampleRateDelim returns the delimiter between the SampleRateTag and
+// its value. Without a delimiter, any tag whose name began with
+// SampleRateTag would be taken for the rate.
+func sampleRateDelim(tagDelim string) string {
+	if tagDelim == "" {
+		return reservedSampleRateDelim
+	}
+	return tagDelim
+}
+
+// sampleRateTagString formats a SampleRateTag with the given rate.
+func sampleRateTagString(rate float64, tagDelim string) string {
+	return SampleRateTag + sampleRateDelim(tagDelim) + strconv.FormatFloat(rate, 'f', -1, 64)
+}
+
+// splitSampleRate returns the sample rate given by the first
+// SampleRateTag in tags, whether the rate was given, and tags with
+// all SampleRateTags removed. If there is no SampleRateTag, or its
+// value is not in the range (0, 1], the rate is 1. The given tags are
+// not modified.
+func splitSampleRate(tags []string, tagDelim string) (float64, bool, []string) {
+	prefix := SampleRateTag + sampleRateDelim(tagDelim)
+
+	rate := 1.0
+
+	var (
+		filtered []string
+		found    bool
+		valid    bool
+	)
+	for i, tag := range tags {
+		if !strings.HasPrefix(tag, prefix) {
+			if found {
+				filtered = append(filtered, tag)
+			}
+			continue
+		}
+
+		if !found {
+			found = true
+			filtered = append(make([]string, 0, len(tags)-1), tags[:i]...)
+			if r, err := strconv.ParseFloat(tag[len(prefix):], 64); err == nil && validSampleRate(r) {
+				rate = r
+				valid = true
+			}
+		}
+	}
+
+	if !found {
+		return rate, false, tags
+	}
+
+	return rate, valid, filtered
+}
+
+// sampleWeight returns the number of occurrences represented by a
+// single stat sent at the given rate. The weight is not rounded, so
+// that stats sampled at rates whose reciprocal is not an integer are
+// not biased.
+func sampleWeight(rate float64) float64 {
+	return 1.0 / rate
+}
+
+var (
+	_ describingSender = &samplingSender{}
+	_ extendedSender   = &samplingSender{}
+)
@@ -0,0 +1,239 @@
+/*
+Copyright 2018 Turbine Labs, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stats
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	tbnstrings "github.com/turbinelabs/nonstdlib/strings"
+	"github.com/turbinelabs/test/assert"
+)
+
+func TestParseSampleRates(t *testing.T) {
+	rates, err := parseSampleRates(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, len(rates), 0)
+
+	rates, err = parseSampleRates([]string{"requests.*=0.1", "a=b=1", "x=0.5"})
+	assert.Nil(t, err)
+	assert.DeepEqual(
+		t,
+		rates,
+		[]sampleRate{
+			{pattern: "requests.*", rate: 0.1},
+			{pattern: "a=b", rate: 1.0},
+			{pattern: "x", rate: 0.5},
+		},
+	)
+
+	testCases := []struct {
+		input         string
+		expectedError string
+	}{
+		{"x", "must be of the form <pattern>=<rate>"},
+		{"=0.1", "must be of the form <pattern>=<rate>"},
+		{"[=0.1", "has an invalid pattern"},
+		{"x=", "must have a rate greater than 0 and at most 1"},
+		{"x=0", "must have a rate greater than 0 and at most 1"},
+		{"x=1.5", "must have a rate greater than 0 and at most 1"},
+		{"x=lots", "must have a rate greater than 0 and at most 1"},
+	}
+
+	for _, tc := range testCases {
+		assert.Group(tc.input, t, func(g *assert.G) {
+			rates, err := parseSampleRates([]string{tc.input})
+			assert.Nil(g, rates)
+			assert.ErrorContains(g, err, tc.expectedError)
+		})
+	}
+}
+
+func TestSplitSampleRate(t *testing.T) {
+	rate, ok, tags := splitSampleRate([]string{"a:b"}, ":")
+	assert.Equal(t, rate, 1.0)
+	assert.False(t, ok)
+	assert.ArrayEqual(t, tags, []string{"a:b"})
+
+	input := []string{"a:b", "sample_rate:0.5", "c:d", "sample_rate:0.1"}
+	rate, ok, tags = splitSampleRate(input, ":")
+	assert.Equal(t, rate, 0.5)
+	assert.True(t, ok)
+	assert.ArrayEqual(t, tags, []string{"a:b", "c:d"})
+	assert.Equal(t, input[1], "sample_rate:0.5")
+
+	rate, ok, tags = splitSampleRate([]string{"sample_rate:2"}, ":")
+	assert.Equal(t, rate, 1.0)
+	assert.False(t, ok)
+	assert.Equal(t, len(tags), 0)
+
+	rate, ok, tags = splitSampleRate([]string{"sample_rate=0.25"}, "")
+	assert.Equal(t, rate, 0.25)
+	assert.True(t, ok)
+	assert.Equal(t, len(tags), 0)
+
+	// without a tag delimiter, the key must match exactly
+	input = []string{"sample_rate0.25", "sample_rates1"}
+	rate, ok, tags = splitSampleRate(input, "")
+	assert.Equal(t, rate, 1.0)
+	assert.False(t, ok)
+	assert.ArrayEqual(t, tags, input)
+	assert.Equal(t, sampleRateTagString(0.25, ""), "sample_rate=0.25")
+}
+
+func TestSampleWeight(t *testing.T) {
+	assert.Equal(t, sampleWeight(1.0), 1.0)
+	assert.Equal(t, sampleWeight(0.5), 2.0)
+	assert.Equal(t, sampleWeight(0.25), 4.0)
+	assert.Equal(t, sampleWeight(0.3), 1.0/0.3)
+}
+
+func TestSamplingSender(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	underlying := newMockXstatsSender(ctrl)
+
+	s := newSamplingSender(
+		underlying,
+		dogstatsdCleaner,
+		0.5,
+		[]sampleRate{
+			{pattern: "requests.*", rate: 0.1},
+			{pattern: "all", rate: 1.0},
+		},
+	)
+
+	random := 0.0
+	s.random = func() float64 { return random }
+
+	gomock.InOrder(
+		underlying.EXPECT().Count("requests.count", 1.0, "a:b", "sample_rate:0.1"),
+		underlying.EXPECT().Histogram("h", 2.0, "sample_rate:0.5"),
+		underlying.EXPECT().Timing("t", time.Second, "sample_rate:0.25"),
+		underlying.EXPECT().Count("all", 1.0),
+		underlying.EXPECT().Gauge("g", 3.0, "a:b"),
+		underlying.EXPECT().Histogram("d", 4.0, "sample_rate:0.5"),
+	)
+
+	s.Count("requests.count", 1.0, "a:b")
+	s.Histogram("h", 2.0)
+	s.Timing("t", time.Second, "sample_rate:0.25")
+	s.Count("all", 1.0)
+	s.Gauge("g", 3.0, "a:b", "sample_rate:0.1")
+	s.Distribution("d", 4.0)
+
+	// dropped
+	random = 0.5
+	s.Count("requests.count", 1.0)
+	s.Histogram("h", 2.0)
+	s.Timing("t", time.Second, "sample_rate:0.25")
+
+	// not sampled
+	underlying.EXPECT().Gauge("g", 3.0)
+	underlying.EXPECT().Count("all", 1.0)
+	s.Gauge("g", 3.0)
+	s.Count("all", 1.0)
+
+	assert.Nil(t, s.Close())
+}
+
+func TestSamplingSenderInvalidDefaultRate(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	underlying := newMockXstatsSender(ctrl)
+
+	s := newSamplingSender(underlying, dogstatsdCleaner, 0.0, nil)
+	s.random = func() float64 { return 0.99 }
+
+	underlying.EXPECT().Count("c", 1.0)
+	s.Count("c", 1.0)
+}
+
+func TestSamplingSenderDoesNotModifyTags(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	underlying := newMockXstatsSender(ctrl)
+
+	s := newSamplingSender(underlying, dogstatsdCleaner, 0.5, nil)
+	s.random = func() float64 { return 0.0 }
+
+	tags := make([]string, 1, 2)
+	tags[0] = "a:b"
+	extra := tags[:2]
+
+	underlying.EXPECT().Count("c", 1.0, "a:b", "sample_rate:0.5")
+	s.Count("c", 1.0, tags...)
+	assert.Equal(t, extra[1], "")
+}
+
+func TestSamplingSenderExtended(t *testing.T) {
+	w := &testWriter{}
+	underlying := newDogstatsdSender(w, time.Hour, defaultMaxPacketLen)
+
+	s := newSamplingSender(underlying, dogstatsdCleaner, 0.5, nil)
+	s.random = func() float64 { return 0.0 }
+
+	s.Distribution("d", 1.0)
+	s.Set("s", "v", "sample_rate:0.1")
+	s.ServiceCheck("sc", ServiceCheckOK, "", "sample_rate:0.1")
+	s.Event("ev", nil, "sample_rate:0.1")
+	assert.Nil(t, s.Close())
+
+	assert.Equal(
+		t,
+		w.String(),
+		"d:1.000000|d|@0.5\ns:v|s\n_sc|sc|0\n_e{2,0}:ev|\n",
+	)
+}
+
+func TestStatsdBackendSampleRates(t *testing.T) {
+	l := mkListener(t)
+	defer l.Close()
+
+	_, port, err := tbnstrings.SplitHostPort(l.Addr(t))
+	assert.Nil(t, err)
+
+	ff := &statsdFromFlags{
+		host:          "127.0.0.1",
+		port:          port,
+		flushInterval: 10 * time.Millisecond,
+		sampleRate:    1.0,
+		lsff:          &latchingSenderFromFlags{},
+	}
+	ff.sampleRates.Strings = []string{"x.sampled=0.5"}
+
+	stats, err := ff.Make()
+	assert.Nil(t, err)
+	defer stats.Close()
+
+	random := 0.75
+	stats.(*xStats).sender.(*samplingSender).random = func() float64 { return random }
+
+	scope := stats.Scope("x")
+	scope.Count("sampled", 1.0)
+	scope.Count("count", 2.0)
+	assert.Equal(t, <-l.Msgs, fmt.Sprintf("x.count:%f|c\n", 2.0))
+
+	random = 0.25
+	scope.Count("sampled", 1.0)
+	assert.Equal(t, <-l.Msgs, fmt.Sprintf("x.sampled:%f|c|@0.5\n", 1.0))
+}
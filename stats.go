@@ -20,6 +20,7 @@ package stats
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/rs/xstats"
@@ -53,6 +54,11 @@ type Stats interface {
 	// Not supported by all backends
 	Event(stat string, fields ...Field)
 
+	// Describe declares metadata for one or more stats. Backends that
+	// support metadata use it to annotate the stats; others ignore it.
+	// Stats should be described before they are first recorded.
+	Describe(descriptors ...Descriptor)
+
 	// AddTag adds a tag to the request client, this tag will be sent with all
 	// subsequent stats queries, for backends that support tags.
 	AddTags(tags ...Tag)
@@ -89,8 +95,11 @@ func newFromSender(
 	return stats
 }
 
+var _ ExtendedStats = &xStats{}
+
 type xStats struct {
 	xstater             xstats.XStater
+	prefix              string
 	sender              xstats.Sender
 	cleaner             cleaner
 	classifyStatusCodes bool
@@ -98,46 +107,83 @@ type xStats struct {
 }
 
 func (xs *xStats) Gauge(stat string, value float64, tags ...Tag) {
-	tags = xs.tagTransformer.transform(tags)
-	if xs.classifyStatusCodes {
-		tags = statusCodeClassifier(tags)
-	}
-	xs.xstater.Gauge(xs.cleaner.cleanStatName(stat), value, xs.cleaner.tagsToStrings(tags)...)
+	xs.xstater.Gauge(xs.cleaner.cleanStatName(stat), value, xs.tagStrings(tags)...)
 }
 
 func (xs *xStats) Count(stat string, count float64, tags ...Tag) {
-	tags = xs.tagTransformer.transform(tags)
-	if xs.classifyStatusCodes {
-		tags = statusCodeClassifier(tags)
-	}
-	xs.xstater.Count(xs.cleaner.cleanStatName(stat), count, xs.cleaner.tagsToStrings(tags)...)
+	xs.xstater.Count(xs.cleaner.cleanStatName(stat), count, xs.tagStrings(tags)...)
 }
 
 func (xs *xStats) Histogram(stat string, value float64, tags ...Tag) {
-	tags = xs.tagTransformer.transform(tags)
-	if xs.classifyStatusCodes {
-		tags = statusCodeClassifier(tags)
-	}
-	xs.xstater.Histogram(xs.cleaner.cleanStatName(stat), value, xs.cleaner.tagsToStrings(tags)...)
+	xs.xstater.Histogram(xs.cleaner.cleanStatName(stat), value, xs.tagStrings(tags)...)
 }
 
 func (xs *xStats) Timing(stat string, value time.Duration, tags ...Tag) {
-	tags = xs.tagTransformer.transform(tags)
-	if xs.classifyStatusCodes {
-		tags = statusCodeClassifier(tags)
+	xs.xstater.Timing(xs.cleaner.cleanStatName(stat), value, xs.tagStrings(tags)...)
+}
+
+// Distribution records a distribution if the underlying sender
+// supports them, and a histogram otherwise.
+func (xs *xStats) Distribution(stat string, value float64, tags ...Tag) {
+	es, ok := xs.sender.(extendedSender)
+	if !ok {
+		xs.Histogram(stat, value, tags...)
+		return
+	}
+
+	es.Distribution(xs.scopedStatName(stat), value, xs.scopedTagStrings(tags)...)
+}
+
+// Set records a set value if the underlying sender supports sets.
+func (xs *xStats) Set(stat string, value string, tags ...Tag) {
+	if es, ok := xs.sender.(extendedSender); ok {
+		es.Set(xs.scopedStatName(stat), value, xs.scopedTagStrings(tags)...)
 	}
-	xs.xstater.Timing(xs.cleaner.cleanStatName(stat), value, xs.cleaner.tagsToStrings(tags)...)
 }
 
+// ServiceCheck records a service check if the underlying sender
+// supports service checks.
+func (xs *xStats) ServiceCheck(
+	name string,
+	status ServiceCheckStatus,
+	message string,
+	tags ...Tag,
+) {
+	if es, ok := xs.sender.(extendedSender); ok {
+		es.ServiceCheck(xs.scopedStatName(name), status, message, xs.scopedTagStrings(tags)...)
+	}
+}
+
+// Event records an event if the underlying sender supports events.
+// The event is named by the scoped stat and tagged with the tags
+// added via AddTags.
 func (xs *xStats) Event(stat string, fields ...Field) {
+	if es, ok := xs.sender.(extendedSender); ok {
+		es.Event(xs.scopedStatName(stat), fields, xs.xstater.GetTags()...)
+	}
 }
 
-func (xs *xStats) AddTags(tags ...Tag) {
-	tags = xs.tagTransformer.transform(tags)
-	if xs.classifyStatusCodes {
-		tags = statusCodeClassifier(tags)
+func (xs *xStats) Describe(descriptors ...Descriptor) {
+	ds, ok := xs.sender.(describingSender)
+	if !ok {
+		return
+	}
+
+	for _, d := range descriptors {
+		d.Name = xs.prefix + xs.cleaner.cleanStatName(d.Name)
+		if d.TagKeys != nil {
+			keys := make([]string, len(d.TagKeys))
+			for i, k := range d.TagKeys {
+				keys[i] = xs.cleaner.cleanTagName(k)
+			}
+			d.TagKeys = keys
+		}
+		ds.Describe(d)
 	}
-	xs.xstater.AddTags(xs.cleaner.tagsToStrings(tags)...)
+}
+
+func (xs *xStats) AddTags(tags ...Tag) {
+	xs.xstater.AddTags(xs.tagStrings(tags)...)
 }
 
 func (xs *xStats) Close() error {
@@ -149,5 +195,28 @@ func (xs *xStats) Close() error {
 
 func (xs *xStats) Scope(scope string, scopes ...string) Stats {
 	xsr := xstats.Scope(xs.xstater, scope, scopes...)
-	return &xStats{xsr, xs.sender, xs.cleaner, xs.classifyStatusCodes, xs.tagTransformer}
+	prefix := xs.prefix + strings.Join(append([]string{scope}, scopes...), xs.cleaner.scopeDelim) +
+		xs.cleaner.scopeDelim
+	return &xStats{xsr, prefix, xs.sender, xs.cleaner, xs.classifyStatusCodes, xs.tagTransformer}
+}
+
+// tagStrings transforms, classifies, and cleans the given tags.
+func (xs *xStats) tagStrings(tags []Tag) []string {
+	tags = xs.tagTransformer.transform(tags)
+	if xs.classifyStatusCodes {
+		tags = statusCodeClassifier(tags)
+	}
+	return xs.cleaner.tagsToStrings(tags)
+}
+
+// scopedStatName cleans and scopes the given stat name for stats sent
+// directly to the underlying sender.
+func (xs *xStats) scopedStatName(stat string) string {
+	return xs.prefix + xs.cleaner.cleanStatName(stat)
+}
+
+// scopedTagStrings is like tagStrings but includes the tags added via
+// AddTags, for stats sent directly to the underlying sender.
+func (xs *xStats) scopedTagStrings(tags []Tag) []string {
+	return append(xs.tagStrings(tags), xs.xstater.GetTags()...)
 }
@@ -147,6 +147,41 @@ func TestScope(t *testing.T) {
 	s.Gauge("gauge", 1.0, NewKVTag(StatusCodeTag, "200"))
 }
 
+type describingXstatsSender struct {
+	xstats.Sender
+	descriptors []Descriptor
+}
+
+func (ds *describingXstatsSender) Describe(d Descriptor) {
+	ds.descriptors = append(ds.descriptors, d)
+}
+
+func TestDescribe(t *testing.T) {
+	ctrl := gomock.NewController(assert.Tracing(t))
+	defer ctrl.Finish()
+
+	sender := &describingXstatsSender{Sender: newMockXstatsSender(ctrl)}
+
+	s := newFromSender(sender, newPrefixStrippingCleaner(), "foo", nil, false)
+	s.Describe(NewDescriptor("abc:g", GaugeMetric, "help"))
+	s.Scope("bar", "baz").Describe(
+		NewDescriptor("def:c", CounterMetric, "").WithUnit("u").WithTagKeys("x:a", "b"),
+	)
+
+	assert.ArrayEqual(
+		t,
+		sender.descriptors,
+		[]Descriptor{
+			{Name: "foo.g", Type: GaugeMetric, Help: "help"},
+			{Name: "foo.bar.baz.c", Type: CounterMetric, Unit: "u", TagKeys: []string{"a", "b"}},
+		},
+	)
+
+	// senders that do not accept descriptors are ignored
+	newFromSender(newMockXstatsSender(ctrl), newIdentityCleaner(), "", nil, false).
+		Describe(NewDescriptor("g", GaugeMetric, "help"))
+}
+
 func TestTags(t *testing.T) {
 	ctrl := gomock.NewController(assert.Tracing(t))
 	defer ctrl.Finish()
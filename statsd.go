@@ -17,17 +17,20 @@ limitations under the License.
 package stats
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/rs/xstats"
-	"github.com/rs/xstats/statsd"
 
 	tbnflag "github.com/turbinelabs/nonstdlib/flag"
 	tbnstrings "github.com/turbinelabs/nonstdlib/strings"
+	tbntime "github.com/turbinelabs/nonstdlib/time"
 )
 
 const (
@@ -35,8 +38,15 @@ const (
 	defaultPort          = 8125
 	defaultFlushInterval = 5 * time.Second
 	defaultMaxPacketLen  = 8192 // assume jumbo ethernet frames that handle 8k payload
+
+	udpTransport      = "udp"
+	tcpTransport      = "tcp"
+	unixgramTransport = "unixgram"
+	unixTransport     = "unix"
 )
 
+var statsdTransports = []string{udpTransport, tcpTransport, unixgramTransport, unixTransport}
+
 var statsdCleaner = cleaner{
 	cleanStatName: stripColons,
 	cleanTagName:  strip,
@@ -48,29 +58,127 @@ var stdoutWriter io.Writer = os.Stdout
 
 type statsdFromFlags struct {
 	flagScope     string
+	transport     string
 	host          string
 	port          int
+	socket        string
 	maxPacketLen  int
+	maxBufferSize int
 	flushInterval time.Duration
+	sampleRate    float64
+	sampleRates   tbnflag.Strings
 	scope         string
 	transforms    string
 	lsff          *latchingSenderFromFlags
 	debug         bool
 }
 
-// mkStatsdSenderFunc allows alternate statsd-look-alike APIs to reuse statsdFromFlags.
+// mkStatsdSenderFunc allows alternate statsd-look-alike APIs to reuse
+// statsdFromFlags. The returned Sender is responsible for closing
+// netWriter when it is closed.
 type mkStatsdSenderFunc func(
 	netWriter io.Writer,
 	flushInterval time.Duration,
 	maxPacketLen int,
 ) xstats.Sender
 
+// newStatsdSender constructs an xstats Sender that emits stats in the
+// statsd format to the given io.Writer. Stats are buffered for the
+// flush interval or until the buffer would exceed maxPacketLen bytes,
+// whichever comes first. Tags are ignored, except that stats carrying
+// a SampleRateTag are sent with the sample rate, so that the server
+// can scale them.
+func newStatsdSender(
+	w io.Writer,
+	flushInterval time.Duration,
+	maxPacketLen int,
+	options ...packetBufferOption,
+) *statsdSender {
+	return &statsdSender{
+		packetBuffer: newPacketBuffer(w, flushInterval, maxPacketLen, options...),
+		tagDelim:     statsdCleaner.tagDelim,
+	}
+}
+
+type statsdSender struct {
+	*packetBuffer
+
+	tagDelim string
+
+	// tagged indicates that tags are sent in the dogstatsd format.
+	tagged bool
+}
+
+// Gauge implements xstats.Sender interface
+func (s *statsdSender) Gauge(stat string, value float64, tags ...string) {
+	s.metric(stat, formatStatsdValue(value), "g", tags)
+}
+
+// Count implements xstats.Sender interface
+func (s *statsdSender) Count(stat string, count float64, tags ...string) {
+	s.metric(stat, formatStatsdValue(count), "c", tags)
+}
+
+// Histogram implements xstats.Sender interface
+func (s *statsdSender) Histogram(stat string, value float64, tags ...string) {
+	s.metric(stat, formatStatsdValue(value), "h", tags)
+}
+
+// Timing implements xstats.Sender interface. Timings are recorded in
+// milliseconds.
+func (s *statsdSender) Timing(stat string, duration time.Duration, tags ...string) {
+	s.metric(stat, formatStatsdValue(duration.Seconds()*1000), "ms", tags)
+}
+
+func (s *statsdSender) metric(stat, value, typ string, tags []string) {
+	rate, _, tags := splitSampleRate(tags, s.tagDelim)
+
+	line := &bytes.Buffer{}
+	fmt.Fprintf(line, "%s:%s|%s", stat, value, typ)
+	if rate < 1.0 {
+		fmt.Fprintf(line, "|@%s", strconv.FormatFloat(rate, 'f', -1, 64))
+	}
+	s.writeTags(line, tags)
+	line.WriteByte('\n')
+
+	s.write(line.Bytes())
+}
+
+// writeTags writes the non-empty tags, if the sender is tagged. Tags
+// removed by the cleaner (e.g. TimestampTag) are empty.
+func (s *statsdSender) writeTags(buf *bytes.Buffer, tags []string) {
+	if !s.tagged {
+		return
+	}
+
+	sep := "|#"
+	for _, tag := range tags {
+		if tag != "" {
+			buf.WriteString(sep)
+			buf.WriteString(tag)
+			sep = ","
+		}
+	}
+}
+
+func formatStatsdValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', 6, 64)
+}
+
 func newStatsdFromFlags(fs tbnflag.FlagSet) *statsdFromFlags {
 	ff := &statsdFromFlags{
-		flagScope: fs.GetScope(),
-		lsff:      newLatchingSenderFromFlags(fs, false),
+		flagScope:   fs.GetScope(),
+		sampleRates: tbnflag.NewStrings(),
+		lsff:        newLatchingSenderFromFlags(fs, false),
 	}
 
+	fs.StringVar(
+		&ff.transport,
+		"transport",
+		udpTransport,
+		"Specifies the transport used to send stats. One of "+strings.Join(statsdTransports, ", ")+". The udp and tcp transports use the host and port flags. The unixgram and unix transports use the socket flag. With tcp and unix, stats are newline-delimited. With every transport but udp, the connection is re-established after failures and stats are buffered while it is unavailable.",
+	)
+
 	fs.StringVar(
 		&ff.host,
 		"host",
@@ -92,6 +200,20 @@ func newStatsdFromFlags(fs tbnflag.FlagSet) *statsdFromFlags {
 		"Specifies the maximum number of payload `bytes` sent per flush. If necessary, flushes will occur before the flush interval to prevent payloads from exceeding this size. The size does not include IP and UDP header bytes. Stats may not be delivered if the total size of the headers and payload exceeds the network's MTU.",
 	)
 
+	fs.StringVar(
+		&ff.socket,
+		"socket",
+		"",
+		"Specifies the `path` of the destination Unix domain socket for stats. Required for the unixgram and unix transports.",
+	)
+
+	fs.IntVar(
+		&ff.maxBufferSize,
+		"max-buffer-size",
+		defaultMaxBufferSize,
+		"Specifies the maximum number of `bytes` buffered while the connection is unavailable. If exceeded, the oldest stats are dropped. Must be at least as large as the max-packet-len. Ignored for the udp transport.",
+	)
+
 	fs.DurationVar(
 		&ff.flushInterval,
 		"flush-interval",
@@ -99,6 +221,19 @@ func newStatsdFromFlags(fs tbnflag.FlagSet) *statsdFromFlags {
 		"Specifies the `duration` between stats flushes.",
 	)
 
+	fs.Float64Var(
+		&ff.sampleRate,
+		"sample-rate",
+		1.0,
+		"Specifies the fraction of counts, histograms and timings that are sent. Sampled stats are sent with their sample rate so that they can be scaled. Must be greater than 0 and at most 1.",
+	)
+
+	fs.Var(
+		&ff.sampleRates,
+		"sample-rates",
+		`Specifies sample rates for stats whose names match a pattern, in the form "<pattern>=<rate>". Patterns apply to the full stat name, including any scope, and may use the wildcards supported by Go's path.Match function (e.g. "requests.*=0.1"). The first matching pattern is used; stats matching no pattern use --{{PREFIX}}sample-rate. May be comma-delimited or specified more than once.`,
+	)
+
 	fs.StringVar(
 		&ff.scope,
 		"scope",
@@ -124,14 +259,40 @@ func newStatsdFromFlags(fs tbnflag.FlagSet) *statsdFromFlags {
 }
 
 func (ff *statsdFromFlags) Validate() error {
-	addr := fmt.Sprintf("%s:%d", ff.host, ff.port)
-
-	if _, _, err := tbnstrings.SplitHostPort(addr); err != nil {
+	switch ff.transport {
+	case "", udpTransport, tcpTransport:
+		addr := fmt.Sprintf("%s:%d", ff.host, ff.port)
+
+		if _, _, err := tbnstrings.SplitHostPort(addr); err != nil {
+			return fmt.Errorf(
+				"--%shost or --%sport is invalid: %s",
+				ff.flagScope,
+				ff.flagScope,
+				err.Error(),
+			)
+		}
+
+	case unixgramTransport, unixTransport:
+		if ff.socket == "" {
+			return fmt.Errorf(
+				"--%ssocket must be specified for the %s transport",
+				ff.flagScope,
+				ff.transport,
+			)
+		}
+
+	default:
 		return fmt.Errorf(
-			"--%shost or --%sport is invalid: %s",
+			"--%stransport must be one of %s",
 			ff.flagScope,
+			strings.Join(statsdTransports, ", "),
+		)
+	}
+
+	if ff.transport != "" && ff.transport != udpTransport && ff.maxBufferSize < ff.maxPacketLen {
+		return fmt.Errorf(
+			"--%smax-buffer-size must be greater than or equal to --%[1]smax-packet-len",
 			ff.flagScope,
-			err.Error(),
 		)
 	}
 
@@ -139,6 +300,17 @@ func (ff *statsdFromFlags) Validate() error {
 		return fmt.Errorf("--%sflush-interval must be greater than zero", ff.flagScope)
 	}
 
+	if !validSampleRate(ff.sampleRate) {
+		return fmt.Errorf(
+			"--%ssample-rate must be greater than 0 and at most 1",
+			ff.flagScope,
+		)
+	}
+
+	if _, err := parseSampleRates(ff.sampleRates.Strings); err != nil {
+		return fmt.Errorf("--%ssample-rates invalid: %s", ff.flagScope, err.Error())
+	}
+
 	if _, err := parseTagTransforms(ff.transforms); err != nil {
 		return fmt.Errorf("--%stransform-tags invalid: %s", ff.flagScope, err.Error())
 	}
@@ -147,38 +319,88 @@ func (ff *statsdFromFlags) Validate() error {
 }
 
 func (ff *statsdFromFlags) Make() (Stats, error) {
-	return ff.makeInternal(statsd.NewMaxPacket, statsdCleaner)
+	return ff.makeWithDeliveryStats(nil)
 }
 
-func (ff *statsdFromFlags) makeInternal(mkSender mkStatsdSenderFunc, c cleaner) (Stats, error) {
+func (ff *statsdFromFlags) makeWithDeliveryStats(ds *deliveryStats) (Stats, error) {
+	return ff.makeInternal(
+		func(w io.Writer, flushInterval time.Duration, maxPacketLen int) xstats.Sender {
+			return newStatsdSender(
+				w,
+				flushInterval,
+				maxPacketLen,
+				packetBufferDeliveryStats(ds),
+			)
+		},
+		statsdCleaner,
+		ds,
+	)
+}
+
+func (ff *statsdFromFlags) makeInternal(
+	mkSender mkStatsdSenderFunc,
+	c cleaner,
+	ds *deliveryStats,
+) (Stats, error) {
 	tagTransformer, err := parseTagTransforms(ff.transforms)
 	if err != nil {
 		return nil, err
 	}
 
-	w, err := ff.mkUDPWriter()
+	sampleRates, err := parseSampleRates(ff.sampleRates.Strings)
 	if err != nil {
 		return nil, err
 	}
 
-	underlying := mkSender(w, ff.flushInterval, ff.maxPacketLen)
+	w, err := ff.mkWriter(ds)
+	if err != nil {
+		return nil, err
+	}
+
+	var underlying xstatsSender = mkSender(w, ff.flushInterval, ff.maxPacketLen)
 
 	// If latching is disabled, underlying is returned unchanged.
 	underlying = ff.lsff.Make(underlying, c)
 
+	// Sampling precedes latching so that latched stats are scaled.
+	underlying = newSamplingSender(underlying, c, ff.sampleRate, sampleRates)
+
 	return newFromSender(underlying, c, ff.scope, tagTransformer, true), nil
 }
 
-func (ff *statsdFromFlags) mkUDPWriter() (io.Writer, error) {
+// mkWriter creates an io.WriteCloser for the configured transport.
+// UDP connections are dialed immediately. Other transports use a
+// reconnectingWriter, which dials on first use. Each write made by a
+// statsd sender contains complete, newline-terminated stats, so
+// writes may be sent as-is as datagrams or on stream connections.
+// Delivery health is recorded to ds, if non-nil.
+func (ff *statsdFromFlags) mkWriter(ds *deliveryStats) (io.WriteCloser, error) {
 	var (
-		w   io.Writer
+		w   io.WriteCloser
 		err error
 	)
 
-	addr := fmt.Sprintf("%s:%d", ff.host, ff.port)
-	w, err = net.Dial("udp", addr)
-	if err != nil {
-		return nil, err
+	switch ff.transport {
+	case "", udpTransport:
+		addr := net.JoinHostPort(ff.host, strconv.Itoa(ff.port))
+		w, err = net.Dial(udpTransport, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if ds != nil {
+			w = &deliveryWriter{w: w, ds: ds, timeSource: tbntime.NewSource()}
+		}
+
+	case tcpTransport:
+		addr := net.JoinHostPort(ff.host, strconv.Itoa(ff.port))
+		w = ff.mkReconnectingWriter(tcpTransport, addr, ds)
+
+	case unixgramTransport, unixTransport:
+		w = ff.mkReconnectingWriter(ff.transport, ff.socket, ds)
+
+	default:
+		return nil, fmt.Errorf("unknown transport %q", ff.transport)
 	}
 
 	if ff.debug {
@@ -188,6 +410,24 @@ func (ff *statsdFromFlags) mkUDPWriter() (io.Writer, error) {
 	return w, nil
 }
 
+func (ff *statsdFromFlags) mkReconnectingWriter(
+	network string,
+	addr string,
+	ds *deliveryStats,
+) io.WriteCloser {
+	bufferSize := ff.maxBufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultMaxBufferSize
+	}
+
+	return newReconnectingWriter(
+		mkDialFunc(network, addr),
+		maxBufferSize(bufferSize),
+		reconnectDelay(ff.flushInterval),
+		writerDeliveryStats(ds),
+	)
+}
+
 // debugWriter differs from io.MultiWriter in that it ignores short
 // writes and errors on its debug Writer.
 type debugWriter struct {
@@ -198,3 +438,19 @@ func (dw *debugWriter) Write(b []byte) (int, error) {
 	defer dw.debug.Write(b)
 	return dw.underlying.Write(b)
 }
+
+// Flush flushes the underlying Writer, if it is a flusher.
+func (dw *debugWriter) Flush() error {
+	if f, ok := dw.underlying.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Close closes the underlying Writer, if it is an io.Closer.
+func (dw *debugWriter) Close() error {
+	if c, ok := dw.underlying.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -17,10 +17,14 @@ limitations under the License.
 package stats
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -133,6 +137,160 @@ func TestStatsdBackendWithScope(t *testing.T) {
 	assert.Equal(t, <-l.Msgs, fmt.Sprintf("x.prefix.gauge:%f|g\n", 3.0))
 }
 
+func TestStatsdBackendTCP(t *testing.T) {
+	l, port, lines := mkTCPListener(t)
+	defer l.Close()
+
+	statsdFromFlags := &statsdFromFlags{
+		transport:     tcpTransport,
+		host:          "127.0.0.1",
+		port:          port,
+		flushInterval: 10 * time.Millisecond,
+		maxPacketLen:  defaultMaxPacketLen,
+		lsff:          &latchingSenderFromFlags{},
+	}
+
+	stats, err := statsdFromFlags.Make()
+	assert.Nil(t, err)
+	defer stats.Close()
+
+	stats.Count("count", 2.0)
+	assert.Equal(t, <-lines, fmt.Sprintf("count:%f|c", 2.0))
+
+	stats.Gauge("gauge", 3.0)
+	assert.Equal(t, <-lines, fmt.Sprintf("gauge:%f|g", 3.0))
+}
+
+func mkTempSocketPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "stats-test")
+	assert.Nil(t, err)
+
+	return filepath.Join(dir, "statsd.sock"), func() { os.RemoveAll(dir) }
+}
+
+func TestStatsdBackendUnixgram(t *testing.T) {
+	path, cleanup := mkTempSocketPath(t)
+	defer cleanup()
+
+	conn, err := net.ListenUnixgram(unixgramTransport, &net.UnixAddr{Name: path, Net: unixgramTransport})
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	statsdFromFlags := &statsdFromFlags{
+		transport:     unixgramTransport,
+		socket:        path,
+		flushInterval: time.Hour,
+		maxPacketLen:  32,
+		lsff:          &latchingSenderFromFlags{},
+	}
+
+	stats, err := statsdFromFlags.Make()
+	assert.Nil(t, err)
+
+	stats.Count("count", 2.0)
+	stats.Gauge("gauge", 3.0)
+	assert.Nil(t, stats.Close())
+
+	// each packet respects max-packet-len
+	buffer := make([]byte, 8192)
+	n, err := conn.Read(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, string(buffer[0:n]), fmt.Sprintf("count:%f|c\n", 2.0))
+
+	n, err = conn.Read(buffer)
+	assert.Nil(t, err)
+	assert.Equal(t, string(buffer[0:n]), fmt.Sprintf("gauge:%f|g\n", 3.0))
+}
+
+func TestStatsdBackendUnixBuffersUntilConnected(t *testing.T) {
+	path, cleanup := mkTempSocketPath(t)
+	defer cleanup()
+
+	statsdFromFlags := &statsdFromFlags{
+		transport:     unixTransport,
+		socket:        path,
+		flushInterval: time.Millisecond,
+		maxPacketLen:  defaultMaxPacketLen,
+		lsff:          &latchingSenderFromFlags{},
+	}
+
+	stats, err := statsdFromFlags.Make()
+	assert.Nil(t, err)
+	defer stats.Close()
+
+	// nothing is listening yet
+	stats.Count("count", 2.0)
+	time.Sleep(10 * time.Millisecond)
+
+	l, err := net.Listen(unixTransport, path)
+	assert.Nil(t, err)
+	defer l.Close()
+
+	lines := make(chan string, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	stats.Gauge("gauge", 3.0)
+	assert.Equal(t, <-lines, fmt.Sprintf("count:%f|c", 2.0))
+	assert.Equal(t, <-lines, fmt.Sprintf("gauge:%f|g", 3.0))
+}
+
+func TestStatsdFromFlagsValidateTransport(t *testing.T) {
+	ff := &statsdFromFlags{
+		flagScope:     "statsd.",
+		transport:     "carrier-pigeon",
+		host:          "127.0.0.1",
+		port:          defaultPort,
+		flushInterval: time.Second,
+		sampleRate:    1.0,
+		maxPacketLen:  100,
+		maxBufferSize: 100,
+		lsff: &latchingSenderFromFlags{
+			latchWindow:    time.Minute,
+			minBucket:      1,
+			numBuckets:     2,
+			openWindows:    1,
+			latePolicy:     "drop",
+			seriesOverflow: "drop",
+		},
+	}
+	assert.ErrorContains(
+		t,
+		ff.Validate(),
+		"--statsd.transport must be one of udp, tcp, unixgram, unix",
+	)
+
+	ff.transport = unixTransport
+	assert.ErrorContains(
+		t,
+		ff.Validate(),
+		"--statsd.socket must be specified for the unix transport",
+	)
+
+	ff.socket = "/var/run/statsd.sock"
+	assert.Nil(t, ff.Validate())
+
+	ff.maxBufferSize = 99
+	assert.ErrorContains(
+		t,
+		ff.Validate(),
+		"--statsd.max-buffer-size must be greater than or equal to --statsd.max-packet-len",
+	)
+
+	ff.transport = udpTransport
+	assert.Nil(t, ff.Validate())
+}
+
 func TestStatsdBackendMakeError(t *testing.T) {
 	statsdFromFlags := &statsdFromFlags{
 		host:          "127.0.0.1",
@@ -231,3 +389,81 @@ func TestDebugWriter(t *testing.T) {
 	assert.NonNil(t, err)
 	assert.Equal(t, debug.String(), "both")
 }
+
+func TestStatsdSenderRecordsFailedWrites(t *testing.T) {
+	ds := newDeliveryStats("statsd")
+	s := newStatsdSender(
+		&failingWriter{io.ErrClosedPipe},
+		time.Hour,
+		12,
+		packetBufferDeliveryStats(ds),
+	)
+
+	s.Count("a", 1)
+	s.Count("b", 2)
+	s.Count("c", 3)
+	assert.Nil(t, s.Close())
+
+	assert.Equal(t, ds.dropped, int64(3))
+}
+
+// blockingWriter is a testWriter whose writes block until release is
+// closed.
+type blockingWriter struct {
+	testWriter
+
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	<-w.release
+	return w.testWriter.Write(b)
+}
+
+func TestStatsdSenderDoesNotBlockOnWriter(t *testing.T) {
+	w := &blockingWriter{release: make(chan struct{})}
+	ds := newDeliveryStats("statsd")
+	s := newStatsdSender(w, time.Hour, 1, packetBufferDeliveryStats(ds))
+
+	// each stat fills a packet; those that cannot be queued while the
+	// writer is blocked are dropped
+	n := defaultMaxQueuedPackets + 10
+	for i := 0; i < n; i++ {
+		s.Count("a", 1)
+	}
+	assert.True(t, ds.dropped > 0)
+
+	close(w.release)
+	assert.Nil(t, s.Close())
+
+	assert.Equal(t, int64(len(w.writes))+ds.dropped, int64(n))
+	for _, write := range w.writes {
+		assert.Equal(t, write, "a:1.000000|c\n")
+	}
+}
+
+// closeCountingWriter is a testWriter that counts calls to Close.
+type closeCountingWriter struct {
+	testWriter
+
+	closes int
+}
+
+func (w *closeCountingWriter) Close() error {
+	w.closes++
+	return nil
+}
+
+func TestStatsdSenderCloseTwice(t *testing.T) {
+	w := &closeCountingWriter{}
+	stats := newFromSender(newStatsdSender(w, time.Hour, 1024), statsdCleaner, "", nil, false)
+
+	// a Stats and its scopes share the sender
+	scoped := stats.Scope("x")
+	scoped.Count("a", 1)
+	assert.Nil(t, scoped.Close())
+	assert.Nil(t, stats.Close())
+
+	assert.Equal(t, w.closes, 1)
+	assert.ArrayEqual(t, w.writes, []string{"x.a:1.000000|c\n"})
+}
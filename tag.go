@@ -24,12 +24,16 @@ const (
 	StatusClassClientErr = "client_error"
 	StatusClassServerErr = "server_error"
 
-	NodeTag         = "node"
-	ProxyTag        = "proxy"
-	ProxyVersionTag = "proxy-version"
-	SourceTag       = "source"
-	TimestampTag    = "timestamp"
-	ZoneTag         = "zone"
+	NodeTag           = "node"
+	ProxyTag          = "proxy"
+	ProxyVersionTag   = "proxy-version"
+	SampleRateTag     = "sample_rate"
+	ScopeTag          = "scope"
+	SourceTag         = "source"
+	StartTimestampTag = "start_timestamp"
+	TimestampTag      = "timestamp"
+	UnitTag           = "unit"
+	ZoneTag           = "zone"
 )
 
 // Tag is an optional piece of metadata to be added to one or more stat points
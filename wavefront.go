@@ -17,15 +17,22 @@ limitations under the License.
 package stats
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"net"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/rs/xstats"
-	"github.com/rs/xstats/statsd"
-
 	tbnflag "github.com/turbinelabs/nonstdlib/flag"
+	tbnstrings "github.com/turbinelabs/nonstdlib/strings"
+	tbntime "github.com/turbinelabs/nonstdlib/time"
+)
+
+const (
+	defaultWavefrontPort = 2878
 )
 
 var (
@@ -49,89 +56,359 @@ var (
 		)
 	}
 
-	cleanWavefrontTagValue = func(s string) string {
-		// "~" is used to separate tags in wavefront's statsd
-		// plugin and must be stripped.
-		s = strings.Replace(s, "~", "", -1)
+	// Line breaks terminate points and cannot be escaped.
+	cleanWavefrontTagValue = mkStrip("\r\n")
 
-		return fmt.Sprintf(`"%s"`, strings.Replace(s, `"`, `\"`, -1))
-	}
+	escapeWavefrontTagValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace
 )
 
-// Per https://community.wavefront.com/docs/DOC-1031.
+// wavefrontDistributions maps latch windows to the prefixes of
+// Wavefront distributions aggregated over the same interval.
+var wavefrontDistributions = map[time.Duration]string{
+	time.Minute:    "!M",
+	time.Hour:      "!H",
+	24 * time.Hour: "!D",
+}
+
+// Per https://docs.wavefront.com/wavefront_data_format.html.
 // Stat names: ascii alphanumeric, hyphen, underscore, period. Forward
 //             slash and comma require quoting.
 // Tag names: ascii alphanumeric, hyphen, underscore, period.
 // Tag values: quoted strings allow any value, including quotes (by
-//             backslash escaping)
-// The wavefront statsd plugin passes tags through without
-// modification or further escaping. Unclear if timestamps can be
-// passed, so be safe and filter them out.
+//             backslash escaping), but not line breaks. Quoting is
+//             handled by wavefrontSender.
 var wavefrontCleaner = cleaner{
 	cleanStatName: cleanWavefront,
-	cleanTagName:  mkSequence(filterTimestamp, cleanWavefront),
+	cleanTagName:  cleanWavefront,
 	cleanTagValue: cleanWavefrontTagValue,
 	tagDelim:      "=",
 	scopeDelim:    ".",
 }
 
+// newWavefrontSender constructs an xstats Sender that emits stats in
+// the Wavefront data format to the given io.Writer, which is
+// expected to be a connection to a Wavefront proxy. Points are
+// buffered for the flush interval or until the buffer would exceed
+// maxPacketLen bytes, whichever comes first.
+//
+// Each point's source is taken from its SourceTag, if present, and
+// otherwise defaults to the given source. TimestampTag values
+// (milliseconds since the Unix epoch) are converted to point
+// timestamps. All other tags with non-empty values become point
+// tags. Timings are recorded in seconds. Latched histograms are
+// emitted as Wavefront distributions, minute distributions unless
+// otherwise configured.
+func newWavefrontSender(
+	w io.Writer,
+	source string,
+	flushInterval time.Duration,
+	maxPacketLen int,
+	options ...packetBufferOption,
+) *wavefrontSender {
+	return &wavefrontSender{
+		packetBuffer: newPacketBuffer(w, flushInterval, maxPacketLen, options...),
+		source:       source,
+		distribution: wavefrontDistributions[time.Minute],
+		timeSource:   tbntime.NewSource(),
+	}
+}
+
 type wavefrontSender struct {
-	s xstats.Sender
+	*packetBuffer
+
+	source string
+
+	// distribution is the prefix of the distributions emitted for
+	// latched histograms, which determines the interval over which
+	// Wavefront aggregates them
+	distribution string
+
+	timeSource tbntime.Source
+}
+
+// wavefrontTags are the resolved tags of a Wavefront point.
+type wavefrontTags struct {
+	source    string
+	timestamp *int64
+	pointTags string
 }
 
 // Gauge implements xstats.Sender interface
-func (wfs *wavefrontSender) Gauge(stat string, value float64, tags ...string) {
-	wfs.s.Gauge(mkStatName(stat, tags), value)
+func (s *wavefrontSender) Gauge(stat string, value float64, tags ...string) {
+	s.point(stat, value, tags)
 }
 
 // Count implements xstats.Sender interface
-func (wfs *wavefrontSender) Count(stat string, count float64, tags ...string) {
-	wfs.s.Count(mkStatName(stat, tags), count)
+func (s *wavefrontSender) Count(stat string, count float64, tags ...string) {
+	s.point(stat, count, tags)
 }
 
 // Histogram implements xstats.Sender interface
-func (wfs *wavefrontSender) Histogram(stat string, value float64, tags ...string) {
-	wfs.s.Histogram(mkStatName(stat, tags), value)
+func (s *wavefrontSender) Histogram(stat string, value float64, tags ...string) {
+	s.point(stat, value, tags)
 }
 
-// Timing implements xstats.Sender interface
-func (wfs *wavefrontSender) Timing(stat string, duration time.Duration, tags ...string) {
-	wfs.s.Timing(mkStatName(stat, tags), duration)
+// Timing implements xstats.Sender interface. Timings are recorded in
+// seconds.
+func (s *wavefrontSender) Timing(stat string, duration time.Duration, tags ...string) {
+	s.point(stat, duration.Seconds(), tags)
 }
 
-// Close implements io.Closer interface
-func (wfs *wavefrontSender) Close() error {
-	if c, ok := wfs.s.(io.Closer); ok {
-		return c.Close()
+// LatchedHistogram emits the histogram as a Wavefront distribution.
+// Each bucket becomes a centroid at the bucket's midpoint, clamped to
+// the histogram's minimum and maximum values. Values in the overflow
+// bucket are represented by a centroid at the maximum value.
+func (s *wavefrontSender) LatchedHistogram(stat string, h LatchedHistogram, tags ...string) {
+	if h.Count == 0 {
+		return
 	}
-	return nil
+
+	resolved := s.resolveTags(tags)
+
+	ts := tbntime.ToUnixMilli(s.timeSource.Now()) / 1000
+	if resolved.timestamp != nil {
+		ts = *resolved.timestamp
+	}
+
+	line := &bytes.Buffer{}
+	fmt.Fprintf(line, "%s %d", s.distribution, ts)
+
+	for _, c := range h.centroids() {
+		fmt.Fprintf(line, " #%d %s", c.count, formatWavefrontValue(c.value))
+	}
+
+	fmt.Fprintf(line, " %s source=\"%s\"%s\n", stat, resolved.source, resolved.pointTags)
+
+	s.write(line.Bytes())
 }
 
-// mkStatName generates a new stat name encoding the given tags
-func mkStatName(stat string, tags []string) string {
-	// TODO: there's definitely some missing escaping here
-	res := make([]string, len(tags)+1)
-	res[0] = stat
-	for i, tag := range tags {
-		res[i+1] = fmt.Sprintf("~%s", tag)
+func (s *wavefrontSender) point(stat string, value float64, tags []string) {
+	resolved := s.resolveTags(tags)
+
+	var line string
+	if resolved.timestamp != nil {
+		line = fmt.Sprintf(
+			"%s %s %d source=\"%s\"%s\n",
+			stat,
+			formatWavefrontValue(value),
+			*resolved.timestamp,
+			resolved.source,
+			resolved.pointTags,
+		)
+	} else {
+		line = fmt.Sprintf(
+			"%s %s source=\"%s\"%s\n",
+			stat,
+			formatWavefrontValue(value),
+			resolved.source,
+			resolved.pointTags,
+		)
+	}
+
+	s.write([]byte(line))
+}
+
+func (s *wavefrontSender) resolveTags(tags []string) wavefrontTags {
+	resolved := wavefrontTags{source: escapeWavefrontTagValue(s.source)}
+
+	pointTags := &bytes.Buffer{}
+	for _, tag := range tags {
+		k, v := tbnstrings.Split2(tag, wavefrontCleaner.tagDelim)
+		if k == "" || v == "" {
+			// Wavefront does not permit empty tag values.
+			continue
+		}
+
+		switch k {
+		case SourceTag:
+			resolved.source = escapeWavefrontTagValue(v)
+			continue
+
+		case TimestampTag:
+			if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+				ts := ms / 1000
+				resolved.timestamp = &ts
+				continue
+			}
+		}
+
+		fmt.Fprintf(pointTags, " %s=\"%s\"", k, escapeWavefrontTagValue(v))
 	}
 
-	return strings.Join(res, "")
+	resolved.pointTags = pointTags.String()
+	return resolved
 }
 
+func formatWavefrontValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+var _ latchableSender = &wavefrontSender{}
+
 type wavefrontFromFlags struct {
-	*statsdFromFlags
+	flagScope     string
+	host          string
+	port          int
+	maxPacketLen  int
+	maxBufferSize int
+	flushInterval time.Duration
+	scope         string
+	transforms    string
+	lsff          *latchingSenderFromFlags
+	debug         bool
 }
 
 func newWavefrontFromFlags(fs tbnflag.FlagSet) statsFromFlags {
-	return &wavefrontFromFlags{newStatsdFromFlags(fs)}
+	ff := &wavefrontFromFlags{
+		flagScope: fs.GetScope(),
+		lsff:      newLatchingSenderFromFlags(fs, false),
+	}
+
+	fs.StringVar(
+		&ff.host,
+		"host",
+		defaultHost,
+		"Specifies the Wavefront proxy host.",
+	)
+
+	fs.IntVar(
+		&ff.port,
+		"port",
+		defaultWavefrontPort,
+		"Specifies the Wavefront proxy port.",
+	)
+
+	fs.IntVar(
+		&ff.maxPacketLen,
+		"max-packet-len",
+		defaultMaxPacketLen,
+		"Specifies the maximum number of payload `bytes` sent per flush. If necessary, flushes will occur before the flush interval to prevent payloads from exceeding this size.",
+	)
+
+	fs.IntVar(
+		&ff.maxBufferSize,
+		"max-buffer-size",
+		defaultMaxBufferSize,
+		"Specifies the maximum number of `bytes` buffered while the Wavefront proxy is unreachable. If exceeded, the oldest stats are dropped. Must be at least as large as the max-packet-len.",
+	)
+
+	fs.DurationVar(
+		&ff.flushInterval,
+		"flush-interval",
+		defaultFlushInterval,
+		"Specifies the `duration` between stats flushes. Reconnection to the Wavefront proxy is attempted at most once per flush.",
+	)
+
+	fs.StringVar(
+		&ff.scope,
+		"scope",
+		"",
+		"If specified, prepends the given scope to metric names.",
+	)
+
+	fs.StringVar(
+		&ff.transforms,
+		"transform-tags",
+		"",
+		transformTagsDesc,
+	)
+
+	fs.BoolVar(
+		&ff.debug,
+		"debug",
+		false,
+		"If enabled, logs the stats data on stdout.",
+	)
+
+	return ff
+}
+
+func (ff *wavefrontFromFlags) Validate() error {
+	if _, _, err := tbnstrings.SplitHostPort(ff.host + ":" + strconv.Itoa(ff.port)); err != nil {
+		return fmt.Errorf(
+			"--%shost or --%sport is invalid: %s",
+			ff.flagScope,
+			ff.flagScope,
+			err.Error(),
+		)
+	}
+
+	if ff.flushInterval <= 0*time.Second {
+		return fmt.Errorf("--%sflush-interval must be greater than zero", ff.flagScope)
+	}
+
+	if ff.maxPacketLen <= 0 {
+		return fmt.Errorf("--%smax-packet-len must be greater than zero", ff.flagScope)
+	}
+
+	if ff.maxBufferSize < ff.maxPacketLen {
+		return fmt.Errorf(
+			"--%smax-buffer-size must be greater than or equal to --%[1]smax-packet-len",
+			ff.flagScope,
+		)
+	}
+
+	if _, err := parseTagTransforms(ff.transforms); err != nil {
+		return fmt.Errorf("--%stransform-tags invalid: %s", ff.flagScope, err.Error())
+	}
+
+	if err := ff.lsff.Validate(); err != nil {
+		return err
+	}
+
+	if _, ok := wavefrontDistributions[ff.lsff.latchWindow]; ff.lsff.enabled && !ok {
+		return fmt.Errorf(
+			"--%swindow must be 1m, 1h, or 24h, matching a Wavefront distribution interval",
+			ff.lsff.flagScope,
+		)
+	}
+
+	return nil
 }
 
 func (ff *wavefrontFromFlags) Make() (Stats, error) {
-	return ff.makeInternal(
-		func(w io.Writer, flushInterval time.Duration, maxPacketLen int) xstats.Sender {
-			return &wavefrontSender{statsd.NewMaxPacket(w, ff.flushInterval, ff.maxPacketLen)}
-		},
-		wavefrontCleaner,
+	return ff.makeWithDeliveryStats(nil)
+}
+
+func (ff *wavefrontFromFlags) makeWithDeliveryStats(ds *deliveryStats) (Stats, error) {
+	tagTransformer, err := parseTagTransforms(ff.transforms)
+	if err != nil {
+		return nil, err
+	}
+
+	var w io.Writer = newReconnectingWriter(
+		mkDialFunc("tcp", ff.addr()),
+		maxBufferSize(ff.maxBufferSize),
+		reconnectDelay(ff.flushInterval),
+		writerDeliveryStats(ds),
 	)
+
+	if ff.debug {
+		w = &debugWriter{w, stdoutWriter}
+	}
+
+	source, err := os.Hostname()
+	if err != nil || source == "" {
+		source = unspecified
+	}
+
+	sender := newWavefrontSender(
+		w,
+		source,
+		ff.flushInterval,
+		ff.maxPacketLen,
+		packetBufferDeliveryStats(ds),
+	)
+	if distribution, ok := wavefrontDistributions[ff.lsff.latchWindow]; ok {
+		sender.distribution = distribution
+	}
+
+	// If latching is disabled, sender is returned unchanged.
+	underlying := ff.lsff.Make(sender, wavefrontCleaner)
+
+	return newFromSender(underlying, wavefrontCleaner, ff.scope, tagTransformer, true), nil
+}
+
+func (ff *wavefrontFromFlags) addr() string {
+	return net.JoinHostPort(ff.host, strconv.Itoa(ff.port))
 }
@@ -17,110 +17,349 @@ limitations under the License.
 package stats
 
 import (
-	"fmt"
+	"bufio"
+	"net"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
-	"github.com/golang/mock/gomock"
 	tbnstrings "github.com/turbinelabs/nonstdlib/strings"
+	tbntime "github.com/turbinelabs/nonstdlib/time"
 	"github.com/turbinelabs/test/assert"
 )
 
+type testWriter struct {
+	lock   sync.Mutex
+	writes []string
+}
+
+func (w *testWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.writes = append(w.writes, string(b))
+	return len(b), nil
+}
+
+func (w *testWriter) String() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return strings.Join(w.writes, "")
+}
+
+func testWavefrontSender(t *testing.T, f func(*wavefrontSender)) string {
+	w := &testWriter{}
+	s := newWavefrontSender(w, "src", time.Hour, defaultMaxPacketLen)
+	f(s)
+	assert.Nil(t, s.Close())
+	return w.String()
+}
+
 func TestWavefrontSenderGauge(t *testing.T) {
-	ctrl := gomock.NewController(assert.Tracing(t))
-	defer ctrl.Finish()
-	mockSender := newMockXstatsSender(ctrl)
-	wfs := &wavefrontSender{mockSender}
-	mockSender.EXPECT().Gauge("foo~bar=baz~blar=blaz", float64(1234))
-	wfs.Gauge("foo", 1234, "bar=baz", "blar=blaz")
+	got := testWavefrontSender(t, func(s *wavefrontSender) {
+		s.Gauge("foo", 1234.5, "bar=baz", "blar=blaz")
+	})
+	assert.Equal(t, got, `foo 1234.5 source="src" bar="baz" blar="blaz"`+"\n")
 }
 
 func TestWavefrontSenderCount(t *testing.T) {
-	ctrl := gomock.NewController(assert.Tracing(t))
-	defer ctrl.Finish()
-	mockSender := newMockXstatsSender(ctrl)
-	wfs := &wavefrontSender{mockSender}
-	mockSender.EXPECT().Count("foo~bar=baz~blar=blaz", float64(1234))
-	wfs.Count("foo", 1234, "bar=baz", "blar=blaz")
+	got := testWavefrontSender(t, func(s *wavefrontSender) {
+		s.Count("foo", 1234, "bar=baz", "blar=blaz")
+	})
+	assert.Equal(t, got, `foo 1234 source="src" bar="baz" blar="blaz"`+"\n")
 }
 
 func TestWavefrontSenderHistogram(t *testing.T) {
-	ctrl := gomock.NewController(assert.Tracing(t))
-	defer ctrl.Finish()
-	mockSender := newMockXstatsSender(ctrl)
-	wfs := &wavefrontSender{mockSender}
-	mockSender.EXPECT().Histogram("foo~bar=baz~blar=blaz", float64(1234))
-	wfs.Histogram("foo", 1234, "bar=baz", "blar=blaz")
+	got := testWavefrontSender(t, func(s *wavefrontSender) {
+		s.Histogram("foo", 0.25, "bar=baz")
+	})
+	assert.Equal(t, got, `foo 0.25 source="src" bar="baz"`+"\n")
 }
 
 func TestWavefrontSenderTiming(t *testing.T) {
-	ctrl := gomock.NewController(assert.Tracing(t))
-	defer ctrl.Finish()
-	mockSender := newMockXstatsSender(ctrl)
-	wfs := &wavefrontSender{mockSender}
-	mockSender.EXPECT().Timing("foo~bar=baz~blar=blaz", 1234*time.Millisecond)
-	wfs.Timing("foo", 1234*time.Millisecond, "bar=baz", "blar=blaz")
+	got := testWavefrontSender(t, func(s *wavefrontSender) {
+		s.Timing("foo", 1234*time.Millisecond, "bar=baz")
+	})
+	assert.Equal(t, got, `foo 1.234 source="src" bar="baz"`+"\n")
 }
 
-func TestWavefrontBackend(t *testing.T) {
-	l := mkListener(t)
-	defer l.Close()
+func TestWavefrontSenderSourceAndTimestampTags(t *testing.T) {
+	got := testWavefrontSender(t, func(s *wavefrontSender) {
+		s.Count("foo", 1, SourceTag+"=other", TimestampTag+"=1500000000123", "a=b")
+		s.Count("foo", 1, TimestampTag+"=not-a-time")
+	})
+	assert.Equal(
+		t,
+		got,
+		`foo 1 1500000000 source="other" a="b"`+"\n"+
+			`foo 1 source="src" timestamp="not-a-time"`+"\n",
+	)
+}
+
+func TestWavefrontSenderEscaping(t *testing.T) {
+	got := testWavefrontSender(t, func(s *wavefrontSender) {
+		s.source = `a "quoted" source`
+		s.Gauge("foo", 1, `q="x"`, `b=back\slash`, "empty", "empty2=")
+	})
+	assert.Equal(
+		t,
+		got,
+		`foo 1 source="a \"quoted\" source" q="\"x\"" b="back\\slash"`+"\n",
+	)
+}
+
+func TestWavefrontSenderLatchedHistogram(t *testing.T) {
+	h := LatchedHistogram{
+		Limits:   []float64{1.0, 2.0, 4.0, 8.0},
+		Buckets:  []int64{1, 0, 2, 1},
+		Overflow: 2,
+		Count:    6,
+		Sum:      30.5,
+		Min:      0.5,
+		Max:      20.0,
+	}
+
+	got := testWavefrontSender(t, func(s *wavefrontSender) {
+		s.LatchedHistogram("foo", h, TimestampTag+"=1500000000000", "a=b")
+		s.LatchedHistogram("empty", LatchedHistogram{Limits: []float64{1}, Buckets: []int64{0}})
+	})
+
+	// buckets: (min, 1] => 0.75, (2, 4] => 3, (4, 8] => 6, overflow => max
+	assert.Equal(
+		t,
+		got,
+		`!M 1500000000 #1 0.75 #2 3 #1 6 #2 20 foo source="src" a="b"`+"\n",
+	)
+
+	tbntime.WithTimeAt(time.Unix(1600000000, 0), func(tc tbntime.ControlledSource) {
+		got = testWavefrontSender(t, func(s *wavefrontSender) {
+			s.timeSource = tc
+			s.LatchedHistogram("foo", h)
+		})
+	})
+
+	assert.Equal(t, got, `!M 1600000000 #1 0.75 #2 3 #1 6 #2 20 foo source="src"`+"\n")
+}
+
+func TestWavefrontSenderLatchedHistogramDistribution(t *testing.T) {
+	h := LatchedHistogram{
+		Limits:  []float64{1},
+		Buckets: []int64{1},
+		Count:   1,
+		Min:     0.5,
+		Max:     0.5,
+	}
+
+	for window, prefix := range map[time.Duration]string{
+		time.Minute:    "!M",
+		time.Hour:      "!H",
+		24 * time.Hour: "!D",
+	} {
+		got := testWavefrontSender(t, func(s *wavefrontSender) {
+			s.distribution = wavefrontDistributions[window]
+			s.LatchedHistogram("foo", h, TimestampTag+"=1500000000000")
+		})
+		assert.Equal(t, got, prefix+` 1500000000 #1 0.5 foo source="src"`+"\n")
+	}
+}
+
+func TestWavefrontSenderMaxPacketLen(t *testing.T) {
+	w := &testWriter{}
+	s := newWavefrontSender(w, "src", time.Hour, 40)
+
+	s.Count("a", 1)
+	s.Count("b", 2)
+	s.Count("c", 3)
+	assert.Nil(t, s.Close())
+
+	assert.ArrayEqual(
+		t,
+		w.writes,
+		[]string{
+			`a 1 source="src"` + "\n" + `b 2 source="src"` + "\n",
+			`c 3 source="src"` + "\n",
+		},
+	)
+}
+
+func TestWavefrontSenderFlushInterval(t *testing.T) {
+	w := &testWriter{}
+	s := newWavefrontSender(w, "src", time.Millisecond, defaultMaxPacketLen)
+	defer s.Close()
+
+	s.Count("a", 1)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for w.String() == "" && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, w.String(), `a 1 source="src"`+"\n")
+}
+
+func mkTCPListener(t *testing.T) (net.Listener, int, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
 
-	addr := l.Addr(t)
-	_, port, err := tbnstrings.SplitHostPort(addr)
+	_, port, err := tbnstrings.SplitHostPort(l.Addr().String())
 	assert.Nil(t, err)
 
+	lines := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+
+	return l, port, lines
+}
+
+func TestWavefrontBackend(t *testing.T) {
+	l, port, lines := mkTCPListener(t)
+	defer l.Close()
+
 	wavefrontFromFlags := &wavefrontFromFlags{
-		&statsdFromFlags{
-			host:          "127.0.0.1",
-			port:          port,
-			flushInterval: 10 * time.Millisecond,
-			lsff:          &latchingSenderFromFlags{},
-		},
+		host:          "127.0.0.1",
+		port:          port,
+		maxPacketLen:  defaultMaxPacketLen,
+		maxBufferSize: defaultMaxBufferSize,
+		flushInterval: 10 * time.Millisecond,
+		lsff:          &latchingSenderFromFlags{},
 	}
 
 	stats, err := wavefrontFromFlags.Make()
 	assert.Nil(t, err)
 	defer stats.Close()
 
+	stats.AddTags(NewKVTag(SourceTag, "the-source"))
 	scope := stats.Scope("prefix")
 
-	scope.Count("count", 2.0, NewKVTag("taggity", "tag"))
-	assert.Equal(t, <-l.Msgs, fmt.Sprintf(`prefix.count~taggity="tag":%f|c`+"\n", 2.0))
+	scope.Count("count", 2.0, NewKVTag("taggity", "tag~tag"))
+	assert.Equal(t, <-lines, `prefix.count 2 source="the-source" taggity="tag~tag"`)
 
 	scope.Gauge("gauge", 3.0)
-	assert.Equal(t, <-l.Msgs, fmt.Sprintf("prefix.gauge:%f|g\n", 3.0))
+	assert.Equal(t, <-lines, `prefix.gauge 3 source="the-source"`)
 }
 
 func TestWavefrontBackendWithScope(t *testing.T) {
-	l := mkListener(t)
+	l, port, lines := mkTCPListener(t)
 	defer l.Close()
 
-	addr := l.Addr(t)
-	_, port, err := tbnstrings.SplitHostPort(addr)
-	assert.Nil(t, err)
-
 	wavefrontFromFlags := &wavefrontFromFlags{
-		&statsdFromFlags{
-			host:          "127.0.0.1",
-			port:          port,
-			flushInterval: 10 * time.Millisecond,
-			lsff:          &latchingSenderFromFlags{},
-			scope:         "x",
-		},
+		host:          "127.0.0.1",
+		port:          port,
+		maxPacketLen:  defaultMaxPacketLen,
+		maxBufferSize: defaultMaxBufferSize,
+		flushInterval: 10 * time.Millisecond,
+		lsff:          &latchingSenderFromFlags{},
+		scope:         "x",
 	}
 
 	stats, err := wavefrontFromFlags.Make()
 	assert.Nil(t, err)
 	defer stats.Close()
 
+	stats.AddTags(NewKVTag(SourceTag, "the-source"))
 	scope := stats.Scope("prefix")
 
 	scope.Count("count", 2.0, NewKVTag("taggity", "tag"))
-	assert.Equal(t, <-l.Msgs, fmt.Sprintf(`x.prefix.count~taggity="tag":%f|c`+"\n", 2.0))
+	assert.Equal(t, <-lines, `x.prefix.count 2 source="the-source" taggity="tag"`)
 
 	scope.Gauge("gauge", 3.0)
-	assert.Equal(t, <-l.Msgs, fmt.Sprintf("x.prefix.gauge:%f|g\n", 3.0))
+	assert.Equal(t, <-lines, `x.prefix.gauge 3 source="the-source"`)
+}
+
+func TestWavefrontBackendLatched(t *testing.T) {
+	l, port, lines := mkTCPListener(t)
+	defer l.Close()
+
+	wavefrontFromFlags := &wavefrontFromFlags{
+		host:          "127.0.0.1",
+		port:          port,
+		maxPacketLen:  defaultMaxPacketLen,
+		maxBufferSize: defaultMaxBufferSize,
+		flushInterval: time.Hour,
+		lsff: &latchingSenderFromFlags{
+			enabled:        true,
+			latchWindow:    time.Hour,
+			minBucket:      1,
+			numBuckets:     2,
+			openWindows:    1,
+			latePolicy:     "drop",
+			seriesOverflow: "drop",
+		},
+	}
+
+	stats, err := wavefrontFromFlags.Make()
+	assert.Nil(t, err)
+
+	stats.AddTags(NewKVTag(SourceTag, "the-source"))
+	stats.Histogram("h", 0.5)
+	stats.Histogram("h", 1.5)
+	assert.Nil(t, stats.Close())
+
+	got := []string{<-lines, <-lines}
+	assert.MatchesRegex(t, got[0], `^!H \d+ #1 0.75 #1 1.5 h source="the-source"$`)
+	assert.MatchesRegex(t, got[1], `^latched_at \d+ \d+ source="[^"]+"$`)
+}
+
+func TestWavefrontFromFlagsValidate(t *testing.T) {
+	ff := &wavefrontFromFlags{
+		flagScope:     "wf.",
+		host:          "127.0.0.1",
+		port:          defaultWavefrontPort,
+		maxPacketLen:  100,
+		maxBufferSize: 99,
+		flushInterval: time.Second,
+		lsff: &latchingSenderFromFlags{
+			latchWindow:    time.Minute,
+			minBucket:      1,
+			numBuckets:     2,
+			openWindows:    1,
+			latePolicy:     "drop",
+			seriesOverflow: "drop",
+		},
+	}
+	assert.ErrorContains(
+		t,
+		ff.Validate(),
+		"--wf.max-buffer-size must be greater than or equal to --wf.max-packet-len",
+	)
+
+	ff.maxPacketLen = 0
+	assert.ErrorContains(t, ff.Validate(), "--wf.max-packet-len must be greater than zero")
+
+	ff.maxPacketLen = 99
+	assert.Nil(t, ff.Validate())
+
+	// latched histograms must match a distribution interval
+	ff.lsff.flagScope = "wf.latch."
+	ff.lsff.enabled = true
+	for _, window := range []time.Duration{time.Minute, time.Hour, 24 * time.Hour} {
+		ff.lsff.latchWindow = window
+		assert.Nil(t, ff.Validate())
+	}
+
+	ff.lsff.latchWindow = 10 * time.Second
+	assert.ErrorContains(
+		t,
+		ff.Validate(),
+		"--wf.latch.window must be 1m, 1h, or 24h, matching a Wavefront distribution interval",
+	)
+
+	// unless latching is disabled
+	ff.lsff.enabled = false
+	assert.Nil(t, ff.Validate())
 }
 
 func TestWavefrontCleanerToTagString(t *testing.T) {
@@ -130,35 +369,39 @@ func TestWavefrontCleanerToTagString(t *testing.T) {
 	}{
 		{
 			tag:      NewKVTag("x", "y"),
-			expected: `x="y"`,
+			expected: `x=y`,
 		},
 		{
 			tag:      NewKVTag("has Space", "y"),
-			expected: `hasSpace="y"`,
+			expected: `hasSpace=y`,
 		},
 		{
 			tag:      NewKVTag("x!@#$%^&*x0", "y"),
-			expected: `xx0="y"`,
+			expected: `xx0=y`,
 		},
 		{
 			tag:      NewKVTag("x-x_x.x", "y"),
-			expected: `x-x_x.x="y"`,
+			expected: `x-x_x.x=y`,
 		},
 		{
 			tag:      NewKVTag("x\U0001f600x", "y"),
-			expected: `xx="y"`,
+			expected: `xx=y`,
 		},
 		{
 			tag:      NewKVTag("x", "y z"),
-			expected: `x="y z"`,
+			expected: `x=y z`,
 		},
 		{
 			tag:      NewKVTag("x", `"quoted"`),
-			expected: `x="\"quoted\""`,
+			expected: `x="quoted"`,
+		},
+		{
+			tag:      NewKVTag("x", "line\nbreak\r"),
+			expected: `x=linebreak`,
 		},
 		{
 			tag:      NewKVTag(TimestampTag, "1234567890"),
-			expected: "",
+			expected: "timestamp=1234567890",
 		},
 	}
 
@@ -31,32 +31,13 @@ func (n *noop) Count(_ string, _ float64, _ ...Tag)        {}
 func (n *noop) Histogram(_ string, _ float64, _ ...Tag)    {}
 func (n *noop) Timing(_ string, _ time.Duration, _ ...Tag) {}
 func (n *noop) Event(_ string, _ ...Field)                 {}
+func (n *noop) Describe(_ ...Descriptor)                   {}
 func (n *noop) AddTags(_ ...Tag)                           {}
 func (n *noop) Scope(_ string, _ ...string) Stats          { return n }
 func (n *noop) Close() error                               { return nil }
 
 var _ Stats = &noop{}
 
-// NewAsyncStats creates a Stats implementation that forwards all
-// measurement calls to an underlying Stats using goroutines. Scoped
-// Stats instances created by this Stats will also be asynchronous.
-func NewAsyncStats(s Stats) Stats {
-	return &async{s}
-}
-
-type async struct {
-	Stats
-}
-
-func (a *async) Gauge(s string, v float64, t ...Tag)        { go a.Stats.Gauge(s, v, t...) }
-func (a *async) Count(s string, v float64, t ...Tag)        { go a.Stats.Count(s, v, t...) }
-func (a *async) Histogram(s string, v float64, t ...Tag)    { go a.Stats.Histogram(s, v, t...) }
-func (a *async) Timing(s string, d time.Duration, t ...Tag) { go a.Stats.Timing(s, d, t...) }
-
-func (a *async) Scope(scope string, scopes ...string) Stats {
-	return &async{a.Stats.Scope(scope, scopes...)}
-}
-
 // NewRecordingStats returns a Stats implementation that records calls on the given
 // channel.
 func NewRecordingStats(ch chan<- Recorded) Stats {
@@ -106,6 +87,7 @@ func (r *recorder) Count(m string, v float64, t ...Tag)        { r.recV("count",
 func (r *recorder) Histogram(m string, v float64, t ...Tag)    { r.recV("histogram", m, v, t) }
 func (r *recorder) Timing(m string, d time.Duration, t ...Tag) { r.recT("timing", m, d, t) }
 func (r *recorder) Event(m string, f ...Field)                 {}
+func (r *recorder) Describe(d ...Descriptor)                   {}
 func (r *recorder) AddTags(t ...Tag)                           { r.tags = append(r.tags, t...) }
 func (r *recorder) Close() error                               { close(r.ch); return nil }
 